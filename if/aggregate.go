@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"ifservice/internal/event"
+)
+
+// Levels of series: one per GROUP_BY group, by default a span endpoint and
+// its caller, or with SERVICE_AGGREGATES also one per service summing its
+// spans, where a shift spread over many endpoints shows although none of
+// them stands out. Edge metrics have one per edge of the service graph.
+const (
+	levelSpan    = "span"
+	levelService = "service"
+	levelEdge    = "edge"
+)
+
+// spanLabels are the GROUP_BY labels service-level series sum over.
+var spanLabels = []string{"span_name", "peer_service"}
+
+// levelLabels are the labels identifying the series of level.
+func levelLabels(level string) []string {
+	switch level {
+	case levelEdge:
+		return edgeLabels
+	case levelSpan:
+		return groupLabels
+	}
+	out := make([]string, 0, len(groupLabels))
+	for _, k := range groupLabels {
+		if !slices.Contains(spanLabels, k) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// serviceOf returns the labels of the service-level series summing the
+// series labels.
+func serviceOf(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if !slices.Contains(spanLabels, k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// anomalousAt reports whether the point of r at t is an anomaly.
+func (r seriesResult) anomalousAt(t time.Time) bool {
+	i, found := slices.BinarySearchFunc(r.times, t, func(a, b time.Time) int { return a.Compare(b) })
+	return found && r.anomalous[i]
+}
+
+// link relates the top points of the series of spans and of their
+// services, scored on the same grid: a span's point to its service when
+// the aggregate is anomalous at the same time, and a service's point to
+// its spans anomalous at the same time, so a service-level anomaly without
+// related spans is one no endpoint shows on its own.
+func link(spans, services []seriesResult) {
+	byService := make(map[string]int, len(services))
+	for i, r := range services {
+		byService[event.Subject(r.Labels)] = i
+	}
+	children := make([][]int, len(services))
+	for i, r := range spans {
+		j, ok := byService[event.Subject(serviceOf(r.Labels))]
+		if !ok {
+			continue
+		}
+		children[j] = append(children[j], i)
+		for k, p := range r.Top {
+			if services[j].anomalousAt(p.Time) {
+				r.Top[k].Related = append(r.Top[k].Related, services[j].Labels)
+			}
+		}
+	}
+	for j, r := range services {
+		for k, p := range r.Top {
+			for _, i := range children[j] {
+				if spans[i].anomalousAt(p.Time) {
+					r.Top[k].Related = append(r.Top[k].Related, spans[i].Labels)
+				}
+			}
+		}
+	}
+}
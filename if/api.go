@@ -0,0 +1,910 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ifservice/internal/event"
+	"ifservice/internal/promresult"
+	"ifservice/internal/store"
+
+	"github.com/arijanluiken/mcp/if/iforest"
+)
+
+// REST API v1 bodies. These types are the contract with consumers: fields
+// may be added, but not renamed or removed, without a new version. They are
+// kept apart from the detector's own types so internal changes don't leak.
+
+// v1Point is one of the most anomalous points of a series.
+type v1Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Score float64   `json:"score"`
+	// PValue is the share of the series' historical scores at least as
+	// high as Score.
+	PValue      float64       `json:"pValue"`
+	Explanation v1Explanation `json:"explanation"`
+	// RunLength is the number of consecutive anomalous points of the run
+	// the point is part of; absent when it is no anomaly.
+	RunLength int `json:"runLength,omitempty"`
+	// Related are the labels of the series of the other level anomalous at
+	// the same time.
+	Related []map[string]string `json:"related,omitempty"`
+}
+
+// v1Explanation puts a value in the context of its window.
+type v1Explanation struct {
+	Mean float64 `json:"mean"`
+	Std  float64 `json:"std"`
+	// Sigma is the signed distance from Mean in Stds, or from the center
+	// of a robust normalization in its unit.
+	Sigma float64 `json:"sigma"`
+	// Percentile is the share of window points at or below the value.
+	Percentile float64 `json:"percentile"`
+}
+
+// v1Sparkline summarizes a window in consecutive buckets of about equal
+// length, oldest first: the lowest, mean and highest value of each.
+type v1Sparkline struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Min   []float64 `json:"min"`
+	Mean  []float64 `json:"mean"`
+	Max   []float64 `json:"max"`
+}
+
+// v1Series is the detection outcome for one series.
+type v1Series struct {
+	// Labels identifying the series, the configured grouping labels, or
+	// those of its service for service-level series.
+	Labels map[string]string `json:"labels"`
+	// Level is span, service for the aggregate of a service's spans, or
+	// edge for a client→server edge.
+	Level string `json:"level"`
+	// Scope is the scope of SCOPES_FILE the series was scored with, if any.
+	Scope  string `json:"scope,omitempty"`
+	Points int    `json:"points"`
+	// Missing steps filled by interpolation before scoring.
+	Missing int `json:"missing"`
+	// Reliable is false when too many steps were missing to score the series;
+	// Top is then empty.
+	Reliable bool `json:"reliable"`
+	// Threshold is the score from which the series' points are anomalies,
+	// see ANOMALY_CONTAMINATION.
+	Threshold float64   `json:"threshold,omitempty"`
+	Top       []v1Point `json:"top"`
+	// Sparkline summarizes the window in 20 buckets; absent when the
+	// series was not scored.
+	Sparkline *v1Sparkline `json:"sparkline,omitempty"`
+}
+
+// v1AnomaliesResponse is the body of GET /api/v1/anomalies/{metric}.
+type v1AnomaliesResponse struct {
+	Metric        string     `json:"metric"`
+	WindowMinutes int        `json:"windowMinutes"`
+	Series        int        `json:"series"`
+	Results       []v1Series `json:"results"`
+	// Truncated is set when the series limit cut the scan down.
+	Truncated *v1Truncation `json:"truncated,omitempty"`
+	// Unavailable lists the clusters that failed with cluster=all.
+	Unavailable []string `json:"unavailable,omitempty"`
+}
+
+// v1Truncation reports a partial result: the detection query matched more
+// series than the limit, so the largest services were not scanned.
+type v1Truncation struct {
+	Series          int      `json:"series"`
+	Limit           int      `json:"limit"`
+	SkippedServices []string `json:"skippedServices"`
+}
+
+// v1ServiceGroup aggregates the series of one service.
+type v1ServiceGroup struct {
+	ServiceName string `json:"serviceName"`
+	// Cluster is set when MIMIR_CLUSTERS_FILE is.
+	Cluster string `json:"cluster,omitempty"`
+	Series  int    `json:"series"`
+	// Unreliable series had too many missing steps to be scored.
+	Unreliable int `json:"unreliable"`
+	// Anomalous series have at least one top point crossing the threshold.
+	Anomalous int `json:"anomalous"`
+	// Anomalies is the number of top points crossing the threshold.
+	Anomalies int     `json:"anomalies"`
+	MaxScore  float64 `json:"maxScore"`
+	// WorstSeries are the labels of the series with MaxScore.
+	WorstSeries map[string]string `json:"worstSeries,omitempty"`
+	// Spans is the span-level detail, present for expanded services.
+	Spans []v1Series `json:"spans,omitempty"`
+	// Aggregate is the service-level series, with SERVICE_AGGREGATES, also
+	// counted in Series, Anomalous and Anomalies.
+	Aggregate *v1Series `json:"aggregate,omitempty"`
+}
+
+// v1Edge is the detection of one client→server edge of the service graph:
+// its request rate and error ratio series.
+type v1Edge struct {
+	Client string `json:"client"`
+	Server string `json:"server"`
+	// Cluster is set when MIMIR_CLUSTERS_FILE is.
+	Cluster string `json:"cluster,omitempty"`
+	// Anomalous is true when a top point of either series crosses its
+	// threshold.
+	Anomalous bool      `json:"anomalous"`
+	MaxScore  float64   `json:"maxScore"`
+	RPS       *v1Series `json:"rps,omitempty"`
+	ErrorRate *v1Series `json:"errorRate,omitempty"`
+}
+
+// v1EdgesResponse is the body of GET /api/v1/anomalies/edges.
+type v1EdgesResponse struct {
+	WindowMinutes int      `json:"windowMinutes"`
+	Edges         []v1Edge `json:"edges"`
+	// Unavailable lists the clusters that failed with cluster=all.
+	Unavailable []string `json:"unavailable,omitempty"`
+}
+
+// v1ServicesResponse is the body of GET /api/v1/anomalies/{metric}/services.
+type v1ServicesResponse struct {
+	Metric        string  `json:"metric"`
+	WindowMinutes int     `json:"windowMinutes"`
+	Threshold     float64 `json:"threshold"`
+	// Contamination, when set, derives a threshold per series instead.
+	Contamination float64 `json:"contamination,omitempty"`
+	// MaxPValue, when set, replaces Threshold in counting anomalies.
+	MaxPValue float64          `json:"maxPValue,omitempty"`
+	Services  []v1ServiceGroup `json:"services"`
+	// Truncated is set when the series limit cut the scan down.
+	Truncated *v1Truncation `json:"truncated,omitempty"`
+	// Unavailable lists the clusters that failed with cluster=all.
+	Unavailable []string `json:"unavailable,omitempty"`
+}
+
+// v1Link points at a resource related to an anomaly.
+type v1Link struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+// v1Event is a stored anomaly event.
+type v1Event struct {
+	ID       int64             `json:"id"`
+	Metric   string            `json:"metric"`
+	Labels   map[string]string `json:"labels"`
+	Time     time.Time         `json:"time"`
+	Value    float64           `json:"value"`
+	Score    float64           `json:"score"`
+	PValue   float64           `json:"pValue,omitempty"`
+	Severity string            `json:"severity"`
+	// RunLength is the number of consecutive anomalous points of the
+	// event's run; absent on events stored before run lengths existed.
+	RunLength int `json:"runLength,omitempty"`
+	// Level is span, service or edge; absent on events stored before
+	// service-level detection existed.
+	Level         string              `json:"level,omitempty"`
+	Related       []map[string]string `json:"related,omitempty"`
+	Scope         string              `json:"scope,omitempty"`
+	WindowMinutes int                 `json:"windowMinutes"`
+	Links         []v1Link            `json:"links,omitempty"`
+	// Explanation is absent on events stored before explanations existed.
+	Explanation *v1Explanation `json:"explanation,omitempty"`
+	// Sparkline summarizes the detection window in 20 buckets; absent on
+	// events stored before sparklines existed.
+	Sparkline *v1Sparkline `json:"sparkline,omitempty"`
+	// Deployment is the latest deployment of the service within
+	// DEPLOYMENT_LOOKBACK before the event, if any.
+	Deployment *v1EventDeployment `json:"deployment,omitempty"`
+	// Kubernetes is the state of the service's deployment when
+	// KUBERNETES_ENRICHMENT is enabled.
+	Kubernetes *v1EventKubernetes `json:"kubernetes,omitempty"`
+}
+
+// v1EventKubernetes is the workload behind an event's service.
+type v1EventKubernetes struct {
+	Namespace         string `json:"namespace"`
+	Deployment        string `json:"deployment"`
+	Replicas          int    `json:"replicas"`
+	ReadyReplicas     int    `json:"readyReplicas"`
+	AvailableReplicas int    `json:"availableReplicas"`
+	UpdatedReplicas   int    `json:"updatedReplicas"`
+	Restarts          int    `json:"restarts"`
+	RecentRestarts    int    `json:"recentRestarts"`
+	// Rollout is "complete", "progressing" or "stalled".
+	Rollout string `json:"rollout"`
+}
+
+// v1EventDeployment is a deployment preceding an event.
+type v1EventDeployment struct {
+	Service       string    `json:"service"`
+	Version       string    `json:"version,omitempty"`
+	Time          time.Time `json:"time"`
+	MinutesBefore float64   `json:"minutesBefore"`
+	// Note reads "deployment of service X occurred N minutes before".
+	Note string `json:"note"`
+}
+
+// v1Deployment is a deployment marker, the body of POST /api/v1/deployments.
+type v1Deployment struct {
+	Service string `json:"service"`
+	Version string `json:"version,omitempty"`
+	// Time defaults to now when posted.
+	Time        time.Time `json:"time"`
+	Description string    `json:"description,omitempty"`
+	// Source is "api" or "grafana:<annotation id>"; set by the service.
+	Source string `json:"source"`
+}
+
+// v1DeploymentsResponse is the body of GET /api/v1/deployments.
+type v1DeploymentsResponse struct {
+	Deployments []v1Deployment `json:"deployments"`
+}
+
+// v1EventsResponse is the body of GET /api/v1/events.
+type v1EventsResponse struct {
+	WindowMinutes int       `json:"windowMinutes"`
+	Threshold     float64   `json:"threshold"`
+	Events        []v1Event `json:"events"`
+}
+
+// v1DailyCount is the number of anomaly events of one service and metric on
+// one UTC day.
+type v1DailyCount struct {
+	Day      string  `json:"day"`
+	Service  string  `json:"service"`
+	Metric   string  `json:"metric"`
+	Count    int     `json:"count"`
+	MaxScore float64 `json:"maxScore"`
+}
+
+// v1DailyResponse is the body of GET /api/v1/events/daily.
+type v1DailyResponse struct {
+	Days []v1DailyCount `json:"days"`
+}
+
+// v1DetectorPoint is one point of a series as the detector scored it.
+type v1DetectorPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	// Filled points were interpolated over a missing step; they are trained
+	// on but never reported.
+	Filled bool `json:"filled"`
+	// Score is absent when the series was not scored.
+	Score *float64 `json:"score,omitempty"`
+}
+
+// v1DetectorSeries is one series after alignment and gap handling.
+type v1DetectorSeries struct {
+	Labels map[string]string `json:"labels"`
+	// Scope is the scope of SCOPES_FILE the series was scored with, if any.
+	Scope   string `json:"scope,omitempty"`
+	Missing int    `json:"missing"`
+	// Reliable is false when too many steps were missing to score the series.
+	Reliable bool `json:"reliable"`
+	// Threshold is the series' score threshold.
+	Threshold float64 `json:"threshold,omitempty"`
+	// TrainPoints is the size of the possibly downsampled training set.
+	TrainPoints int               `json:"trainPoints"`
+	Points      []v1DetectorPoint `json:"points"`
+	Top         []v1Point         `json:"top"`
+}
+
+// v1DetectorResponse is the body of GET /api/v1/series/{metric}.
+type v1DetectorResponse struct {
+	Metric        string             `json:"metric"`
+	WindowMinutes int                `json:"windowMinutes"`
+	Start         time.Time          `json:"start"`
+	End           time.Time          `json:"end"`
+	StepSeconds   float64            `json:"stepSeconds"`
+	MaxGapRatio   float64            `json:"maxGapRatio"`
+	Forest        v1Forest           `json:"forest"`
+	Normalization string             `json:"normalization"`
+	QueryMode     string             `json:"queryMode"`
+	Series        []v1DetectorSeries `json:"series"`
+}
+
+// v1Forest is the isolation forest configuration series were scored with.
+type v1Forest struct {
+	Trees      int `json:"trees"`
+	SampleSize int `json:"sampleSize"`
+	// MaxDepth 0 is ceil(log2(sampleSize)).
+	MaxDepth int `json:"maxDepth"`
+}
+
+// v1SeriesResponse is the body of GET /api/v1/series. Points are [unix
+// seconds, value] pairs.
+type v1SeriesResponse struct {
+	Query  string       `json:"query"`
+	Points [][2]float64 `json:"points"`
+}
+
+// v1HistogramResponse is the body of GET /api/v1/histogram: the latency
+// distribution of server spans over the window, bounds in milliseconds.
+// Modes are the le of the peak buckets.
+type v1HistogramResponse struct {
+	Query         string `json:"query"`
+	WindowMinutes int    `json:"windowMinutes"`
+	// Rate is requests per second; bucket rates add up to it.
+	Rate      float64             `json:"rate"`
+	Quantiles map[string]float64  `json:"quantiles"`
+	Modes     []string            `json:"modes"`
+	Shape     string              `json:"shape"`
+	Buckets   []promresult.Bucket `json:"buckets"`
+}
+
+func toV1Series(r seriesResult) v1Series {
+	top := make([]v1Point, 0, len(r.Top))
+	for _, p := range r.Top {
+		top = append(top, v1Point{Time: p.Time, Value: p.Value, Score: p.Score, PValue: p.PValue, Explanation: v1Explanation(p.Explanation), RunLength: p.RunLength, Related: p.Related})
+	}
+	out := v1Series{Labels: r.Labels, Level: r.Level, Scope: r.Scope, Points: r.Points, Missing: r.Missing, Reliable: r.Reliable, Threshold: r.Threshold, Top: top}
+	if r.Sparkline != nil {
+		sp := v1Sparkline(*r.Sparkline)
+		out.Sparkline = &sp
+	}
+	return out
+}
+
+func toV1Truncation(tr *truncation) *v1Truncation {
+	if tr == nil {
+		return nil
+	}
+	return &v1Truncation{Series: tr.Series, Limit: tr.Limit, SkippedServices: tr.Skipped}
+}
+
+func toV1Event(ev store.Event) v1Event {
+	out := v1Event{
+		ID:            ev.ID,
+		Metric:        ev.Metric,
+		Labels:        ev.Labels,
+		Time:          ev.Time,
+		Value:         ev.Value,
+		Score:         ev.Score,
+		PValue:        ev.PValue,
+		Severity:      ev.Severity,
+		RunLength:     ev.RunLength,
+		Level:         ev.Level,
+		Related:       ev.Related,
+		Scope:         ev.Scope,
+		WindowMinutes: ev.WindowMinutes,
+	}
+	for _, l := range ev.Links {
+		out.Links = append(out.Links, v1Link{Rel: l.Rel, Href: l.Href})
+	}
+	if ev.Explanation != nil {
+		e := v1Explanation(*ev.Explanation)
+		out.Explanation = &e
+	}
+	if ev.Sparkline != nil {
+		sp := v1Sparkline(*ev.Sparkline)
+		out.Sparkline = &sp
+	}
+	if d := ev.Deployment; d != nil {
+		out.Deployment = &v1EventDeployment{Service: d.Service, Version: d.Version, Time: d.Time, MinutesBefore: d.MinutesBefore, Note: d.Note()}
+	}
+	if k := ev.Kubernetes; k != nil {
+		v := v1EventKubernetes(*k)
+		out.Kubernetes = &v
+	}
+	return out
+}
+
+// groupByService aggregates results per service_name, most anomalous
+// first. Services in expand, or all with "*", include their series.
+func groupByService(results []seriesResult, isAnomaly func(seriesResult, topPoint) bool, expand map[string]bool) []v1ServiceGroup {
+	byName := map[string]*v1ServiceGroup{}
+	var order []string
+	for _, r := range results {
+		name := r.Labels["service_name"]
+		key := r.Labels["cluster"] + "/" + name
+		g, found := byName[key]
+		if !found {
+			g = &v1ServiceGroup{ServiceName: name, Cluster: r.Labels["cluster"]}
+			byName[key] = g
+			order = append(order, key)
+		}
+		g.Series++
+		if !r.Reliable {
+			g.Unreliable++
+		}
+		anomalous := false
+		for _, p := range r.Top {
+			if isAnomaly(r, p) {
+				g.Anomalies++
+				anomalous = true
+			}
+			if p.Score > g.MaxScore {
+				g.MaxScore = p.Score
+				g.WorstSeries = r.Labels
+			}
+		}
+		if anomalous {
+			g.Anomalous++
+		}
+		if r.Level == levelService {
+			agg := toV1Series(r)
+			g.Aggregate = &agg
+		} else if expand["*"] || expand[name] {
+			g.Spans = append(g.Spans, toV1Series(r))
+		}
+	}
+	out := make([]v1ServiceGroup, 0, len(order))
+	for _, key := range order {
+		out = append(out, *byName[key])
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Anomalous != out[j].Anomalous {
+			return out[i].Anomalous > out[j].Anomalous
+		}
+		return out[i].MaxScore > out[j].MaxScore
+	})
+	return out
+}
+
+// apiParam is a query parameter of an operation.
+type apiParam struct {
+	Name, Type, Description string
+	Required                bool
+}
+
+// apiOperation is one GET endpoint of the REST API. Response is a value of
+// the body type; the OpenAPI schema is derived from it. Legacy is the
+// pre-v1 path still served as a deprecated alias.
+type apiOperation struct {
+	Path, Legacy         string
+	Summary, Description string
+	Params               []apiParam
+	ContentType          string
+	Response             any
+	Handler              http.HandlerFunc
+}
+
+// clusterParam selects the cluster of an anomaly scan.
+var clusterParam = apiParam{Name: "cluster", Type: "string", Description: "Cluster of MIMIR_CLUSTERS_FILE to scan, by default the first; all scans every cluster and labels the series with theirs"}
+
+// apiOperations is the REST API of the service: what is routed and what
+// /openapi.json publishes.
+func (s *service) apiOperations() []apiOperation {
+	var ops []apiOperation
+	for _, m := range []struct{ metric, legacy string }{
+		{"rps", "/anomalies/all"},
+		{"error_rate", "/anomalies/all_error"},
+		{"latency_p95", "/anomalies/all_latency"},
+	} {
+		ops = append(ops, apiOperation{
+			Path:        "/api/v1/anomalies/" + m.metric,
+			Legacy:      m.legacy,
+			Summary:     "Detect anomalies on " + m.metric + " of all server spans",
+			Description: "Scores every series over the detection window and returns its top 3 points. Points at or above the threshold are stored and published as events.",
+			Params:      []apiParam{{Name: "service", Type: "string", Description: "Only return the series of this service_name"}, clusterParam},
+			Response:    v1AnomaliesResponse{},
+			Handler:     s.handleAnomalies(m.metric),
+		}, apiOperation{
+			Path:        "/api/v1/anomalies/" + m.metric + "/services",
+			Summary:     "Detect anomalies on " + m.metric + ", grouped by service",
+			Description: "Runs the same detection and aggregates the series of each service: counts, anomalies at or above the threshold and the max score. Most anomalous services first.",
+			Params:      []apiParam{{Name: "expand", Type: "string", Description: "Comma separated service names, or *, whose series are included as spans"}, clusterParam},
+			Response:    v1ServicesResponse{},
+			Handler:     s.handleAnomaliesByService(m.metric),
+		}, apiOperation{
+			Path:        "/api/v1/series/" + m.metric,
+			Summary:     "The " + m.metric + " series as the detector scores them",
+			Description: "Fetches and preprocesses the series like a scan (alignment onto the step grid, gap interpolation) and scores them, without publishing events. Each point carries its score and whether it was interpolated. Label parameters select series by exact match; above MAX_SERIES one is required. The forest parameters override the configured ones for this request, to try other values before setting them.",
+			Params:      append(groupParams(), forestParams...),
+			Response:    v1DetectorResponse{},
+			Handler:     s.handleDetectorSeries(m.metric),
+		})
+	}
+	ops = append(ops, apiOperation{
+		Path:        "/api/v1/anomalies/edges",
+		Summary:     "Detect anomalies on the edges of the service graph",
+		Description: "Scores the request rate (edge_rps) and the share of failed requests (edge_error_rate) of every client→server edge of the servicegraph connector's metrics, like the span metrics, and returns both per edge, most anomalous first. Points at or above the threshold are stored and published as events labelled client and server.",
+		Params:      []apiParam{{Name: "service", Type: "string", Description: "Only return the edges this service is the client or server of"}, clusterParam},
+		Response:    v1EdgesResponse{},
+		Handler:     s.handleEdges,
+	})
+	seriesParams := append([]apiParam{{Name: "metric", Type: "string", Required: true, Description: "rps, error_rate or latency_p95"}}, groupParams()...)
+	return append(ops,
+		apiOperation{
+			Path:        "/api/v1/anomalies/stream",
+			Legacy:      "/anomalies/stream",
+			Summary:     "Stream anomaly events",
+			Description: "Server-Sent Events; each event is an anomaly CloudEvent with the store ID as SSE id. Resume with the Last-Event-ID header or lastEventId.",
+			Params:      []apiParam{{Name: "lastEventId", Type: "integer", Description: "Replay stored events after this ID first"}},
+			ContentType: "text/event-stream",
+			Response:    event.CloudEvent{},
+			Handler:     s.handleStream,
+		},
+		apiOperation{
+			Path:    "/api/v1/events",
+			Legacy:  "/ui/api/events",
+			Summary: "Most recent stored anomaly events",
+			Params: []apiParam{
+				{Name: "limit", Type: "integer", Description: "Number of events (default 500)"},
+				{Name: "service", Type: "string", Description: "Only events of this service_name"},
+				{Name: "metric", Type: "string", Description: "Only events of this metric"},
+				{Name: "severity", Type: "string", Description: "Only events of this severity, warning or critical"},
+				{Name: "from", Type: "string", Description: "Only events at or after this RFC 3339 time"},
+				{Name: "to", Type: "string", Description: "Only events before this RFC 3339 time"},
+			},
+			Response: v1EventsResponse{},
+			Handler:  s.handleEvents,
+		},
+		apiOperation{
+			Path:        "/api/v1/events/daily",
+			Summary:     "Daily anomaly event counts per service and metric",
+			Description: "Counts of stored events merged with the roll-ups of events pruned by retention, newest day first.",
+			Params:      []apiParam{{Name: "service", Type: "string", Description: "Only return the counts of this service_name"}},
+			Response:    v1DailyResponse{},
+			Handler:     s.handleDaily,
+		},
+		apiOperation{
+			Path:        "/report",
+			Summary:     "Digest of the anomaly events of the last hour or day",
+			Description: "Events per service and metric, with the change against the period before and each service's most anomalous series, services with the most events first. REPORT_WEBHOOK_URL pushes it at the end of every REPORT_PERIOD.",
+			Params: []apiParam{
+				{Name: "period", Type: "string", Description: "hour or day (default)"},
+				{Name: "format", Type: "string", Description: "markdown (default) or html"},
+			},
+			ContentType: "text/markdown",
+			Response:    "",
+			Handler:     s.handleReport,
+		},
+		apiOperation{
+			Path:        "/api/v1/deployments",
+			Summary:     "Deployment markers",
+			Description: "Newest first. POST a deployment (service, optional version, time and description) to record one; anomaly events of a service within DEPLOYMENT_LOOKBACK after it carry it. With GRAFANA_ANNOTATION_TAG set, tagged Grafana annotations are imported too.",
+			Params: []apiParam{
+				{Name: "service", Type: "string", Description: "Only deployments of this service"},
+				{Name: "from", Type: "string", Description: "Only deployments at or after this RFC 3339 time"},
+				{Name: "to", Type: "string", Description: "Only deployments before this RFC 3339 time"},
+			},
+			Response: v1DeploymentsResponse{},
+			Handler:  s.handleDeployments,
+		},
+		apiOperation{
+			Path:        "/api/v1/rules",
+			Summary:     "Ruler rule groups alerting on anomaly scores",
+			Description: "Recording rules over the anomaly_score and anomaly_score_threshold gauges on /metrics, and a warning and a critical alert, as YAML for mimirtool rules sync or a Prometheus rule file. The gauges must reach Mimir, e.g. scraped by the collector and remote-written, and are updated by scans, so SCAN_INTERVAL should be set.",
+			Params: []apiParam{
+				{Name: "format", Type: "string", Description: "mimir (default), with a namespace, or prometheus"},
+				{Name: "namespace", Type: "string", Description: "Ruler namespace of the mimir format (default if-service)"},
+			},
+			ContentType: "application/yaml",
+			Response:    "",
+			Handler:     s.handleRules,
+		},
+		apiOperation{
+			Path:        "/api/v1/histogram",
+			Summary:     "Latency distribution of server spans",
+			Description: "Rates per latency bucket in milliseconds over the window, with quantiles and the buckets that are modes of the distribution: one mode is a uniform slowdown, two a slow tail. Label parameters select series by exact match.",
+			Params:      append([]apiParam{{Name: "window", Type: "integer", Description: "Minutes, by default the detection window, at most MAX_WINDOW_MINUTES"}}, groupParams()...),
+			Response:    v1HistogramResponse{},
+			Handler:     s.handleHistogram,
+		},
+		apiOperation{
+			Path:     "/api/v1/series",
+			Legacy:   "/ui/api/series",
+			Summary:  "One series over the detection window",
+			Params:   seriesParams,
+			Response: v1SeriesResponse{},
+			Handler:  s.handleSeries,
+		},
+	)
+}
+
+// registerAPI routes ops on mux, each legacy path as a deprecated alias.
+func registerAPI(mux *http.ServeMux, ops []apiOperation) {
+	for _, op := range ops {
+		mux.HandleFunc(op.Path, op.Handler)
+		if op.Legacy != "" {
+			mux.HandleFunc(op.Legacy, deprecated(op.Path, op.Handler))
+		}
+	}
+}
+
+// deprecated marks responses of an old path with the Deprecation header
+// and a link to its successor.
+func deprecated(successor string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		h(w, r)
+	}
+}
+
+// scanStatus is the HTTP status of a failed scan.
+func scanStatus(err error) int {
+	var le *seriesLimitError
+	if errors.As(err, &le) {
+		return http.StatusUnprocessableEntity
+	}
+	if errors.Is(err, errUnknownCluster) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// handleAnomalies serves the per-series top anomalies for metric.
+func (s *service) handleAnomalies(metric string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, tr, unavailable, err := s.scanClusters(r.Context(), metric, r.URL.Query().Get("cluster"))
+		if err != nil {
+			http.Error(w, err.Error(), scanStatus(err))
+			return
+		}
+		svc := r.URL.Query().Get("service")
+		out := v1AnomaliesResponse{Metric: metric, WindowMinutes: s.window, Results: make([]v1Series, 0, len(results)), Truncated: toV1Truncation(tr), Unavailable: unavailable}
+		for _, res := range results {
+			if svc == "" || res.Labels["service_name"] == svc {
+				out.Results = append(out.Results, toV1Series(res))
+			}
+		}
+		out.Series = len(out.Results)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	}
+}
+
+// handleAnomaliesByService serves the detection results for metric grouped
+// by service.
+func (s *service) handleAnomaliesByService(metric string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, tr, unavailable, err := s.scanClusters(r.Context(), metric, r.URL.Query().Get("cluster"))
+		if err != nil {
+			http.Error(w, err.Error(), scanStatus(err))
+			return
+		}
+		expand := map[string]bool{}
+		if v := r.URL.Query().Get("expand"); v != "" {
+			for _, name := range strings.Split(v, ",") {
+				expand[strings.TrimSpace(name)] = true
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v1ServicesResponse{
+			Metric:        metric,
+			WindowMinutes: s.window,
+			Threshold:     s.threshold,
+			Contamination: s.contamination,
+			MaxPValue:     s.maxPValue,
+			Services:      groupByService(results, func(r seriesResult, p topPoint) bool { return s.scoped(r.Scope).anomalous(metric, p, r.Threshold) }, expand),
+			Truncated:     toV1Truncation(tr),
+			Unavailable:   unavailable,
+		})
+	}
+}
+
+func (s *service) handleEvents(w http.ResponseWriter, r *http.Request) {
+	limit := 500
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	q := r.URL.Query()
+	var from, to time.Time
+	for _, b := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(b.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "invalid "+b.name, http.StatusBadRequest)
+				return
+			}
+			*b.t = t
+		}
+	}
+	svc, metric, severity := q.Get("service"), q.Get("metric"), q.Get("severity")
+	events := s.hub.store.Find(func(ev store.Event) bool {
+		return (svc == "" || ev.Labels["service_name"] == svc) &&
+			(metric == "" || ev.Metric == metric) &&
+			(severity == "" || s.eventSeverity(ev) == severity) &&
+			(from.IsZero() || !ev.Time.Before(from)) &&
+			(to.IsZero() || ev.Time.Before(to))
+	}, limit)
+	out := v1EventsResponse{WindowMinutes: s.window, Threshold: s.threshold, Events: make([]v1Event, 0, len(events))}
+	for _, ev := range events {
+		v := toV1Event(ev)
+		v.Severity = s.eventSeverity(ev)
+		out.Events = append(out.Events, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// eventSeverity is the severity of ev, derived from its score for events
+// stored without one.
+func (s *service) eventSeverity(ev store.Event) string {
+	if ev.Severity != "" {
+		return ev.Severity
+	}
+	return s.severity(ev.Score)
+}
+
+func (s *service) handleDaily(w http.ResponseWriter, r *http.Request) {
+	svc := r.URL.Query().Get("service")
+	out := v1DailyResponse{Days: []v1DailyCount{}}
+	for _, d := range s.hub.store.Daily() {
+		if svc == "" || d.Service == svc {
+			out.Days = append(out.Days, v1DailyCount(d))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// groupParams are query parameters named after the grouping labels.
+// forestParams override the forest hyperparameters of a request.
+var forestParams = []apiParam{
+	{Name: "trees", Type: "integer", Description: "Number of trees, 1 to 1000 (default FOREST_TREES)"},
+	{Name: "sampleSize", Type: "integer", Description: "Points each tree is fit on, 2 to 4096 (default FOREST_SAMPLE_SIZE)"},
+	{Name: "maxDepth", Type: "integer", Description: "Depth limit of the trees, 1 to 30, or 0 for ceil(log2(sampleSize)) (default FOREST_MAX_DEPTH)"},
+}
+
+// requestForest returns the forest configuration with the overrides of q.
+func (s *service) requestForest(q url.Values) (iforest.Options, error) {
+	o := s.forest
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{{"trees", &o.Trees}, {"sampleSize", &o.SampleSize}, {"maxDepth", &o.MaxDepth}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return o, fmt.Errorf("invalid %s", p.name)
+			}
+			*p.v = n
+		}
+	}
+	return o, checkForest(o)
+}
+
+func groupParams() []apiParam {
+	params := make([]apiParam, 0, len(groupLabels))
+	for _, k := range groupLabels {
+		params = append(params, apiParam{Name: k, Type: "string"})
+	}
+	return params
+}
+
+// handleDetectorSeries serves the preprocessed series of metric with the
+// score of every point, so an alert can be traced back to its data.
+func (s *service) handleDetectorSeries(metric string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		forest, err := s.requestForest(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		matchers := ""
+		for _, k := range groupLabels {
+			if v := q.Get(k); v != "" {
+				matchers += fmt.Sprintf(", %s=%q", k, v)
+			}
+		}
+		if matchers == "" && s.maxSeries > 0 {
+			if _, tr, err := s.limitSeries(r.Context(), metric); err != nil {
+				http.Error(w, err.Error(), scanStatus(err))
+				return
+			} else if tr != nil {
+				http.Error(w, fmt.Sprintf("%d series exceed MAX_SERIES=%d; select series by label", tr.Series, tr.Limit), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		end := time.Now()
+		g := promresult.NewGrid(end.Add(-time.Duration(s.window)*time.Minute), end, s.step)
+		fetch := func(fg promresult.Grid) ([]promresult.Series, error) {
+			return fetchers[metric](r.Context(), s.c, fg, groupBy(), matchers)
+		}
+		var series []windowSeries
+		if matchers == "" {
+			series, err = s.windows.fetch(metric, g, fetch)
+		} else {
+			series, err = (*windowCache)(nil).fetch(metric, g, fetch)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		out := v1DetectorResponse{
+			Metric:        metric,
+			WindowMinutes: s.window,
+			Start:         g.Start,
+			End:           g.End(),
+			StepSeconds:   g.Step.Seconds(),
+			MaxGapRatio:   s.maxGapRatio,
+			Forest:        v1Forest{Trees: forest.Trees, SampleSize: forest.SampleSize, MaxDepth: forest.MaxDepth},
+			Normalization: s.normalization[metric],
+			QueryMode:     queryMode(metric),
+			Series:        make([]v1DetectorSeries, 0, len(series)),
+		}
+		for _, ps := range series {
+			// analyze only scores, so the copy publishes nothing; the
+			// parameters override the forest of the series' scope
+			cs := *s.scopeFor(metric, ps.Labels)
+			cs.forest, _ = cs.requestForest(q)
+			res, cl, scores := cs.analyze(metric, levelSpan, ps, g)
+			if len(cl.Values) == 0 {
+				continue
+			}
+			ds := v1DetectorSeries{
+				Labels:    res.Labels,
+				Scope:     res.Scope,
+				Missing:   res.Missing,
+				Reliable:  res.Reliable,
+				Threshold: res.Threshold,
+				Points:    make([]v1DetectorPoint, len(cl.Values)),
+				Top:       toV1Series(res).Top,
+			}
+			if scores != nil {
+				ds.TrainPoints = len(downsample(cl.Values, s.trainMaxPoints, s.trainAgg))
+			}
+			for i := range cl.Values {
+				ds.Points[i] = v1DetectorPoint{Time: cl.Times[i], Value: cl.Values[i], Filled: cl.Filled[i]}
+				if scores != nil {
+					ds.Points[i].Score = &scores[i]
+				}
+			}
+			out.Series = append(out.Series, ds)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	}
+}
+
+func (s *service) handleSeries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	expr, ok := seriesExprs[q.Get("metric")]
+	if !ok {
+		http.Error(w, "unknown metric", http.StatusBadRequest)
+		return
+	}
+	matchers := make([]string, 0, len(groupLabels))
+	for _, k := range groupLabels {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", k, q.Get(k)))
+	}
+	promQL := expr(strings.Join(matchers, ", "), s.step)
+	if promQL == "" {
+		http.Error(w, "latency metric not discovered yet", http.StatusServiceUnavailable)
+		return
+	}
+	end := time.Now()
+	raw, err := s.c.QueryRange(r.Context(), promQL, end.Add(-time.Duration(s.window)*time.Minute), end, s.step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	series, err := promresult.DecodeMatrix(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	// NaN is not valid JSON
+	points := [][2]float64{}
+	if len(series) > 0 {
+		for _, p := range series[0].Points {
+			if !math.IsNaN(p.V) && !math.IsInf(p.V, 0) {
+				points = append(points, [2]float64{float64(p.T.Unix()), p.V})
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v1SeriesResponse{Query: promQL, Points: points})
+}
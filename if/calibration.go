@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// calibBins is the resolution of a score histogram over [0,1].
+const calibBins = 200
+
+// scoreHist is the score distribution of one series: one count per bin,
+// halved whenever the total reaches the cap, so old scans fade out.
+type scoreHist struct {
+	bins  [calibBins]uint32
+	total uint32
+	// last is the time of the newest point observed; overlapping windows
+	// add only points after it
+	last time.Time
+}
+
+// calibrator turns raw isolation forest scores into empirical p-values: the
+// share of a series' historical scores at least as high. A p-value of 0.01
+// then reads as "1% of this series' normal points score this high",
+// whatever the raw score of such points is.
+type calibrator struct {
+	mu sync.Mutex
+	// minSamples is the history needed before it is used; until then the
+	// current window is the reference
+	minSamples int
+	// maxSamples caps each histogram's total
+	maxSamples int
+	series     map[string]*scoreHist
+	swept      time.Time
+}
+
+func newCalibrator(minSamples, maxSamples int) *calibrator {
+	return &calibrator{minSamples: minSamples, maxSamples: maxSamples, series: map[string]*scoreHist{}}
+}
+
+func calibBin(score float64) int {
+	b := int(score * calibBins)
+	if b < 0 {
+		return 0
+	}
+	if b >= calibBins {
+		return calibBins - 1
+	}
+	return b
+}
+
+// pValues returns the p-value of each of scores against the history of
+// key, or, with too little history, against the window's scores themselves.
+// It then adds the window's points newer than any seen before to the
+// history.
+func (c *calibrator) pValues(key string, times []time.Time, scores []float64) []float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.swept) > time.Hour {
+		// forget series not seen for a day
+		for k, h := range c.series {
+			if now.Sub(h.last) > 24*time.Hour {
+				delete(c.series, k)
+			}
+		}
+		c.swept = now
+	}
+	h, found := c.series[key]
+	if !found {
+		h = &scoreHist{}
+		c.series[key] = h
+	}
+
+	out := make([]float64, len(scores))
+	if int(h.total) >= c.minSamples {
+		// above[b] counts history scores in bin b or higher
+		var above [calibBins + 1]uint32
+		for b := calibBins - 1; b >= 0; b-- {
+			above[b] = above[b+1] + h.bins[b]
+		}
+		for i, s := range scores {
+			out[i] = float64(above[calibBin(s)]+1) / float64(h.total+1)
+		}
+	} else {
+		sorted := slices.Clone(scores)
+		sort.Float64s(sorted)
+		for i, s := range scores {
+			out[i] = float64(len(sorted)-sort.SearchFloat64s(sorted, s)) / float64(len(sorted))
+		}
+	}
+
+	for i, t := range times {
+		if !t.After(h.last) {
+			continue
+		}
+		h.bins[calibBin(scores[i])]++
+		h.total++
+		h.last = t
+		if int(h.total) >= c.maxSamples {
+			h.total = 0
+			for b := range h.bins {
+				h.bins[b] /= 2
+				h.total += h.bins[b]
+			}
+		}
+	}
+	return out
+}
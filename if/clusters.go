@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	mimir "ifservice/internal/mimir"
+	"ifservice/internal/secret"
+)
+
+// cluster is a Mimir backend anomaly endpoints can scan by name, read from
+// MIMIR_CLUSTERS_FILE. Tenant, pipe-separated, and Tenants name the tenants
+// it queries, several at once with tenant federation.
+type cluster struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Tenant      string   `json:"tenant"`
+	Tenants     []string `json:"tenants"`
+	BearerToken string   `json:"bearerToken"`
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	// BearerTokenFile and PasswordFile name files holding the credentials
+	// instead, e.g. secret mounts, re-read when rotated.
+	BearerTokenFile string `json:"bearerTokenFile"`
+	PasswordFile    string `json:"passwordFile"`
+
+	bearerToken, password secret.Secret
+}
+
+// loadClusters reads a JSON array of clusters. Names must be unique and
+// not "all", which selects every cluster.
+func loadClusters(path string) ([]cluster, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []cluster
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s: no clusters", path)
+	}
+	seen := map[string]bool{}
+	for i, cl := range out {
+		if cl.Name == "" || cl.Name == "all" || seen[cl.Name] {
+			return nil, fmt.Errorf("%s: invalid or duplicate cluster name %q", path, cl.Name)
+		}
+		if cl.URL == "" {
+			return nil, fmt.Errorf("%s: cluster %q has no url", path, cl.Name)
+		}
+		seen[cl.Name] = true
+		if out[i].bearerToken, err = secret.New(cl.BearerToken, cl.BearerTokenFile); err != nil {
+			return nil, fmt.Errorf("%s: cluster %q: bearer token: %w", path, cl.Name, err)
+		}
+		if out[i].password, err = secret.New(cl.Password, cl.PasswordFile); err != nil {
+			return nil, fmt.Errorf("%s: cluster %q: password: %w", path, cl.Name, err)
+		}
+		tenants := cl.Tenants
+		if cl.Tenant != "" {
+			tenants = append(strings.Split(cl.Tenant, "|"), tenants...)
+		}
+		t, err := federatedTenant(tenants)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cluster %q: %w", path, cl.Name, err)
+		}
+		out[i].Tenant, out[i].Tenants = t, nil
+	}
+	return out, nil
+}
+
+// federatedTenant returns the X-Scope-OrgID of tenants: several are joined
+// with "|", which Mimir queries together when tenant federation is enabled.
+func federatedTenant(tenants []string) (string, error) {
+	for _, t := range tenants {
+		if t == "" || strings.Contains(t, "|") {
+			return "", fmt.Errorf("invalid tenant %q", t)
+		}
+	}
+	return strings.Join(tenants, "|"), nil
+}
+
+// client returns a client of cl with the settings of base.
+func (cl cluster) client(base *mimir.Client) *mimir.Client {
+	c := *base
+	c.BaseURL = strings.TrimSuffix(cl.URL, "/")
+	c.Tenant = cl.Tenant
+	c.BearerToken, c.Username, c.Password = cl.bearerToken, cl.Username, cl.password
+	return &c
+}
+
+// errUnknownCluster is returned for a cluster parameter naming no cluster.
+var errUnknownCluster = errors.New("unknown cluster")
+
+// clusterScan is a service scanning one of several clusters: its results
+// and events carry a cluster label, and it keeps no window cache and
+// exports no scores, which belong to background scans of the first cluster.
+func (s *service) clusterScan(name string, c *mimir.Client) *service {
+	cs := *s
+	cs.c, cs.cluster = c, name
+	cs.windows, cs.scores = nil, nil
+	return &cs
+}
+
+// scanClusters scans metric on the cluster named name: the first cluster
+// when empty, every cluster with "all". Clusters failing in "all" are
+// returned as unavailable, unless all fail.
+func (s *service) scanClusters(ctx context.Context, metric, name string) ([]seriesResult, *truncation, []string, error) {
+	if name == "" || name == s.cluster {
+		results, tr, err := s.scan(ctx, metric)
+		return results, tr, nil, err
+	}
+	if name != "all" {
+		cs, found := s.clusterScans[name]
+		if !found {
+			return nil, nil, nil, fmt.Errorf("%w: %s", errUnknownCluster, name)
+		}
+		results, tr, err := cs.scan(ctx, metric)
+		return results, tr, nil, err
+	}
+	type scanned struct {
+		results []seriesResult
+		tr      *truncation
+		err     error
+	}
+	out := make([]scanned, len(s.clusterNames))
+	var wg sync.WaitGroup
+	for i, n := range s.clusterNames {
+		cs := s
+		if n != s.cluster {
+			cs = s.clusterScans[n]
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out[i].results, out[i].tr, out[i].err = cs.scan(ctx, metric)
+		}()
+	}
+	wg.Wait()
+	var results []seriesResult
+	var tr *truncation
+	var unavailable []string
+	var firstErr error
+	for i, sc := range out {
+		if sc.err != nil {
+			unavailable = append(unavailable, s.clusterNames[i]+": "+sc.err.Error())
+			if firstErr == nil {
+				firstErr = sc.err
+			}
+			continue
+		}
+		results = append(results, sc.results...)
+		if sc.tr != nil {
+			if tr == nil {
+				tr = &truncation{Limit: sc.tr.Limit}
+			}
+			tr.Series += sc.tr.Series
+			tr.Skipped = append(tr.Skipped, sc.tr.Skipped...)
+		}
+	}
+	if len(unavailable) == len(out) {
+		return nil, nil, nil, firstErr
+	}
+	return results, tr, unavailable, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ifservice/internal/event"
+	"ifservice/internal/secret"
+)
+
+// deployment is a change to a service, e.g. a release, that anomalies
+// shortly after it are likely related to.
+type deployment struct {
+	Service     string    `json:"service"`
+	Version     string    `json:"version,omitempty"`
+	Time        time.Time `json:"time"`
+	Description string    `json:"description,omitempty"`
+	// Source is "api" for posted deployments or "grafana:<id>" for
+	// annotations.
+	Source string `json:"source"`
+}
+
+// deployments holds deployment markers ordered by time. When a path is
+// given they are appended to a JSON lines file replayed on startup.
+type deployments struct {
+	mu   sync.RWMutex
+	list []deployment
+	// retention bounds how long markers are kept in memory; 0 keeps all
+	retention time.Duration
+	f         *os.File
+}
+
+func openDeployments(path string, retention time.Duration) (*deployments, error) {
+	d := &deployments{retention: retention}
+	if path == "" {
+		return d, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var dep deployment
+		if err := json.Unmarshal(sc.Bytes(), &dep); err != nil || dep.Service == "" {
+			// skip a torn trailing line from an unclean shutdown
+			continue
+		}
+		d.insert(dep)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.f = f
+	return d, nil
+}
+
+// add stores dep unless a marker from the same Grafana annotation, or of
+// the same service, version and time, is known. It reports whether dep was
+// new.
+func (d *deployments) add(dep deployment) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, o := range d.list {
+		if (dep.Source != "api" && o.Source == dep.Source) ||
+			(o.Service == dep.Service && o.Version == dep.Version && o.Time.Equal(dep.Time)) {
+			return false, nil
+		}
+	}
+	if d.f != nil {
+		b, err := json.Marshal(dep)
+		if err != nil {
+			return false, err
+		}
+		if _, err := d.f.Write(append(b, '\n')); err != nil {
+			return false, err
+		}
+	}
+	d.insert(dep)
+	return true, nil
+}
+
+// insert adds dep in time order and drops markers beyond retention. The
+// caller holds the lock, or owns d.
+func (d *deployments) insert(dep deployment) {
+	i := sort.Search(len(d.list), func(i int) bool { return d.list[i].Time.After(dep.Time) })
+	d.list = append(d.list, deployment{})
+	copy(d.list[i+1:], d.list[i:])
+	d.list[i] = dep
+	if d.retention > 0 {
+		cut := time.Now().Add(-d.retention)
+		n := sort.Search(len(d.list), func(i int) bool { return !d.list[i].Time.Before(cut) })
+		d.list = d.list[n:]
+	}
+}
+
+// find returns the markers between from and to, of service when set,
+// newest first. Zero times leave the range open.
+func (d *deployments) find(service string, from, to time.Time) []deployment {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	out := []deployment{}
+	for i := len(d.list) - 1; i >= 0; i-- {
+		dep := d.list[i]
+		if (service == "" || dep.Service == service) &&
+			(from.IsZero() || !dep.Time.Before(from)) &&
+			(to.IsZero() || dep.Time.Before(to)) {
+			out = append(out, dep)
+		}
+	}
+	return out
+}
+
+// latest returns the newest marker of service at most within before at.
+func (d *deployments) latest(service string, at time.Time, within time.Duration) (deployment, bool) {
+	found := d.find(service, at.Add(-within), at.Add(time.Nanosecond))
+	if len(found) == 0 {
+		return deployment{}, false
+	}
+	return found[0], true
+}
+
+// deploymentBefore annotates a point of service at time at with the latest
+// deployment of the service within s.deployLookback before it.
+func (s *service) deploymentBefore(service string, at time.Time) *event.Deployment {
+	if s.deploys == nil || service == "" {
+		return nil
+	}
+	dep, found := s.deploys.latest(service, at, s.deployLookback)
+	if !found {
+		return nil
+	}
+	return &event.Deployment{
+		Service:       dep.Service,
+		Version:       dep.Version,
+		Time:          dep.Time,
+		MinutesBefore: at.Sub(dep.Time).Minutes(),
+	}
+}
+
+// handleDeployments lists deployment markers on GET and records one on
+// POST.
+func (s *service) handleDeployments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		var from, to time.Time
+		for _, b := range []struct {
+			name string
+			t    *time.Time
+		}{{"from", &from}, {"to", &to}} {
+			if v := q.Get(b.name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, "invalid "+b.name, http.StatusBadRequest)
+					return
+				}
+				*b.t = t
+			}
+		}
+		out := v1DeploymentsResponse{Deployments: []v1Deployment{}}
+		for _, dep := range s.deploys.find(q.Get("service"), from, to) {
+			out.Deployments = append(out.Deployments, v1Deployment(dep))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	case http.MethodPost:
+		var in v1Deployment
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&in); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if in.Service == "" {
+			http.Error(w, "service required", http.StatusBadRequest)
+			return
+		}
+		if in.Time.IsZero() {
+			in.Time = time.Now().UTC()
+		}
+		in.Source = "api"
+		if _, err := s.deploys.add(deployment(in)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("deployment of %s %s at %s", in.Service, in.Version, in.Time.Format(time.RFC3339))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(in)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// grafanaAnnotations imports deployment markers from Grafana annotations
+// tagged tag. The service is given by a "service:<name>" (or
+// "service=<name>") tag and the version by an optional "version:<v>" tag;
+// annotations without a service are skipped.
+type grafanaAnnotations struct {
+	url, tag string
+	token    secret.Secret
+	client   *http.Client
+}
+
+// follow polls the annotations of the last lookback every interval until
+// ctx is done.
+func (g grafanaAnnotations) follow(ctx context.Context, d *deployments, interval, lookback time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := g.poll(ctx, d, lookback); err != nil {
+			log.Printf("grafana annotations: %v", err)
+		} else if n > 0 {
+			log.Printf("grafana annotations: %d new deployments", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g grafanaAnnotations) poll(ctx context.Context, d *deployments, lookback time.Duration) (int, error) {
+	now := time.Now()
+	q := url.Values{}
+	q.Set("tags", g.tag)
+	q.Set("type", "annotation")
+	q.Set("from", strconv.FormatInt(now.Add(-lookback).UnixMilli(), 10))
+	q.Set("to", strconv.FormatInt(now.UnixMilli(), 10))
+	q.Set("limit", "1000")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.url+"/api/annotations?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if token := g.token.Get(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := g.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", res.Status)
+	}
+	var annotations []struct {
+		ID   int64    `json:"id"`
+		Time int64    `json:"time"`
+		Tags []string `json:"tags"`
+		Text string   `json:"text"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&annotations); err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, a := range annotations {
+		dep := deployment{Time: time.UnixMilli(a.Time).UTC(), Description: a.Text, Source: fmt.Sprintf("grafana:%d", a.ID)}
+		for _, t := range a.Tags {
+			if v, ok := tagValue(t, "service"); ok {
+				dep.Service = v
+			}
+			if v, ok := tagValue(t, "version"); ok {
+				dep.Version = v
+			}
+		}
+		if dep.Service == "" {
+			continue
+		}
+		isNew, err := d.add(dep)
+		if err != nil {
+			return added, err
+		}
+		if isNew {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// tagValue returns the value of a "key:value" or "key=value" tag.
+func tagValue(tag, key string) (string, bool) {
+	for _, sep := range []string{":", "="} {
+		if v, ok := strings.CutPrefix(tag, key+sep); ok && v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"ifservice/internal/mimir"
+	"ifservice/internal/promresult"
+)
+
+// Metrics of the servicegraph connector, counting requests between a
+// client and a server service.
+const (
+	graphRequestsMetric = "traces_service_graph_request_total"
+	graphFailedMetric   = "traces_service_graph_request_failed_total"
+)
+
+// edgeLabels identify an edge of the service graph.
+var edgeLabels = []string{"client", "server"}
+
+// edgeFetchers maps the metrics of service graph edges to their fetch
+// functions. An edge can fail while both of its services look acceptable,
+// e.g. the errors of one caller drowned in the server's other traffic.
+var edgeFetchers = map[string]fetchFunc{
+	"edge_rps":        fetchEdgeRPS,
+	"edge_error_rate": fetchEdgeErrorRate,
+}
+
+// detectedMetrics returns the metrics of fetchers and edgeFetchers.
+func detectedMetrics() []string {
+	out := make([]string, 0, len(fetchers)+len(edgeFetchers))
+	for metric := range fetchers {
+		out = append(out, metric)
+	}
+	for metric := range edgeFetchers {
+		out = append(out, metric)
+	}
+	return out
+}
+
+// fetchEdgeRPS pulls the request rate of every client→server edge over the
+// grid.
+func fetchEdgeRPS(ctx context.Context, c *mimir.Client, g promresult.Grid, by, matchers string) ([]promresult.Series, error) {
+	q := `sum by (` + by + `) (rate({__name__="` + graphRequestsMetric + `"` + matchers + `}[5m]))`
+	return fetchMatrix(ctx, c, q, g)
+}
+
+// fetchEdgeErrorRate pulls the share of failed requests of every edge over
+// the grid. Edges without failed requests are 0 rather than missing, so an
+// edge starting to fail within the window has a baseline.
+func fetchEdgeErrorRate(ctx context.Context, c *mimir.Client, g promresult.Grid, by, matchers string) ([]promresult.Series, error) {
+	requests := `sum by (` + by + `) (rate({__name__="` + graphRequestsMetric + `"` + matchers + `}[5m]))`
+	failed := `sum by (` + by + `) (rate({__name__="` + graphFailedMetric + `"` + matchers + `}[5m]))`
+	q := `(` + failed + ` or ` + requests + ` * 0) / ` + requests
+	return fetchMatrix(ctx, c, q, g)
+}
+
+// scanEdges scans the edges of an edge metric. There are far fewer edges
+// than spans, so they are fetched in one query, whatever the series limit
+// and page size, and export no score gauges, which are labelled by
+// GROUP_BY.
+func (s *service) scanEdges(ctx context.Context, metric string, fetch fetchFunc) ([]seriesResult, *truncation, error) {
+	end := time.Now()
+	g := promresult.NewGrid(end.Add(-time.Duration(s.window)*time.Minute), end, s.step)
+	series, err := s.windows.fetch(metric, g, func(fg promresult.Grid) ([]promresult.Series, error) {
+		return fetch(ctx, s.c, fg, strings.Join(edgeLabels, ", "), "")
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	results := s.score(metric, levelEdge, g, series)
+	if !publishes(ctx) {
+		return results, nil, nil
+	}
+	for _, res := range results {
+		s.scoped(res.Scope).emit(metric, res)
+	}
+	return results, nil, nil
+}
+
+// handleEdges serves the detection results of both edge metrics per edge,
+// most anomalous first.
+func (s *service) handleEdges(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	svc := q.Get("service")
+	byEdge := map[string]*v1Edge{}
+	var unavailable []string
+	for _, metric := range []string{"edge_rps", "edge_error_rate"} {
+		results, _, un, err := s.scanClusters(r.Context(), metric, q.Get("cluster"))
+		if errors.Is(err, errNoData) && metric != "edge_rps" {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), scanStatus(err))
+			return
+		}
+		unavailable = un
+		for _, res := range results {
+			l := res.Labels
+			if svc != "" && l["client"] != svc && l["server"] != svc {
+				continue
+			}
+			key := l["cluster"] + "/" + l["client"] + "/" + l["server"]
+			e := byEdge[key]
+			if e == nil {
+				e = &v1Edge{Client: l["client"], Server: l["server"], Cluster: l["cluster"]}
+				byEdge[key] = e
+			}
+			series := toV1Series(res)
+			if metric == "edge_rps" {
+				e.RPS = &series
+			} else {
+				e.ErrorRate = &series
+			}
+			for _, p := range res.Top {
+				if s.scoped(res.Scope).anomalous(metric, p, res.Threshold) {
+					e.Anomalous = true
+				}
+				e.MaxScore = max(e.MaxScore, p.Score)
+			}
+		}
+	}
+	out := v1EdgesResponse{WindowMinutes: s.window, Edges: make([]v1Edge, 0, len(byEdge)), Unavailable: unavailable}
+	for _, e := range byEdge {
+		out.Edges = append(out.Edges, *e)
+	}
+	sort.Slice(out.Edges, func(i, j int) bool {
+		a, b := out.Edges[i], out.Edges[j]
+		if a.Anomalous != b.Anomalous {
+			return a.Anomalous
+		}
+		if a.MaxScore != b.MaxScore {
+			return a.MaxScore > b.MaxScore
+		}
+		return a.Client+"/"+a.Server < b.Client+"/"+b.Server
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
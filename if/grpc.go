@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"ifservice/internal/anomalypb"
+	"ifservice/internal/event"
+	"ifservice/internal/store"
+)
+
+// anomalyServer implements anomalypb.AnomalyServiceServer on top of service.
+type anomalyServer struct {
+	anomalypb.UnimplementedAnomalyServiceServer
+	svc *service
+}
+
+// serveGRPC serves the anomaly gRPC API on addr until the listener fails,
+// over TLS with tlsConfig when not nil.
+func serveGRPC(addr string, svc *service, tlsConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(requestIDInterceptor)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	gs := grpc.NewServer(opts...)
+	anomalypb.RegisterAnomalyServiceServer(gs, &anomalyServer{svc: svc})
+	return gs.Serve(lis)
+}
+
+func (s *anomalyServer) ListAnomalies(ctx context.Context, req *anomalypb.ListAnomaliesRequest) (*anomalypb.ListAnomaliesResponse, error) {
+	metric := req.GetMetric()
+	if metric == "" {
+		metric = "rps"
+	}
+	if _, ok := fetchers[metric]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown metric: %s", metric)
+	}
+	// a read: polling it must not publish events, the scans of the HTTP
+	// endpoints and the scan loop do
+	results, _, err := s.svc.scan(withoutEvents(ctx), metric)
+	var le *seriesLimitError
+	if errors.As(err, &le) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	out := &anomalypb.ListAnomaliesResponse{
+		WindowMinutes: int32(s.svc.window),
+		Metric:        metric,
+		Series:        int32(len(results)),
+	}
+	for _, res := range results {
+		for _, p := range res.Top {
+			if p.Score < req.GetMinScore() {
+				continue
+			}
+			out.Anomalies = append(out.Anomalies, toProto(store.Event{Anomaly: event.Anomaly{Labels: res.Labels, Metric: metric, Time: p.Time, Value: p.Value, Score: p.Score, PValue: p.PValue}}))
+		}
+	}
+	return out, nil
+}
+
+func (s *anomalyServer) StreamAnomalies(req *anomalypb.StreamAnomaliesRequest, stream anomalypb.AnomalyService_StreamAnomaliesServer) error {
+	events, cancel := s.svc.hub.subscribe()
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			if len(req.GetMetrics()) > 0 && !slices.Contains(req.GetMetrics(), ev.Metric) {
+				continue
+			}
+			if req.GetServiceName() != "" && req.GetServiceName() != ev.Labels["service_name"] {
+				continue
+			}
+			if err := stream.Send(toProto(ev)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func toProto(ev store.Event) *anomalypb.AnomalyEvent {
+	return &anomalypb.AnomalyEvent{
+		ServiceName: ev.Labels["service_name"],
+		SpanName:    ev.Labels["span_name"],
+		PeerService: ev.Labels["peer_service"],
+		Metric:      ev.Metric,
+		Time:        timestamppb.New(ev.Time),
+		Value:       ev.Value,
+		Score:       ev.Score,
+		PValue:      ev.PValue,
+	}
+}
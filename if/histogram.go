@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ifservice/internal/promresult"
+)
+
+// modeMinShare is the share of observations a histogram bucket needs to be
+// a peak, so a stray slow request does not make a tail.
+const modeMinShare = 0.05
+
+// histogramShape names a distribution by its number of modes.
+func histogramShape(modes int) string {
+	switch modes {
+	case 0:
+		return "empty"
+	case 1:
+		return "unimodal"
+	case 2:
+		return "bimodal"
+	}
+	return "multimodal"
+}
+
+// handleHistogram serves the bucket distribution of the server spans
+// selected by the grouping label parameters over window minutes (default
+// the detection window), to tell a uniform slowdown from a slow tail.
+func (s *service) handleHistogram(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	window := s.window
+	if v := q.Get("window"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+		window = n
+		if err := s.limits.check(time.Duration(n)*time.Minute, 0); err != nil {
+			http.Error(w, "invalid window: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	matchers := ""
+	for _, k := range groupLabels {
+		if v := q.Get(k); v != "" {
+			matchers += fmt.Sprintf(", %s=%q", k, v)
+		}
+	}
+	end := time.Now()
+	lm, err := detectLatencyMetric(r.Context(), s.c, end.Add(-time.Duration(window)*time.Minute), end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// recorded buckets are 5m rates already
+	promQL := fmt.Sprintf(`sum by (le) (rate({__name__="%s", span_kind="SPAN_KIND_SERVER"%s}[%dm]))`, lm.name, matchers, window)
+	if lm.recorded {
+		promQL = fmt.Sprintf(`sum by (le) (avg_over_time({__name__="%s"%s}[%dm]))`, lm.name, matchers, window)
+	}
+	raw, err := s.c.Query(r.Context(), promQL, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	samples, err := promresult.DecodeVector(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	h := promresult.NewHistogram(samples, lm.toMs)
+	out := v1HistogramResponse{Query: promQL, WindowMinutes: window, Rate: h.Rate, Quantiles: map[string]float64{}, Modes: []string{}, Buckets: h.Buckets}
+	if out.Buckets == nil {
+		out.Buckets = []promresult.Bucket{}
+	}
+	for _, p := range []float64{0.5, 0.9, 0.95, 0.99} {
+		// NaN is not valid JSON
+		if v := h.Quantile(p); !math.IsNaN(v) {
+			out.Quantiles["p"+strconv.Itoa(int(p*100))] = v
+		}
+	}
+	modes := h.Modes(modeMinShare)
+	for _, i := range modes {
+		out.Modes = append(out.Modes, h.Buckets[i].Le)
+	}
+	out.Shape = histogramShape(len(modes))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"ifservice/internal/event"
+	"ifservice/internal/store"
+)
+
+// eventKey identifies the point an event refers to, so rescans of an
+// overlapping window do not publish the same anomaly twice.
+func eventKey(e store.Event) string {
+	return e.Metric + "|" + event.Subject(e.Labels) + "|" + e.Time.UTC().Format(time.RFC3339)
+}
+
+// hub persists newly detected anomaly events and fans them out to stream
+// subscribers.
+type hub struct {
+	mu    sync.Mutex
+	store *store.Store
+	subs  map[chan store.Event]struct{}
+	seen  map[string]time.Time
+	ttl   time.Duration
+	sinks []func(store.Event)
+}
+
+// newHub returns a hub writing to st and remembering published points for
+// ttl (typically the detection window) to suppress duplicates.
+func newHub(st *store.Store, ttl time.Duration) *hub {
+	return &hub{
+		store: st,
+		subs:  map[chan store.Event]struct{}{},
+		seen:  map[string]time.Time{},
+		ttl:   ttl,
+	}
+}
+
+// addSink registers fn to receive every stored event. fn must not block.
+func (h *hub) addSink(fn func(store.Event)) {
+	h.mu.Lock()
+	h.sinks = append(h.sinks, fn)
+	h.mu.Unlock()
+}
+
+// subscribe registers a new subscriber. The returned func must be called to
+// release it.
+func (h *hub) subscribe() (<-chan store.Event, func()) {
+	ch := make(chan store.Event, 64)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// subscribers returns the number of stream subscribers.
+func (h *hub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// publish stores ev and delivers it to all subscribers unless it was already
+// published. Slow subscribers drop events rather than block detection; they
+// can resume from the store.
+func (h *hub) publish(ev store.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for k, t := range h.seen {
+		if now.Sub(t) > h.ttl {
+			delete(h.seen, k)
+		}
+	}
+	k := eventKey(ev)
+	if _, ok := h.seen[k]; ok {
+		return
+	}
+	h.seen[k] = now
+	ev, err := h.store.Append(ev)
+	if err != nil {
+		log.Printf("store anomaly event: %v", err)
+		return
+	}
+	for _, fn := range h.sinks {
+		fn(ev)
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
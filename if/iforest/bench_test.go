@@ -0,0 +1,56 @@
+package iforest
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// window is a detection window of one series: two hours of minute points.
+func window() []float64 {
+	return normal(rand.New(rand.NewSource(1)), 120)
+}
+
+// BenchmarkScan fits and scores one series the way a scan does, per series
+// and per scan.
+func BenchmarkScan(b *testing.B) {
+	vals := window()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f := New(vals, Options{Trees: 100, SampleSize: 64})
+		for _, v := range vals {
+			_ = f.Score(v)
+		}
+	}
+}
+
+func BenchmarkFit(b *testing.B) {
+	vals := window()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		New(vals, Options{Trees: 100, SampleSize: 64})
+	}
+}
+
+func BenchmarkFitMultivariate(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	points := make([][]float64, 120)
+	for i := range points {
+		points[i] = []float64{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewMultivariate(points, Options{Trees: 100, SampleSize: 64}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScore(b *testing.B) {
+	vals := window()
+	f := New(vals, Options{Trees: 100, SampleSize: 64, Seed: 1})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = f.Score(vals[i%len(vals)])
+	}
+}
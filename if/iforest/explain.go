@@ -0,0 +1,109 @@
+package iforest
+
+import "fmt"
+
+// Split is a split of a tree of the forest.
+type Split struct {
+	Tree    int     `json:"tree"`
+	Depth   int     `json:"depth"`
+	Feature int     `json:"feature"`
+	Value   float64 `json:"value"`
+	// Size is the number of subsample points split.
+	Size int `json:"size"`
+}
+
+// Splits returns every split of the forest, tree by tree, each tree's
+// from the root down. Their values per feature and depth are the
+// distribution of the cuts the forest isolates points with.
+func (f *Forest) Splits() []Split {
+	var out []Split
+	var stack []*Tree
+	for i, t := range f.Trees {
+		stack = append(stack[:0], t)
+		for len(stack) > 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if n == nil || n.Leaf {
+				continue
+			}
+			out = append(out, Split{Tree: i, Depth: n.Depth, Feature: n.Feature, Value: n.Split, Size: n.Size})
+			stack = append(stack, n.Right, n.Left)
+		}
+	}
+	return out
+}
+
+// Step is a split on the path of a point through a tree.
+type Step struct {
+	Feature int     `json:"feature"`
+	Split   float64 `json:"split"`
+	// Left tells whether the point went left, its Feature value below
+	// Split.
+	Left bool `json:"left"`
+}
+
+// Path returns the splits the point x passes through in tree i, from the
+// root to the leaf it ends in.
+func (f *Forest) Path(i int, x ...float64) []Step {
+	f.check(x)
+	var out []Step
+	for n := f.Trees[i]; n != nil && !n.Leaf && n.Left != nil && n.Right != nil; {
+		left := x[n.Feature] < n.Split
+		out = append(out, Step{Feature: n.Feature, Split: n.Split, Left: left})
+		if left {
+			n = n.Left
+		} else {
+			n = n.Right
+		}
+	}
+	return out
+}
+
+// Explanation tells why a point scored as it did.
+type Explanation struct {
+	Score float64 `json:"score"`
+	// PathLength is the mean of PathLengths, the depths at which each tree
+	// isolates the point; the shorter, the higher the score. C is the
+	// length at which the score is 0.5.
+	PathLength  float64   `json:"pathLength"`
+	PathLengths []float64 `json:"pathLengths"`
+	C           float64   `json:"c"`
+	// Importance is the share of each feature in isolating the point: the
+	// splits on its paths, those of trees isolating it early weighing
+	// more. It sums to 1, or is all 0 when no tree splits the point.
+	Importance []float64 `json:"importance"`
+}
+
+// Explain scores the point x with the path length of every tree and the
+// importance of each feature.
+func (f *Forest) Explain(x ...float64) Explanation {
+	e := Explanation{Score: f.Score(x...), C: f.C, PathLengths: make([]float64, len(f.Trees)), Importance: make([]float64, f.Dims)}
+	total := 0.0
+	for i, t := range f.Trees {
+		e.PathLengths[i] = pathLenTree(t, x)
+		e.PathLength += e.PathLengths[i]
+		path := f.Path(i, x...)
+		for _, s := range path {
+			// the tree weighs 1/len(path), shared by the splits on it
+			w := 1 / float64(len(path)*len(path))
+			e.Importance[s.Feature] += w
+			total += w
+		}
+	}
+	if len(f.Trees) > 0 {
+		e.PathLength /= float64(len(f.Trees))
+	}
+	if total > 0 {
+		for q := range e.Importance {
+			e.Importance[q] /= total
+		}
+	}
+	return e
+}
+
+// check panics unless x has Dims features.
+func (f *Forest) check(x []float64) {
+	if len(x) != f.Dims {
+		panic(fmt.Sprintf("iforest: scoring a point of %d features in a forest of %d", len(x), f.Dims))
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/arijanluiken/mcp/if/iforest
+
+go 1.22
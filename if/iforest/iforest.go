@@ -0,0 +1,285 @@
+// Package iforest is an isolation forest (Liu, Ting and Zhou, 2008) for
+// scoring points of one or more features by how easily random splits
+// isolate them: anomalies are few and different, so they end up closer to
+// the root of the trees.
+//
+// Fit a forest on a sample of normal behaviour, then score points against
+// it:
+//
+//	f := iforest.New(values, iforest.Options{})
+//	if f.Score(v) > 0.6 {
+//		// v is anomalous
+//	}
+//
+// Points of several features, e.g. request rate, error rate and latency of
+// one minute, are fit with NewMultivariate and scored with Score(x...).
+// Features should be on comparable scales, e.g. z-scores, as each split
+// draws its value uniformly between the minimum and maximum of a feature.
+//
+// The package has no dependencies outside the standard library. A Forest
+// is immutable once fit and safe for concurrent scoring.
+package iforest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// Defaults of Options. The subsample size is the one the anomaly service
+// fits its series on: minute points of a window of an hour or two.
+const (
+	DefaultTrees      = 100
+	DefaultSampleSize = 64
+)
+
+// Options configure fitting. The zero value fits DefaultTrees trees on
+// subsamples of DefaultSampleSize points with random seeds.
+type Options struct {
+	// Trees is the number of trees.
+	Trees int
+	// SampleSize is the number of points, drawn with replacement, each tree
+	// is fit on, at most the number of points.
+	SampleSize int
+	// MaxDepth limits the depth of the trees. By default it is
+	// ceil(log2(SampleSize)), the average depth of an unbalanced tree, below
+	// which only normal points are split further.
+	MaxDepth int
+	// Seed, when not 0, makes fitting deterministic: the same points,
+	// options and seed give the same forest.
+	Seed int64
+}
+
+// Tree is a node of an isolation tree. Points with a Feature value below
+// Split go Left, others Right. Trees marshal to JSON as nested nodes.
+type Tree struct {
+	Feature int     `json:"feature"`
+	Split   float64 `json:"split"`
+	Left    *Tree   `json:"left,omitempty"`
+	Right   *Tree   `json:"right,omitempty"`
+	Leaf    bool    `json:"leaf"`
+	Depth   int     `json:"depth"`
+	// Size is the number of subsample points that reached the node.
+	Size int `json:"size"`
+}
+
+// Forest is a fit isolation forest.
+type Forest struct {
+	Trees []*Tree `json:"trees"`
+	// C is the average path length of an unsuccessful search in a binary
+	// search tree of the sample size, normalizing path lengths to scores.
+	C float64 `json:"c"`
+	// Dims is the number of features of the points.
+	Dims int `json:"dims"`
+}
+
+// averagePathLength computes c(n) ~ 2H(n-1) - 2(n-1)/n where H is harmonic number
+func averagePathLength(n int) float64 {
+	if n <= 1 {
+		return 0
+	}
+	// Harmonic number approximation
+	h := 0.0
+	for i := 1; i < n; i++ {
+		h += 1.0 / float64(i)
+	}
+	return 2*h - 2*float64(n-1)/float64(n)
+}
+
+// New fits a forest on values, points of one feature. With no values, every
+// point scores 0.
+func New(values []float64, opts Options) *Forest {
+	return fit(values, 1, opts)
+}
+
+// NewMultivariate fits a forest on points of the same, non-zero number of
+// features.
+func NewMultivariate(points [][]float64, opts Options) (*Forest, error) {
+	if len(points) == 0 {
+		return nil, errors.New("iforest: no points")
+	}
+	dims := len(points[0])
+	if dims == 0 {
+		return nil, errors.New("iforest: points have no features")
+	}
+	flat := make([]float64, 0, len(points)*dims)
+	for i, p := range points {
+		if len(p) != dims {
+			return nil, fmt.Errorf("iforest: point %d has %d features, point 0 has %d", i, len(p), dims)
+		}
+		flat = append(flat, p...)
+	}
+	return fit(flat, dims, opts), nil
+}
+
+// fitter is the scratch space of fitting, pooled so scans fitting a forest
+// per series reuse it.
+type fitter struct {
+	rng *rand.Rand
+	// idx holds the subsample as indexes of points, partitioned in place
+	// by the splits so each node's points are a range of it.
+	idx []int32
+	// nodes of all trees, linked by the indexes in kids until copied into
+	// the forest
+	nodes []Tree
+	kids  [][2]int32
+	roots []int32
+	stack []frame
+}
+
+// frame is a node to fit on the points idx[lo:hi].
+type frame struct {
+	node, lo, hi int32
+}
+
+var fitters = sync.Pool{New: func() any { return &fitter{rng: rand.New(rand.NewSource(1))} }}
+
+// fit fits a forest on the points of dims features laid out one after the
+// other in data.
+func fit(data []float64, dims int, opts Options) *Forest {
+	n := len(data) / dims
+	trees, psi := opts.Trees, opts.SampleSize
+	if trees <= 0 {
+		trees = DefaultTrees
+	}
+	if psi <= 0 {
+		psi = DefaultSampleSize
+	}
+	psi = min(psi, n)
+	if psi == 0 {
+		return &Forest{Dims: dims}
+	}
+	maxDepth := opts.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = int(math.Ceil(math.Log2(float64(psi))))
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+	ft := fitters.Get().(*fitter)
+	defer fitters.Put(ft)
+	// a source per fit: deterministic when seeded, and without contention
+	// on the global one when fit concurrently
+	ft.rng.Seed(seed)
+	ft.nodes, ft.kids, ft.roots = ft.nodes[:0], ft.kids[:0], ft.roots[:0]
+	if cap(ft.idx) < psi {
+		ft.idx = make([]int32, psi)
+	}
+	ft.idx = ft.idx[:psi]
+	for range trees {
+		for j := range ft.idx {
+			ft.idx[j] = int32(ft.rng.Intn(n))
+		}
+		ft.roots = append(ft.roots, ft.fitTree(data, dims, maxDepth))
+	}
+	// one allocation for the nodes of all trees, close together for scoring
+	slab := make([]Tree, len(ft.nodes))
+	copy(slab, ft.nodes)
+	for i, k := range ft.kids {
+		if !slab[i].Leaf {
+			slab[i].Left, slab[i].Right = &slab[k[0]], &slab[k[1]]
+		}
+	}
+	f := &Forest{Trees: make([]*Tree, trees), C: averagePathLength(psi), Dims: dims}
+	for i, r := range ft.roots {
+		f.Trees[i] = &slab[r]
+	}
+	return f
+}
+
+// fitTree builds a random isolation tree on the subsample in idx, splitting
+// each node on a random feature that is not constant in it, and returns its
+// root. Nodes are fit depth first, left first.
+func (ft *fitter) fitTree(data []float64, dims, maxDepth int) int32 {
+	root := ft.add(0, len(ft.idx))
+	ft.stack = append(ft.stack[:0], frame{node: root, lo: 0, hi: int32(len(ft.idx))})
+	for len(ft.stack) > 0 {
+		fr := ft.stack[len(ft.stack)-1]
+		ft.stack = ft.stack[:len(ft.stack)-1]
+		// nd is valid until the children are added
+		nd := &ft.nodes[fr.node]
+		nd.Leaf = true // unless split below
+		points := ft.idx[fr.lo:fr.hi]
+		if nd.Depth >= maxDepth || len(points) <= 1 {
+			continue
+		}
+		// try the features in random order
+		offset := ft.rng.Intn(dims)
+		for i := 0; i < dims; i++ {
+			q := (offset + i) % dims
+			minV, maxV := data[int(points[0])*dims+q], data[int(points[0])*dims+q]
+			for _, p := range points[1:] {
+				v := data[int(p)*dims+q]
+				if v < minV {
+					minV = v
+				}
+				if v > maxV {
+					maxV = v
+				}
+			}
+			if minV == maxV {
+				continue
+			}
+			split := minV + ft.rng.Float64()*(maxV-minV)
+			// points below split first
+			mid := 0
+			for j, p := range points {
+				if data[int(p)*dims+q] < split {
+					points[mid], points[j] = points[j], points[mid]
+					mid++
+				}
+			}
+			nd.Leaf, nd.Feature, nd.Split = false, q, split
+			depth := nd.Depth + 1
+			left, right := ft.add(depth, mid), ft.add(depth, len(points)-mid)
+			ft.kids[fr.node] = [2]int32{left, right}
+			m := fr.lo + int32(mid)
+			ft.stack = append(ft.stack, frame{node: right, lo: m, hi: fr.hi}, frame{node: left, lo: fr.lo, hi: m})
+			break
+		}
+	}
+	return root
+}
+
+// add adds a node of size points at depth.
+func (ft *fitter) add(depth, size int) int32 {
+	ft.nodes = append(ft.nodes, Tree{Depth: depth, Size: size})
+	ft.kids = append(ft.kids, [2]int32{})
+	return int32(len(ft.nodes) - 1)
+}
+
+// pathLength computes expected path length for a point x across the forest
+func (f *Forest) pathLength(x []float64) float64 {
+	pl := 0.0
+	for _, t := range f.Trees {
+		pl += pathLenTree(t, x)
+	}
+	return pl / float64(len(f.Trees))
+}
+
+// pathLenTree is the depth of the leaf x ends in.
+func pathLenTree(t *Tree, x []float64) float64 {
+	for !t.Leaf && t.Left != nil && t.Right != nil {
+		if x[t.Feature] < t.Split {
+			t = t.Left
+		} else {
+			t = t.Right
+		}
+	}
+	return float64(t.Depth)
+}
+
+// Score returns the anomaly score of the point x in [0,1], higher meaning
+// more anomalous; points scoring well above 0.5 are anomalies. x must have
+// Dims features.
+func (f *Forest) Score(x ...float64) float64 {
+	f.check(x)
+	if f.C == 0 {
+		return 0
+	}
+	E := f.pathLength(x)
+	return math.Pow(2, -E/f.C)
+}
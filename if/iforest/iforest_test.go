@@ -0,0 +1,96 @@
+package iforest
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func normal(rng *rand.Rand, n int) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = rng.NormFloat64()
+	}
+	return out
+}
+
+func TestScoreOutlier(t *testing.T) {
+	values := normal(rand.New(rand.NewSource(1)), 500)
+	f := New(values, Options{Seed: 1})
+	if in, out := f.Score(0), f.Score(8); out <= 0.6 || in >= out {
+		t.Errorf("Score(0) = %v, Score(8) = %v, want the outlier above 0.6 and the inlier", in, out)
+	}
+}
+
+func TestSeedDeterministic(t *testing.T) {
+	values := normal(rand.New(rand.NewSource(1)), 200)
+	a, b := New(values, Options{Seed: 7}), New(values, Options{Seed: 7})
+	for _, x := range []float64{-3, 0, 0.5, 4} {
+		if sa, sb := a.Score(x), b.Score(x); sa != sb {
+			t.Errorf("Score(%v) = %v and %v with the same seed", x, sa, sb)
+		}
+	}
+}
+
+func TestMultivariate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	points := make([][]float64, 500)
+	for i := range points {
+		// two correlated features
+		x := rng.NormFloat64()
+		points[i] = []float64{x, x + 0.1*rng.NormFloat64()}
+	}
+	f, err := NewMultivariate(points, Options{Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each feature is normal on its own, the pair is not
+	if in, out := f.Score(1, 1), f.Score(1, -1); in >= out {
+		t.Errorf("Score(1, 1) = %v, Score(1, -1) = %v, want the uncorrelated point higher", in, out)
+	}
+	if _, err := NewMultivariate([][]float64{{1, 2}, {3}}, Options{}); err == nil {
+		t.Error("ragged points: want error")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	points := make([][]float64, 500)
+	for i := range points {
+		points[i] = []float64{rng.NormFloat64(), rng.NormFloat64()}
+	}
+	f, err := NewMultivariate(points, Options{Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := f.Explain(0, 6)
+	if e.Score != f.Score(0, 6) || len(e.PathLengths) != len(f.Trees) {
+		t.Fatalf("Explain = %+v, want the score and a path length per tree", e)
+	}
+	if e.Importance[1] <= 0.5 {
+		t.Errorf("importance = %v, want feature 1 most important", e.Importance)
+	}
+	for i := range f.Trees {
+		if got := len(f.Path(i, 0, 6)); float64(got) != e.PathLengths[i] {
+			t.Errorf("tree %d: path of %d steps, path length %v", i, got, e.PathLengths[i])
+		}
+	}
+	for _, s := range f.Splits() {
+		if s.Size < 2 {
+			t.Fatalf("split %+v of fewer than 2 points", s)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	if s := New(nil, Options{}).Score(1); s != 0 {
+		t.Errorf("Score = %v on an empty forest, want 0", s)
+	}
+}
+
+func Example() {
+	values := []float64{10, 11, 9, 10, 12, 11, 10, 9, 10, 11, 10, 50}
+	f := New(values, Options{Trees: 100, SampleSize: 64, Seed: 1})
+	fmt.Println(f.Score(50) > f.Score(10))
+	// Output: true
+}
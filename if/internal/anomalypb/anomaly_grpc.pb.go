@@ -0,0 +1,175 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: anomaly/v1/anomaly.proto
+
+package anomalypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	AnomalyService_ListAnomalies_FullMethodName   = "/anomaly.v1.AnomalyService/ListAnomalies"
+	AnomalyService_StreamAnomalies_FullMethodName = "/anomaly.v1.AnomalyService/StreamAnomalies"
+)
+
+// AnomalyServiceClient is the client API for AnomalyService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// AnomalyService exposes the if-service anomaly API over gRPC.
+type AnomalyServiceClient interface {
+	// ListAnomalies runs detection for a metric over the configured window and
+	// returns the top anomalous points of every series.
+	ListAnomalies(ctx context.Context, in *ListAnomaliesRequest, opts ...grpc.CallOption) (*ListAnomaliesResponse, error)
+	// StreamAnomalies pushes anomaly events crossing the score threshold as they
+	// are detected, for consumers that prefer push over poll.
+	StreamAnomalies(ctx context.Context, in *StreamAnomaliesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AnomalyEvent], error)
+}
+
+type anomalyServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAnomalyServiceClient(cc grpc.ClientConnInterface) AnomalyServiceClient {
+	return &anomalyServiceClient{cc}
+}
+
+func (c *anomalyServiceClient) ListAnomalies(ctx context.Context, in *ListAnomaliesRequest, opts ...grpc.CallOption) (*ListAnomaliesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListAnomaliesResponse)
+	err := c.cc.Invoke(ctx, AnomalyService_ListAnomalies_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *anomalyServiceClient) StreamAnomalies(ctx context.Context, in *StreamAnomaliesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AnomalyEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AnomalyService_ServiceDesc.Streams[0], AnomalyService_StreamAnomalies_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamAnomaliesRequest, AnomalyEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AnomalyService_StreamAnomaliesClient = grpc.ServerStreamingClient[AnomalyEvent]
+
+// AnomalyServiceServer is the server API for AnomalyService service.
+// All implementations must embed UnimplementedAnomalyServiceServer
+// for forward compatibility.
+//
+// AnomalyService exposes the if-service anomaly API over gRPC.
+type AnomalyServiceServer interface {
+	// ListAnomalies runs detection for a metric over the configured window and
+	// returns the top anomalous points of every series.
+	ListAnomalies(context.Context, *ListAnomaliesRequest) (*ListAnomaliesResponse, error)
+	// StreamAnomalies pushes anomaly events crossing the score threshold as they
+	// are detected, for consumers that prefer push over poll.
+	StreamAnomalies(*StreamAnomaliesRequest, grpc.ServerStreamingServer[AnomalyEvent]) error
+	mustEmbedUnimplementedAnomalyServiceServer()
+}
+
+// UnimplementedAnomalyServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAnomalyServiceServer struct{}
+
+func (UnimplementedAnomalyServiceServer) ListAnomalies(context.Context, *ListAnomaliesRequest) (*ListAnomaliesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAnomalies not implemented")
+}
+func (UnimplementedAnomalyServiceServer) StreamAnomalies(*StreamAnomaliesRequest, grpc.ServerStreamingServer[AnomalyEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamAnomalies not implemented")
+}
+func (UnimplementedAnomalyServiceServer) mustEmbedUnimplementedAnomalyServiceServer() {}
+func (UnimplementedAnomalyServiceServer) testEmbeddedByValue()                        {}
+
+// UnsafeAnomalyServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AnomalyServiceServer will
+// result in compilation errors.
+type UnsafeAnomalyServiceServer interface {
+	mustEmbedUnimplementedAnomalyServiceServer()
+}
+
+func RegisterAnomalyServiceServer(s grpc.ServiceRegistrar, srv AnomalyServiceServer) {
+	// If the following call pancis, it indicates UnimplementedAnomalyServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AnomalyService_ServiceDesc, srv)
+}
+
+func _AnomalyService_ListAnomalies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAnomaliesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnomalyServiceServer).ListAnomalies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnomalyService_ListAnomalies_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnomalyServiceServer).ListAnomalies(ctx, req.(*ListAnomaliesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AnomalyService_StreamAnomalies_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamAnomaliesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AnomalyServiceServer).StreamAnomalies(m, &grpc.GenericServerStream[StreamAnomaliesRequest, AnomalyEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AnomalyService_StreamAnomaliesServer = grpc.ServerStreamingServer[AnomalyEvent]
+
+// AnomalyService_ServiceDesc is the grpc.ServiceDesc for AnomalyService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AnomalyService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "anomaly.v1.AnomalyService",
+	HandlerType: (*AnomalyServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListAnomalies",
+			Handler:    _AnomalyService_ListAnomalies_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamAnomalies",
+			Handler:       _AnomalyService_StreamAnomalies_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "anomaly/v1/anomaly.proto",
+}
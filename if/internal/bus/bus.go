@@ -0,0 +1,88 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Publisher sends encoded events to a message bus. key is used for
+// partitioning where the bus supports it.
+type Publisher interface {
+	Publish(ctx context.Context, key string, payload []byte) error
+	Close() error
+}
+
+// ContentType is the structured-mode CloudEvents content type.
+const ContentType = "application/cloudevents+json"
+
+// New returns a publisher for kind ("nats" or "kafka"). addr is the NATS URL
+// or a comma separated list of Kafka brokers; dest is the subject or topic.
+func New(kind, addr, dest string) (Publisher, error) {
+	switch kind {
+	case "nats":
+		return NewNATS(addr, dest)
+	case "kafka":
+		return NewKafka(strings.Split(addr, ","), dest), nil
+	default:
+		return nil, fmt.Errorf("unknown bus kind: %s", kind)
+	}
+}
+
+type natsPublisher struct {
+	nc      *nats.Conn
+	subject string
+}
+
+// NewNATS connects to url and publishes on subject. The connection
+// reconnects on its own after transient failures.
+func NewNATS(url, subject string) (Publisher, error) {
+	nc, err := nats.Connect(url, nats.Name("if-service"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{nc: nc, subject: subject}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, key string, payload []byte) error {
+	msg := nats.NewMsg(p.subject)
+	msg.Header.Set("content-type", ContentType)
+	msg.Data = payload
+	return p.nc.PublishMsg(msg)
+}
+
+func (p *natsPublisher) Close() error {
+	return p.nc.Drain()
+}
+
+type kafkaPublisher struct {
+	w *kafka.Writer
+}
+
+// NewKafka publishes to topic on brokers, keyed so events of one service keep
+// their order within a partition.
+func NewKafka(brokers []string, topic string) Publisher {
+	return &kafkaPublisher{w: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: 100 * time.Millisecond,
+		RequiredAcks: kafka.RequireOne,
+	}}
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, key string, payload []byte) error {
+	return p.w.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(key),
+		Value:   payload,
+		Headers: []kafka.Header{{Key: "content-type", Value: []byte(ContentType)}},
+	})
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,79 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=1.0": true,
+		"br, gzip; q=0.5":     true,
+		"gzip;q=0":            false,
+		"identity":            false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	body := strings.Repeat(`{"series":[1,2,3]}`, 100)
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", "1800")
+			_, _ = io.WriteString(w, body)
+		case "/stream":
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: x\n\n")
+			w.(http.Flusher).Flush()
+		case "/error":
+			http.Error(w, "failed", http.StatusInternalServerError)
+		}
+	}))
+	get := func(path string, gzipped bool) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if gzipped {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	res := get("/json", true)
+	if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Content-Length") != "" {
+		t.Fatalf("json headers = %v, want gzip without Content-Length", res.Header)
+	}
+	zr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != body {
+		t.Errorf("decompressed body = %.40q..., want the handler's", b)
+	}
+
+	if res := get("/json", false); res.Header.Get("Content-Encoding") != "" {
+		t.Error("compressed for a client not accepting gzip")
+	}
+	if res := get("/stream", true); res.Header.Get("Content-Encoding") != "" {
+		t.Error("compressed an event stream")
+	}
+	res = get("/error", true)
+	zr, err = gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); res.StatusCode != http.StatusInternalServerError || string(b) != "failed\n" {
+		t.Errorf("error = %d %q, want 500 failed", res.StatusCode, b)
+	}
+}
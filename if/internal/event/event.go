@@ -0,0 +1,206 @@
+// Package event defines the versioned anomaly event schema shared by every
+// if-service output (log line, message bus, SSE stream).
+//
+// Events are CloudEvents 1.0 in structured JSON mode. Breaking changes to the
+// data payload get a new Type and DataSchema version; additive changes do not.
+package event
+
+import (
+	_ "embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SpecVersion = "1.0"
+	// Type is the CloudEvents type of anomaly events, versioned with the schema.
+	Type = "io.ifservice.anomaly.v1"
+	// DataSchema is where the service serves Schema.
+	DataSchema = "/schemas/anomaly-event/v1.json"
+)
+
+// Schema is the JSON Schema of a CloudEvent carrying an Anomaly.
+//
+//go:embed anomaly.v1.schema.json
+var Schema []byte
+
+// Anomaly is the data payload of an anomaly event.
+type Anomaly struct {
+	// Metric the point was detected on, e.g. "rps", "error_rate", "latency_p95"
+	// or, on edges, "edge_rps" and "edge_error_rate".
+	Metric string `json:"metric"`
+	// Labels identifying the series, by default service_name, span_name and peer_service.
+	Labels map[string]string `json:"labels"`
+	// Time of the anomalous point.
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	// Score is the isolation forest score in [0,1].
+	Score float64 `json:"score"`
+	// PValue is the calibrated score: the share of the series' historical
+	// scores at least as high. Absent on events stored before calibration.
+	PValue float64 `json:"pValue,omitempty"`
+	// Severity is "warning", or "critical" for scores at or above the
+	// critical score. Events stored before severities existed have none.
+	Severity string `json:"severity,omitempty"`
+	// RunLength is the number of consecutive anomalous points of the run
+	// the point is part of, within the window. Absent on events stored
+	// before run lengths existed.
+	RunLength int `json:"runLength,omitempty"`
+	// Level is "span" for a series of the grouping labels, "service" for
+	// the aggregate of a service's spans, or "edge" for a client and server
+	// of the service graph. Absent on events stored before service-level
+	// detection existed.
+	Level string `json:"level,omitempty"`
+	// Related are the labels of the series of the other level anomalous at
+	// the same time: the service of a span event, or the spans of a service
+	// event.
+	Related []map[string]string `json:"related,omitempty"`
+	// Scope is the scope of SCOPES_FILE the series was detected with, if
+	// any.
+	Scope string `json:"scope,omitempty"`
+	// WindowMinutes is the detection window the score is relative to.
+	WindowMinutes int `json:"windowMinutes"`
+	// Links to related resources, e.g. a Grafana Explore view of the series.
+	Links []Link `json:"links,omitempty"`
+	// Explanation puts the value in the context of its window.
+	Explanation *Explanation `json:"explanation,omitempty"`
+	// Sparkline summarizes the window, to draw the series without querying
+	// it. Absent on events stored before sparklines existed.
+	Sparkline *Sparkline `json:"sparkline,omitempty"`
+	// Deployment is the latest deployment of the series' service shortly
+	// before the point, if any.
+	Deployment *Deployment `json:"deployment,omitempty"`
+	// Kubernetes describes the workload of the series' service when
+	// KUBERNETES_ENRICHMENT is enabled and it was found.
+	Kubernetes *Kubernetes `json:"kubernetes,omitempty"`
+}
+
+// Kubernetes is the state of the deployment behind a service when the
+// anomaly was detected.
+type Kubernetes struct {
+	Namespace  string `json:"namespace"`
+	Deployment string `json:"deployment"`
+	// Replicas is the desired count.
+	Replicas          int `json:"replicas"`
+	ReadyReplicas     int `json:"readyReplicas"`
+	AvailableReplicas int `json:"availableReplicas"`
+	UpdatedReplicas   int `json:"updatedReplicas"`
+	// Restarts counts container restarts of the current pods,
+	// RecentRestarts those within the last hour by default.
+	Restarts       int `json:"restarts"`
+	RecentRestarts int `json:"recentRestarts"`
+	// Rollout is "complete", "progressing" or "stalled".
+	Rollout string `json:"rollout"`
+}
+
+// Deployment is a deployment marker preceding an anomaly.
+type Deployment struct {
+	Service string    `json:"service"`
+	Version string    `json:"version,omitempty"`
+	Time    time.Time `json:"time"`
+	// MinutesBefore is how long before the anomalous point it happened.
+	MinutesBefore float64 `json:"minutesBefore"`
+}
+
+// Note renders d as "deployment of service X occurred N minutes before".
+func (d Deployment) Note() string {
+	what := d.Service
+	if d.Version != "" {
+		what += " " + d.Version
+	}
+	return fmt.Sprintf("deployment of %s occurred %.0f minutes before", what, d.MinutesBefore)
+}
+
+// Explanation describes how unusual a point is within the window it was
+// scored on, so its significance can be judged without querying the series.
+type Explanation struct {
+	// Mean and Std of the series over the window.
+	Mean float64 `json:"mean"`
+	Std  float64 `json:"std"`
+	// Sigma is the signed distance of the value from Mean in Stds, or from
+	// the median or winsorized mean in robust standard deviations with the
+	// series' normalization; 0 for a constant series.
+	Sigma float64 `json:"sigma"`
+	// Percentile is the share of window points at or below the value, 0 to
+	// 100.
+	Percentile float64 `json:"percentile"`
+}
+
+// Sparkline summarizes a window in consecutive buckets of about equal
+// length, oldest first: the lowest, mean and highest value of each.
+type Sparkline struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Min   []float64 `json:"min"`
+	Mean  []float64 `json:"mean"`
+	Max   []float64 `json:"max"`
+}
+
+// Link points at a resource related to an anomaly.
+type Link struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+// CloudEvent is the envelope every output emits.
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	DataSchema      string    `json:"dataschema"`
+	Data            Anomaly   `json:"data"`
+}
+
+// New wraps a with the envelope attributes. id must be unique per source.
+func New(source string, id int64, a Anomaly) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     SpecVersion,
+		ID:              strconv.FormatInt(id, 10),
+		Source:          source,
+		Type:            Type,
+		Subject:         Subject(a.Labels),
+		Time:            a.Time,
+		DataContentType: "application/json",
+		DataSchema:      DataSchema,
+		Data:            a,
+	}
+}
+
+// Subject renders series labels as a sorted PromQL-style label set, e.g.
+// {peer_service="a",service_name="b",span_name="GET /x"}.
+func Subject(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// LogLine is the single-line text form of the event.
+func (e CloudEvent) LogLine() string {
+	svc := e.Data.Labels["service_name"]
+	if svc == "" {
+		svc = "unknown"
+	}
+	line := fmt.Sprintf("anomaly detected: service=%s metric=%s id=%s type=%s subject=%s time=%s value=%g score=%.3f pValue=%.4g severity=%s window=%dm",
+		svc, e.Data.Metric, e.ID, e.Type, e.Subject, e.Data.Time.Format(time.RFC3339), e.Data.Value, e.Data.Score, e.Data.PValue, e.Data.Severity, e.Data.WindowMinutes)
+	if d := e.Data.Deployment; d != nil {
+		line += fmt.Sprintf(" deployment=%q", d.Note())
+	}
+	if k := e.Data.Kubernetes; k != nil {
+		line += fmt.Sprintf(" k8s=%s/%s ready=%d/%d recentRestarts=%d rollout=%s", k.Namespace, k.Deployment, k.ReadyReplicas, k.Replicas, k.RecentRestarts, k.Rollout)
+	}
+	return line
+}
@@ -0,0 +1,272 @@
+// Package kube maps services to the Kubernetes deployments running them and
+// describes their state: replicas, container restarts and rollouts.
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceAccountDir holds the pod's API credentials.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Workload is the state of the deployment behind a service.
+type Workload struct {
+	Namespace  string
+	Deployment string
+	// Replicas is the desired count; the others are from the status.
+	Replicas, ReadyReplicas, AvailableReplicas, UpdatedReplicas int
+	// Restarts counts container restarts of the current pods,
+	// RecentRestarts those that ended within the restart window.
+	Restarts, RecentRestarts int
+	// Rollout is "complete", "progressing" or "stalled" (past its progress
+	// deadline).
+	Rollout string
+}
+
+// Client keeps a snapshot of the workloads of all services, refreshed by
+// Run, so lookups never wait on the API server.
+type Client struct {
+	url    string
+	client *http.Client
+	// Label names the pod template label holding the service name; a
+	// deployment named after the service matches too.
+	Label string
+	// Namespaces limits the lookup; empty means all namespaces.
+	Namespaces []string
+	// RestartWindow is how recent a restart must be to count as recent.
+	RestartWindow time.Duration
+
+	mu        sync.RWMutex
+	workloads map[string]Workload
+}
+
+// NewInCluster returns a client of the API server the pod runs under,
+// authenticating with its service account. The account needs list on
+// deployments (apps) and pods.
+func NewInCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes enrichment: not running in a cluster")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes enrichment: invalid ca.crt")
+	}
+	return &Client{
+		url: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   15 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		Label:         "app.kubernetes.io/name",
+		RestartWindow: time.Hour,
+		workloads:     map[string]Workload{},
+	}, nil
+}
+
+// Workload returns the workload of service as of the last refresh.
+func (c *Client) Workload(service string) (Workload, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	w, found := c.workloads[service]
+	return w, found
+}
+
+// Run refreshes the snapshot every interval until ctx is done. Failed
+// refreshes keep the previous snapshot.
+func (c *Client) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rctx, cancel := context.WithTimeout(ctx, interval)
+		if err := c.Refresh(rctx); err != nil {
+			log.Printf("kubernetes enrichment: %v", err)
+		}
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type deployment struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas *int `json:"replicas"`
+		Selector struct {
+			MatchLabels map[string]string `json:"matchLabels"`
+		} `json:"selector"`
+		Template struct {
+			Metadata struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		} `json:"template"`
+	} `json:"spec"`
+	Status struct {
+		ObservedGeneration int64 `json:"observedGeneration"`
+		ReadyReplicas      int   `json:"readyReplicas"`
+		AvailableReplicas  int   `json:"availableReplicas"`
+		UpdatedReplicas    int   `json:"updatedReplicas"`
+		Conditions         []struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+type pod struct {
+	Metadata struct {
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Status struct {
+		ContainerStatuses []struct {
+			RestartCount int `json:"restartCount"`
+			LastState    struct {
+				Terminated *struct {
+					FinishedAt time.Time `json:"finishedAt"`
+				} `json:"terminated"`
+			} `json:"lastState"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// Refresh lists deployments and pods and rebuilds the snapshot.
+func (c *Client) Refresh(ctx context.Context) error {
+	namespaces := c.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	var deps []deployment
+	var pods []pod
+	for _, ns := range namespaces {
+		prefix := ""
+		if ns != "" {
+			prefix = "/namespaces/" + url.PathEscape(ns)
+		}
+		var dl struct{ Items []deployment }
+		if err := c.get(ctx, "/apis/apps/v1"+prefix+"/deployments", &dl); err != nil {
+			return err
+		}
+		deps = append(deps, dl.Items...)
+		var pl struct{ Items []pod }
+		if err := c.get(ctx, "/api/v1"+prefix+"/pods", &pl); err != nil {
+			return err
+		}
+		pods = append(pods, pl.Items...)
+	}
+	// a label match wins over a name match, then the first namespace
+	sort.SliceStable(deps, func(i, j int) bool { return deps[i].Metadata.Namespace < deps[j].Metadata.Namespace })
+	byService := map[string]Workload{}
+	byLabel := map[string]bool{}
+	since := time.Now().Add(-c.RestartWindow)
+	for _, d := range deps {
+		service, labelled := d.Spec.Template.Metadata.Labels[c.Label], true
+		if service == "" {
+			service, labelled = d.Metadata.Name, false
+		}
+		if _, found := byService[service]; found && (byLabel[service] || !labelled) {
+			continue
+		}
+		w := Workload{
+			Namespace:         d.Metadata.Namespace,
+			Deployment:        d.Metadata.Name,
+			Replicas:          1,
+			ReadyReplicas:     d.Status.ReadyReplicas,
+			AvailableReplicas: d.Status.AvailableReplicas,
+			UpdatedReplicas:   d.Status.UpdatedReplicas,
+			Rollout:           "complete",
+		}
+		if d.Spec.Replicas != nil {
+			w.Replicas = *d.Spec.Replicas
+		}
+		if d.Status.ObservedGeneration < d.Metadata.Generation || w.UpdatedReplicas < w.Replicas || w.AvailableReplicas < w.Replicas {
+			w.Rollout = "progressing"
+		}
+		for _, cond := range d.Status.Conditions {
+			if cond.Type == "Progressing" && cond.Reason == "ProgressDeadlineExceeded" {
+				w.Rollout = "stalled"
+			}
+		}
+		for _, p := range pods {
+			if p.Metadata.Namespace != d.Metadata.Namespace || !matches(p.Metadata.Labels, d.Spec.Selector.MatchLabels) {
+				continue
+			}
+			for _, cs := range p.Status.ContainerStatuses {
+				w.Restarts += cs.RestartCount
+				if t := cs.LastState.Terminated; t != nil && t.FinishedAt.After(since) {
+					w.RecentRestarts++
+				}
+			}
+		}
+		byService[service], byLabel[service] = w, labelled
+	}
+	c.mu.Lock()
+	c.workloads = byService
+	c.mu.Unlock()
+	return nil
+}
+
+// matches reports whether labels has every selector label; an empty
+// selector matches nothing.
+func matches(labels, selector map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// get reads path with the service account token, read on every call since
+// it is rotated, and decodes the response into out.
+func (c *Client) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("GET %s: %s: %s", path, res.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
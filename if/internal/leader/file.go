@@ -0,0 +1,80 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// fileLease is the content of a lock file.
+type fileLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+type fileLock struct {
+	path string
+	id   string
+}
+
+// NewFile returns a lock kept in a file at path, e.g. next to the anomaly
+// store on a volume all replicas mount. The file is replaced atomically
+// and read back, so of two replicas taking an expired lease at once only
+// the last writer wins; it needs a file system with atomic rename.
+func NewFile(path, id string) Lock {
+	return &fileLock{path: path, id: id}
+}
+
+func (l *fileLock) read() (fileLease, error) {
+	var fl fileLease
+	b, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fl, nil
+	}
+	if err != nil {
+		return fl, err
+	}
+	if err := json.Unmarshal(b, &fl); err != nil {
+		// a torn write; treat as expired
+		return fileLease{}, nil
+	}
+	return fl, nil
+}
+
+func (l *fileLock) TryAcquire(ctx context.Context, ttl time.Duration) (bool, error) {
+	cur, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if cur.Holder != "" && cur.Holder != l.id && now.Before(cur.Expires) {
+		return false, nil
+	}
+	b, err := json.Marshal(fileLease{Holder: l.id, Expires: now.Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+	tmp := l.path + "." + l.id + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	cur, err = l.read()
+	if err != nil {
+		return false, err
+	}
+	return cur.Holder == l.id, nil
+}
+
+func (l *fileLock) Release(ctx context.Context) error {
+	cur, err := l.read()
+	if err != nil || cur.Holder != l.id {
+		return err
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,178 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the pod's API credentials and namespace.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// microTime is the format of Lease times.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// lease is the part of a coordination.k8s.io/v1 Lease the lock uses.
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+type kubernetesLock struct {
+	url    string
+	name   string
+	ns     string
+	id     string
+	client *http.Client
+}
+
+// NewKubernetes returns a lock on the Lease name in the pod's namespace,
+// through the API server with the pod's service account. The account needs
+// get, create and update on leases in coordination.k8s.io. Updates carry
+// the resourceVersion read, so concurrent takeovers fail with a conflict.
+func NewKubernetes(name, id string) (Lock, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes leader election: not running in a cluster")
+	}
+	ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes leader election: invalid ca.crt")
+	}
+	return &kubernetesLock{
+		url:  "https://" + net.JoinHostPort(host, port),
+		name: name,
+		ns:   strings.TrimSpace(string(ns)),
+		id:   id,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (l *kubernetesLock) leasesURL() string {
+	return l.url + "/apis/coordination.k8s.io/v1/namespaces/" + l.ns + "/leases"
+}
+
+// do sends a request with the service account token, read on every call
+// since it is rotated, and decodes a 2xx response into out.
+func (l *kubernetesLock) do(ctx context.Context, method, url string, in, out any) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	res, err := l.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return res.StatusCode, fmt.Errorf("%s %s: %s: %s", method, url, res.Status, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	}
+	return res.StatusCode, nil
+}
+
+func (l *kubernetesLock) TryAcquire(ctx context.Context, ttl time.Duration) (bool, error) {
+	var cur lease
+	status, err := l.do(ctx, http.MethodGet, l.leasesURL()+"/"+l.name, nil, &cur)
+	now := time.Now().UTC()
+	if status == http.StatusNotFound {
+		var nl lease
+		nl.APIVersion, nl.Kind = "coordination.k8s.io/v1", "Lease"
+		nl.Metadata.Name, nl.Metadata.Namespace = l.name, l.ns
+		nl.Spec.HolderIdentity = l.id
+		nl.Spec.LeaseDurationSeconds = int(ttl.Seconds())
+		nl.Spec.AcquireTime, nl.Spec.RenewTime = now.Format(microTime), now.Format(microTime)
+		status, err = l.do(ctx, http.MethodPost, l.leasesURL(), nl, nil)
+		if status == http.StatusConflict {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	sp := &cur.Spec
+	if sp.HolderIdentity != "" && sp.HolderIdentity != l.id {
+		renewed, err := time.Parse(microTime, sp.RenewTime)
+		if err == nil && now.Before(renewed.Add(time.Duration(sp.LeaseDurationSeconds)*time.Second)) {
+			return false, nil
+		}
+	}
+	if sp.HolderIdentity != l.id {
+		sp.HolderIdentity = l.id
+		sp.AcquireTime = now.Format(microTime)
+		sp.LeaseTransitions++
+	}
+	sp.LeaseDurationSeconds = int(ttl.Seconds())
+	sp.RenewTime = now.Format(microTime)
+	status, err = l.do(ctx, http.MethodPut, l.leasesURL()+"/"+l.name, cur, nil)
+	if status == http.StatusConflict {
+		// another replica updated the lease since it was read
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *kubernetesLock) Release(ctx context.Context) error {
+	var cur lease
+	if _, err := l.do(ctx, http.MethodGet, l.leasesURL()+"/"+l.name, nil, &cur); err != nil {
+		return err
+	}
+	if cur.Spec.HolderIdentity != l.id {
+		return nil
+	}
+	cur.Spec.HolderIdentity = ""
+	_, err := l.do(ctx, http.MethodPut, l.leasesURL()+"/"+l.name, cur, nil)
+	return err
+}
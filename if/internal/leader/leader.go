@@ -0,0 +1,84 @@
+// Package leader elects one replica among several to run background work,
+// through a lease that the holder renews and others take over once expired.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Lock is a lease held by at most one replica at a time.
+type Lock interface {
+	// TryAcquire takes the lease, or renews it when already held, for ttl.
+	// It reports whether this replica holds the lease afterwards.
+	TryAcquire(ctx context.Context, ttl time.Duration) (bool, error)
+	// Release gives the lease up if this replica holds it.
+	Release(ctx context.Context) error
+}
+
+// New returns the lock of kind ("file" or "kubernetes") for holder id.
+// target is the lock file path or the Lease name.
+func New(kind, target, id string) (Lock, error) {
+	switch kind {
+	case "file":
+		return NewFile(target, id), nil
+	case "kubernetes":
+		return NewKubernetes(target, id)
+	default:
+		return nil, fmt.Errorf("unknown leader election kind: %s", kind)
+	}
+}
+
+// Elector keeps trying to hold a lock and tracks whether it does.
+type Elector struct {
+	lock    Lock
+	ttl     time.Duration
+	leading atomic.Bool
+}
+
+func NewElector(lock Lock, ttl time.Duration) *Elector {
+	return &Elector{lock: lock, ttl: ttl}
+}
+
+// Leading reports whether this replica held the lease at the last attempt.
+// A nil Elector always leads, so a single replica needs no election.
+func (e *Elector) Leading() bool {
+	return e == nil || e.leading.Load()
+}
+
+// Run acquires or renews the lease every third of its ttl until ctx is done,
+// then releases it. A failed renewal gives up leadership: the lease may
+// expire before the next attempt succeeds.
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		actx, cancel := context.WithTimeout(ctx, e.ttl/3)
+		held, err := e.lock.TryAcquire(actx, e.ttl)
+		cancel()
+		if err != nil {
+			log.Printf("leader election: %v", err)
+			held = false
+		}
+		if e.leading.Swap(held) != held {
+			if held {
+				log.Printf("leader election: acquired lease, running scans")
+			} else {
+				log.Printf("leader election: lost lease, serving reads only")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if e.leading.Swap(false) {
+				rctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_ = e.lock.Release(rctx)
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package mimir
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Client metrics, registered with the default registry so they show up on
+// the service's /metrics endpoint. op is query, query_range, series or
+// label_values; code is the HTTP status code or "error" when no response was
+// received.
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mimir_client_request_duration_seconds",
+		Help:    "Duration of Mimir HTTP API requests, per attempt.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"op"})
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mimir_client_requests_total",
+		Help: "Mimir HTTP API requests by status code, per attempt.",
+	}, []string{"op", "code"})
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mimir_client_retries_total",
+		Help: "Mimir HTTP API requests retried after a transient failure.",
+	}, []string{"op"})
+	slowTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mimir_client_slow_queries_total",
+		Help: "Mimir HTTP API calls slower than the slow query threshold.",
+	}, []string{"op"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, requestsTotal, retriesTotal, slowTotal)
+}
+
+// maxLoggedQuery is how much of a query is kept in slow query logs.
+const maxLoggedQuery = 200
+
+// logSlow logs a call that took longer than the slow query threshold. The
+// query is truncated and identified by a short hash, so long queries stay
+// greppable without flooding the log.
+func (c *Client) logSlow(ctx context.Context, op string, q url.Values, took time.Duration) {
+	if c.SlowQuery <= 0 || took < c.SlowQuery {
+		return
+	}
+	slowTotal.WithLabelValues(op).Inc()
+	text := q.Get("query")
+	if text == "" {
+		text = strings.Join(q["match[]"], " ")
+	}
+	sum := sha256.Sum256([]byte(text))
+	if len(text) > maxLoggedQuery {
+		text = text[:maxLoggedQuery] + "..."
+	}
+	log.Printf("mimir slow %s took %s: hash=%s query=%s%s", op, took.Round(time.Millisecond), hex.EncodeToString(sum[:6]), text, requestTag(ctx))
+}
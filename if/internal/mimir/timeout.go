@@ -0,0 +1,55 @@
+package mimir
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Timeouts bound the calls of each kind, retries included, unless the
+// context ends sooner. Queries send the time they have left as the timeout
+// parameter, so the backend stops evaluating a query no one waits for
+// anymore. 0 leaves a kind to the context.
+type Timeouts struct {
+	Instant time.Duration
+	Range   time.Duration
+	// Series covers the metadata calls: series, label names and values.
+	Series time.Duration
+}
+
+// DefaultTimeouts are the timeouts of New.
+var DefaultTimeouts = Timeouts{Instant: 15 * time.Second, Range: 30 * time.Second, Series: 15 * time.Second}
+
+// of returns the timeout of the calls of op.
+func (t Timeouts) of(op string) time.Duration {
+	switch op {
+	case "query":
+		return t.Instant
+	case "query_range", "query_exemplars":
+		return t.Range
+	}
+	return t.Series
+}
+
+// withTimeout bounds ctx by the timeout of the calls of op.
+func (c *Client) withTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	if d := c.Timeouts.of(op); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return ctx, func() {}
+}
+
+// setTimeout sets the timeout parameter of a query to the time ctx has
+// left, in seconds, which every backend parses.
+func setTimeout(ctx context.Context, op string, q url.Values) {
+	if op != "query" && op != "query_range" {
+		return
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	left := max(time.Until(deadline).Round(time.Millisecond), time.Millisecond)
+	q.Set("timeout", strconv.FormatFloat(left.Seconds(), 'f', -1, 64))
+}
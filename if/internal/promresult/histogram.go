@@ -0,0 +1,119 @@
+package promresult
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Bucket is one bucket of a histogram: the rate of observations above the
+// previous bucket's Le up to Le, its Share of all observations and the
+// Cumulative share up to Le.
+type Bucket struct {
+	Le         string  `json:"le"`
+	Rate       float64 `json:"rate"`
+	Share      float64 `json:"share"`
+	Cumulative float64 `json:"cumulative"`
+	upper      float64
+}
+
+// Histogram is a bucket distribution, lowest bucket first, and the total
+// rate of observations.
+type Histogram struct {
+	Buckets []Bucket `json:"buckets"`
+	Rate    float64  `json:"rate"`
+}
+
+// NewHistogram builds the histogram of cumulative bucket rates by le, as
+// summed by le from a _bucket metric, scaling the bounds by scale, e.g. 1000
+// from seconds to milliseconds. Samples without a numeric le are ignored.
+// A cumulative rate below the previous one, of buckets scraped at different
+// times, counts as the previous.
+func NewHistogram(samples []Sample, scale float64) Histogram {
+	var h Histogram
+	for _, s := range samples {
+		le, err := strconv.ParseFloat(s.Labels["le"], 64)
+		if err != nil || math.IsNaN(le) || math.IsNaN(s.V) {
+			continue
+		}
+		h.Buckets = append(h.Buckets, Bucket{upper: le * scale, Rate: s.V})
+	}
+	sort.Slice(h.Buckets, func(i, j int) bool { return h.Buckets[i].upper < h.Buckets[j].upper })
+	var prev float64
+	for i := range h.Buckets {
+		b := &h.Buckets[i]
+		b.Le = strconv.FormatFloat(b.upper, 'g', -1, 64)
+		if math.IsInf(b.upper, 1) {
+			b.Le = "+Inf"
+		}
+		cum := math.Max(b.Rate, prev)
+		b.Rate, prev = cum-prev, cum
+	}
+	h.Rate = prev
+	if h.Rate > 0 {
+		var cum float64
+		for i := range h.Buckets {
+			b := &h.Buckets[i]
+			cum += b.Rate
+			b.Share, b.Cumulative = b.Rate/h.Rate, cum/h.Rate
+		}
+	}
+	return h
+}
+
+// Quantile estimates the q-quantile like histogram_quantile: interpolated
+// linearly within its bucket, from 0 in the first, and the highest finite
+// bound in the +Inf bucket. It is NaN without observations.
+func (h Histogram) Quantile(q float64) float64 {
+	if h.Rate <= 0 || len(h.Buckets) == 0 {
+		return math.NaN()
+	}
+	rank := q * h.Rate
+	var lower, cum float64
+	for i, b := range h.Buckets {
+		if cum+b.Rate >= rank && b.Rate > 0 {
+			if math.IsInf(b.upper, 1) {
+				if i == 0 {
+					return math.NaN()
+				}
+				return h.Buckets[i-1].upper
+			}
+			return lower + (b.upper-lower)*(rank-cum)/b.Rate
+		}
+		lower, cum = b.upper, cum+b.Rate
+	}
+	return lower
+}
+
+// Modes returns the indexes of the peaks of the distribution: buckets
+// holding at least minShare of it and more than their neighbours, with a
+// bucket holding at most half of the smaller peak between two peaks. With
+// roughly exponential bounds, shares approximate the density over log
+// latency, so two modes tell a slow tail apart from an overall slowdown.
+func (h Histogram) Modes(minShare float64) []int {
+	var modes []int
+	valley := math.Inf(1)
+	for i, b := range h.Buckets {
+		peak := b.Share >= minShare && b.Share > 0 &&
+			(i == 0 || h.Buckets[i-1].Share < b.Share) &&
+			(i == len(h.Buckets)-1 || h.Buckets[i+1].Share <= b.Share)
+		if !peak {
+			valley = math.Min(valley, b.Share)
+			continue
+		}
+		if n := len(modes); n > 0 {
+			prev := h.Buckets[modes[n-1]].Share
+			if valley > math.Min(prev, b.Share)/2 {
+				// one broad peak: keep its highest bucket
+				if b.Share > prev {
+					modes[n-1] = i
+				}
+				valley = math.Inf(1)
+				continue
+			}
+		}
+		modes = append(modes, i)
+		valley = math.Inf(1)
+	}
+	return modes
+}
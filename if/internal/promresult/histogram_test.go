@@ -0,0 +1,88 @@
+package promresult
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func bucketSamples(les []string, cum []float64) []Sample {
+	out := make([]Sample, len(les))
+	for i := range les {
+		out[i] = Sample{Labels: map[string]string{"le": les[i]}, Point: Point{V: cum[i]}}
+	}
+	return out
+}
+
+func TestNewHistogram(t *testing.T) {
+	// out of order, a decreasing cumulative rate and a sample without le
+	samples := bucketSamples([]string{"0.1", "0.01", "+Inf", "0.05"}, []float64{6, 2, 10, 1})
+	samples = append(samples, Sample{Labels: map[string]string{}, Point: Point{V: 99}})
+	h := NewHistogram(samples, 1000)
+	var les []string
+	var rates []float64
+	for _, b := range h.Buckets {
+		les = append(les, b.Le)
+		rates = append(rates, b.Rate)
+	}
+	if want := []string{"10", "50", "100", "+Inf"}; !reflect.DeepEqual(les, want) {
+		t.Errorf("le = %v, want %v", les, want)
+	}
+	if want := []float64{2, 0, 4, 4}; !reflect.DeepEqual(rates, want) {
+		t.Errorf("rates = %v, want %v", rates, want)
+	}
+	if h.Rate != 10 {
+		t.Errorf("rate = %v, want 10", h.Rate)
+	}
+	if last := h.Buckets[len(h.Buckets)-1]; last.Cumulative != 1 || last.Share != 0.4 {
+		t.Errorf("+Inf bucket = %+v, want share 0.4, cumulative 1", last)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := NewHistogram(bucketSamples([]string{"10", "20", "+Inf"}, []float64{5, 9, 10}), 1)
+	for _, tt := range []struct{ q, want float64 }{
+		{0.25, 5},   // halfway into the first bucket, from 0
+		{0.7, 15},   // halfway into the second
+		{0.99, 20},  // in +Inf: the highest finite bound
+		{0.5, 10},   // the first bucket's bound
+		{0.05, 1.0}, // a tenth into the first bucket
+	} {
+		if got := h.Quantile(tt.q); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+	if got := NewHistogram(nil, 1).Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("Quantile of empty = %v, want NaN", got)
+	}
+}
+
+func TestHistogramModes(t *testing.T) {
+	les := []string{"5", "10", "25", "50", "100", "250", "500", "+Inf"}
+	cumulative := func(rates ...float64) []float64 {
+		out := make([]float64, len(rates))
+		var c float64
+		for i, r := range rates {
+			c += r
+			out[i] = c
+		}
+		return out
+	}
+	tests := []struct {
+		name  string
+		rates []float64
+		want  []int
+	}{
+		{"unimodal", []float64{1, 4, 10, 4, 1, 0, 0, 0}, []int{2}},
+		{"bimodal tail", []float64{1, 10, 3, 1, 1, 6, 1, 0}, []int{1, 5}},
+		{"shallow dip is one mode", []float64{1, 10, 8, 9, 1, 0, 0, 0}, []int{1}},
+		{"small bump ignored", []float64{1, 20, 4, 1, 0, 1, 0, 0}, []int{1}},
+		{"empty", []float64{0, 0, 0, 0, 0, 0, 0, 0}, nil},
+	}
+	for _, tt := range tests {
+		h := NewHistogram(bucketSamples(les, cumulative(tt.rates...)), 1)
+		if got := h.Modes(0.05); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Modes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
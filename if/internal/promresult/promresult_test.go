@@ -0,0 +1,143 @@
+package promresult
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		opts    Options
+		want    float64
+		wantNaN bool
+		wantErr bool
+	}{
+		{in: "1.5", opts: DefaultOptions, want: 1.5},
+		{in: "1e3", opts: DefaultOptions, want: 1000},
+		{in: "-0.25", opts: DefaultOptions, want: -0.25},
+		{in: "NaN", opts: DefaultOptions, wantNaN: true},
+		{in: "+Inf", opts: DefaultOptions, wantNaN: true},
+		{in: "-Inf", opts: DefaultOptions, wantNaN: true},
+		{in: "NaN", opts: Options{NaN: Zero, Inf: Zero}, want: 0},
+		{in: "+Inf", opts: Options{NaN: Zero, Inf: Zero}, want: 0},
+		{in: "+Inf", opts: Options{Inf: Keep}, want: math.Inf(1)},
+		{in: "-Inf", opts: Options{Inf: Keep}, want: math.Inf(-1)},
+		{in: "NaN", opts: Options{NaN: Keep}, wantNaN: true},
+		{in: "", opts: DefaultOptions, wantErr: true},
+		{in: "abc", opts: DefaultOptions, wantErr: true},
+		{in: "1,5", opts: DefaultOptions, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseValue(tt.in, tt.opts)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseValue(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseValue(%q) error: %v", tt.in, err)
+			continue
+		}
+		if tt.wantNaN {
+			if !math.IsNaN(got) {
+				t.Errorf("ParseValue(%q, %+v) = %v, want NaN", tt.in, tt.opts, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseValue(%q, %+v) = %v, want %v", tt.in, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeMatrix(t *testing.T) {
+	raw := []byte(`{"resultType":"matrix","result":[
+		{"metric":{"service_name":"a"},"values":[[1700000000,"1"],[1700000060.5,"NaN"],[1700000120,"+Inf"],[1700000180,"2.5"]]}
+	]}`)
+	series, err := DecodeMatrix(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || series[0].Labels["service_name"] != "a" {
+		t.Fatalf("unexpected series: %+v", series)
+	}
+	pts := series[0].Points
+	if len(pts) != 4 {
+		t.Fatalf("got %d points, want 4", len(pts))
+	}
+	if pts[0].V != 1 || pts[3].V != 2.5 {
+		t.Errorf("regular values = %v, %v; want 1, 2.5", pts[0].V, pts[3].V)
+	}
+	if !math.IsNaN(pts[1].V) || !math.IsNaN(pts[2].V) {
+		t.Errorf("special values = %v, %v; want NaN, NaN", pts[1].V, pts[2].V)
+	}
+	if want := time.Unix(1700000060, 500*int64(time.Millisecond)); !pts[1].T.Equal(want) {
+		t.Errorf("timestamp = %v, want %v", pts[1].T, want)
+	}
+}
+
+func TestDecodeMatrixRejectsMalformed(t *testing.T) {
+	for _, raw := range []string{
+		`{"resultType":"matrix","result":[{"metric":{},"values":[[1700000000,"oops"]]}]}`,
+		`{"resultType":"matrix","result":[{"metric":{},"values":[[1700000000]]}]}`,
+		`{"resultType":"matrix","result":[{"metric":{},"values":[["x","1"]]}]}`,
+		`{"resultType":"vector","result":[]}`,
+	} {
+		if _, err := DecodeMatrix([]byte(raw)); err == nil {
+			t.Errorf("DecodeMatrix(%s) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestDecodeMatrixWithZeroPolicy(t *testing.T) {
+	raw := []byte(`{"resultType":"matrix","result":[{"metric":{},"values":[[1700000000,"NaN"],[1700000060,"-Inf"]]}]}`)
+	series, err := DecodeMatrixWith(raw, Options{NaN: Zero, Inf: Zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range series[0].Points {
+		if p.V != 0 {
+			t.Errorf("value = %v, want 0", p.V)
+		}
+	}
+}
+
+func TestStreamMatrix(t *testing.T) {
+	raw := `{"resultType":"matrix","result":[
+		{"metric":{"service_name":"a"},"values":[[1700000000,"1"]]},
+		{"metric":{"service_name":"b"},"values":[[1700000000,"2"]]},
+		{"metric":{"service_name":"c"},"values":[[1700000000,"3"]]}
+	],"stats":{"samples":3}}`
+	var got []string
+	stop := errors.New("stop")
+	err := StreamMatrix(json.NewDecoder(strings.NewReader(raw)), DefaultOptions, func(s Series) error {
+		got = append(got, s.Labels["service_name"])
+		if len(got) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || strings.Join(got, ",") != "a,b" {
+		t.Errorf("StreamMatrix stopped after %v with %v, want a,b and the callback's error", got, err)
+	}
+	got = nil
+	err = StreamMatrix(json.NewDecoder(strings.NewReader(raw)), DefaultOptions, func(s Series) error {
+		got = append(got, s.Labels["service_name"])
+		return nil
+	})
+	if err != nil || strings.Join(got, ",") != "a,b,c" {
+		t.Errorf("StreamMatrix = %v, %v; want a,b,c", got, err)
+	}
+	if err := StreamMatrix(json.NewDecoder(strings.NewReader("null")), DefaultOptions, func(Series) error {
+		t.Error("series in null data")
+		return nil
+	}); err != nil {
+		t.Errorf("StreamMatrix(null) = %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	s, err := New("inline", "")
+	if err != nil || s.Get() != "inline" {
+		t.Fatalf("New inline = %q, %v", s.Get(), err)
+	}
+	if _, err := New("inline", "/some/file"); err == nil {
+		t.Error("New with a value and a file succeeded")
+	}
+	if _, err := New("", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("New of a missing file succeeded")
+	}
+	if (Secret{}).Get() != "" {
+		t.Error("zero Secret is not empty")
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	write := func(v string) {
+		if err := os.WriteFile(path, []byte(v), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first\n")
+	s, err := File(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get(); got != "first" {
+		t.Fatalf("Get = %q, want first", got)
+	}
+	write("rotated\n")
+	if got := s.Get(); got != "rotated" {
+		t.Errorf("Get after rotation = %q, want rotated", got)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get(); got != "rotated" {
+		t.Errorf("Get of a removed file = %q, want the last value", got)
+	}
+	write("back\n")
+	if got := s.Get(); got != "back" {
+		t.Errorf("Get after the file is back = %q, want back", got)
+	}
+}
+
+// TestSymlinkSwap rotates the secret like Kubernetes updates secret
+// volumes: the file is a symlink through a directory link swapped to a new
+// directory.
+func TestSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	version := func(name, v string) {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "token"), []byte(v), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(name, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version("v1", "aaaa")
+	path := filepath.Join(dir, "token")
+	if err := os.Symlink(filepath.Join("..data", "token"), path); err != nil {
+		t.Fatal(err)
+	}
+	s, err := File(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same size, and possibly the same modification time
+	version("v2", "bbbb")
+	if got := s.Get(); got != "bbbb" {
+		t.Errorf("Get after the swap = %q, want bbbb", got)
+	}
+}
@@ -0,0 +1,287 @@
+package spanmetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPoints bounds the steps of a range query, like Prometheus.
+const maxPoints = 11000
+
+// Handler serves /api/v1/query, /api/v1/query_range, /api/v1/series,
+// /api/v1/labels and /api/v1/label/<name>/values of the Prometheus HTTP API
+// over the store.
+// Exemplars are not recorded: /api/v1/query_exemplars is always empty.
+func (s *Store) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query", s.handleQuery)
+	mux.HandleFunc("/api/v1/query_range", s.handleQueryRange)
+	mux.HandleFunc("/api/v1/series", s.handleSeries)
+	mux.HandleFunc("/api/v1/labels", s.handleLabels)
+	mux.HandleFunc("/api/v1/label/", s.handleLabelValues)
+	mux.HandleFunc("/api/v1/query_exemplars", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, []any{})
+	})
+	return mux
+}
+
+// Transport serves requests with Handler in process, for a client of the
+// store in the same binary.
+func (s *Store) Transport() http.RoundTripper {
+	return handlerTransport{s.Handler()}
+}
+
+type handlerTransport struct{ h http.Handler }
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.h.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+func (s *Store) handleQuery(w http.ResponseWriter, r *http.Request) {
+	n, err := parse(r.FormValue("query"))
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	t, err := parseTime(r.FormValue("time"), time.Now())
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	v, err := evaluator{store: s, t: t.UnixMilli()}.eval(n)
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	ts := float64(t.UnixMilli()) / 1000
+	if f, ok := v.(float64); ok {
+		respond(w, map[string]any{"resultType": "scalar", "result": []any{ts, formatValue(f)}})
+		return
+	}
+	result := []any{}
+	for _, el := range v.(vector) {
+		result = append(result, map[string]any{"metric": el.labels, "value": []any{ts, formatValue(el.v)}})
+	}
+	respond(w, map[string]any{"resultType": "vector", "result": result})
+}
+
+func (s *Store) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	n, err := parse(r.FormValue("query"))
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	start, err := parseTime(r.FormValue("start"), time.Time{})
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	end, err := parseTime(r.FormValue("end"), time.Time{})
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	step, err := parseStep(r.FormValue("step"))
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		badData(w, fmt.Errorf("invalid start or end"))
+		return
+	}
+	if end.Sub(start)/step > maxPoints {
+		badData(w, fmt.Errorf("exceeded maximum resolution of %d points per series", maxPoints))
+		return
+	}
+	type matrixSeries struct {
+		Metric map[string]string `json:"metric"`
+		Values [][]any           `json:"values"`
+	}
+	byKey := map[string]*matrixSeries{}
+	for t := start; !t.After(end); t = t.Add(step) {
+		v, err := evaluator{store: s, t: t.UnixMilli()}.eval(n)
+		if err != nil {
+			badData(w, err)
+			return
+		}
+		vec, ok := v.(vector)
+		if !ok {
+			vec = vector{{labels: map[string]string{}, v: v.(float64)}}
+		}
+		for _, el := range vec {
+			k := key(el.labels)
+			ms := byKey[k]
+			if ms == nil {
+				ms = &matrixSeries{Metric: el.labels}
+				byKey[k] = ms
+			}
+			ms.Values = append(ms.Values, []any{float64(t.UnixMilli()) / 1000, formatValue(el.v)})
+		}
+	}
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]*matrixSeries, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, byKey[k])
+	}
+	respond(w, map[string]any{"resultType": "matrix", "result": result})
+}
+
+// matched returns the label sets of the series with samples between start
+// and end matching any of the match[] selectors.
+func (s *Store) matched(r *http.Request) ([]map[string]string, error) {
+	start, err := parseTime(r.FormValue("start"), time.Now().Add(-s.Retention))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTime(r.FormValue("end"), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		selectors = []string{`{__name__=~".+"}`}
+	}
+	seen := map[string]bool{}
+	var out []map[string]string
+	for _, sel := range selectors {
+		n, err := parse(sel)
+		if err != nil {
+			return nil, err
+		}
+		vs, ok := n.(vectorSel)
+		if !ok {
+			return nil, fmt.Errorf("invalid selector %q", sel)
+		}
+		for _, sr := range s.selectSeries(vs.matchers, start.UnixMilli(), end.UnixMilli()) {
+			if k := key(sr.labels); !seen[k] {
+				seen[k] = true
+				out = append(out, sr.labels)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (s *Store) handleSeries(w http.ResponseWriter, r *http.Request) {
+	series, err := s.matched(r)
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	if series == nil {
+		series = []map[string]string{}
+	}
+	respond(w, series)
+}
+
+func (s *Store) handleLabels(w http.ResponseWriter, r *http.Request) {
+	series, err := s.matched(r)
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	seen := map[string]bool{}
+	names := []string{}
+	for _, l := range series {
+		for k := range l {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+	respond(w, names)
+}
+
+func (s *Store) handleLabelValues(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/label/"), "/values")
+	if !ok || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	series, err := s.matched(r)
+	if err != nil {
+		badData(w, err)
+		return
+	}
+	seen := map[string]bool{}
+	values := []string{}
+	for _, l := range series {
+		if v, ok := l[name]; ok && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	respond(w, values)
+}
+
+// parseTime parses a Unix timestamp in seconds or an RFC 3339 time; empty
+// gives def.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.UnixMilli(int64(f * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+// parseStep parses a step in float seconds or as a duration.
+func parseStep(s string) (time.Duration, error) {
+	d, err := parseDuration(s)
+	if f, ferr := strconv.ParseFloat(s, 64); ferr == nil {
+		d, err = time.Duration(f*float64(time.Second)), nil
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid step %q", s)
+	}
+	return d, nil
+}
+
+// formatValue renders a sample value as the Prometheus API does.
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func respond(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": data})
+}
+
+func badData(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "error", "errorType": "bad_data", "error": err.Error()})
+}
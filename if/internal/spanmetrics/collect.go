@@ -0,0 +1,233 @@
+package spanmetrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Scrape reads the Prometheus text exposition of target every interval into
+// the store until ctx is done. Series get job and instance labels unless
+// they carry them already.
+func (s *Store) Scrape(ctx context.Context, target, job string, interval time.Duration) {
+	u, err := url.Parse(target)
+	if err != nil {
+		log.Printf("scrape %s: %v", target, err)
+		return
+	}
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := s.scrapeOnce(ctx, client, target, map[string]string{"job": job, "instance": u.Host}); err != nil {
+			log.Printf("scrape %s: %v", target, err)
+		} else if n == 0 {
+			log.Printf("scrape %s: no samples", target)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Store) scrapeOnce(ctx context.Context, client *http.Client, target string, targetLabels map[string]string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", res.Status)
+	}
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixMilli()
+	n := 0
+	app := s.appender()
+	defer app.commit()
+	add := func(m *dto.Metric, name string, extra map[string]string, v float64) {
+		labels := map[string]string{"__name__": name}
+		for k, v := range targetLabels {
+			labels[k] = v
+		}
+		for _, lp := range m.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		for k, v := range extra {
+			labels[k] = v
+		}
+		t := now
+		if m.TimestampMs != nil {
+			t = m.GetTimestampMs()
+		}
+		app.add(labels, t, v)
+		n++
+	}
+	for name, mf := range families {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(m, name, nil, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(m, name, nil, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(m, name, nil, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, b := range h.GetBucket() {
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+					add(m, name+"_bucket", map[string]string{"le": formatValue(b.GetUpperBound())}, float64(b.GetCumulativeCount()))
+				}
+				if !inf {
+					add(m, name+"_bucket", map[string]string{"le": "+Inf"}, float64(h.GetSampleCount()))
+				}
+				add(m, name+"_sum", nil, h.GetSampleSum())
+				add(m, name+"_count", nil, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				sm := m.GetSummary()
+				for _, q := range sm.GetQuantile() {
+					add(m, name, map[string]string{"quantile": formatValue(q.GetQuantile())}, q.GetValue())
+				}
+				add(m, name+"_sum", nil, sm.GetSampleSum())
+				add(m, name+"_count", nil, float64(sm.GetSampleCount()))
+			}
+		}
+	}
+	return n, nil
+}
+
+// maxWriteBytes bounds the decompressed size of a remote write request.
+const maxWriteBytes = 32 << 20
+
+// RemoteWriteHandler accepts Prometheus remote write 1.0 requests, snappy
+// compressed WriteRequest protobufs, into the store.
+func (s *Store) RemoteWriteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		compressed, err := io.ReadAll(io.LimitReader(r.Body, maxWriteBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n, err := snappy.DecodedLen(compressed); err != nil || n > maxWriteBytes {
+			http.Error(w, "invalid snappy payload", http.StatusBadRequest)
+			return
+		}
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.appendWriteRequest(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// appendWriteRequest decodes a WriteRequest: timeseries (1) of labels (1:
+// name 1, value 2) and samples (2: value 1, timestamp 2). Metadata and
+// exemplars are skipped.
+func (s *Store) appendWriteRequest(b []byte) error {
+	app := s.appender()
+	defer app.commit()
+	return eachField(b, func(num protowire.Number, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		labels := map[string]string{}
+		var samples []sample
+		err := eachField(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				var name, value string
+				err := eachField(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case 1:
+						name = string(v)
+					case 2:
+						value = string(v)
+					}
+					return nil
+				})
+				labels[name] = value
+				return err
+			case 2:
+				var smp sample
+				err := eachField(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case 1:
+						f, _ := protowire.ConsumeFixed64(v)
+						smp.v = math.Float64frombits(f)
+					case 2:
+						t, _ := protowire.ConsumeVarint(v)
+						smp.t = int64(t)
+					}
+					return nil
+				})
+				samples = append(samples, smp)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, smp := range samples {
+			app.add(labels, smp.t, smp.v)
+		}
+		return nil
+	})
+}
+
+// eachField calls fn with the number and value of each field of the
+// protobuf message b: the content of length-delimited fields, else the raw
+// varint or fixed-size bytes.
+func eachField(b []byte, fn func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		v := b[:m]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+		if err := fn(num, v); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package spanmetrics
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// Metric names, as remote-written by the collector connectors.
+const (
+	callsMetric       = "traces_span_metrics_calls_total"
+	durationMetric    = "traces_span_metrics_duration_milliseconds"
+	graphMetric       = "traces_service_graph_request_total"
+	graphFailedMetric = "traces_service_graph_request_failed_total"
+)
+
+// bucketsMs are the duration histogram bounds, those of the collector
+// configuration in milliseconds.
+var bucketsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// dimensions are span attributes, or else resource attributes, added as
+// labels, dots replaced by underscores.
+var dimensions = []string{"peer.service", "http.status_code", "http.response.status_code", "rpc.grpc.status_code", "db.system", "db.operation", "deployment.environment", "service.version", "tenant.id"}
+
+// edgeTTL bounds how long half of a service graph edge waits for the other.
+// A client half with a peer.service, say a database, then makes an edge to
+// that virtual node, like the collector's servicegraph connector.
+const edgeTTL = 10 * time.Second
+
+// Receiver is an OTLP trace service recording the spans it receives in a
+// store.
+type Receiver struct {
+	collectortrace.UnimplementedTraceServiceServer
+	store *Store
+
+	mu sync.Mutex
+	// client spans by trace and span ID, server spans by trace and parent
+	// span ID, until the other side of the call arrives
+	clients, servers map[string]edgeHalf
+}
+
+type edgeHalf struct {
+	service string
+	// peer is the peer.service of a client half.
+	peer   string
+	failed bool
+	at     time.Time
+}
+
+// NewReceiver returns a receiver recording into store.
+func NewReceiver(store *Store) *Receiver {
+	return &Receiver{store: store, clients: map[string]edgeHalf{}, servers: map[string]edgeHalf{}}
+}
+
+// Serve serves the OTLP gRPC trace service on addr until the listener fails.
+func (r *Receiver) Serve(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	gs := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(gs, r)
+	return gs.Serve(lis)
+}
+
+// Export records the spans of req.
+func (r *Receiver) Export(_ context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	for _, rs := range req.GetResourceSpans() {
+		resource := map[string]string{}
+		for _, kv := range rs.GetResource().GetAttributes() {
+			resource[kv.GetKey()] = attrValue(kv.GetValue())
+		}
+		service := resource["service.name"]
+		if service == "" {
+			service = "unknown_service"
+		}
+		for _, ss := range rs.GetScopeSpans() {
+			for _, sp := range ss.GetSpans() {
+				r.record(service, resource, sp)
+			}
+		}
+	}
+	r.expire(time.Now())
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+// record adds a span of a resource to the call and duration counters and
+// pairs it into a service graph edge.
+func (r *Receiver) record(service string, resource map[string]string, sp *tracepb.Span) {
+	labels := map[string]string{
+		"service_name": service,
+		"span_name":    sp.GetName(),
+		"span_kind":    sp.GetKind().String(),
+		"status_code":  sp.GetStatus().GetCode().String(),
+	}
+	for _, d := range dimensions {
+		if v, ok := resource[d]; ok {
+			labels[strings.ReplaceAll(d, ".", "_")] = v
+		}
+	}
+	for _, kv := range sp.GetAttributes() {
+		for _, d := range dimensions {
+			if kv.GetKey() == d {
+				labels[strings.ReplaceAll(d, ".", "_")] = attrValue(kv.GetValue())
+			}
+		}
+	}
+	r.store.add(withName(labels, callsMetric), 1)
+	ms := float64(sp.GetEndTimeUnixNano()-sp.GetStartTimeUnixNano()) / 1e6
+	for _, b := range bucketsMs {
+		// every bucket exists from the first span on, as in a histogram
+		n := 0.0
+		if ms <= b {
+			n = 1
+		}
+		r.store.add(withLabel(withName(labels, durationMetric+"_bucket"), "le", strconv.FormatFloat(b, 'g', -1, 64)), n)
+	}
+	r.store.add(withLabel(withName(labels, durationMetric+"_bucket"), "le", "+Inf"), 1)
+	r.store.add(withName(labels, durationMetric+"_sum"), ms)
+	r.store.add(withName(labels, durationMetric+"_count"), 1)
+
+	failed := sp.GetStatus().GetCode() == tracepb.Status_STATUS_CODE_ERROR
+	trace := hex.EncodeToString(sp.GetTraceId())
+	switch sp.GetKind() {
+	case tracepb.Span_SPAN_KIND_CLIENT, tracepb.Span_SPAN_KIND_PRODUCER:
+		r.pair(trace+hex.EncodeToString(sp.GetSpanId()), edgeHalf{service: service, peer: labels["peer_service"], failed: failed}, true)
+	case tracepb.Span_SPAN_KIND_SERVER, tracepb.Span_SPAN_KIND_CONSUMER:
+		if len(sp.GetParentSpanId()) > 0 {
+			r.pair(trace+hex.EncodeToString(sp.GetParentSpanId()), edgeHalf{service: service, failed: failed}, false)
+		}
+	}
+}
+
+// pair completes the edge of a call once both its client and server span
+// have arrived.
+func (r *Receiver) pair(id string, h edgeHalf, client bool) {
+	r.mu.Lock()
+	mine, other := r.servers, r.clients
+	if client {
+		mine, other = r.clients, r.servers
+	}
+	o, found := other[id]
+	if !found {
+		h.at = time.Now()
+		mine[id] = h
+		r.mu.Unlock()
+		return
+	}
+	delete(other, id)
+	r.mu.Unlock()
+	c, s := o, h
+	if client {
+		c, s = h, o
+	}
+	r.edge(c.service, s.service, c.failed || s.failed)
+}
+
+func (r *Receiver) edge(client, server string, failed bool) {
+	labels := map[string]string{"client": client, "server": server}
+	r.store.add(withName(labels, graphMetric), 1)
+	f := 0.0
+	if failed {
+		f = 1
+	}
+	r.store.add(withName(labels, graphFailedMetric), f)
+}
+
+// expire drops edge halves waiting longer than edgeTTL, client halves with
+// a peer becoming edges to it.
+func (r *Receiver) expire(now time.Time) {
+	var virtual []edgeHalf
+	r.mu.Lock()
+	for _, m := range []map[string]edgeHalf{r.clients, r.servers} {
+		for id, h := range m {
+			if now.Sub(h.at) > edgeTTL {
+				delete(m, id)
+				if h.peer != "" {
+					virtual = append(virtual, h)
+				}
+			}
+		}
+	}
+	r.mu.Unlock()
+	for _, h := range virtual {
+		r.edge(h.service, h.peer, h.failed)
+	}
+}
+
+// attrValue renders a scalar attribute value as a label value.
+func attrValue(v *commonpb.AnyValue) string {
+	switch x := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return x.StringValue
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(x.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(x.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(x.BoolValue)
+	}
+	return ""
+}
+
+func withName(labels map[string]string, name string) map[string]string {
+	return withLabel(labels, "__name__", name)
+}
+
+// withLabel returns a copy of labels with name set to value.
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[name] = value
+	return out
+}
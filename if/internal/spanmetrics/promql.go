@@ -0,0 +1,773 @@
+package spanmetrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The PromQL subset of the queries of the anomaly service and the MCP tools:
+// selectors with offset, rate, increase, last_over_time and
+// histogram_quantile, the sum, count, avg, min, max, topk and bottomk
+// aggregations with by or without, arithmetic and or.
+
+// lookback is how far an instant selector looks back for a sample.
+const lookback = 5 * time.Minute
+
+type node interface{}
+
+type (
+	numberLit float64
+	vectorSel struct {
+		matchers []matcher
+		offset   time.Duration
+	}
+	matrixSel struct {
+		vectorSel
+		rng time.Duration
+	}
+	call struct {
+		fn   string
+		args []node
+	}
+	aggregation struct {
+		op       string
+		grouping []string
+		without  bool
+		param    node
+		expr     node
+	}
+	binary struct {
+		op       string
+		lhs, rhs node
+	}
+)
+
+var aggregations = map[string]bool{"sum": true, "count": true, "avg": true, "min": true, "max": true, "topk": true, "bottomk": true}
+
+type token struct {
+	kind byte // 'i'dent, 'n'umber, 'd'uration, 's'tring, 'p'unctuation, 0 at the end
+	text string
+}
+
+func lex(q string) ([]token, error) {
+	var out []token
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(q) && q[j] != c {
+				if q[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			if j >= len(q) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s := q[i+1 : j]
+			if c != '`' {
+				u, err := strconv.Unquote(`"` + strings.ReplaceAll(s, `\'`, `'`) + `"`)
+				if err != nil {
+					return nil, fmt.Errorf("invalid string at %d", i)
+				}
+				s = u
+			}
+			out = append(out, token{'s', s})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(q) && (q[j] >= '0' && q[j] <= '9' || q[j] == '.' || q[j] == 'e' && j+1 < len(q) && (q[j+1] == '-' || q[j+1] >= '0' && q[j+1] <= '9')) {
+				if q[j] == 'e' {
+					j++
+				}
+				j++
+			}
+			k := j
+			for k < len(q) && strings.IndexByte("smhdwy", q[k]) >= 0 {
+				k++
+			}
+			if k > j {
+				out = append(out, token{'d', q[i:k]})
+			} else {
+				out = append(out, token{'n', q[i:j]})
+			}
+			i = k
+		case c == '_' || c == ':' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(q) && (q[j] == '_' || q[j] == ':' || unicode.IsLetter(rune(q[j])) || q[j] >= '0' && q[j] <= '9') {
+				j++
+			}
+			out = append(out, token{'i', q[i:j]})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(q) {
+				if two := q[i : i+2]; two == "!=" || two == "=~" || two == "!~" {
+					op = two
+				}
+			}
+			if !strings.Contains("{}()[],=+-*/", op) && len(op) == 1 {
+				return nil, fmt.Errorf("unexpected %q at %d", op, i)
+			}
+			out = append(out, token{'p', op})
+			i += len(op)
+		}
+	}
+	return out, nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return token{}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(text string) error {
+	if t := p.next(); t.text != text || t.kind == 's' {
+		return fmt.Errorf("expected %q, got %q", text, t.text)
+	}
+	return nil
+}
+
+// parse parses a PromQL expression of the supported subset.
+func parse(q string) (node, error) {
+	toks, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	n, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	return n, nil
+}
+
+// precedence of the binary operators, by level.
+var precedence = [][]string{{"or"}, {"+", "-"}, {"*", "/"}}
+
+func (p *parser) binary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	lhs, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != 'p' && t.kind != 'i' || !contains(precedence[level], t.text) {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = binary{op: t.text, lhs: lhs, rhs: rhs}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if t := p.peek(); t.kind == 'p' && t.text == "-" {
+		p.next()
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return binary{op: "*", lhs: numberLit(-1), rhs: n}, nil
+	}
+	n, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == 'p' && t.text == "[" {
+		p.next()
+		d, err := p.duration()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		vs, ok := n.(vectorSel)
+		if !ok {
+			return nil, fmt.Errorf("ranges are only supported on selectors")
+		}
+		n = matrixSel{vectorSel: vs, rng: d}
+	}
+	if t := p.peek(); t.kind == 'i' && t.text == "offset" {
+		p.next()
+		d, err := p.duration()
+		if err != nil {
+			return nil, err
+		}
+		switch s := n.(type) {
+		case vectorSel:
+			s.offset = d
+			n = s
+		case matrixSel:
+			s.offset = d
+			n = s
+		default:
+			return nil, fmt.Errorf("offset is only supported on selectors")
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) duration() (time.Duration, error) {
+	t := p.next()
+	if t.kind != 'd' {
+		return 0, fmt.Errorf("expected duration, got %q", t.text)
+	}
+	return parseDuration(t.text)
+}
+
+// parseDuration parses a PromQL duration such as 5m or 1h30m.
+func parseDuration(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour, 'y': 365 * 24 * time.Hour}
+	var d time.Duration
+	for s != "" {
+		i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, _ := strconv.Atoi(s[:i])
+		u, ok := units[s[i]]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d += time.Duration(n) * u
+		s = s[i+1:]
+	}
+	return d, nil
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case 'n':
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return numberLit(v), nil
+	case 'p':
+		switch t.text {
+		case "(":
+			n, err := p.binary(0)
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "{":
+			p.pos--
+			return p.selector("")
+		}
+	case 'i':
+		if aggregations[t.text] {
+			return p.aggregation(t.text)
+		}
+		if nt := p.peek(); nt.kind == 'p' && nt.text == "(" {
+			p.next()
+			c := call{fn: t.text}
+			for {
+				if nt := p.peek(); nt.kind == 'p' && nt.text == ")" {
+					p.next()
+					return c, nil
+				}
+				arg, err := p.binary(0)
+				if err != nil {
+					return nil, err
+				}
+				c.args = append(c.args, arg)
+				if nt := p.peek(); nt.kind != 'p' || nt.text != "," {
+					return c, p.expect(")")
+				}
+				p.next()
+			}
+		}
+		return p.selector(t.text)
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *parser) selector(name string) (node, error) {
+	var vs vectorSel
+	if name != "" {
+		m, _ := newMatcher("__name__", "=", name)
+		vs.matchers = append(vs.matchers, m)
+	}
+	if t := p.peek(); t.kind == 'p' && t.text == "{" {
+		p.next()
+		for {
+			t := p.next()
+			if t.kind == 'p' && t.text == "}" {
+				break
+			}
+			if t.kind != 'i' {
+				return nil, fmt.Errorf("expected label name, got %q", t.text)
+			}
+			op := p.next()
+			if op.kind != 'p' || !contains([]string{"=", "!=", "=~", "!~"}, op.text) {
+				return nil, fmt.Errorf("expected matcher, got %q", op.text)
+			}
+			v := p.next()
+			if v.kind != 's' {
+				return nil, fmt.Errorf("expected string, got %q", v.text)
+			}
+			m, err := newMatcher(t.text, op.text, v.text)
+			if err != nil {
+				return nil, err
+			}
+			vs.matchers = append(vs.matchers, m)
+			if nt := p.peek(); nt.kind == 'p' && nt.text == "," {
+				p.next()
+			}
+		}
+	}
+	if len(vs.matchers) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return vs, nil
+}
+
+func (p *parser) aggregation(op string) (node, error) {
+	a := aggregation{op: op}
+	grouping := func() error {
+		if t := p.peek(); t.kind == 'i' && (t.text == "by" || t.text == "without") {
+			p.next()
+			a.without = t.text == "without"
+			if err := p.expect("("); err != nil {
+				return err
+			}
+			for {
+				t := p.next()
+				if t.kind == 'p' && t.text == ")" {
+					return nil
+				}
+				if t.kind == 'i' {
+					a.grouping = append(a.grouping, t.text)
+				} else if t.text != "," {
+					return fmt.Errorf("expected label name, got %q", t.text)
+				}
+			}
+		}
+		return nil
+	}
+	if err := grouping(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	first, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	a.expr = first
+	if t := p.peek(); t.kind == 'p' && t.text == "," {
+		p.next()
+		a.param = first
+		if a.expr, err = p.binary(0); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return a, grouping()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// element is a sample of an instant vector.
+type element struct {
+	labels map[string]string
+	v      float64
+}
+
+type vector []element
+
+// evaluator evaluates expressions at one time, in milliseconds.
+type evaluator struct {
+	store *Store
+	t     int64
+}
+
+// eval returns a float64 for scalars and a vector otherwise.
+func (e evaluator) eval(n node) (any, error) {
+	switch n := n.(type) {
+	case numberLit:
+		return float64(n), nil
+	case vectorSel:
+		end := e.t - n.offset.Milliseconds()
+		var out vector
+		for _, s := range e.store.selectSeries(n.matchers, end-lookback.Milliseconds()+1, end) {
+			out = append(out, element{labels: s.labels, v: s.samples[len(s.samples)-1].v})
+		}
+		return out, nil
+	case matrixSel:
+		return nil, fmt.Errorf("range vectors are only supported as function arguments")
+	case call:
+		return e.call(n)
+	case aggregation:
+		return e.aggregate(n)
+	case binary:
+		return e.binary(n)
+	}
+	return nil, fmt.Errorf("unsupported expression")
+}
+
+func (e evaluator) vector(n node) (vector, error) {
+	v, err := e.eval(n)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(vector)
+	if !ok {
+		return nil, fmt.Errorf("expected instant vector")
+	}
+	return vec, nil
+}
+
+func (e evaluator) scalar(n node) (float64, error) {
+	v, err := e.eval(n)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("expected scalar")
+	}
+	return f, nil
+}
+
+func (e evaluator) call(c call) (any, error) {
+	switch c.fn {
+	case "rate", "increase", "last_over_time":
+		if len(c.args) != 1 {
+			return nil, fmt.Errorf("%s takes one argument", c.fn)
+		}
+		m, ok := c.args[0].(matrixSel)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a range vector", c.fn)
+		}
+		end := e.t - m.offset.Milliseconds()
+		start := end - m.rng.Milliseconds()
+		var out vector
+		for _, s := range e.store.selectSeries(m.matchers, start+1, end) {
+			if c.fn == "last_over_time" {
+				out = append(out, element{labels: s.labels, v: s.samples[len(s.samples)-1].v})
+				continue
+			}
+			if len(s.samples) < 2 {
+				continue
+			}
+			v := extrapolatedIncrease(s.samples, start, end)
+			if c.fn == "rate" {
+				v /= m.rng.Seconds()
+			}
+			out = append(out, element{labels: dropName(s.labels), v: v})
+		}
+		return out, nil
+	case "histogram_quantile":
+		if len(c.args) != 2 {
+			return nil, fmt.Errorf("histogram_quantile takes two arguments")
+		}
+		q, err := e.scalar(c.args[0])
+		if err != nil {
+			return nil, err
+		}
+		vec, err := e.vector(c.args[1])
+		if err != nil {
+			return nil, err
+		}
+		return histogramQuantile(q, vec), nil
+	}
+	return nil, fmt.Errorf("unsupported function %s", c.fn)
+}
+
+// extrapolatedIncrease is the increase of a counter over the range like
+// Prometheus computes it: corrected for resets and extrapolated towards the
+// range boundaries.
+func extrapolatedIncrease(samples []sample, start, end int64) float64 {
+	first, last := samples[0], samples[len(samples)-1]
+	result := last.v - first.v
+	for i := 1; i < len(samples); i++ {
+		if samples[i].v < samples[i-1].v {
+			result += samples[i-1].v
+		}
+	}
+	toStart := float64(first.t-start) / 1000
+	toEnd := float64(end-last.t) / 1000
+	sampled := float64(last.t-first.t) / 1000
+	if sampled == 0 {
+		return 0
+	}
+	avg := sampled / float64(len(samples)-1)
+	if result > 0 && first.v >= 0 {
+		if toZero := sampled * first.v / result; toZero < toStart {
+			toStart = toZero
+		}
+	}
+	threshold := avg * 1.1
+	interval := sampled
+	for _, d := range []float64{toStart, toEnd} {
+		if d < threshold {
+			interval += d
+		} else {
+			interval += avg / 2
+		}
+	}
+	return result * interval / sampled
+}
+
+// histogramQuantile computes the q-quantile of the le buckets of each
+// series, interpolating linearly within the bucket like Prometheus.
+func histogramQuantile(q float64, vec vector) vector {
+	type bucket struct{ le, count float64 }
+	groups := map[string][]bucket{}
+	labels := map[string]map[string]string{}
+	for _, el := range vec {
+		le, err := strconv.ParseFloat(el.labels["le"], 64)
+		if err != nil {
+			continue
+		}
+		l := dropName(el.labels)
+		delete(l, "le")
+		k := key(l)
+		groups[k] = append(groups[k], bucket{le, el.v})
+		labels[k] = l
+	}
+	var out vector
+	for k, bs := range groups {
+		sort.Slice(bs, func(i, j int) bool { return bs[i].le < bs[j].le })
+		for i := 1; i < len(bs); i++ {
+			bs[i].count = math.Max(bs[i].count, bs[i-1].count)
+		}
+		v := math.NaN()
+		switch {
+		case q < 0:
+			v = math.Inf(-1)
+		case q > 1:
+			v = math.Inf(1)
+		case len(bs) < 2 || !math.IsInf(bs[len(bs)-1].le, 1) || bs[len(bs)-1].count == 0:
+		default:
+			rank := q * bs[len(bs)-1].count
+			b := sort.Search(len(bs)-1, func(i int) bool { return bs[i].count >= rank })
+			switch {
+			case b == len(bs)-1:
+				v = bs[len(bs)-2].le
+			case b == 0 && bs[0].le <= 0:
+				v = bs[0].le
+			default:
+				lo, count := 0.0, bs[b].count
+				if b > 0 {
+					lo, count, rank = bs[b-1].le, count-bs[b-1].count, rank-bs[b-1].count
+				}
+				v = lo + (bs[b].le-lo)*(rank/count)
+			}
+		}
+		out = append(out, element{labels: labels[k], v: v})
+	}
+	return out
+}
+
+func (e evaluator) aggregate(a aggregation) (any, error) {
+	vec, err := e.vector(a.expr)
+	if err != nil {
+		return nil, err
+	}
+	k := 0
+	if a.op == "topk" || a.op == "bottomk" {
+		if a.param == nil {
+			return nil, fmt.Errorf("%s needs a parameter", a.op)
+		}
+		f, err := e.scalar(a.param)
+		if err != nil {
+			return nil, err
+		}
+		k = int(f)
+	}
+	type group struct {
+		labels map[string]string
+		els    vector
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, el := range vec {
+		l := map[string]string{}
+		if a.without {
+			l = dropName(el.labels)
+			for _, name := range a.grouping {
+				delete(l, name)
+			}
+		} else {
+			for _, name := range a.grouping {
+				if v, ok := el.labels[name]; ok {
+					l[name] = v
+				}
+			}
+		}
+		gk := key(l)
+		g := groups[gk]
+		if g == nil {
+			g = &group{labels: l}
+			groups[gk] = g
+			order = append(order, gk)
+		}
+		g.els = append(g.els, el)
+	}
+	var out vector
+	for _, gk := range order {
+		g := groups[gk]
+		switch a.op {
+		case "topk", "bottomk":
+			sort.SliceStable(g.els, func(i, j int) bool {
+				if a.op == "topk" {
+					return g.els[i].v > g.els[j].v
+				}
+				return g.els[i].v < g.els[j].v
+			})
+			out = append(out, g.els[:min(k, len(g.els))]...)
+			continue
+		}
+		v := g.els[0].v
+		switch a.op {
+		case "sum", "avg":
+			for _, el := range g.els[1:] {
+				v += el.v
+			}
+			if a.op == "avg" {
+				v /= float64(len(g.els))
+			}
+		case "count":
+			v = float64(len(g.els))
+		case "min":
+			for _, el := range g.els[1:] {
+				v = math.Min(v, el.v)
+			}
+		case "max":
+			for _, el := range g.els[1:] {
+				v = math.Max(v, el.v)
+			}
+		}
+		out = append(out, element{labels: g.labels, v: v})
+	}
+	return out, nil
+}
+
+func (e evaluator) binary(b binary) (any, error) {
+	lhs, err := e.eval(b.lhs)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := e.eval(b.rhs)
+	if err != nil {
+		return nil, err
+	}
+	if b.op == "or" {
+		lv, lok := lhs.(vector)
+		rv, rok := rhs.(vector)
+		if !lok || !rok {
+			return nil, fmt.Errorf("or expects instant vectors")
+		}
+		seen := map[string]bool{}
+		for _, el := range lv {
+			seen[key(dropName(el.labels))] = true
+		}
+		out := append(vector{}, lv...)
+		for _, el := range rv {
+			if !seen[key(dropName(el.labels))] {
+				out = append(out, el)
+			}
+		}
+		return out, nil
+	}
+	apply := func(x, y float64) float64 {
+		switch b.op {
+		case "+":
+			return x + y
+		case "-":
+			return x - y
+		case "*":
+			return x * y
+		}
+		return x / y
+	}
+	switch l := lhs.(type) {
+	case float64:
+		if r, ok := rhs.(float64); ok {
+			return apply(l, r), nil
+		}
+		var out vector
+		for _, el := range rhs.(vector) {
+			out = append(out, element{labels: dropName(el.labels), v: apply(l, el.v)})
+		}
+		return out, nil
+	case vector:
+		if r, ok := rhs.(float64); ok {
+			var out vector
+			for _, el := range l {
+				out = append(out, element{labels: dropName(el.labels), v: apply(el.v, r)})
+			}
+			return out, nil
+		}
+		byKey := map[string]float64{}
+		for _, el := range rhs.(vector) {
+			byKey[key(dropName(el.labels))] = el.v
+		}
+		var out vector
+		for _, el := range l {
+			ls := dropName(el.labels)
+			if r, ok := byKey[key(ls)]; ok {
+				out = append(out, element{labels: ls, v: apply(el.v, r)})
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported operands")
+}
+
+// dropName returns a copy of labels without the metric name.
+func dropName(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != "__name__" {
+			out[k] = v
+		}
+	}
+	return out
+}
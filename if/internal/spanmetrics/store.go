@@ -0,0 +1,257 @@
+// Package spanmetrics computes span metrics from OTLP traces in process, like
+// the collector's spanmetrics and servicegraph connectors, or collects them
+// by scrape and remote write, and serves them through a subset of the
+// Prometheus HTTP API, for setups without Mimir.
+package spanmetrics
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// sample is a counter value at a time in milliseconds.
+type sample struct {
+	t int64
+	v float64
+}
+
+// counter is a counter of the OTLP receiver. start, until its first
+// sample, is when it was created.
+type counter struct {
+	labels  map[string]string
+	value   float64
+	updated time.Time
+	start   int64
+}
+
+// Store keeps samples in an embedded Prometheus TSDB for Retention. The
+// counters of the OTLP receiver are sampled into it every Interval, like a
+// scrape; scrapes and remote write append their samples as they come.
+type Store struct {
+	Interval  time.Duration
+	Retention time.Duration
+
+	db *tsdb.DB
+	// tmp is the directory of a store without one, removed on Close.
+	tmp string
+
+	mu       sync.Mutex
+	counters map[string]*counter
+}
+
+// Open opens the TSDB in dir (created if missing), sampling every interval
+// and keeping retention of samples. An empty dir keeps them in a temporary
+// directory, lost on restart.
+func Open(dir string, interval, retention time.Duration) (*Store, error) {
+	s := &Store{Interval: interval, Retention: retention, counters: map[string]*counter{}}
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "if-local-tsdb-")
+		if err != nil {
+			return nil, err
+		}
+		dir, s.tmp = tmp, tmp
+	}
+	opts := *tsdb.DefaultOptions
+	opts.RetentionDuration = uint64(retention.Milliseconds())
+	db, err := tsdb.Open(dir, nil, nil, &opts)
+	if err != nil {
+		if s.tmp != "" {
+			os.RemoveAll(s.tmp)
+		}
+		return nil, err
+	}
+	s.db = db
+	return s, nil
+}
+
+// Close flushes and closes the TSDB.
+func (s *Store) Close() error {
+	err := s.db.Close()
+	if s.tmp != "" {
+		os.RemoveAll(s.tmp)
+	}
+	return err
+}
+
+// key identifies a label set.
+func key(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// add increments the counter of labels by delta. A new counter starts with
+// a zero sample, so rate() counts its first increments.
+func (s *Store) add(labels map[string]string, delta float64) {
+	now := time.Now()
+	k := key(labels)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.counters[k]
+	if c == nil {
+		c = &counter{labels: labels, start: now.UnixMilli()}
+		s.counters[k] = c
+	}
+	c.value += delta
+	c.updated = now
+}
+
+// appender batches samples into the TSDB until commit.
+type appender struct {
+	app tsdb.Appender
+}
+
+func (s *Store) appender() appender { return appender{app: s.db.Appender()} }
+
+// add appends a sample at t, in milliseconds, to the series of labels.
+// Samples out of order, or older than the TSDB accepts, are dropped.
+func (a appender) add(lbls map[string]string, t int64, v float64) {
+	_, err := a.app.Add(labels.FromMap(lbls), t, v)
+	switch {
+	case err == nil, errors.Is(err, tsdb.ErrOutOfOrderSample), errors.Is(err, tsdb.ErrAmendSample), errors.Is(err, tsdb.ErrOutOfBounds):
+	default:
+		log.Printf("local store: %v", err)
+	}
+}
+
+func (a appender) commit() {
+	if err := a.app.Commit(); err != nil {
+		log.Printf("local store: %v", err)
+	}
+}
+
+// Run samples every counter every Interval until ctx is done, dropping
+// counters not updated for Retention.
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.scrape(now)
+		}
+	}
+}
+
+func (s *Store) scrape(now time.Time) {
+	cut := now.Add(-s.Retention)
+	app := s.appender()
+	s.mu.Lock()
+	for k, c := range s.counters {
+		if c.updated.Before(cut) {
+			delete(s.counters, k)
+			continue
+		}
+		if c.start != 0 {
+			app.add(c.labels, c.start, 0)
+			c.start = 0
+		}
+		app.add(c.labels, now.UnixMilli(), c.value)
+	}
+	s.mu.Unlock()
+	app.commit()
+}
+
+// matcher is a label matcher of a selector.
+type matcher struct {
+	name, op, value string
+	re              *regexp.Regexp
+}
+
+func newMatcher(name, op, value string) (matcher, error) {
+	m := matcher{name: name, op: op, value: value}
+	if op == "=~" || op == "!~" {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Name, Matches and String make m a TSDB label matcher.
+func (m matcher) Name() string          { return m.name }
+func (m matcher) Matches(v string) bool { return m.matches(v) }
+func (m matcher) String() string        { return m.name + m.op + `"` + m.value + `"` }
+
+func (m matcher) matches(v string) bool {
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+// selected is a series matching a selector with its samples in a range.
+type selected struct {
+	labels  map[string]string
+	samples []sample
+}
+
+// selectSeries returns the series matching all matchers with samples
+// between mint and maxt, in milliseconds and inclusive.
+func (s *Store) selectSeries(matchers []matcher, mint, maxt int64) []selected {
+	q, err := s.db.Querier(mint, maxt)
+	if err != nil {
+		log.Printf("local store: %v", err)
+		return nil
+	}
+	defer q.Close()
+	ms := make([]labels.Matcher, len(matchers))
+	for i, m := range matchers {
+		ms[i] = m
+	}
+	set, err := q.Select(ms...)
+	if err != nil {
+		log.Printf("local store: %v", err)
+		return nil
+	}
+	var out []selected
+	for set.Next() {
+		sr := set.At()
+		var samples []sample
+		it := sr.Iterator()
+		for ok := it.Seek(mint); ok; ok = it.Next() {
+			t, v := it.At()
+			if t > maxt {
+				break
+			}
+			samples = append(samples, sample{t: t, v: v})
+		}
+		if len(samples) > 0 {
+			out = append(out, selected{labels: sr.Labels().Map(), samples: samples})
+		}
+	}
+	if err := set.Err(); err != nil {
+		log.Printf("local store: %v", err)
+	}
+	return out
+}
@@ -0,0 +1,283 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"ifservice/internal/event"
+)
+
+// Event is a persisted anomaly event.
+type Event struct {
+	ID int64 `json:"id"`
+	event.Anomaly
+}
+
+// DailyCount is the number of anomaly events of one service and metric on
+// one UTC day.
+type DailyCount struct {
+	Day      string  `json:"day"`
+	Service  string  `json:"service"`
+	Metric   string  `json:"metric"`
+	Count    int     `json:"count"`
+	MaxScore float64 `json:"maxScore"`
+}
+
+// record is a line of the store file that is not an event: the last
+// assigned ID, written on compaction so IDs survive pruning every event, or
+// a daily roll-up of pruned events.
+type record struct {
+	LastID int64       `json:"lastId,omitempty"`
+	Daily  *DailyCount `json:"daily,omitempty"`
+}
+
+// Store keeps detected anomaly events with monotonically increasing IDs.
+// Events are held in memory and, when a path is given, appended to a JSON lines
+// file that is replayed on startup so IDs survive restarts.
+type Store struct {
+	mu     sync.RWMutex
+	events []Event
+	// daily holds the roll-ups of pruned events
+	daily  []DailyCount
+	lastID int64
+	path   string
+	f      *os.File
+}
+
+// Open loads events from path (created if missing). An empty path keeps
+// events in memory only.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path == "" {
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var rec record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// skip a torn trailing line from an unclean shutdown
+			continue
+		}
+		if rec.Daily != nil {
+			s.daily = append(s.daily, *rec.Daily)
+			continue
+		}
+		if rec.LastID > s.lastID {
+			s.lastID = rec.LastID
+		}
+		var ev Event
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil || ev.ID == 0 {
+			continue
+		}
+		s.events = append(s.events, ev)
+		if ev.ID > s.lastID {
+			s.lastID = ev.ID
+		}
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+// Append assigns the next ID to ev, persists it and returns it.
+func (s *Store) Append(ev Event) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ev.ID = s.lastID + 1
+	if s.f != nil {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return Event{}, err
+		}
+		if _, err := s.f.Write(append(b, '\n')); err != nil {
+			return Event{}, err
+		}
+	}
+	s.lastID = ev.ID
+	s.events = append(s.events, ev)
+	return ev, nil
+}
+
+// Since returns all events with an ID greater than id, oldest first.
+func (s *Store) Since(id int64) []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.events), func(i int) bool { return s.events[i].ID > id })
+	out := make([]Event, len(s.events)-i)
+	copy(out, s.events[i:])
+	return out
+}
+
+// Last returns the n most recent events, oldest first.
+func (s *Store) Last(n int) []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := len(s.events) - n
+	if i < 0 {
+		i = 0
+	}
+	out := make([]Event, len(s.events)-i)
+	copy(out, s.events[i:])
+	return out
+}
+
+// Find returns the n most recent events match accepts, oldest first.
+func (s *Store) Find(match func(Event) bool, n int) []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Event
+	for i := len(s.events) - 1; i >= 0 && len(out) < n; i-- {
+		if match(s.events[i]) {
+			out = append(out, s.events[i])
+		}
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// Prune drops events older than before. With rollup, they are first counted
+// into the daily roll-ups. The file is then rewritten without them.
+func (s *Store) Prune(before time.Time, rollup bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keep := make([]Event, 0, len(s.events))
+	var old []Event
+	for _, ev := range s.events {
+		if ev.Time.Before(before) {
+			old = append(old, ev)
+		} else {
+			keep = append(keep, ev)
+		}
+	}
+	if len(old) == 0 {
+		return 0, nil
+	}
+	daily := s.daily
+	if rollup {
+		daily = countDaily(s.daily, old)
+	}
+	if s.f != nil {
+		if err := s.rewrite(daily, keep); err != nil {
+			return 0, err
+		}
+	}
+	s.events, s.daily = keep, daily
+	return len(old), nil
+}
+
+// rewrite replaces the file with the last ID, daily and events, through a
+// temporary file so a crash leaves either the old or the new file.
+func (s *Store) rewrite(daily []DailyCount, events []Event) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(record{LastID: s.lastID})
+	for i := 0; err == nil && i < len(daily); i++ {
+		err = enc.Encode(record{Daily: &daily[i]})
+	}
+	for i := 0; err == nil && i < len(events); i++ {
+		err = enc.Encode(events[i])
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	nf, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = nf
+	return nil
+}
+
+// Daily returns per-day event counts by service and metric: the roll-ups of
+// pruned events merged with the stored events, newest day first.
+func (s *Store) Daily() []DailyCount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return countDaily(s.daily, s.events)
+}
+
+// countDaily adds events to the daily counts, returning a new sorted slice.
+func countDaily(daily []DailyCount, events []Event) []DailyCount {
+	type key struct{ day, service, metric string }
+	m := map[key]DailyCount{}
+	for _, d := range daily {
+		k := key{d.Day, d.Service, d.Metric}
+		cur, found := m[k]
+		if found {
+			d.Count += cur.Count
+			d.MaxScore = max(d.MaxScore, cur.MaxScore)
+		}
+		m[k] = d
+	}
+	for _, ev := range events {
+		k := key{ev.Time.UTC().Format(time.DateOnly), ev.Labels["service_name"], ev.Metric}
+		d := m[k]
+		d.Day, d.Service, d.Metric = k.day, k.service, k.metric
+		d.Count++
+		d.MaxScore = max(d.MaxScore, ev.Score)
+		m[k] = d
+	}
+	out := make([]DailyCount, 0, len(m))
+	for _, d := range m {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Day != b.Day {
+			return a.Day > b.Day
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.Metric < b.Metric
+	})
+	return out
+}
+
+// Close syncs and closes the backing file, if any. Events appended after it
+// are kept in memory only.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return err
+}
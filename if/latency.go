@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mimir "ifservice/internal/mimir"
+	"ifservice/internal/promresult"
+)
+
+// Histogram bucket metric names emitted by spanmetrics across collector
+// versions, by unit. Millisecond names are preferred when both exist.
+var (
+	latencyBucketsMs = []string{
+		"traces_span_metrics_duration_milliseconds_bucket",
+		"traces_spanmetrics_duration_milliseconds_bucket",
+		"duration_milliseconds_bucket",
+		"traces_spanmetrics_latency_bucket",
+	}
+	latencyBucketsSec = []string{
+		"traces_span_metrics_duration_seconds_bucket",
+		"traces_spanmetrics_duration_seconds_bucket",
+		"duration_seconds_bucket",
+	}
+)
+
+// latencyQuantile is the percentile tracked by the latency_p95 metric.
+const latencyQuantile = 0.95
+
+// latencyMetric is the detected histogram metric and the factor converting
+// its unit to milliseconds. A recorded metric holds bucket rates already.
+type latencyMetric struct {
+	name     string
+	toMs     float64
+	found    bool
+	recorded bool
+}
+
+var (
+	latencyMu     sync.Mutex
+	latencyCached latencyMetric
+)
+
+// detectLatencyMetric finds which histogram bucket metric exists in the
+// backend. A successful result is cached; a miss is retried on the next call.
+func detectLatencyMetric(ctx context.Context, c *mimir.Client, start, end time.Time) (latencyMetric, error) {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	if latencyCached.found {
+		return latencyCached, nil
+	}
+	if recorded.latency != "" {
+		latencyCached = latencyMetric{name: recorded.latency, toMs: 1, found: true, recorded: true}
+		return latencyCached, nil
+	}
+	all := append(append([]string{}, latencyBucketsMs...), latencyBucketsSec...)
+	names, err := c.LabelValues(ctx, "__name__", []string{`{__name__=~"` + strings.Join(all, "|") + `"}`}, start, end)
+	if err != nil {
+		return latencyMetric{}, err
+	}
+	present := map[string]bool{}
+	for _, n := range names {
+		present[n] = true
+	}
+	for _, n := range latencyBucketsMs {
+		if present[n] {
+			latencyCached = latencyMetric{name: n, toMs: 1, found: true}
+			return latencyCached, nil
+		}
+	}
+	for _, n := range latencyBucketsSec {
+		if present[n] {
+			latencyCached = latencyMetric{name: n, toMs: 1000, found: true}
+			return latencyCached, nil
+		}
+	}
+	return latencyMetric{}, fmt.Errorf("no spanmetrics duration histogram found")
+}
+
+// latencyExpr is the p95 PromQL (in milliseconds) for series selected by
+// matchers, which must start with a comma when non-empty. Buckets are summed
+// per le before histogram_quantile so series with sparse bucket sets still
+// combine into a complete histogram; rate() absorbs counter resets.
+func latencyExpr(lm latencyMetric, groupBy, matchers string) string {
+	by := "le"
+	if groupBy != "" {
+		by = groupBy + ", le"
+	}
+	buckets := fmt.Sprintf(`rate({__name__="%s", span_kind="SPAN_KIND_SERVER"%s}[5m])`, lm.name, matchers)
+	if lm.recorded {
+		buckets = fmt.Sprintf(`{__name__="%s"%s}`, lm.name, matchers)
+	}
+	q := fmt.Sprintf(`histogram_quantile(%g, sum by (%s) (%s))`, latencyQuantile, by, buckets)
+	if lm.toMs != 1 {
+		q = fmt.Sprintf(`(%s) * %g`, q, lm.toMs)
+	}
+	return q
+}
+
+// fetchAllLatency pulls p95 server latency in milliseconds for ALL server
+// spans grouped by the labels by over the grid. Steps without traffic
+// yield NaN from histogram_quantile and are treated as missing rather than
+// zero latency.
+func fetchAllLatency(ctx context.Context, c *mimir.Client, g promresult.Grid, by, matchers string) ([]promresult.Series, error) {
+	lm, err := detectLatencyMetric(ctx, c, g.Start, g.End())
+	if err != nil {
+		return nil, err
+	}
+	q := latencyExpr(lm, by, matchers)
+	return fetchMatrix(ctx, c, q, g)
+}
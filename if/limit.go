@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mimir "ifservice/internal/mimir"
+	"ifservice/internal/promresult"
+)
+
+// serviceCount is the number of detection series of one service.
+type serviceCount struct {
+	Service string
+	Series  int
+}
+
+// seriesLimitError is returned by a scan whose detection query would match
+// more series than the limit allows.
+type seriesLimitError struct {
+	Metric string
+	Series int
+	Limit  int
+	// Largest are the services with the most series, most first.
+	Largest []serviceCount
+}
+
+func (e *seriesLimitError) Error() string {
+	var top []string
+	for _, sc := range e.Largest {
+		if sc.Service != "" {
+			top = append(top, fmt.Sprintf("%s=%d", sc.Service, sc.Series))
+		}
+	}
+	msg := fmt.Sprintf("%s: %d series exceed MAX_SERIES=%d", e.Metric, e.Series, e.Limit)
+	if len(top) > 0 {
+		msg += " (largest services: " + strings.Join(top, ", ") + ")"
+	}
+	return msg + "; narrow GROUP_BY, raise MAX_SERIES or set SERIES_LIMIT_MODE=partial"
+}
+
+// truncation describes a partial scan: the services left out to stay within
+// the series limit.
+type truncation struct {
+	// Series is the number of series the full detection query matches.
+	Series  int
+	Limit   int
+	Skipped []string
+}
+
+// countSeries returns the number of detection series per service over the
+// window. It counts the calls metric, which has a series for every group
+// the latency histogram has too.
+func countSeries(ctx context.Context, c *mimir.Client, windowM int) ([]serviceCount, error) {
+	q := fmt.Sprintf(`count by (service_name) (count by (%s) (last_over_time(%s[%dm])))`, groupBy(), callsSelector(""), windowM)
+	raw, err := c.Query(ctx, q, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	samples, err := promresult.DecodeVector(raw)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]serviceCount, 0, len(samples))
+	for _, smp := range samples {
+		out = append(out, serviceCount{Service: smp.Labels["service_name"], Series: int(smp.V)})
+	}
+	return out, nil
+}
+
+// limitSeries runs the pre-flight series count of a scan of metric. Within
+// the limit it returns every service. Above it, it fails in error mode; in
+// partial mode it keeps the smallest services that fit and reports the
+// rest as skipped.
+func (s *service) limitSeries(ctx context.Context, metric string) ([]string, *truncation, error) {
+	counts, err := countSeries(ctx, s.c, s.window)
+	if err != nil {
+		return nil, nil, fmt.Errorf("series count: %w", err)
+	}
+	total := 0
+	for _, sc := range counts {
+		total += sc.Series
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Series != counts[j].Series {
+			return counts[i].Series < counts[j].Series
+		}
+		return counts[i].Service < counts[j].Service
+	})
+	limitErr := func() error {
+		largest := make([]serviceCount, 0, 5)
+		for i := len(counts) - 1; i >= 0 && len(largest) < 5; i-- {
+			largest = append(largest, counts[i])
+		}
+		return &seriesLimitError{Metric: metric, Series: total, Limit: s.maxSeries, Largest: largest}
+	}
+	if total > s.maxSeries && !s.partialSeries {
+		return nil, nil, limitErr()
+	}
+
+	var services []string
+	var tr *truncation
+	kept := 0
+	for _, sc := range counts {
+		if kept+sc.Series > s.maxSeries {
+			if tr == nil {
+				tr = &truncation{Series: total, Limit: s.maxSeries}
+			}
+			tr.Skipped = append(tr.Skipped, sc.Service)
+			continue
+		}
+		kept += sc.Series
+		services = append(services, sc.Service)
+	}
+	if tr != nil && len(services) == 0 {
+		return nil, nil, limitErr()
+	}
+	sort.Strings(services)
+	if tr != nil {
+		sort.Strings(tr.Skipped)
+	}
+	return services, tr, nil
+}
+
+// serviceMatcher restricts a detection query to services.
+func serviceMatcher(services []string) string {
+	quoted := make([]string, len(services))
+	for i, svc := range services {
+		quoted[i] = regexp.QuoteMeta(svc)
+	}
+	return ", service_name=~" + strconv.Quote(strings.Join(quoted, "|"))
+}
@@ -3,28 +3,43 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"ifservice/internal/iforest"
+	"ifservice/internal/bus"
+	"ifservice/internal/compress"
+	"ifservice/internal/event"
+	"ifservice/internal/kube"
+	"ifservice/internal/leader"
 	mimir "ifservice/internal/mimir"
-)
+	"ifservice/internal/promresult"
+	"ifservice/internal/secret"
+	"ifservice/internal/spanmetrics"
+	"ifservice/internal/store"
 
-type promMatrix struct {
-	ResultType string       `json:"resultType"`
-	Result     []promSeries `json:"result"`
-}
+	"github.com/arijanluiken/mcp/if/iforest"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
 
-type promSeries struct {
-	Metric map[string]string `json:"metric"`
-	Values [][]interface{}   `json:"values"`
-}
+// version is the version of the build, set with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
 
 func getenv(k, def string) string {
 	if v := os.Getenv(k); v != "" {
@@ -33,256 +48,154 @@ func getenv(k, def string) string {
 	return def
 }
 
-func sane(v float64) (float64, bool) {
-	if math.IsNaN(v) || math.IsInf(v, 0) {
-		return 0, false
+// getenvSecret returns the secret k, read instead from the file named by
+// k_FILE when that is set, e.g. a Docker or Kubernetes secret mount, and
+// re-read when the file is rotated.
+func getenvSecret(k string) secret.Secret {
+	sec, err := secret.New(os.Getenv(k), os.Getenv(k+"_FILE"))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", k, err)
 	}
-	return v, true
+	return sec
+}
+
+// mimirOptions returns how the Mimir client connects, from MIMIR_PROXY_URL,
+// MIMIR_DIAL_TIMEOUT, MIMIR_UNIX_SOCKET and MIMIR_DNS_SERVER.
+func mimirOptions() mimir.Options {
+	opts := mimir.Options{UnixSocket: getenv("MIMIR_UNIX_SOCKET", ""), DNSServer: getenv("MIMIR_DNS_SERVER", "")}
+	if v := getenv("MIMIR_PROXY_URL", ""); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" {
+			// without the URL, which may hold credentials
+			log.Fatal("invalid MIMIR_PROXY_URL: want e.g. http://proxy:3128")
+		}
+		opts.Proxy = u
+	}
+	if v := getenv("MIMIR_DIAL_TIMEOUT", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid MIMIR_DIAL_TIMEOUT %q", v)
+		}
+		opts.DialTimeout = d
+	}
+	if opts.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(opts.DNSServer); err != nil {
+			log.Fatalf("invalid MIMIR_DNS_SERVER %q: want host:port", opts.DNSServer)
+		}
+	}
+	return opts
 }
 
 // PromQL regex to match spanmetrics call counters across versions
 const metricRegex = `traces_spanmetrics_calls_total|traces_span_metrics_calls_total|calls_total`
 
-// logAnomalyEvents writes one log line per anomaly above the threshold.
-// For now, the event includes only service_name and metric type as requested.
-func logAnomalyEvents(serviceName, metric string, topIdx []int, scores []float64, threshold float64) {
-	for _, i := range topIdx {
-		if i >= 0 && i < len(scores) && scores[i] >= threshold {
-			log.Printf("anomaly detected: service=%s metric=%s", serviceName, metric)
-		}
-	}
+// groupLabels are the labels detection series are summed by; they identify
+// a series in results and events. Set with GROUP_BY.
+var groupLabels = []string{"service_name", "span_name", "peer_service"}
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// groupBy returns groupLabels as the label list of a PromQL "by" clause.
+func groupBy() string {
+	return strings.Join(groupLabels, ", ")
 }
 
-// fetchAllRPS pulls spanmetrics RPS for ALL server spans, grouped by service/span/peer, over a window
-func fetchAllRPS(ctx context.Context, c *mimir.Client, windowM int) ([]promSeries, [][]float64, [][]time.Time, error) {
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := time.Minute
-	// Group by key labels to keep one series per span endpoint and caller
+// errNoData is returned when a detection query matches no series.
+var errNoData = errors.New("no data")
+
+// fetchAllRPS pulls spanmetrics RPS for ALL server spans, grouped by the labels by, over the grid.
+// matchers, empty or starting with a comma, narrow the selector (e.g. to a page of services).
+func fetchAllRPS(ctx context.Context, c *mimir.Client, g promresult.Grid, by, matchers string) ([]promresult.Series, error) {
+	// Group by key labels to keep one series per span endpoint and caller by default
 	// Supports both upstream metric names used by spanmetrics connector
-	q := `sum by (service_name, span_name, peer_service) (rate(({__name__=~"` + metricRegex + `", span_kind="SPAN_KIND_SERVER"}[5m])))`
-	raw, err := c.QueryRange(ctx, q, start, end, step)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	var resp struct {
-		Data promMatrix `json:"data"`
-	}
-	if err := json.Unmarshal(raw, &resp); err != nil {
-		return nil, nil, nil, err
-	}
-	if len(resp.Data.Result) == 0 {
-		return nil, nil, nil, fmt.Errorf("no data")
-	}
-	series := resp.Data.Result
-	allVals := make([][]float64, len(series))
-	allTs := make([][]time.Time, len(series))
-	for i, s := range series {
-		vals := make([]float64, 0, len(s.Values))
-		ts := make([]time.Time, 0, len(s.Values))
-		for _, v := range s.Values {
-			if len(v) != 2 {
-				continue
-			}
-			sec, _ := v[0].(float64)
-			str, _ := v[1].(string)
-			var f float64
-			fmt.Sscan(str, &f)
-			if fv, ok := sane(f); ok {
-				vals = append(vals, fv)
-			} else {
-				vals = append(vals, 0)
-			}
-			ts = append(ts, time.Unix(int64(sec), 0))
-		}
-		allVals[i] = vals
-		allTs[i] = ts
-	}
-	return series, allVals, allTs, nil
+	q := `sum by (` + by + `) (` + callsExpr("rps", matchers, g.Step) + `)`
+	return fetchMatrix(ctx, c, q, g)
 }
 
 // fetchAllErrorRate pulls error rate (error calls / total calls) for ALL server spans
-// grouped by service/span/peer over a window
-func fetchAllErrorRate(ctx context.Context, c *mimir.Client, windowM int) ([]promSeries, [][]float64, [][]time.Time, error) {
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := time.Minute
-	q := `sum by (service_name, span_name, peer_service) (rate(({__name__=~"` + metricRegex + `", span_kind="SPAN_KIND_SERVER", status_code="STATUS_CODE_ERROR"}[5m]))) /
-		  sum by (service_name, span_name, peer_service) (rate(({__name__=~"` + metricRegex + `", span_kind="SPAN_KIND_SERVER"}[5m])))`
-	raw, err := c.QueryRange(ctx, q, start, end, step)
+// grouped by the labels by over the grid
+func fetchAllErrorRate(ctx context.Context, c *mimir.Client, g promresult.Grid, by, matchers string) ([]promresult.Series, error) {
+	q := `sum by (` + by + `) (` + errorsExpr("error_rate", matchers, g.Step) + `) /
+		  sum by (` + by + `) (` + callsExpr("error_rate", matchers, g.Step) + `)`
+	return fetchMatrix(ctx, c, q, g)
+}
+
+// fetchMatrix runs a range query over the grid at its step and decodes its
+// series as the response is read.
+func fetchMatrix(ctx context.Context, c *mimir.Client, q string, g promresult.Grid) ([]promresult.Series, error) {
+	var series []promresult.Series
+	err := c.QueryRangeStream(ctx, q, g.Start, g.End(), g.Step, func(dec *json.Decoder) error {
+		return promresult.StreamMatrix(dec, promresult.DefaultOptions, func(s promresult.Series) error {
+			series = append(series, s)
+			return nil
+		})
+	})
 	if err != nil {
-		return nil, nil, nil, err
-	}
-	var resp struct {
-		Data promMatrix `json:"data"`
-	}
-	if err := json.Unmarshal(raw, &resp); err != nil {
-		return nil, nil, nil, err
-	}
-	if len(resp.Data.Result) == 0 {
-		return nil, nil, nil, fmt.Errorf("no data")
-	}
-	series := resp.Data.Result
-	allVals := make([][]float64, len(series))
-	allTs := make([][]time.Time, len(series))
-	for i, s := range series {
-		vals := make([]float64, 0, len(s.Values))
-		ts := make([]time.Time, 0, len(s.Values))
-		for _, v := range s.Values {
-			if len(v) != 2 {
-				continue
-			}
-			sec, _ := v[0].(float64)
-			str, _ := v[1].(string)
-			var f float64
-			fmt.Sscan(str, &f)
-			if fv, ok := sane(f); ok {
-				vals = append(vals, fv)
-			} else {
-				vals = append(vals, 0)
-			}
-			ts = append(ts, time.Unix(int64(sec), 0))
-		}
-		allVals[i] = vals
-		allTs[i] = ts
+		return nil, err
+	}
+	if len(series) == 0 {
+		return nil, errNoData
 	}
-	return series, allVals, allTs, nil
+	return series, nil
 }
 
-// fetchServices returns distinct service_name values that have server-side spans in the window
+// fetchServices returns distinct service_name values that have server-side spans in the window.
+// A single instant count by (service_name) is far cheaper for Mimir than listing every series via /series.
 func fetchServices(ctx context.Context, c *mimir.Client, windowM int) ([]string, error) {
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	// Ask for any spanmetrics calls series within window and parse labels
-	matchers := []string{`{__name__=~"` + metricRegex + `"}`}
-	raw, err := c.Series(ctx, matchers, start, end)
+	q := fmt.Sprintf(`count by (service_name) (last_over_time(%s[%dm]))`, callsSelector(""), windowM)
+	raw, err := c.Query(ctx, q, time.Now())
 	if err != nil {
 		return nil, err
 	}
-	var data []map[string]string
-	var payload struct {
-		Status string              `json:"status"`
-		Data   []map[string]string `json:"data"`
-	}
-	// The client returns qr.Data which is already the raw Data field, so unmarshal directly
-	if err := json.Unmarshal(raw, &data); err == nil {
-		payload.Data = data
-	} else if err := json.Unmarshal(raw, &payload); err == nil {
-		// some proxies may wrap differently
+	samples, err := promresult.DecodeVector(raw)
+	if err != nil {
+		return nil, err
 	}
-	seen := map[string]struct{}{}
-	for _, lbls := range payload.Data {
-		if name := lbls["service_name"]; name != "" {
-			seen[name] = struct{}{}
+	out := make([]string, 0, len(samples))
+	for _, smp := range samples {
+		if name := smp.Labels["service_name"]; name != "" {
+			out = append(out, name)
 		}
 	}
-	out := make([]string, 0, len(seen))
-	for k := range seen {
-		out = append(out, k)
-	}
 	sort.Strings(out)
 	return out, nil
 }
 
-// fetchRPS pulls spanmetrics RPS for a server (optionally by client) over a window
-// Deprecated: single-target fetch, no longer used
-func fetchRPS(ctx context.Context, c *mimir.Client, server, client string, windowM int) ([]float64, []time.Time, error) {
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := time.Minute
-	filter := fmt.Sprintf(`service_name="%s", span_kind="SPAN_KIND_SERVER"`, server)
-	if client != "" {
-		filter += fmt.Sprintf(",peer_service=\"%s\"", client)
-	}
-	q := fmt.Sprintf(`sum(rate(({__name__=~"%s", %s}[5m])))`, metricRegex, filter)
-	raw, err := c.QueryRange(ctx, q, start, end, step)
-	if err != nil {
-		return nil, nil, err
-	}
-	var resp struct {
-		Data promMatrix `json:"data"`
-	}
-	if err := json.Unmarshal(raw, &resp); err != nil {
-		return nil, nil, err
-	}
-	if len(resp.Data.Result) == 0 {
-		return nil, nil, fmt.Errorf("no data")
-	}
-	series := resp.Data.Result[0]
-	vals := make([]float64, 0, len(series.Values))
-	ts := make([]time.Time, 0, len(series.Values))
-	for _, v := range series.Values {
-		if len(v) != 2 {
-			continue
-		}
-		sec, _ := v[0].(float64)
-		s := v[1].(string)
-		var f float64
-		fmt.Sscan(s, &f)
-		if fv, ok := sane(f); ok {
-			vals = append(vals, fv)
-		} else {
-			vals = append(vals, 0)
-		}
-		ts = append(ts, time.Unix(int64(sec), 0))
-	}
-	return vals, ts, nil
-}
+// Bounds of the forest hyperparameters: beyond them scans cost much CPU
+// for no accuracy, or trees are too few or shallow to isolate anything.
+const (
+	maxForestTrees      = 1000
+	maxForestSampleSize = 4096
+	maxForestDepth      = 30
+)
 
-// fetchErrorRate pulls error rate for a specific server (optionally by client)
-// Deprecated: single-target fetch, no longer used
-func fetchErrorRate(ctx context.Context, c *mimir.Client, server, client string, windowM int) ([]float64, []time.Time, error) {
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := time.Minute
-	filter := fmt.Sprintf(`service_name="%s", span_kind="SPAN_KIND_SERVER"`, server)
-	if client != "" {
-		filter += fmt.Sprintf(",peer_service=\"%s\"", client)
-	}
-	q := fmt.Sprintf(`sum(rate(({__name__=~"%s", %s, status_code="STATUS_CODE_ERROR"}[5m])))/sum(rate(({__name__=~"%s", %s}[5m])))`, metricRegex, filter, metricRegex, filter)
-	raw, err := c.QueryRange(ctx, q, start, end, step)
-	if err != nil {
-		return nil, nil, err
-	}
-	var resp struct {
-		Data promMatrix `json:"data"`
-	}
-	if err := json.Unmarshal(raw, &resp); err != nil {
-		return nil, nil, err
-	}
-	if len(resp.Data.Result) == 0 {
-		return nil, nil, fmt.Errorf("no data")
-	}
-	series := resp.Data.Result[0]
-	vals := make([]float64, 0, len(series.Values))
-	ts := make([]time.Time, 0, len(series.Values))
-	for _, v := range series.Values {
-		if len(v) != 2 {
-			continue
-		}
-		sec, _ := v[0].(float64)
-		s := v[1].(string)
-		var f float64
-		fmt.Sscan(s, &f)
-		if fv, ok := sane(f); ok {
-			vals = append(vals, fv)
-		} else {
-			vals = append(vals, 0)
-		}
-		ts = append(ts, time.Unix(int64(sec), 0))
-	}
-	return vals, ts, nil
+// checkForest validates forest hyperparameters from the configuration or a
+// request. A zero MaxDepth derives it from the sample size.
+func checkForest(o iforest.Options) error {
+	switch {
+	case o.Trees < 1 || o.Trees > maxForestTrees:
+		return fmt.Errorf("trees must be between 1 and %d", maxForestTrees)
+	case o.SampleSize < 2 || o.SampleSize > maxForestSampleSize:
+		return fmt.Errorf("sample size must be between 2 and %d", maxForestSampleSize)
+	case o.MaxDepth < 0 || o.MaxDepth > maxForestDepth:
+		return fmt.Errorf("max depth must be between 1 and %d, or 0 for ceil(log2(sample size))", maxForestDepth)
+	}
+	return nil
 }
 
-// detectAnomalies trains an IF on the window and returns the top-k anomalous points.
-func detectAnomalies(vals []float64, k int) ([]int, []float64) {
-	// Normalize (z-score) to stabilize splits
-	mu, sd := meanStd(vals)
+// detectAnomalies trains an IF configured by opts on train, a possibly
+// downsampled copy of the window, scores every point of vals and returns
+// the top-k anomalous points. Values are normalized by sc.
+func detectAnomalies(vals, train []float64, k int, opts iforest.Options, sc scaler) ([]int, []float64) {
 	norm := make([]float64, len(vals))
 	for i, v := range vals {
-		norm[i] = (v - mu) / (sd + 1e-9)
+		norm[i] = sc.apply(v)
+	}
+	normTrain := make([]float64, len(train))
+	for i, v := range train {
+		normTrain[i] = sc.apply(v)
 	}
-	f := iforest.New(norm, 100, min(64, len(norm)))
+	f := iforest.New(normTrain, opts)
 	scores := make([]float64, len(norm))
 	for i, v := range norm {
 		scores[i] = f.Score(v)
@@ -298,6 +211,32 @@ func detectAnomalies(vals []float64, k int) ([]int, []float64) {
 	return idx[:k], scores
 }
 
+// downsample reduces vals to at most maxPoints training points by
+// aggregating consecutive buckets with agg ("mean" or "max"). maxPoints <= 0
+// or a short series returns vals as is.
+func downsample(vals []float64, maxPoints int, agg string) []float64 {
+	if maxPoints <= 0 || len(vals) <= maxPoints {
+		return vals
+	}
+	out := make([]float64, maxPoints)
+	for b := range out {
+		lo, hi := b*len(vals)/maxPoints, (b+1)*len(vals)/maxPoints
+		v := vals[lo]
+		for _, x := range vals[lo+1 : hi] {
+			if agg == "max" {
+				v = math.Max(v, x)
+			} else {
+				v += x
+			}
+		}
+		if agg != "max" {
+			v /= float64(hi - lo)
+		}
+		out[b] = v
+	}
+	return out
+}
+
 func meanStd(x []float64) (float64, float64) {
 	if len(x) == 0 {
 		return 0, 1
@@ -322,6 +261,20 @@ func min(a, b int) int {
 	return b
 }
 
+// pruneStore drops events older than retention from st at startup and then
+// hourly, rolling them up into daily counts when rollup is set.
+func pruneStore(st *store.Store, retention time.Duration, rollup bool) {
+	for {
+		n, err := st.Prune(time.Now().Add(-retention), rollup)
+		if err != nil {
+			log.Printf("anomaly store prune failed: %v", err)
+		} else if n > 0 {
+			log.Printf("anomaly store: pruned %d events older than %s", n, retention)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
 func main() {
 	log.SetFlags(0)
 	mimirURL := getenv("MIMIR_URL", "http://mimir:9009/prometheus")
@@ -335,10 +288,499 @@ func main() {
 	if v := getenv("ANOMALY_SCORE_THRESHOLD", ""); v != "" {
 		fmt.Sscanf(v, "%f", &threshold)
 	}
+	// when set, the expected share of anomalous points, e.g. 0.005; each
+	// series' threshold is then derived from its window's scores
+	contamination := 0.0
+	if v := getenv("ANOMALY_CONTAMINATION", ""); v != "" {
+		if _, err := fmt.Sscanf(v, "%f", &contamination); err != nil || contamination < 0 || contamination >= 0.5 {
+			log.Fatalf("invalid ANOMALY_CONTAMINATION %q", v)
+		}
+	}
+	// when set, events are points whose calibrated p-value is at most this,
+	// e.g. 0.01, instead of those scoring at least the threshold
+	maxPValue := 0.0
+	if v := getenv("ANOMALY_MAX_P_VALUE", ""); v != "" {
+		if _, err := fmt.Sscanf(v, "%f", &maxPValue); err != nil || maxPValue < 0 || maxPValue >= 1 {
+			log.Fatalf("invalid ANOMALY_MAX_P_VALUE %q", v)
+		}
+	}
+	// scores a series needs before its own history calibrates them; until
+	// then p-values are relative to the current window
+	calibMin := 500
+	if v := getenv("CALIBRATION_MIN_SAMPLES", ""); v != "" {
+		if _, err := fmt.Sscanf(v, "%d", &calibMin); err != nil || calibMin < 1 {
+			log.Fatalf("invalid CALIBRATION_MIN_SAMPLES %q", v)
+		}
+	}
+	// events scoring at least this are critical, the others warnings
+	criticalScore := 0.8
+	if v := getenv("ANOMALY_CRITICAL_SCORE", ""); v != "" {
+		fmt.Sscanf(v, "%f", &criticalScore)
+	}
+	// request rate from which events get their score's full severity; below
+	// it the score is scaled down for severity. Unset disables weighting
+	referenceRPS := 0.0
+	if v := getenv("TRAFFIC_REFERENCE_RPS", ""); v != "" {
+		if _, err := fmt.Sscanf(v, "%f", &referenceRPS); err != nil || referenceRPS < 0 {
+			log.Fatalf("invalid TRAFFIC_REFERENCE_RPS %q", v)
+		}
+	}
+	// low-traffic hours and days, in QUIET_TIMEZONE, where points need
+	// QUIET_SCORE_THRESHOLD to be anomalies
+	var quiet *quietHours
+	if hours, days := getenv("QUIET_HOURS", ""), getenv("QUIET_DAYS", ""); hours != "" || days != "" {
+		loc, err := time.LoadLocation(getenv("QUIET_TIMEZONE", "UTC"))
+		if err != nil {
+			log.Fatalf("invalid QUIET_TIMEZONE: %v", err)
+		}
+		quietThreshold := 0.75
+		if v := getenv("QUIET_SCORE_THRESHOLD", ""); v != "" {
+			if _, err := fmt.Sscanf(v, "%f", &quietThreshold); err != nil {
+				log.Fatalf("invalid QUIET_SCORE_THRESHOLD %q", v)
+			}
+		}
+		if quiet, err = parseQuietHours(hours, days, loc, quietThreshold); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// resolution of the common grid all series are aligned onto. Default 1m
+	step := time.Minute
+	if v := getenv("SCAN_STEP", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			log.Fatalf("invalid SCAN_STEP %q", v)
+		}
+		step = d
+	}
+	// bounds of query time ranges: of the detection window at SCAN_STEP and
+	// of the window parameter of the histogram endpoint
+	limits := rangeLimits{maxWindow: defaultMaxWindowMinutes * time.Minute, maxPoints: defaultMaxPoints}
+	if v := getenv("MAX_WINDOW_MINUTES", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid MAX_WINDOW_MINUTES %q", v)
+		}
+		limits.maxWindow = time.Duration(n) * time.Minute
+	}
+	if v := getenv("MAX_POINTS", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 {
+			log.Fatalf("invalid MAX_POINTS %q", v)
+		}
+		limits.maxPoints = n
+	}
+	if err := limits.check(time.Duration(window)*time.Minute, step); err != nil {
+		log.Fatalf("WINDOW_MINUTES %d at SCAN_STEP %s: %v", window, step, err)
+	}
+	// series with a larger share of missing steps are reported but not scored
+	maxGapRatio := 0.2
+	if v := getenv("MAX_GAP_RATIO", ""); v != "" {
+		fmt.Sscanf(v, "%f", &maxGapRatio)
+	}
+
+	// scans fetch only the tail since the previous scan, plus this overlap
+	var windows *windowCache
+	if getenv("SCAN_INCREMENTAL", "true") == "true" {
+		overlap := 5 * time.Minute
+		if v := getenv("SCAN_OVERLAP", ""); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				log.Fatalf("invalid SCAN_OVERLAP %q", v)
+			}
+			overlap = d
+		}
+		windows = newWindowCache(overlap)
+	}
+
+	// longer series are downsampled to this many points for training; all
+	// points are still scored
+	trainMaxPoints := 360
+	fmt.Sscanf(getenv("TRAIN_MAX_POINTS", "360"), "%d", &trainMaxPoints)
+	trainAgg := getenv("TRAIN_DOWNSAMPLE", "mean")
+	if trainAgg != "mean" && trainAgg != "max" {
+		log.Fatalf("invalid TRAIN_DOWNSAMPLE %q", trainAgg)
+	}
+
+	// isolation forest hyperparameters, trading accuracy for CPU
+	forest := iforest.Options{Trees: 100, SampleSize: 64}
+	for _, p := range []struct {
+		env string
+		v   *int
+	}{{"FOREST_TREES", &forest.Trees}, {"FOREST_SAMPLE_SIZE", &forest.SampleSize}, {"FOREST_MAX_DEPTH", &forest.MaxDepth}} {
+		if v := getenv(p.env, ""); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				log.Fatalf("invalid %s %q", p.env, v)
+			}
+			*p.v = n
+		}
+	}
+	if err := checkForest(forest); err != nil {
+		log.Fatalf("invalid FOREST_* configuration: %v", err)
+	}
+
+	// normalization of each metric's series before scoring
+	normalization := map[string]string{}
+	for _, metric := range detectedMetrics() {
+		v := getenv("NORMALIZATION_"+strings.ToUpper(metric), getenv("NORMALIZATION", "zscore"))
+		if !slices.Contains(normalizations, v) {
+			log.Fatalf("invalid normalization %q of %s: %s", v, metric, strings.Join(normalizations, ", "))
+		}
+		normalization[metric] = v
+	}
+
+	// direction of the deviations of each metric raising events
+	directions := map[string]direction{}
+	for _, metric := range detectedMetrics() {
+		d := defaultDirections[metric]
+		if v := getenv("DIRECTION_"+strings.ToUpper(metric), ""); v != "" {
+			d = direction(v)
+			if d != directionBoth && d != directionHigh && d != directionLow {
+				log.Fatalf("invalid DIRECTION_%s %q: high, low or both", strings.ToUpper(metric), v)
+			}
+		}
+		directions[metric] = d
+	}
+
+	// consecutive anomalous points an event of each severity needs
+	sustains := map[string]sustain{}
+	for _, severity := range []string{"warning", "critical"} {
+		k := "SUSTAIN_" + strings.ToUpper(severity)
+		if v := getenv(k, ""); v != "" {
+			r, err := parseSustain(v)
+			if err != nil {
+				log.Fatalf("%s: %v", k, err)
+			}
+			sustains[severity] = r
+			log.Printf("%s events need %s anomalous points", severity, r)
+		}
+	}
+
+	// labels series are grouped by, e.g. adding namespace or dropping
+	// peer_service to cut cardinality
+	if v := getenv("GROUP_BY", ""); v != "" {
+		groupLabels = nil
+		for _, l := range strings.Split(v, ",") {
+			l = strings.TrimSpace(l)
+			if !labelNameRe.MatchString(l) || slices.Contains(groupLabels, l) {
+				log.Fatalf("invalid GROUP_BY %q", v)
+			}
+			groupLabels = append(groupLabels, l)
+		}
+	}
+	// pre-aggregated recording rules read instead of the raw spanmetrics
+	for _, r := range []struct {
+		env  string
+		name *string
+	}{{"RECORDED_RATE_METRIC", &recorded.rate}, {"RECORDED_ERROR_METRIC", &recorded.errors}, {"RECORDED_LATENCY_METRIC", &recorded.latency}} {
+		if v := getenv(r.env, ""); v != "" {
+			if !metricNameRe.MatchString(v) {
+				log.Fatalf("invalid %s %q", r.env, v)
+			}
+			*r.name = v
+		}
+	}
+
+	// rps and error_rate as rates or counts per step
+	for metric := range fetchers {
+		v := getenv("QUERY_MODE_"+strings.ToUpper(metric), getenv("QUERY_MODE", "rate"))
+		if !slices.Contains(queryModes, v) {
+			log.Fatalf("invalid query mode %q of %s: %s", v, metric, strings.Join(queryModes, ", "))
+		}
+		if v == "increase" && metric == "latency_p95" {
+			if getenv("QUERY_MODE_LATENCY_P95", "") != "" {
+				log.Fatalf("QUERY_MODE_LATENCY_P95: latency is always a quantile over 5m")
+			}
+			continue
+		}
+		increaseMetrics[metric] = v == "increase"
+	}
 
-	c := mimir.New(mimirURL)
+	// streaming mode: fetch and score this many services at a time
+	pageSize := 0
+	fmt.Sscanf(getenv("SCAN_PAGE_SIZE", "0"), "%d", &pageSize)
+	if pageSize > 0 && !slices.Contains(groupLabels, "service_name") {
+		// pages are selected by service_name
+		log.Fatalf("SCAN_PAGE_SIZE requires service_name in GROUP_BY")
+	}
+
+	// detection on each service's spans summed, besides the spans
+	aggregates := getenv("SERVICE_AGGREGATES", "") == "true"
+	if aggregates && !slices.Contains(groupLabels, "service_name") {
+		log.Fatalf("SERVICE_AGGREGATES requires service_name in GROUP_BY")
+	}
 
-	// Discover and log which services we will detect anomalies on (for /anomalies/all* endpoints)
+	// scans counting more series than this fail, or in partial mode skip
+	// the largest services; 0 disables the pre-flight count
+	maxSeries := 10000
+	fmt.Sscanf(getenv("MAX_SERIES", "10000"), "%d", &maxSeries)
+	limitMode := getenv("SERIES_LIMIT_MODE", "error")
+	if limitMode != "error" && limitMode != "partial" {
+		log.Fatalf("invalid SERIES_LIMIT_MODE %q", limitMode)
+	}
+	if limitMode == "partial" && !slices.Contains(groupLabels, "service_name") {
+		log.Fatalf("SERIES_LIMIT_MODE=partial requires service_name in GROUP_BY")
+	}
+	if pageSize > 0 && windows != nil {
+		// the window cache would hold every series again
+		log.Printf("SCAN_PAGE_SIZE set: incremental scans disabled")
+		windows = nil
+	}
+
+	c := mimir.New(mimirURL, mimirOptions())
+	profile, err := mimir.ParseProfile(getenv("MIMIR_BACKEND", "mimir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.Profile = profile
+	fmt.Sscanf(getenv("MIMIR_RETRIES", "2"), "%d", &c.Retries)
+	// credentials of the Mimir backend, the secrets also from files
+	c.BearerToken, c.Username, c.Password = getenvSecret("MIMIR_BEARER_TOKEN"), getenv("MIMIR_USERNAME", ""), getenvSecret("MIMIR_PASSWORD")
+	// so Mimir operators can tell the load of the detector from other queries
+	c.UserAgent, c.QuerySource = "if-service/"+version, getenv("MIMIR_QUERY_SOURCE", "")
+	if v := getenv("MIMIR_SLOW_QUERY", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid MIMIR_SLOW_QUERY %q", v)
+		}
+		c.SlowQuery = d
+	}
+	// timeouts of instant queries, range queries and metadata calls, also
+	// sent to the backend as the query timeout
+	for _, t := range []struct {
+		env string
+		dst *time.Duration
+	}{{"MIMIR_TIMEOUT_INSTANT", &c.Timeouts.Instant}, {"MIMIR_TIMEOUT_RANGE", &c.Timeouts.Range}, {"MIMIR_TIMEOUT_SERIES", &c.Timeouts.Series}} {
+		if v := getenv(t.env, ""); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				log.Fatalf("invalid %s %q", t.env, v)
+			}
+			*t.dst = d
+		}
+	}
+	// Mimir tenant, several pipe-separated for tenant federation
+	if v := getenv("MIMIR_TENANT", ""); v != "" {
+		if c.Tenant, err = federatedTenant(strings.Split(v, "|")); err != nil {
+			log.Fatalf("invalid MIMIR_TENANT %q", v)
+		}
+	}
+	// Optional TLS, with client certificates, on both listeners
+	tlsConfig := serverTLS()
+	// Optional further Mimir clusters the anomaly endpoints can scan; the
+	// first replaces MIMIR_URL
+	var clusters []cluster
+	if path := getenv("MIMIR_CLUSTERS_FILE", ""); path != "" {
+		if clusters, err = loadClusters(path); err != nil {
+			log.Fatalf("load clusters: %v", err)
+		}
+		c = clusters[0].client(c)
+	}
+	// SIGINT and SIGTERM stop the HTTP server, the background scans and the
+	// leader lease, then close the event store and the local store so the
+	// event file is synced and the TSDB head flushed
+	shutdown, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// background holds the goroutines shutdown waits for
+	var background sync.WaitGroup
+
+	// Optional local metrics store, fed by an OTLP trace receiver computing
+	// spanmetrics, scrapes or remote write and served at /local/prometheus;
+	// without MIMIR_URL the detector reads it
+	var local *spanmetrics.Store
+	otlpAddr := getenv("OTLP_LISTEN_ADDR", "")
+	var scrapeTargets []string
+	if v := getenv("LOCAL_SCRAPE_TARGETS", ""); v != "" {
+		scrapeTargets = strings.Split(v, ",")
+	}
+	remoteWrite := getenv("LOCAL_REMOTE_WRITE", "") == "true"
+	if otlpAddr != "" || scrapeTargets != nil || remoteWrite {
+		interval, retention, scrapeInterval := 15*time.Second, 6*time.Hour, 15*time.Second
+		// OTLP_RETENTION is the deprecated name of LOCAL_RETENTION
+		retentionEnv := "LOCAL_RETENTION"
+		if getenv(retentionEnv, "") == "" && getenv("OTLP_RETENTION", "") != "" {
+			retentionEnv = "OTLP_RETENTION"
+			log.Printf("OTLP_RETENTION is deprecated, use LOCAL_RETENTION")
+		}
+		for _, d := range []struct {
+			env string
+			d   *time.Duration
+		}{{"OTLP_SCRAPE_INTERVAL", &interval}, {retentionEnv, &retention}, {"LOCAL_SCRAPE_INTERVAL", &scrapeInterval}} {
+			if v := getenv(d.env, ""); v != "" {
+				parsed, err := time.ParseDuration(v)
+				if err != nil || parsed < time.Second {
+					log.Fatalf("invalid %s %q", d.env, v)
+				}
+				*d.d = parsed
+			}
+		}
+		if local, err = spanmetrics.Open(getenv("LOCAL_STORE_PATH", ""), interval, retention); err != nil {
+			log.Fatalf("open local store: %v", err)
+		}
+		go local.Run(shutdown)
+		if otlpAddr != "" {
+			go func() {
+				log.Printf("OTLP trace receiver listening on %s", otlpAddr)
+				if err := spanmetrics.NewReceiver(local).Serve(otlpAddr); err != nil {
+					log.Fatalf("otlp receiver error: %v", err)
+				}
+			}()
+		}
+		for _, target := range scrapeTargets {
+			target = strings.TrimSpace(target)
+			log.Printf("scraping %s every %s into the local store", target, scrapeInterval)
+			go local.Scrape(shutdown, target, getenv("LOCAL_SCRAPE_JOB", "local"), scrapeInterval)
+		}
+		if os.Getenv("MIMIR_URL") == "" && clusters == nil {
+			c.BaseURL = "http://local"
+			c.HTTPClient = &http.Client{Transport: local.Transport()}
+			log.Printf("reading spanmetrics of the local store instead of Mimir")
+		}
+	}
+
+	// Persistent event store backing stream resume; memory-only when unset
+	st, err := store.Open(getenv("ANOMALY_STORE_PATH", ""))
+	if err != nil {
+		log.Fatalf("open anomaly store: %v", err)
+	}
+	// events older than this are pruned, optionally rolled up into daily
+	// counts per service; 0 keeps everything
+	retention := 30 * 24 * time.Hour
+	if v := getenv("ANOMALY_RETENTION", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid ANOMALY_RETENTION %q", v)
+		}
+		retention = d
+	}
+	if retention > 0 {
+		go pruneStore(st, retention, getenv("ANOMALY_ROLLUP", "") == "true")
+	}
+	// deployment markers, posted or imported from Grafana annotations
+	deploys, err := openDeployments(getenv("DEPLOYMENT_STORE_PATH", ""), retention)
+	if err != nil {
+		log.Fatalf("open deployment store: %v", err)
+	}
+	// events within this after a deployment of their service carry it
+	deployLookback := time.Hour
+	if v := getenv("DEPLOYMENT_LOOKBACK", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid DEPLOYMENT_LOOKBACK %q", v)
+		}
+		deployLookback = d
+	}
+	svc := &service{
+		c:                 c,
+		window:            window,
+		step:              step,
+		limits:            limits,
+		threshold:         threshold,
+		contamination:     contamination,
+		maxPValue:         maxPValue,
+		calib:             newCalibrator(calibMin, max(20*calibMin, 10000)),
+		criticalScore:     criticalScore,
+		referenceRPS:      referenceRPS,
+		traffic:           newTraffic(),
+		quiet:             quiet,
+		maxGapRatio:       maxGapRatio,
+		hub:               newHub(st, time.Duration(window)*time.Minute),
+		windows:           windows,
+		trainMaxPoints:    trainMaxPoints,
+		trainAgg:          trainAgg,
+		forest:            forest,
+		normalization:     normalization,
+		direction:         directions,
+		sustain:           sustains,
+		aggregates:        aggregates,
+		pageSize:          pageSize,
+		maxSeries:         maxSeries,
+		partialSeries:     limitMode == "partial",
+		source:            getenv("EVENT_SOURCE", "/if-service"),
+		grafanaURL:        strings.TrimSuffix(getenv("GRAFANA_URL", ""), "/"),
+		grafanaDatasource: getenv("GRAFANA_DATASOURCE", "Mimir"),
+		deploys:           deploys,
+		deployLookback:    deployLookback,
+		scores:            newScoreMetrics(groupLabels),
+	}
+	if len(clusters) > 0 {
+		svc.cluster = clusters[0].Name
+	}
+	// Optional import of Grafana annotations with this tag as deployments
+	if tag := getenv("GRAFANA_ANNOTATION_TAG", ""); tag != "" {
+		if svc.grafanaURL == "" {
+			log.Fatal("GRAFANA_ANNOTATION_TAG requires GRAFANA_URL")
+		}
+		interval := time.Minute
+		if v := getenv("GRAFANA_ANNOTATION_INTERVAL", ""); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Second {
+				log.Fatalf("invalid GRAFANA_ANNOTATION_INTERVAL %q", v)
+			}
+			interval = d
+		}
+		g := grafanaAnnotations{url: svc.grafanaURL, token: getenvSecret("GRAFANA_TOKEN"), tag: tag, client: &http.Client{Timeout: 10 * time.Second}}
+		// far enough back to cover every point of the detection window
+		go g.follow(context.Background(), deploys, interval, time.Duration(window)*time.Minute+deployLookback)
+		log.Printf("importing Grafana annotations tagged %q as deployments every %s", tag, interval)
+	}
+	// Optional enrichment of events with the state of the service's
+	// Kubernetes deployment, read from the API server with the pod's
+	// service account
+	if getenv("KUBERNETES_ENRICHMENT", "") == "true" {
+		kc, err := kube.NewInCluster()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		kc.Label = getenv("KUBE_SERVICE_LABEL", kc.Label)
+		if v := getenv("KUBE_NAMESPACES", ""); v != "" {
+			for _, ns := range strings.Split(v, ",") {
+				if ns = strings.TrimSpace(ns); ns != "" {
+					kc.Namespaces = append(kc.Namespaces, ns)
+				}
+			}
+		}
+		if v := getenv("KUBE_RESTART_WINDOW", ""); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				log.Fatalf("invalid KUBE_RESTART_WINDOW %q", v)
+			}
+			kc.RestartWindow = d
+		}
+		interval := 30 * time.Second
+		if v := getenv("KUBE_REFRESH_INTERVAL", ""); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Second {
+				log.Fatalf("invalid KUBE_REFRESH_INTERVAL %q", v)
+			}
+			interval = d
+		}
+		go kc.Run(context.Background(), interval)
+		svc.kube = kc
+		log.Printf("enriching events with Kubernetes workloads by pod label %s every %s", kc.Label, interval)
+	}
+	svc.hub.addSink(logSink(svc.source))
+	// Optional named scopes of series detected with their own settings,
+	// posting their events to their own notifiers
+	if path := getenv("SCOPES_FILE", ""); path != "" {
+		scopes, err := loadScopes(path)
+		if err != nil {
+			log.Fatalf("load scopes: %v", err)
+		}
+		for _, sc := range scopes {
+			sc.prepare(svc)
+			if len(sc.Notifiers) > 0 {
+				sink := newScopeSink(sc, svc.source)
+				go sink.run(context.Background())
+				svc.hub.addSink(sink.enqueue)
+			}
+			log.Printf("scope %s: %d notifiers", sc.Name, len(sc.Notifiers))
+		}
+		svc.scopes = scopes
+	}
+	expvar.Publish("stream_subscribers", expvar.Func(func() any { return svc.hub.subscribers() }))
+
+	// Discover and log which services we will detect anomalies on (for the /api/v1/anomalies endpoints)
 	func() {
 		var services []string
 		var err error
@@ -361,112 +803,207 @@ func main() {
 		log.Printf("anomalies will be detected on services (%d): %s", len(services), strings.Join(services, ", "))
 	}()
 
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); w.Write([]byte("ok")) })
+	// own mux: net/http/pprof and expvar register on http.DefaultServeMux
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); w.Write([]byte("ok")) })
 
-	// New: anomalies for ALL spans grouped by service_name/span_name/peer_service
-	http.HandleFunc("/anomalies/all", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		series, allVals, allTs, err := fetchAllRPS(ctx, c, window)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+	// Prometheus metrics, including the Mimir client's request metrics
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// REST API under /api/v1; the pre-v1 paths remain as deprecated aliases.
+	// Served endpoints and the OpenAPI document share one route table.
+	ops := svc.apiOperations()
+	registerAPI(mux, ops)
+	mux.HandleFunc("/openapi.json", handleOpenAPI(ops))
+	mux.HandleFunc("/docs", handleSwaggerUI)
+	mux.Handle("/docs/", handleSwaggerAssets())
+
+	if local != nil {
+		mux.Handle("/local/prometheus/", http.StripPrefix("/local/prometheus", local.Handler()))
+		if remoteWrite {
+			mux.Handle("/local/prometheus/api/v1/push", local.RemoteWriteHandler())
 		}
-		// Build per-series results
-		results := make([]map[string]any, 0, len(series))
-		for i, s := range series {
-			vals := allVals[i]
-			ts := allTs[i]
-			if len(vals) == 0 {
-				continue
-			}
-			// top-3 per series
-			idx, scores := detectAnomalies(vals, 3)
-			// fire events for RPS anomalies per service
-			svc := s.Metric["service_name"]
-			if svc == "" {
-				svc = "unknown"
-			}
-			logAnomalyEvents(svc, "rps", idx, scores, threshold)
-			top := make([]map[string]any, 0, len(idx))
-			for _, j := range idx {
-				top = append(top, map[string]any{
-					"time":  ts[j].Format(time.RFC3339),
-					"value": vals[j],
-					"score": scores[j],
-				})
-			}
-			// pick only the key identifying labels to keep payload tidy
-			labels := map[string]string{
-				"service_name": s.Metric["service_name"],
-				"span_name":    s.Metric["span_name"],
-				"peer_service": s.Metric["peer_service"],
-			}
-			results = append(results, map[string]any{
-				"labels": labels,
-				"points": len(vals),
-				"top":    top,
-			})
-		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"windowMinutes": window,
-			"series":        len(results),
-			"results":       results,
-			"metric":        "rps",
-		})
+	}
+
+	// read-only dashboard of stored anomalies
+	mux.Handle("/ui/", handleUI())
+
+	// Optional pprof and expvar diagnostics, behind a token
+	if getenv("DEBUG_ENDPOINTS", "") == "true" {
+		token := getenvSecret("DEBUG_TOKEN")
+		if token.Get() == "" {
+			log.Fatal("DEBUG_ENDPOINTS requires DEBUG_TOKEN")
+		}
+		mux.Handle("/debug/", handleDebug(token))
+		log.Printf("debug endpoints enabled at /debug/pprof/ and /debug/vars")
+	}
+
+	// JSON schema of the anomaly event payload emitted by every output
+	mux.HandleFunc(event.DataSchema, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/schema+json")
+		_, _ = w.Write(event.Schema)
 	})
 
-	// anomalies for ALL spans using error rate
-	http.HandleFunc("/anomalies/all_error", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		series, allVals, allTs, err := fetchAllErrorRate(ctx, c, window)
+	// Optional message bus publishing of anomaly events as CloudEvents
+	if kind := getenv("BUS_KIND", ""); kind != "" {
+		var addr, dest string
+		switch kind {
+		case "nats":
+			addr, dest = getenv("NATS_URL", "nats://nats:4222"), getenv("NATS_SUBJECT", "anomalies")
+		case "kafka":
+			addr, dest = getenv("KAFKA_BROKERS", "kafka:9092"), getenv("KAFKA_TOPIC", "anomalies")
+		}
+		pub, err := bus.New(kind, addr, dest)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+			log.Fatalf("bus publisher: %v", err)
 		}
-		results := make([]map[string]any, 0, len(series))
-		for i, s := range series {
-			vals := allVals[i]
-			ts := allTs[i]
-			if len(vals) == 0 {
-				continue
-			}
-			idx, scores := detectAnomalies(vals, 3)
-			// fire events for error rate anomalies per service
-			svc := s.Metric["service_name"]
-			if svc == "" {
-				svc = "unknown"
+		defer pub.Close()
+		sink := newBusSink(pub, svc.source)
+		go sink.run(context.Background())
+		svc.hub.addSink(sink.enqueue)
+		expvar.Publish("bus_queue", expvar.Func(func() any { return len(sink.queue) }))
+		log.Printf("publishing anomaly events to %s %s (%s)", kind, dest, addr)
+	}
+
+	// Optional digest of the stored events pushed to a chat webhook at the
+	// end of every hour or day
+	if u := getenvSecret("REPORT_WEBHOOK_URL"); u.Get() != "" {
+		period := getenv("REPORT_PERIOD", "day")
+		if _, ok := reportPeriods[period]; !ok {
+			log.Fatalf("invalid REPORT_PERIOD %q: hour or day", period)
+		}
+		p := reportPusher{url: u, period: period, client: &http.Client{}}
+		go p.run(context.Background(), svc)
+		log.Printf("pushing the %s anomaly digest to the report webhook", period)
+	}
+
+	// Optional leader election among replicas: only the lease holder scans in
+	// the background and publishes events
+	if kind := getenv("LEADER_ELECTION", ""); kind != "" {
+		id := getenv("LEADER_ID", "")
+		if id == "" {
+			id, _ = os.Hostname()
+		}
+		target := getenv("LEADER_LOCK", "")
+		if target == "" && kind == "kubernetes" {
+			target = "if-service"
+		}
+		if target == "" && kind == "file" {
+			path := getenv("ANOMALY_STORE_PATH", "")
+			if path == "" {
+				log.Fatal("LEADER_ELECTION=file requires LEADER_LOCK or ANOMALY_STORE_PATH")
 			}
-			logAnomalyEvents(svc, "error_rate", idx, scores, threshold)
-			top := make([]map[string]any, 0, len(idx))
-			for _, j := range idx {
-				top = append(top, map[string]any{
-					"time":  ts[j].Format(time.RFC3339),
-					"value": vals[j],
-					"score": scores[j],
-				})
+			target = path + ".lock"
+		}
+		ttl := 15 * time.Second
+		if v := getenv("LEADER_LEASE", ""); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 3*time.Second {
+				log.Fatalf("invalid LEADER_LEASE %q", v)
 			}
-			labels := map[string]string{
-				"service_name": s.Metric["service_name"],
-				"span_name":    s.Metric["span_name"],
-				"peer_service": s.Metric["peer_service"],
+			ttl = d
+		}
+		lock, err := leader.New(kind, target, id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		svc.leader = leader.NewElector(lock, ttl)
+		// release the lease on shutdown so another replica takes over at once
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			svc.leader.Run(shutdown)
+		}()
+		expvar.Publish("leader", expvar.Func(func() any { return svc.leader.Leading() }))
+		log.Printf("leader election (%s) on %s as %s", kind, target, id)
+	}
+	if len(clusters) > 0 {
+		svc.clusterScans = map[string]*service{}
+		for _, cl := range clusters {
+			svc.clusterNames = append(svc.clusterNames, cl.Name)
+			if cl.Name != svc.cluster {
+				svc.clusterScans[cl.Name] = svc.clusterScan(cl.Name, cl.client(c))
 			}
-			results = append(results, map[string]any{
-				"labels": labels,
-				"points": len(vals),
-				"top":    top,
-			})
-		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"windowMinutes": window,
-			"series":        len(results),
-			"results":       results,
-			"metric":        "error_rate",
-		})
-	})
+		}
+		log.Printf("clusters: %s (background scans cover %s)", strings.Join(svc.clusterNames, ", "), svc.cluster)
+	}
+
+	// Optional background scanning feeds stream subscribers without polling.
+	// SCAN_INTERVAL_<METRIC> overrides SCAN_INTERVAL per metric; 0 disables.
+	parseInterval := func(k string) time.Duration {
+		v := getenv(k, "")
+		if v == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid %s %q", k, v)
+		}
+		return d
+	}
+	baseInterval := parseInterval("SCAN_INTERVAL")
+	// random delay before each metric's first scan
+	jitter := parseInterval("SCAN_JITTER")
+	metrics := make([]string, 0, len(fetchers))
+	for metric := range fetchers {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	if getenv("SCAN_EDGES", "") == "true" {
+		metrics = append(metrics, "edge_error_rate", "edge_rps")
+	}
+	for _, metric := range metrics {
+		interval := baseInterval
+		if k := "SCAN_INTERVAL_" + strings.ToUpper(metric); getenv(k, "") != "" {
+			interval = parseInterval(k)
+		}
+		if interval <= 0 {
+			continue
+		}
+		log.Printf("background scan of %s every %s", metric, interval)
+		go svc.schedule(shutdown, metric, interval, jitter)
+	}
+
+	grpcAddr := getenv("IF_GRPC_LISTEN_ADDR", ":9031")
+	go func() {
+		log.Printf("isolation-forest gRPC service listening on %s", grpcAddr)
+		if err := serveGRPC(grpcAddr, svc, tlsConfig); err != nil {
+			log.Fatalf("grpc server error: %v", err)
+		}
+	}()
 
 	addr := getenv("IF_LISTEN_ADDR", ":9030")
-	log.Printf("isolation-forest service listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	srv := &http.Server{Addr: addr, Handler: withRequestID(compress.Handler(mux)), TLSConfig: tlsConfig}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			log.Printf("isolation-forest service listening on %s with TLS (client certificates required: %t)", addr, tlsConfig.ClientCAs != nil)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("isolation-forest service listening on %s", addr)
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-shutdown.Done()
+	// a second signal kills the process without waiting
+	stop()
+	log.Printf("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("http server shutdown: %v", err)
+	}
+	background.Wait()
+	if err := st.Close(); err != nil {
+		log.Printf("close anomaly store: %v", err)
+	}
+	if local != nil {
+		if err := local.Close(); err != nil {
+			log.Printf("close local store: %v", err)
+		}
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// normalizations are the ways a series is scaled before it is scored, set
+// by NORMALIZATION and NORMALIZATION_<METRIC>: by its mean and standard
+// deviation (zscore), its median and median absolute deviation (mad), the
+// mean and standard deviation of its values clipped to their 5th and 95th
+// percentiles (winsorized), or not at all.
+//
+// The forest draws splits uniformly between the extremes of its training
+// points, so the scale does not change univariate scores. It sets the
+// center and unit of the sigma in explanations, which the outliers being
+// explained inflate less with the robust strategies.
+var normalizations = []string{"zscore", "mad", "winsorized", "none"}
+
+// winsorQuantile is the share of points winsorized clips at each end.
+const winsorQuantile = 0.05
+
+// scaler normalizes the values of one series.
+type scaler struct {
+	center, scale float64
+}
+
+// newScaler returns the scaler of method for the window vals.
+func newScaler(method string, vals []float64) scaler {
+	switch method {
+	case "none":
+		return scaler{center: 0, scale: 1}
+	case "mad":
+		sorted := slices.Clone(vals)
+		slices.Sort(sorted)
+		med := quantileSorted(sorted, 0.5)
+		dev := make([]float64, len(vals))
+		for i, v := range vals {
+			dev[i] = math.Abs(v - med)
+		}
+		slices.Sort(dev)
+		// 1.4826 MAD estimates the standard deviation of normal data
+		scale := 1.4826 * quantileSorted(dev, 0.5)
+		if scale == 0 {
+			// mostly constant, e.g. error rates of 0 with a few errors
+			_, scale = meanStd(vals)
+		}
+		return scaler{center: med, scale: scale + 1e-9}
+	case "winsorized":
+		sorted := slices.Clone(vals)
+		slices.Sort(sorted)
+		lo, hi := quantileSorted(sorted, winsorQuantile), quantileSorted(sorted, 1-winsorQuantile)
+		clipped := make([]float64, len(vals))
+		for i, v := range vals {
+			clipped[i] = math.Min(math.Max(v, lo), hi)
+		}
+		mu, sd := meanStd(clipped)
+		return scaler{center: mu, scale: sd + 1e-9}
+	default:
+		mu, sd := meanStd(vals)
+		return scaler{center: mu, scale: sd + 1e-9}
+	}
+}
+
+// apply normalizes v.
+func (sc scaler) apply(v float64) float64 {
+	return (v - sc.center) / sc.scale
+}
+
+// quantileSorted returns the q quantile of sorted, interpolating between
+// neighbours; 0 when empty.
+func quantileSorted(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := q * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (pos-float64(i))*(sorted[i+1]-sorted[i])
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// openAPISpec builds the OpenAPI 3.0 document of ops.
+func openAPISpec(ops []apiOperation) map[string]any {
+	g := schemaGen{defs: map[string]any{}}
+	paths := map[string]any{}
+	for _, op := range ops {
+		params := []any{}
+		for _, p := range op.Params {
+			params = append(params, map[string]any{
+				"name": p.Name, "in": "query", "required": p.Required,
+				"description": p.Description, "schema": map[string]any{"type": p.Type},
+			})
+		}
+		ct := op.ContentType
+		if ct == "" {
+			ct = "application/json"
+		}
+		get := map[string]any{
+			"summary":     op.Summary,
+			"description": op.Description,
+			"parameters":  params,
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "OK",
+					"content":     map[string]any{ct: map[string]any{"schema": g.schema(reflect.TypeOf(op.Response))}},
+				},
+				"default": map[string]any{
+					"description": "Error",
+					"content":     map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+				},
+			},
+		}
+		paths[op.Path] = map[string]any{"get": get}
+		if op.Legacy != "" {
+			alias := map[string]any{"deprecated": true, "description": "Deprecated alias of " + op.Path + "."}
+			for k, v := range get {
+				if k != "description" {
+					alias[k] = v
+				}
+			}
+			paths[op.Legacy] = map[string]any{"get": alias}
+		}
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "if-service",
+			"version":     "1.0.0",
+			"description": "Isolation forest anomaly detection on spanmetrics",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": g.defs},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaGen derives JSON schemas from Go types. Named structs become
+// component schemas referenced by $ref.
+type schemaGen struct {
+	defs map[string]any
+}
+
+func (g schemaGen) schema(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		return g.schema(t.Elem())
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name := t.Name()
+		if _, done := g.defs[name]; !done {
+			g.defs[name] = nil // break cycles
+			g.defs[name] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.object(t)
+	}
+	return map[string]any{}
+}
+
+// object describes a struct the way encoding/json marshals it: json tag
+// names, embedded structs inlined, omitempty fields optional.
+func (g schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	return map[string]any{"type": "object", "properties": props, "required": required}
+}
+
+// handleOpenAPI serves the spec of ops, built once.
+func handleOpenAPI(ops []apiOperation) http.HandlerFunc {
+	spec, err := json.Marshal(openAPISpec(ops))
+	if err != nil {
+		panic(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(spec)
+	}
+}
+
+// swaggerFiles are the Swagger UI assets served under /docs/, vendored from
+// swagger-ui-dist (see swaggerui/README.md) so the page needs no internet
+// access.
+//
+//go:embed swaggerui/*.css swaggerui/*.js
+var swaggerFiles embed.FS
+
+// swaggerUI renders /openapi.json with the embedded Swagger UI.
+const swaggerUI = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>if-service API</title>
+<link rel="stylesheet" href="/docs/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="/docs/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+func handleSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(swaggerUI))
+}
+
+// handleSwaggerAssets serves the Swagger UI assets, and the page at /docs/
+// rather than a listing of them.
+func handleSwaggerAssets() http.Handler {
+	static, _ := fs.Sub(swaggerFiles, "swaggerui")
+	assets := http.StripPrefix("/docs/", http.FileServer(http.FS(static)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/docs/" {
+			handleSwaggerUI(w, r)
+			return
+		}
+		assets.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"ifservice/internal/bus"
+	"ifservice/internal/event"
+	"ifservice/internal/store"
+)
+
+// busSink publishes anomaly events to a message bus from its own goroutine so
+// a slow broker never stalls detection.
+type busSink struct {
+	pub    bus.Publisher
+	source string
+	queue  chan store.Event
+}
+
+func newBusSink(pub bus.Publisher, source string) *busSink {
+	return &busSink{pub: pub, source: source, queue: make(chan store.Event, 256)}
+}
+
+// enqueue hands ev to the publisher, dropping it when the queue is full.
+func (b *busSink) enqueue(ev store.Event) {
+	select {
+	case b.queue <- ev:
+	default:
+		log.Printf("bus queue full, dropping anomaly event %d", ev.ID)
+	}
+}
+
+func (b *busSink) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-b.queue:
+			payload, err := json.Marshal(event.New(b.source, ev.ID, ev.Anomaly))
+			if err != nil {
+				log.Printf("encode anomaly event %d: %v", ev.ID, err)
+				continue
+			}
+			pctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := b.pub.Publish(pctx, ev.Labels["service_name"], payload); err != nil {
+				log.Printf("publish anomaly event %d: %v", ev.ID, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// logSink writes the text form of every stored event to the log.
+func logSink(source string) func(store.Event) {
+	return func(ev store.Event) {
+		log.Print(event.New(source, ev.ID, ev.Anomaly).LogLine())
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults of rangeLimits, the same for the anomaly service and the MCP
+// server: eight weeks, the longest seasonality profile of the MCP tools,
+// and the most points per series Prometheus returns for a range query.
+const (
+	defaultMaxWindowMinutes = 8 * 7 * 24 * 60
+	defaultMaxPoints        = 11000
+)
+
+// rangeLimits bound the time range of queries: maxWindow its length and
+// maxPoints the points per series of range queries.
+type rangeLimits struct {
+	maxWindow time.Duration
+	maxPoints int
+}
+
+// check returns an error suggesting the allowed ranges when a query over
+// window, evaluated every step or once when step is 0, exceeds l.
+func (l rangeLimits) check(window, step time.Duration) error {
+	if window > l.maxWindow {
+		return fmt.Errorf("a time range of %d minutes exceeds the maximum of %d minutes", int(window.Minutes()), int(l.maxWindow.Minutes()))
+	}
+	if step <= 0 {
+		return nil
+	}
+	if points := int(window/step) + 1; points > l.maxPoints {
+		maxMinutes := int((time.Duration(l.maxPoints-1) * step).Minutes())
+		minStep := (window/time.Duration(l.maxPoints-1) + time.Second - 1).Truncate(time.Second)
+		return fmt.Errorf("a time range of %d minutes at a %s step is %d points per series, more than the maximum of %d: use at most %d minutes at this step, or a step of at least %s",
+			int(window.Minutes()), step, points, l.maxPoints, maxMinutes, minStep)
+	}
+	return nil
+}
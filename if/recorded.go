@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// recordedMetrics name recording rules pre-aggregating the spanmetrics,
+// read instead of the raw metrics when set so that scans don't match every
+// calls series by __name__ regex. Each is a per-second rate over 5m of
+// server spans summed by groupLabels: all calls, failed calls, and latency
+// buckets in milliseconds, also by le. GET /api/v1/rules renders the rules.
+type recordedMetrics struct {
+	rate, errors, latency string
+}
+
+// recorded is set from RECORDED_RATE_METRIC, RECORDED_ERROR_METRIC and
+// RECORDED_LATENCY_METRIC; empty names read the raw metrics.
+var recorded recordedMetrics
+
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// callsSelector selects the calls series of server spans, or their recorded
+// rate, narrowed by matchers, empty or starting with a comma.
+func callsSelector(matchers string) string {
+	if recorded.rate != "" {
+		return `{__name__="` + recorded.rate + `"` + matchers + `}`
+	}
+	return `{__name__=~"` + metricRegex + `", span_kind="SPAN_KIND_SERVER"` + matchers + `}`
+}
+
+// callsRate is the per-second rate of server span calls selected by
+// matchers.
+func callsRate(matchers string) string {
+	if recorded.rate != "" {
+		return callsSelector(matchers)
+	}
+	return `rate(` + callsSelector(matchers) + `[5m])`
+}
+
+// errorsRate is the per-second rate of failed server span calls selected by
+// matchers.
+func errorsRate(matchers string) string {
+	if recorded.errors != "" {
+		return `{__name__="` + recorded.errors + `"` + matchers + `}`
+	}
+	return `rate({__name__=~"` + metricRegex + `", span_kind="SPAN_KIND_SERVER", status_code="STATUS_CODE_ERROR"` + matchers + `}[5m])`
+}
+
+// queryModes are how rps and error_rate are queried, set by QUERY_MODE and
+// QUERY_MODE_<METRIC>: as rates over 5m, or as the calls counted in each
+// step, which a short spike changes as much as a whole step's worth instead
+// of a fifth of it when the step is a minute.
+var queryModes = []string{"rate", "increase"}
+
+// increaseMetrics are the metrics queried as counts per step.
+var increaseMetrics = map[string]bool{}
+
+// queryMode returns the query mode of metric.
+func queryMode(metric string) string {
+	if increaseMetrics[metric] {
+		return "increase"
+	}
+	return "rate"
+}
+
+// stepRange is step as a PromQL range selector, covering the samples of
+// one step of a range query.
+func stepRange(step time.Duration) string {
+	return fmt.Sprintf("[%ds]", max(int(step.Seconds()), 1))
+}
+
+// callsExpr is the calls of server spans selected by matchers, per second
+// or, when metric is queried in increase mode, per step. Recording rules
+// hold 5m rates, so counts read the raw metrics.
+func callsExpr(metric, matchers string, step time.Duration) string {
+	if !increaseMetrics[metric] {
+		return callsRate(matchers)
+	}
+	return `increase({__name__=~"` + metricRegex + `", span_kind="SPAN_KIND_SERVER"` + matchers + `}` + stepRange(step) + `)`
+}
+
+// errorsExpr is the failed calls of server spans like callsExpr.
+func errorsExpr(metric, matchers string, step time.Duration) string {
+	if !increaseMetrics[metric] {
+		return errorsRate(matchers)
+	}
+	return `increase({__name__=~"` + metricRegex + `", span_kind="SPAN_KIND_SERVER", status_code="STATUS_CODE_ERROR"` + matchers + `}` + stepRange(step) + `)`
+}
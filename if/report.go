@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"ifservice/internal/event"
+	"ifservice/internal/secret"
+	"ifservice/internal/store"
+)
+
+// reportPeriods are the periods a digest covers.
+var reportPeriods = map[string]time.Duration{"hour": time.Hour, "day": 24 * time.Hour}
+
+// digest summarizes the stored anomaly events of a period per service, with
+// the counts of the period before for trends.
+type digest struct {
+	Period   string
+	From, To time.Time
+	Events   int
+	Previous int
+	Services []digestService
+}
+
+type digestService struct {
+	Service  string
+	Events   int
+	Previous int
+	Critical int
+	MaxScore float64
+	Metrics  []digestMetric
+	// Top is the series with the most events.
+	Top       string
+	TopEvents int
+}
+
+type digestMetric struct {
+	Metric   string
+	Events   int
+	Previous int
+}
+
+// Trend is the change of the count against the period before.
+func (s digestService) Trend() string { return trend(s.Events, s.Previous) }
+
+func (m digestMetric) Trend() string { return trend(m.Events, m.Previous) }
+
+func (d digest) Trend() string { return trend(d.Events, d.Previous) }
+
+func trend(n, prev int) string {
+	switch {
+	case n == prev:
+		return "="
+	case prev == 0:
+		return fmt.Sprintf("+%d (new)", n)
+	default:
+		return fmt.Sprintf("%+d (%+.0f%%)", n-prev, 100*float64(n-prev)/float64(prev))
+	}
+}
+
+// digest builds the digest of the period ending at to.
+func (s *service) digest(period string, to time.Time) digest {
+	d := reportPeriods[period]
+	from, prevFrom := to.Add(-d), to.Add(-2*d)
+	out := digest{Period: period, From: from.UTC(), To: to.UTC()}
+	type series struct {
+		svc, subject string
+	}
+	services := map[string]*digestService{}
+	metrics := map[string]map[string]*digestMetric{}
+	bySeries := map[series]int{}
+	get := func(name string) *digestService {
+		ds := services[name]
+		if ds == nil {
+			ds = &digestService{Service: name}
+			services[name] = ds
+			metrics[name] = map[string]*digestMetric{}
+		}
+		return ds
+	}
+	getMetric := func(svc, name string) *digestMetric {
+		m := metrics[svc][name]
+		if m == nil {
+			m = &digestMetric{Metric: name}
+			metrics[svc][name] = m
+		}
+		return m
+	}
+	events := s.hub.store.Find(func(ev store.Event) bool {
+		return !ev.Time.Before(prevFrom) && ev.Time.Before(to)
+	}, math.MaxInt)
+	for _, ev := range events {
+		name := ev.Labels["service_name"]
+		if ev.Level == levelEdge {
+			// edges count towards their server
+			name = ev.Labels["server"]
+		}
+		ds := get(name)
+		m := getMetric(name, ev.Metric)
+		if ev.Time.Before(from) {
+			out.Previous++
+			ds.Previous++
+			m.Previous++
+			continue
+		}
+		out.Events++
+		ds.Events++
+		m.Events++
+		if s.eventSeverity(ev) == "critical" {
+			ds.Critical++
+		}
+		ds.MaxScore = max(ds.MaxScore, ev.Score)
+		k := series{name, ev.Metric + " " + event.Subject(ev.Labels)}
+		bySeries[k]++
+		if n := bySeries[k]; n > ds.TopEvents || (n == ds.TopEvents && k.subject < ds.Top) {
+			ds.Top, ds.TopEvents = k.subject, n
+		}
+	}
+	for name, ds := range services {
+		for _, m := range metrics[name] {
+			ds.Metrics = append(ds.Metrics, *m)
+		}
+		sort.Slice(ds.Metrics, func(i, j int) bool { return ds.Metrics[i].Metric < ds.Metrics[j].Metric })
+		out.Services = append(out.Services, *ds)
+	}
+	// most anomalous first; services quiet in both periods are not listed
+	sort.Slice(out.Services, func(i, j int) bool {
+		a, b := out.Services[i], out.Services[j]
+		if a.Events != b.Events {
+			return a.Events > b.Events
+		}
+		return a.Service < b.Service
+	})
+	return out
+}
+
+// markdown renders d as a markdown report.
+func (d digest) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Anomaly digest, %s to %s\n\n", d.From.Format(time.RFC3339), d.To.Format(time.RFC3339))
+	fmt.Fprintf(&b, "%d anomaly events in the last %s, %s against the %s before.\n", d.Events, d.Period, d.Trend(), d.Period)
+	for _, s := range d.Services {
+		name := s.Service
+		if name == "" {
+			name = "(no service)"
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", name)
+		fmt.Fprintf(&b, "%d events (%s), %d critical", s.Events, s.Trend(), s.Critical)
+		if s.Events > 0 {
+			fmt.Fprintf(&b, ", max score %.3f", s.MaxScore)
+		}
+		b.WriteString(".\n\n| Metric | Events | Previous | Trend |\n|---|---:|---:|---|\n")
+		for _, m := range s.Metrics {
+			fmt.Fprintf(&b, "| %s | %d | %d | %s |\n", m.Metric, m.Events, m.Previous, m.Trend())
+		}
+		if s.Top != "" {
+			fmt.Fprintf(&b, "\nMost anomalous series: `%s` (%d events)\n", s.Top, s.TopEvents)
+		}
+	}
+	return b.String()
+}
+
+var reportHTML = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Anomaly digest</title>
+<style>body{font-family:sans-serif;margin:2em}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:.2em .6em}td.n{text-align:right}</style>
+</head><body>
+<h1>Anomaly digest, {{.From.Format "2006-01-02T15:04:05Z07:00"}} to {{.To.Format "2006-01-02T15:04:05Z07:00"}}</h1>
+<p>{{.Events}} anomaly events in the last {{.Period}}, {{.Trend}} against the {{.Period}} before.</p>
+{{range .Services}}
+<h2>{{if .Service}}{{.Service}}{{else}}(no service){{end}}</h2>
+<p>{{.Events}} events ({{.Trend}}), {{.Critical}} critical{{if .Events}}, max score {{printf "%.3f" .MaxScore}}{{end}}.</p>
+<table><tr><th>Metric</th><th>Events</th><th>Previous</th><th>Trend</th></tr>
+{{range .Metrics}}<tr><td>{{.Metric}}</td><td class="n">{{.Events}}</td><td class="n">{{.Previous}}</td><td>{{.Trend}}</td></tr>
+{{end}}</table>
+{{if .Top}}<p>Most anomalous series: <code>{{.Top}}</code> ({{.TopEvents}} events)</p>{{end}}
+{{end}}
+</body></html>
+`))
+
+// handleReport serves the digest of the last hour or day as markdown or
+// HTML.
+func (s *service) handleReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	period := q.Get("period")
+	if period == "" {
+		period = "day"
+	}
+	if _, ok := reportPeriods[period]; !ok {
+		http.Error(w, "invalid period: hour or day", http.StatusBadRequest)
+		return
+	}
+	d := s.digest(period, time.Now())
+	switch q.Get("format") {
+	case "", "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		_, _ = w.Write([]byte(d.markdown()))
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = reportHTML.Execute(w, d)
+	default:
+		http.Error(w, "invalid format: markdown or html", http.StatusBadRequest)
+	}
+}
+
+// reportPusher posts the digest of each period, when it ends, to a webhook
+// as {"text": markdown}, the payload of Slack and Mattermost incoming
+// webhooks.
+type reportPusher struct {
+	url    secret.Secret
+	period string
+	client *http.Client
+}
+
+// run pushes a digest at every period boundary until ctx is done. Only the
+// leader pushes, like it publishes events.
+func (p reportPusher) run(ctx context.Context, s *service) {
+	d := reportPeriods[p.period]
+	for {
+		next := time.Now().Truncate(d).Add(d)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		if !s.leader.Leading() {
+			continue
+		}
+		if err := p.push(ctx, s.digest(p.period, next)); err != nil {
+			log.Printf("report webhook: %v", err)
+		}
+	}
+}
+
+func (p reportPusher) push(ctx context.Context, d digest) error {
+	body, err := json.Marshal(map[string]string{"text": d.markdown()})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url.Get(), bytes.NewReader(body))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}
+
+// withoutURL strips the URL from the error of a request to a URL that is a
+// secret itself, like those of chat webhooks, so it stays out of the log.
+func withoutURL(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return fmt.Errorf("%s: %w", ue.Op, ue.Err)
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	mimir "ifservice/internal/mimir"
+)
+
+// requestID returns id when it is a valid request ID, e.g. the caller's
+// X-Request-ID, else a new one.
+func requestID(id string) string {
+	if mimir.ValidRequestID(id) {
+		return id
+	}
+	return mimir.NewRequestID()
+}
+
+// withRequestID gives each request the caller's X-Request-ID, e.g. that of
+// the MCP tool call, or a new one, sends it on to Mimir with the scan's
+// queries and returns it in the response header, errors included.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r.Header.Get("X-Request-ID"))
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(mimir.WithRequestID(r.Context(), id)))
+	})
+}
+
+// requestIDInterceptor does for unary gRPC calls what withRequestID does
+// for HTTP requests, with the x-request-id metadata.
+func requestIDInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-request-id"); len(v) > 0 {
+			id = v[0]
+		}
+	}
+	id = requestID(id)
+	_ = grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	return handler(mimir.WithRequestID(ctx, id), req)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scoreMetrics export the latest score of every scanned series on /metrics,
+// so that scraped and remote-written to Mimir they can drive ruler alerts.
+// Series are labelled with metric and the group labels.
+type scoreMetrics struct {
+	score, threshold *prometheus.GaugeVec
+}
+
+func newScoreMetrics(labels []string) *scoreMetrics {
+	labels = append([]string{"metric"}, labels...)
+	m := &scoreMetrics{
+		score: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "anomaly_score",
+			Help: "Isolation forest score of the last point of the series in the latest scan.",
+		}, labels),
+		threshold: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "anomaly_score_threshold",
+			Help: "Score from which points of the series are anomalies.",
+		}, labels),
+	}
+	prometheus.MustRegister(m.score, m.threshold)
+	return m
+}
+
+// exportScores replaces the exported scores of metric with those of a
+// scan's results. Only the leader exports, like it publishes events.
+func (s *service) exportScores(metric string, results []seriesResult) {
+	if s.scores == nil || !s.leader.Leading() {
+		return
+	}
+	s.scores.score.DeletePartialMatch(prometheus.Labels{"metric": metric})
+	s.scores.threshold.DeletePartialMatch(prometheus.Labels{"metric": metric})
+	for _, res := range results {
+		if !res.Reliable || res.Points == 0 {
+			continue
+		}
+		labels := prometheus.Labels{"metric": metric}
+		for _, k := range groupLabels {
+			labels[k] = res.Labels[k]
+		}
+		s.scores.score.With(labels).Set(res.Latest)
+		s.scores.threshold.With(labels).Set(res.Threshold)
+	}
+}
+
+// ruleGroups renders ruler rule groups over the exported scores: recording
+// rules aggregating them and a warning and a critical alert. With a
+// namespace the file is in the mimirtool format, else a plain Prometheus
+// rule file.
+func (s *service) ruleGroups(namespace string) string {
+	var b strings.Builder
+	if namespace != "" {
+		fmt.Fprintf(&b, "namespace: %s\n", strconv.Quote(namespace))
+	}
+	by := "metric"
+	record := "anomaly_score:max"
+	if slices.Contains(groupLabels, "service_name") {
+		by, record = "service_name, metric", "service_name:anomaly_score:max"
+	}
+	var ident []string
+	for _, k := range groupLabels {
+		ident = append(ident, fmt.Sprintf("%s={{ $labels.%s }}", k, k))
+	}
+	summary := fmt.Sprintf("Anomalous {{ $labels.metric }} of %s", strings.Join(ident, " "))
+	description := fmt.Sprintf("Isolation forest score {{ printf \"%%.2f\" $value }} over the last %d minutes.", s.window)
+	critical := strconv.FormatFloat(s.criticalScore, 'g', -1, 64)
+
+	b.WriteString("groups:\n")
+	if pre := preaggregationRules(); pre != "" {
+		b.WriteString("  - name: if-service-preaggregation\n    rules:\n")
+		b.WriteString(pre)
+	}
+	b.WriteString("  - name: if-service-recording\n    rules:\n")
+	fmt.Fprintf(&b, "      - record: %s\n        expr: %s\n", record, strconv.Quote(fmt.Sprintf("max by (%s) (anomaly_score)", by)))
+	fmt.Fprintf(&b, "      - record: anomaly_score:threshold_ratio\n        expr: %s\n", strconv.Quote("anomaly_score / anomaly_score_threshold"))
+	b.WriteString("  - name: if-service-alerts\n    rules:\n")
+	for _, a := range []struct{ name, severity, expr string }{
+		{"AnomalyWarning", "warning", "(anomaly_score >= anomaly_score_threshold) < " + critical},
+		{"AnomalyCritical", "critical", "(anomaly_score >= anomaly_score_threshold) >= " + critical},
+	} {
+		fmt.Fprintf(&b, "      - alert: %s\n        expr: %s\n", a.name, strconv.Quote(a.expr))
+		fmt.Fprintf(&b, "        labels:\n          severity: %s\n", a.severity)
+		fmt.Fprintf(&b, "        annotations:\n          summary: %s\n          description: %s\n", strconv.Quote(summary), strconv.Quote(description))
+	}
+	return b.String()
+}
+
+// preaggregationRules renders the recording rules of the configured
+// recorded metrics, computed from the raw spanmetrics.
+func preaggregationRules() string {
+	var b strings.Builder
+	by := groupBy()
+	for _, r := range []struct{ record, expr string }{
+		{recorded.rate, fmt.Sprintf(`sum by (%s) (rate({__name__=~"%s", span_kind="SPAN_KIND_SERVER"}[5m]))`, by, metricRegex)},
+		{recorded.errors, fmt.Sprintf(`sum by (%s) (rate({__name__=~"%s", span_kind="SPAN_KIND_SERVER", status_code="STATUS_CODE_ERROR"}[5m]))`, by, metricRegex)},
+		{recorded.latency, fmt.Sprintf(`sum by (%s, le) (rate({__name__=~"%s", span_kind="SPAN_KIND_SERVER"}[5m]))`, by, strings.Join(latencyBucketsMs, "|"))},
+	} {
+		if r.record != "" {
+			fmt.Fprintf(&b, "      - record: %s\n        expr: %s\n", r.record, strconv.Quote(r.expr))
+		}
+	}
+	return b.String()
+}
+
+// handleRules serves the rule groups as YAML, for GitOps repositories of
+// ruler rules.
+func (s *service) handleRules(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	switch r.URL.Query().Get("format") {
+	case "", "mimir":
+		if namespace == "" {
+			namespace = "if-service"
+		}
+	case "prometheus":
+		namespace = ""
+	default:
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write([]byte(s.ruleGroups(namespace)))
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"ifservice/internal/event"
+	"ifservice/internal/kube"
+	"ifservice/internal/leader"
+	mimir "ifservice/internal/mimir"
+	"ifservice/internal/promresult"
+	"ifservice/internal/store"
+
+	"github.com/arijanluiken/mcp/if/iforest"
+)
+
+// fetchFunc pulls all series of one metric over the grid, at the grid step.
+// matchers, empty or starting with a comma, are added to every selector, and
+// series are summed by the comma separated labels by.
+type fetchFunc func(ctx context.Context, c *mimir.Client, g promresult.Grid, by, matchers string) ([]promresult.Series, error)
+
+// fetchers maps the metric name used in responses and events to its fetch function.
+var fetchers = map[string]fetchFunc{
+	"rps":         fetchAllRPS,
+	"error_rate":  fetchAllErrorRate,
+	"latency_p95": fetchAllLatency,
+}
+
+// seriesExprs builds the single-series PromQL of a metric from label matchers,
+// for links back to the data an event was detected on.
+var seriesExprs = map[string]func(matchers string, step time.Duration) string{
+	"rps": func(m string, step time.Duration) string {
+		return `sum(` + callsExpr("rps", ", "+m, step) + `)`
+	},
+	"error_rate": func(m string, step time.Duration) string {
+		return `sum(` + errorsExpr("error_rate", ", "+m, step) + `) / sum(` + callsExpr("error_rate", ", "+m, step) + `)`
+	},
+	"latency_p95": func(m string, _ time.Duration) string {
+		latencyMu.Lock()
+		lm := latencyCached
+		latencyMu.Unlock()
+		if !lm.found {
+			return ""
+		}
+		return latencyExpr(lm, "", ", "+m)
+	},
+}
+
+// service holds the detector state shared by the HTTP and gRPC APIs.
+type service struct {
+	c      *mimir.Client
+	window int
+	step   time.Duration
+	// limits bound the windows requests ask for
+	limits    rangeLimits
+	threshold float64
+	// contamination, when positive, is the expected share of anomalous
+	// points; each series' threshold is then the matching quantile of its
+	// window's scores rather than threshold
+	contamination float64
+	// maxPValue, when positive, replaces threshold: points with a
+	// calibrated p-value at or below it are anomalies
+	maxPValue float64
+	calib     *calibrator
+	// criticalScore is the score from which events are critical rather
+	// than warnings
+	criticalScore float64
+	// referenceRPS, when positive, is the request rate from which events
+	// get their full score's severity, see trafficWeight
+	referenceRPS float64
+	traffic      *traffic
+	// quiet, when set, raises the score threshold in low-traffic hours
+	quiet       *quietHours
+	maxGapRatio float64
+	hub         *hub
+	// windows caches fetched series between scans; nil fetches every window
+	// in full
+	windows *windowCache
+	// trainMaxPoints and trainAgg bound the forest's training set, see
+	// downsample
+	trainMaxPoints int
+	trainAgg       string
+	// forest configures the isolation forest of every series
+	forest iforest.Options
+	// normalization is the normalization of the series of each metric
+	normalization map[string]string
+	// direction is the direction of deviations that are anomalies, per
+	// metric; a metric without one has both
+	direction map[string]direction
+	// sustain is how many points around an anomaly must be anomalous for
+	// an event of each severity
+	sustain map[string]sustain
+	// scopes are the named scopes of SCOPES_FILE, and scope the name of
+	// the one whose settings a copy has, see scopeFor
+	scopes []*scope
+	scope  string
+	// aggregates enables detection on the service-level aggregate of each
+	// service's series, see levelService
+	aggregates bool
+	// pageSize is the number of services fetched per query in streaming
+	// mode; 0 fetches all series at once
+	pageSize int
+	// leader, when set, limits background scans and event publishing to
+	// the replica holding the lease
+	leader *leader.Elector
+	// maxSeries, when positive, caps the series a scan may fetch, checked
+	// by a count query first; above it the scan fails, or with
+	// partialSeries skips the largest services
+	maxSeries         int
+	partialSeries     bool
+	source            string
+	grafanaURL        string
+	grafanaDatasource string
+	// deploys are the known deployments; events get the latest of their
+	// service within deployLookback
+	deploys        *deployments
+	deployLookback time.Duration
+	// kube, when set, enriches events with the service's workload
+	kube *kube.Client
+	// scores, when set, exports the latest score of each series
+	scores *scoreMetrics
+	// cluster, when set, labels results and events; clusterScans scan the
+	// other clusters of clusterNames, see scanClusters
+	cluster      string
+	clusterNames []string
+	clusterScans map[string]*service
+}
+
+// topPoint is one of the most anomalous points of a series.
+type topPoint struct {
+	// Index is the position of the point in the cleaned series.
+	Index       int
+	Time        time.Time
+	Value       float64
+	Score       float64
+	PValue      float64
+	Explanation event.Explanation
+	// RunLength is the number of consecutive anomalous points of the run
+	// the point is part of.
+	RunLength int
+	// Related are the labels of the series of the other level anomalous at
+	// the same time, see link.
+	Related []map[string]string
+}
+
+// seriesResult is the detection outcome for one series.
+type seriesResult struct {
+	Labels map[string]string
+	// Level is levelSpan, or levelService for the aggregate of a service.
+	Level string
+	// Scope is the scope whose settings the series was scored with, if any.
+	Scope  string
+	Points int
+	// Missing steps filled by interpolation before scoring.
+	Missing int
+	// Reliable is false when too many steps were missing to score the series.
+	Reliable bool
+	// Sparkline summarizes the cleaned series; nil when it was not scored.
+	Sparkline *event.Sparkline
+	// Threshold is the score from which points are anomalies: the fixed
+	// threshold, or derived from the window's scores with a contamination.
+	Threshold float64
+	// Latest is the score of the last point, exported as anomaly_score.
+	Latest float64
+	Top    []topPoint
+	// center is the value the series' points deviate from, and anomalous
+	// tells which of its points, at times, are anomalies, see markAnomalous.
+	center    float64
+	anomalous []bool
+	times     []time.Time
+}
+
+// quietKey marks the context of a scan that publishes no events.
+type quietKey struct{}
+
+// withoutEvents returns ctx for read-only scans: they detect like any other
+// but leave publishing events to the scans of the HTTP endpoints and the
+// scan loop, so clients polling them do not publish the same points again.
+func withoutEvents(ctx context.Context) context.Context {
+	return context.WithValue(ctx, quietKey{}, true)
+}
+
+// publishes reports whether a scan of ctx publishes events.
+func publishes(ctx context.Context) bool {
+	quiet, _ := ctx.Value(quietKey{}).(bool)
+	return !quiet
+}
+
+// scan fetches all series for metric, scores them and publishes events for
+// points crossing the threshold, unless ctx is withoutEvents. With a page size, series are fetched and
+// scored one page of services at a time, so only one page's values are held
+// in memory. A partial scan, cut down to the series limit, also returns
+// what it left out.
+func (s *service) scan(ctx context.Context, metric string) ([]seriesResult, *truncation, error) {
+	if fetch, ok := edgeFetchers[metric]; ok {
+		return s.scanEdges(ctx, metric, fetch)
+	}
+	fetch, ok := fetchers[metric]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown metric: %s", metric)
+	}
+	var services []string
+	var tr *truncation
+	if s.maxSeries > 0 {
+		var err error
+		if services, tr, err = s.limitSeries(ctx, metric); err != nil {
+			return nil, nil, err
+		}
+		if tr != nil {
+			log.Printf("scan %s: %d series exceed MAX_SERIES=%d, skipping %d services request=%s", metric, tr.Series, tr.Limit, len(tr.Skipped), mimir.RequestID(ctx))
+		}
+	}
+	end := time.Now()
+	g := promresult.NewGrid(end.Add(-time.Duration(s.window)*time.Minute), end, s.step)
+	if s.pageSize <= 0 {
+		wc, matchers := s.windows, ""
+		if tr != nil {
+			// the kept services may change between scans, so partial
+			// scans bypass the window cache
+			wc, matchers = nil, serviceMatcher(services)
+		}
+		series, err := wc.fetch(metric, g, func(fg promresult.Grid) ([]promresult.Series, error) {
+			return fetch(ctx, s.c, fg, groupBy(), matchers)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		var aggregates []windowSeries
+		if s.aggregates {
+			aggregates, err = wc.fetch(metric+"/"+levelService, g, func(fg promresult.Grid) ([]promresult.Series, error) {
+				return fetch(ctx, s.c, fg, strings.Join(levelLabels(levelService), ", "), matchers)
+			})
+			if err != nil && !errors.Is(err, errNoData) {
+				return nil, nil, err
+			}
+		}
+		results := s.detect(ctx, metric, g, series, aggregates)
+		s.exportScores(metric, results)
+		return results, tr, nil
+	}
+
+	if s.maxSeries <= 0 {
+		var err error
+		if services, err = fetchServices(ctx, s.c, s.window); err != nil {
+			return nil, nil, err
+		}
+	}
+	var results []seriesResult
+	for i := 0; i < len(services); i += s.pageSize {
+		page := services[i:min(i+s.pageSize, len(services))]
+		series, err := fetch(ctx, s.c, g, groupBy(), serviceMatcher(page))
+		if errors.Is(err, errNoData) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var aggregates []promresult.Series
+		if s.aggregates {
+			aggregates, err = fetch(ctx, s.c, g, strings.Join(levelLabels(levelService), ", "), serviceMatcher(page))
+			if err != nil && !errors.Is(err, errNoData) {
+				return nil, nil, err
+			}
+		}
+		results = append(results, s.detect(ctx, metric, g, alignSeries(series, g), alignSeries(aggregates, g))...)
+	}
+	if len(results) == 0 {
+		return nil, nil, errNoData
+	}
+	s.exportScores(metric, results)
+	return results, tr, nil
+}
+
+// detect scores each series, and the service-level aggregates of their
+// services when fetched, links the two and publishes their anomalies unless
+// ctx is withoutEvents.
+func (s *service) detect(ctx context.Context, metric string, g promresult.Grid, series, aggregates []windowSeries) []seriesResult {
+	results := s.score(metric, levelSpan, g, series)
+	if len(aggregates) > 0 {
+		services := s.score(metric, levelService, g, aggregates)
+		link(results, services)
+		results = append(results, services...)
+	}
+	if !publishes(ctx) {
+		return results
+	}
+	for _, res := range results {
+		s.scoped(res.Scope).emit(metric, res)
+	}
+	return results
+}
+
+// score scores each series of level.
+func (s *service) score(metric, level string, g promresult.Grid, series []windowSeries) []seriesResult {
+	results := make([]seriesResult, 0, len(series))
+	for _, ps := range series {
+		s := s.scopeFor(metric, ps.Labels)
+		res, cl, scores := s.analyze(metric, level, ps, g)
+		if len(cl.Values) == 0 {
+			continue
+		}
+		if metric == "rps" {
+			mu, _ := meanStd(cl.Values)
+			if increaseMetrics[metric] {
+				mu /= g.Step.Seconds()
+			}
+			s.traffic.observe(event.Subject(res.Labels), mu)
+		}
+		if scores != nil {
+			pv := s.calib.pValues(metric+event.Subject(res.Labels), cl.Times, scores)
+			for i := range res.Top {
+				res.Top[i].PValue = pv[res.Top[i].Index]
+			}
+			s.markAnomalous(metric, &res, cl, scores, pv)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// analyze cleans one series of level and scores it when reliable. It
+// returns the cleaned series the forest saw and the score of each of its
+// points, nil when it was not scored.
+func (s *service) analyze(metric, level string, ps windowSeries, g promresult.Grid) (seriesResult, promresult.Cleaned, []float64) {
+	cl := promresult.Clean(ps.Aligned, g)
+	// pick only the key identifying labels to keep payload tidy
+	keys := levelLabels(level)
+	labels := make(map[string]string, len(keys))
+	for _, k := range keys {
+		labels[k] = ps.Labels[k]
+	}
+	if s.cluster != "" {
+		labels["cluster"] = s.cluster
+	}
+	res := seriesResult{Labels: labels, Level: level, Scope: s.scope, Points: len(cl.Values), Missing: cl.Missing, Reliable: cl.MissingRatio() <= s.maxGapRatio}
+	if len(cl.Values) == 0 || !res.Reliable {
+		return res, cl, nil
+	}
+	// top-3 per series, never reporting interpolated points
+	sc := newScaler(s.normalization[metric], cl.Values)
+	idx, scores := detectAnomalies(cl.Values, downsample(cl.Values, s.trainMaxPoints, s.trainAgg), len(cl.Values), s.forest, sc)
+	res.Threshold = s.seriesThreshold(scores)
+	res.Sparkline = sparkline(cl.Times, cl.Values, sparklineBuckets)
+	res.Latest = scores[len(scores)-1]
+	mu, sd := meanStd(cl.Values)
+	if n := s.normalization[metric]; n == "zscore" || n == "none" {
+		// sigma in standard deviations, exactly
+		sc = scaler{center: mu, scale: sd}
+	}
+	res.center = sc.center
+	for _, j := range idx {
+		if len(res.Top) == 3 {
+			break
+		}
+		if cl.Filled[j] {
+			continue
+		}
+		res.Top = append(res.Top, topPoint{Index: j, Time: cl.Times[j], Value: cl.Values[j], Score: scores[j], Explanation: explain(cl.Values, j, mu, sd, sc)})
+	}
+	return res, cl, scores
+}
+
+// explain describes vals[i] against the window vals with mean mu and
+// standard deviation sd, its sigma normalized by sc.
+func explain(vals []float64, i int, mu, sd float64, sc scaler) event.Explanation {
+	e := event.Explanation{Mean: mu, Std: sd}
+	if sd > 0 {
+		e.Sigma = sc.apply(vals[i])
+	}
+	n := 0
+	for _, v := range vals {
+		if v <= vals[i] {
+			n++
+		}
+	}
+	e.Percentile = 100 * float64(n) / float64(len(vals))
+	return e
+}
+
+// sparklineBuckets is the number of buckets of a sparkline.
+const sparklineBuckets = 20
+
+// sparkline summarizes vals at times in up to n buckets of consecutive
+// points, all of them when there are fewer.
+func sparkline(times []time.Time, vals []float64, n int) *event.Sparkline {
+	n = min(n, len(vals))
+	if n == 0 {
+		return nil
+	}
+	sp := &event.Sparkline{Start: times[0], End: times[len(times)-1], Min: make([]float64, n), Mean: make([]float64, n), Max: make([]float64, n)}
+	for b := 0; b < n; b++ {
+		part := vals[b*len(vals)/n : (b+1)*len(vals)/n]
+		mu, _ := meanStd(part)
+		sp.Min[b], sp.Mean[b], sp.Max[b] = slices.Min(part), mu, slices.Max(part)
+	}
+	return sp
+}
+
+// minContaminationThreshold is the lowest derived threshold: isolation
+// forest scores up to 0.5 mean no point stands out, so a window without
+// outliers yields no anomalies whatever the contamination.
+const minContaminationThreshold = 0.5
+
+// seriesThreshold returns the score threshold of a series with the given
+// window scores. With a contamination c it is the (1-c) quantile of the
+// scores, interpolated between ranks, so about c of the points reach it.
+func (s *service) seriesThreshold(scores []float64) float64 {
+	if s.contamination <= 0 || len(scores) == 0 {
+		return s.threshold
+	}
+	sorted := slices.Clone(scores)
+	slices.Sort(sorted)
+	pos := (1 - s.contamination) * float64(len(sorted)-1)
+	lo := int(pos)
+	q := sorted[lo]
+	if lo+1 < len(sorted) {
+		q += (pos - float64(lo)) * (sorted[lo+1] - sorted[lo])
+	}
+	return max(q, minContaminationThreshold)
+}
+
+// anomalous reports whether top point p of a series of metric with the
+// given score threshold crosses it, see anomalousPoint.
+func (s *service) anomalous(metric string, p topPoint, threshold float64) bool {
+	return s.anomalousPoint(metric, p.Time, p.Explanation.Sigma, p.Score, p.PValue, threshold)
+}
+
+// anomalousPoint reports whether a point at t of a series of metric, dev
+// from its center, crosses the series' score threshold, or with calibrated
+// thresholds the p-value limit, in a direction that matters for metric.
+// Within quiet hours it also needs their threshold.
+func (s *service) anomalousPoint(metric string, t time.Time, dev, score, pValue, threshold float64) bool {
+	if !s.direction[metric].matches(dev) {
+		return false
+	}
+	if s.quiet.contains(t) && score < s.quiet.threshold {
+		return false
+	}
+	if s.maxPValue > 0 {
+		return pValue > 0 && pValue <= s.maxPValue
+	}
+	return score >= threshold
+}
+
+// emit publishes one event per anomalous top point of res.
+func (s *service) emit(metric string, res seriesResult) {
+	if !s.leader.Leading() {
+		// the leader publishes; followers only answer queries
+		return
+	}
+	for _, p := range res.Top {
+		if !s.anomalous(metric, p, res.Threshold) {
+			continue
+		}
+		severity, sustained := s.sustainedSeverity(s.severity(p.Score*s.trafficWeight(res.Labels)), res.anomalous, p.Index)
+		if !sustained {
+			continue
+		}
+		s.hub.publish(store.Event{Anomaly: event.Anomaly{
+			Metric:        metric,
+			Labels:        res.Labels,
+			Time:          p.Time,
+			Value:         p.Value,
+			Score:         p.Score,
+			PValue:        p.PValue,
+			Severity:      severity,
+			RunLength:     p.RunLength,
+			Level:         res.Level,
+			Scope:         s.scope,
+			Related:       p.Related,
+			WindowMinutes: s.window,
+			Links:         s.links(metric, res.Labels, p.Time),
+			Explanation:   &p.Explanation,
+			Sparkline:     res.Sparkline,
+			Deployment:    s.deploymentBefore(res.Labels["service_name"], p.Time),
+			Kubernetes:    s.workload(res.Labels["service_name"]),
+		}})
+	}
+}
+
+// direction is which deviations from a series' center are anomalies: high
+// values, low values or both, the zero value.
+type direction string
+
+const (
+	directionBoth direction = "both"
+	directionHigh direction = "high"
+	directionLow  direction = "low"
+)
+
+// defaultDirections are the directions of metrics without DIRECTION_<METRIC>:
+// a drop in errors or latency is no incident, a drop in traffic may be.
+var defaultDirections = map[string]direction{"rps": directionBoth, "error_rate": directionHigh, "latency_p95": directionHigh, "edge_rps": directionBoth, "edge_error_rate": directionHigh}
+
+// matches tells whether a point sigma from the series' center deviates in
+// direction d.
+func (d direction) matches(sigma float64) bool {
+	switch d {
+	case directionHigh:
+		return sigma > 0
+	case directionLow:
+		return sigma < 0
+	}
+	return true
+}
+
+// workload describes the Kubernetes deployment of service, if known.
+func (s *service) workload(service string) *event.Kubernetes {
+	if s.kube == nil || service == "" {
+		return nil
+	}
+	w, found := s.kube.Workload(service)
+	if !found {
+		return nil
+	}
+	k := event.Kubernetes(w)
+	return &k
+}
+
+// severity classifies an event score.
+func (s *service) severity(score float64) string {
+	if score >= s.criticalScore {
+		return "critical"
+	}
+	return "warning"
+}
+
+// links returns related resources for an anomalous point: a Grafana Explore
+// view of the series around it when GRAFANA_URL is configured.
+func (s *service) links(metric string, labels map[string]string, at time.Time) []event.Link {
+	expr, ok := seriesExprs[metric]
+	if !ok || s.grafanaURL == "" {
+		return nil
+	}
+	matchers := make([]string, 0, len(groupLabels))
+	for _, k := range groupLabels {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	q := expr(strings.Join(matchers, ", "), s.step)
+	if q == "" {
+		return nil
+	}
+	pane, _ := json.Marshal(map[string]any{
+		"datasource": s.grafanaDatasource,
+		"queries":    []map[string]string{{"refId": "A", "expr": q}},
+		"range": map[string]string{
+			"from": fmt.Sprintf("%d", at.Add(-time.Duration(s.window)*time.Minute).UnixMilli()),
+			"to":   fmt.Sprintf("%d", at.Add(10*time.Minute).UnixMilli()),
+		},
+	})
+	return []event.Link{{Rel: "explore", Href: s.grafanaURL + "/explore?left=" + url.QueryEscape(string(pane))}}
+}
+
+// schedule scans metric every interval so stream subscribers receive events
+// without anyone polling the HTTP endpoints. The first scan waits a random
+// delay of up to jitter, so replicas started together don't scan in step.
+// Ticks due while a scan still runs are skipped rather than queued.
+func (s *service) schedule(ctx context.Context, metric string, interval, jitter time.Duration) {
+	if jitter > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rand.N(jitter)):
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		began := time.Now()
+		// followers skip the scan; the leader's events reach the store
+		if s.leader.Leading() {
+			id := mimir.NewRequestID()
+			if _, _, err := s.scan(mimir.WithRequestID(ctx, id), metric); err != nil {
+				log.Printf("background scan %s failed: %v request=%s", metric, err, id)
+			}
+		}
+		if took := time.Since(began); took > interval {
+			select {
+			case <-ticker.C:
+			default:
+			}
+			log.Printf("background scan %s took %s, skipped %d cycles", metric, took.Round(time.Millisecond), int(took/interval))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"ifservice/internal/event"
+	"ifservice/internal/secret"
+	"ifservice/internal/store"
+
+	"github.com/arijanluiken/mcp/if/iforest"
+)
+
+// scope is a named part of the series, read from SCOPES_FILE, detected
+// with its own settings instead of the global ones, e.g. strict thresholds
+// for payment services and relaxed ones for batch jobs. Settings left out
+// are the global ones. A series belongs to the first scope of the file
+// whose selector and metrics match it; series of no scope keep the global
+// settings.
+type scope struct {
+	Name string `json:"name"`
+	// Selector matches series labels against regular expressions, fully
+	// anchored like PromQL's =~; labels a series lacks are "".
+	Selector map[string]string `json:"selector"`
+	// Metrics the scope covers, all when empty.
+	Metrics       []string      `json:"metrics"`
+	Detector      scopeDetector `json:"detector"`
+	Threshold     *float64      `json:"threshold"`
+	CriticalScore *float64      `json:"criticalScore"`
+	Contamination *float64      `json:"contamination"`
+	MaxPValue     *float64      `json:"maxPValue"`
+	// Direction of each metric, as DIRECTION_<METRIC>.
+	Direction map[string]direction `json:"direction"`
+	// Sustain of each severity, as SUSTAIN_WARNING and SUSTAIN_CRITICAL.
+	Sustain   map[string]string `json:"sustain"`
+	Notifiers []scopeNotifier   `json:"notifiers"`
+
+	selector map[string]*regexp.Regexp
+	// the global settings merged with the scope's, see prepare
+	normalization map[string]string
+	direction     map[string]direction
+	sustain       map[string]sustain
+}
+
+// scopeDetector configures the isolation forest and normalization of a
+// scope, as FOREST_* and NORMALIZATION.
+type scopeDetector struct {
+	Trees         *int   `json:"trees"`
+	SampleSize    *int   `json:"sampleSize"`
+	MaxDepth      *int   `json:"maxDepth"`
+	Normalization string `json:"normalization"`
+}
+
+// scopeNotifier is a webhook receiving the events of a scope.
+type scopeNotifier struct {
+	URL string `json:"url"`
+	// URLFile names a file holding the URL instead, which for chat
+	// webhooks is a secret, re-read when rotated.
+	URLFile string `json:"urlFile"`
+	// Format is cloudevent, the default, posting the CloudEvent, or text
+	// posting {"text": line} like Slack and Mattermost incoming webhooks.
+	Format string `json:"format"`
+	// MinSeverity critical leaves warnings out.
+	MinSeverity string `json:"minSeverity"`
+
+	url secret.Secret
+}
+
+// loadScopes reads a JSON array of scopes.
+func loadScopes(path string) ([]*scope, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []*scope
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for _, sc := range out {
+		if sc.Name == "" || seen[sc.Name] {
+			return nil, fmt.Errorf("%s: invalid or duplicate scope name %q", path, sc.Name)
+		}
+		seen[sc.Name] = true
+		if err := sc.check(); err != nil {
+			return nil, fmt.Errorf("%s: scope %q: %w", path, sc.Name, err)
+		}
+	}
+	return out, nil
+}
+
+// check validates sc and compiles its selector.
+func (sc *scope) check() error {
+	sc.selector = map[string]*regexp.Regexp{}
+	for k, v := range sc.Selector {
+		if !labelNameRe.MatchString(k) {
+			return fmt.Errorf("invalid selector label %q", k)
+		}
+		re, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return fmt.Errorf("selector %s: %w", k, err)
+		}
+		sc.selector[k] = re
+	}
+	metrics := detectedMetrics()
+	for _, m := range sc.Metrics {
+		if !slices.Contains(metrics, m) {
+			return fmt.Errorf("unknown metric %q", m)
+		}
+	}
+	// each forest setting is checked on its own
+	o := iforest.Options{Trees: 1, SampleSize: 2}
+	d := sc.Detector
+	for _, p := range []struct {
+		v   *int
+		dst *int
+	}{{d.Trees, &o.Trees}, {d.SampleSize, &o.SampleSize}, {d.MaxDepth, &o.MaxDepth}} {
+		if p.v != nil {
+			*p.dst = *p.v
+		}
+	}
+	if err := checkForest(o); err != nil {
+		return err
+	}
+	if d.Normalization != "" && !slices.Contains(normalizations, d.Normalization) {
+		return fmt.Errorf("invalid normalization %q", d.Normalization)
+	}
+	for _, p := range []struct {
+		name     string
+		v        *float64
+		min, max float64
+		open     bool
+	}{
+		{"threshold", sc.Threshold, 0, 1, false},
+		{"criticalScore", sc.CriticalScore, 0, 1, false},
+		{"contamination", sc.Contamination, 0, 0.5, true},
+		{"maxPValue", sc.MaxPValue, 0, 1, true},
+	} {
+		if p.v != nil && (*p.v < p.min || *p.v > p.max || (p.open && *p.v == p.max)) {
+			return fmt.Errorf("invalid %s %v", p.name, *p.v)
+		}
+	}
+	for m, d := range sc.Direction {
+		if !slices.Contains(metrics, m) {
+			return fmt.Errorf("direction of unknown metric %q", m)
+		}
+		if d != directionBoth && d != directionHigh && d != directionLow {
+			return fmt.Errorf("invalid direction %q of %s: high, low or both", d, m)
+		}
+	}
+	sc.sustain = map[string]sustain{}
+	for severity, v := range sc.Sustain {
+		if severity != "warning" && severity != "critical" {
+			return fmt.Errorf("sustain of unknown severity %q", severity)
+		}
+		r, err := parseSustain(v)
+		if err != nil {
+			return fmt.Errorf("sustain %s: %w", severity, err)
+		}
+		sc.sustain[severity] = r
+	}
+	for i, n := range sc.Notifiers {
+		var err error
+		if sc.Notifiers[i].url, err = secret.New(n.URL, n.URLFile); err != nil {
+			return fmt.Errorf("notifier %d: url: %w", i, err)
+		}
+		if u, err := url.Parse(sc.Notifiers[i].url.Get()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			// the URL of a file is left out as a secret
+			if n.URLFile != "" {
+				return fmt.Errorf("invalid notifier url in %s", n.URLFile)
+			}
+			return fmt.Errorf("invalid notifier url %q", n.URL)
+		}
+		if n.Format != "" && n.Format != "cloudevent" && n.Format != "text" {
+			return fmt.Errorf("invalid notifier format %q: cloudevent or text", n.Format)
+		}
+		if n.MinSeverity != "" && n.MinSeverity != "warning" && n.MinSeverity != "critical" {
+			return fmt.Errorf("invalid notifier minSeverity %q", n.MinSeverity)
+		}
+	}
+	return nil
+}
+
+// prepare merges the per-metric and per-severity settings of sc over those
+// of s, so applying the scope only assigns them.
+func (sc *scope) prepare(s *service) {
+	sc.normalization = maps.Clone(s.normalization)
+	if n := sc.Detector.Normalization; n != "" {
+		for m := range sc.normalization {
+			sc.normalization[m] = n
+		}
+	}
+	sc.direction = maps.Clone(s.direction)
+	maps.Copy(sc.direction, sc.Direction)
+	sustains := maps.Clone(s.sustain)
+	maps.Copy(sustains, sc.sustain)
+	sc.sustain = sustains
+}
+
+// covers reports whether the series of metric with labels belong to sc.
+func (sc *scope) covers(metric string, labels map[string]string) bool {
+	if len(sc.Metrics) > 0 && !slices.Contains(sc.Metrics, metric) {
+		return false
+	}
+	for k, re := range sc.selector {
+		if !re.MatchString(labels[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns a copy of s with the settings of sc, like clusterScan.
+func (sc *scope) apply(s *service) *service {
+	cs := *s
+	cs.scope = sc.Name
+	d := sc.Detector
+	for _, p := range []struct {
+		v   *int
+		dst *int
+	}{{d.Trees, &cs.forest.Trees}, {d.SampleSize, &cs.forest.SampleSize}, {d.MaxDepth, &cs.forest.MaxDepth}} {
+		if p.v != nil {
+			*p.dst = *p.v
+		}
+	}
+	for _, p := range []struct {
+		v   *float64
+		dst *float64
+	}{{sc.Threshold, &cs.threshold}, {sc.CriticalScore, &cs.criticalScore}, {sc.Contamination, &cs.contamination}, {sc.MaxPValue, &cs.maxPValue}} {
+		if p.v != nil {
+			*p.dst = *p.v
+		}
+	}
+	cs.normalization, cs.direction, cs.sustain = sc.normalization, sc.direction, sc.sustain
+	return &cs
+}
+
+// scopeFor returns s with the settings of the scope of the series of
+// metric with labels, s itself when none covers it.
+func (s *service) scopeFor(metric string, labels map[string]string) *service {
+	for _, sc := range s.scopes {
+		if sc.covers(metric, labels) {
+			return sc.apply(s)
+		}
+	}
+	return s
+}
+
+// scoped returns s with the settings of the scope named name, s itself
+// for "".
+func (s *service) scoped(name string) *service {
+	if name == "" || name == s.scope {
+		return s
+	}
+	for _, sc := range s.scopes {
+		if sc.Name == name {
+			return sc.apply(s)
+		}
+	}
+	return s
+}
+
+// scopeSink posts the events of a scope to its notifiers from its own
+// goroutine, like busSink.
+type scopeSink struct {
+	scope  *scope
+	source string
+	client *http.Client
+	queue  chan store.Event
+}
+
+func newScopeSink(sc *scope, source string) *scopeSink {
+	return &scopeSink{scope: sc, source: source, client: &http.Client{Timeout: 10 * time.Second}, queue: make(chan store.Event, 256)}
+}
+
+// enqueue hands the events of the sink's scope to its notifiers, dropping
+// them when the queue is full.
+func (n *scopeSink) enqueue(ev store.Event) {
+	if ev.Scope != n.scope.Name {
+		return
+	}
+	select {
+	case n.queue <- ev:
+	default:
+		log.Printf("scope %s: notifier queue full, dropping anomaly event %d", n.scope.Name, ev.ID)
+	}
+}
+
+func (n *scopeSink) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-n.queue:
+			ce := event.New(n.source, ev.ID, ev.Anomaly)
+			for i, nt := range n.scope.Notifiers {
+				if nt.MinSeverity == "critical" && ev.Severity != "critical" {
+					continue
+				}
+				if err := n.post(ctx, nt, ce); err != nil {
+					log.Printf("scope %s: notifier %d, anomaly event %d: %v", n.scope.Name, i, ev.ID, err)
+				}
+			}
+		}
+	}
+}
+
+func (n *scopeSink) post(ctx context.Context, nt scopeNotifier, ce event.CloudEvent) error {
+	var body any = ce
+	contentType := "application/cloudevents+json"
+	if nt.Format == "text" {
+		body, contentType = map[string]string{"text": ce.LogLine()}, "application/json"
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, nt.url.Get(), bytes.NewReader(b))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := n.client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ifservice/internal/event"
+	"ifservice/internal/store"
+)
+
+// handleStream holds the connection open and writes each newly detected
+// anomaly as a Server-Sent Event. Clients resuming with Last-Event-ID (header
+// or lastEventId query parameter) first receive the stored events they missed.
+func (s *service) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var last int64
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	if lastID != "" {
+		id, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		last = id
+	}
+
+	// subscribe before replaying so nothing published in between is lost
+	events, cancel := s.hub.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if lastID != "" {
+		for _, ev := range s.hub.store.Since(last) {
+			if err := writeSSE(w, s.source, ev); err != nil {
+				return
+			}
+			last = ev.ID
+		}
+		flusher.Flush()
+	}
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev := <-events:
+			if ev.ID <= last {
+				continue
+			}
+			if err := writeSSE(w, s.source, ev); err != nil {
+				return
+			}
+			last = ev.ID
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSE writes ev as a CloudEvent named after the event type, with its
+// store ID as the event ID.
+func writeSSE(w http.ResponseWriter, source string, ev store.Event) error {
+	b, err := json.Marshal(event.New(source, ev.ID, ev.Anomaly))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, event.Type, b)
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ifservice/internal/promresult"
+)
+
+// maxSustainPoints bounds the N of a sustain requirement.
+const maxSustainPoints = 60
+
+// sustain requires m of n consecutive points of a series, one of them the
+// anomaly, to be anomalous before an event fires. The zero value, like 1 of
+// 1, requires the anomaly alone.
+type sustain struct {
+	m, n int
+}
+
+// parseSustain parses "M" (M consecutive points) or "M/N".
+func parseSustain(v string) (sustain, error) {
+	ms, ns, ratio := strings.Cut(v, "/")
+	m, err := strconv.Atoi(ms)
+	if err != nil {
+		return sustain{}, fmt.Errorf("invalid %q: M or M/N points", v)
+	}
+	n := m
+	if ratio {
+		if n, err = strconv.Atoi(ns); err != nil {
+			return sustain{}, fmt.Errorf("invalid %q: M or M/N points", v)
+		}
+	}
+	if m < 1 || n < m || n > maxSustainPoints {
+		return sustain{}, fmt.Errorf("invalid %q: 1 <= M <= N <= %d", v, maxSustainPoints)
+	}
+	return sustain{m: m, n: n}, nil
+}
+
+func (r sustain) String() string {
+	return fmt.Sprintf("%d/%d", max(r.m, 1), max(r.n, 1))
+}
+
+// met tells whether some n consecutive points including point j have at
+// least m anomalous among them.
+func (r sustain) met(anomalous []bool, j int) bool {
+	if r.m <= 1 {
+		return true
+	}
+	for lo := max(j-r.n+1, 0); lo <= j && lo+r.n <= len(anomalous); lo++ {
+		count := 0
+		for _, a := range anomalous[lo : lo+r.n] {
+			if a {
+				count++
+			}
+		}
+		if count >= r.m {
+			return true
+		}
+	}
+	return false
+}
+
+// sustainedSeverity checks the requirement of severity for the anomaly at
+// point j. A critical anomaly short of its requirement is a warning if it
+// meets the warning's.
+func (s *service) sustainedSeverity(severity string, anomalous []bool, j int) (string, bool) {
+	if s.sustain[severity].met(anomalous, j) {
+		return severity, true
+	}
+	if severity == "critical" && s.sustain["warning"].met(anomalous, j) {
+		return "warning", true
+	}
+	return "", false
+}
+
+// markAnomalous marks which points of res's cleaned series cl are
+// anomalies, given their scores and p-values, and sets the run length of
+// its top points. Interpolated points are never anomalies.
+func (s *service) markAnomalous(metric string, res *seriesResult, cl promresult.Cleaned, scores, pValues []float64) {
+	res.anomalous, res.times = make([]bool, len(scores)), cl.Times
+	for i := range scores {
+		res.anomalous[i] = !cl.Filled[i] && s.anomalousPoint(metric, cl.Times[i], cl.Values[i]-res.center, scores[i], pValues[i], res.Threshold)
+	}
+	for i := range res.Top {
+		res.Top[i].RunLength = runLength(res.anomalous, res.Top[i].Index)
+	}
+}
+
+// runLength is the length of the run of anomalous points including point
+// j, 0 when j is not anomalous.
+func runLength(anomalous []bool, j int) int {
+	if !anomalous[j] {
+		return 0
+	}
+	lo, hi := j, j
+	for lo > 0 && anomalous[lo-1] {
+		lo--
+	}
+	for hi < len(anomalous)-1 && anomalous[hi+1] {
+		hi++
+	}
+	return hi - lo + 1
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+
+	"ifservice/internal/secret"
+)
+
+// serverTLS returns the TLS config of the HTTP and gRPC listeners, from
+// IF_TLS_CERT_FILE and IF_TLS_KEY_FILE, or nil without them. With
+// IF_TLS_CLIENT_CA_FILE clients, e.g. the MCP server, must present a
+// certificate signed by one of its CAs. The certificate is re-read when its
+// files change.
+func serverTLS() *tls.Config {
+	certFile, keyFile := getenv("IF_TLS_CERT_FILE", ""), getenv("IF_TLS_KEY_FILE", "")
+	caFile := getenv("IF_TLS_CLIENT_CA_FILE", "")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			log.Fatal("IF_TLS_CLIENT_CA_FILE requires IF_TLS_CERT_FILE and IF_TLS_KEY_FILE")
+		}
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		log.Fatal("IF_TLS_CERT_FILE and IF_TLS_KEY_FILE are set together")
+	}
+	kp, err := secret.LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("load TLS certificate: %v", err)
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return kp.Certificate()
+		},
+	}
+	if caFile != "" {
+		if cfg.ClientCAs, err = secret.LoadCertPool(caFile); err != nil {
+			log.Fatalf("load IF_TLS_CLIENT_CA_FILE: %v", err)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
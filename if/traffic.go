@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"ifservice/internal/event"
+)
+
+// trafficTTL is how long a series' request rate from an rps scan is used.
+const trafficTTL = time.Hour
+
+type trafficSample struct {
+	rps float64
+	at  time.Time
+}
+
+// traffic remembers the mean request rate of each series, as seen by the
+// latest rps scan, to weight the severity of its other metrics' events.
+type traffic struct {
+	mu    sync.Mutex
+	rps   map[string]trafficSample
+	swept time.Time
+}
+
+func newTraffic() *traffic {
+	return &traffic{rps: map[string]trafficSample{}}
+}
+
+func (t *traffic) observe(subject string, rps float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.swept) > trafficTTL {
+		for k, smp := range t.rps {
+			if now.Sub(smp.at) > trafficTTL {
+				delete(t.rps, k)
+			}
+		}
+		t.swept = now
+	}
+	t.rps[subject] = trafficSample{rps: rps, at: now}
+}
+
+// lookup returns the recent request rate of subject, if known.
+func (t *traffic) lookup(subject string) (float64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	smp, ok := t.rps[subject]
+	if !ok || time.Since(smp.at) > trafficTTL {
+		return 0, false
+	}
+	return smp.rps, true
+}
+
+// quietHours are the times of day and week with little traffic, where a
+// higher score threshold applies.
+type quietHours struct {
+	loc *time.Location
+	// from and to are minutes of the day; from > to wraps past midnight
+	from, to int
+	days     [7]bool
+	// threshold is the score points need within quiet hours
+	threshold float64
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseQuietHours parses a daily range like "22:00-06:00" (empty for none)
+// and comma separated whole days like "sat,sun".
+func parseQuietHours(hours, days string, loc *time.Location, threshold float64) (*quietHours, error) {
+	q := &quietHours{loc: loc, threshold: threshold}
+	if hours != "" {
+		var fh, fm, th, tm int
+		if n, err := fmt.Sscanf(hours, "%d:%d-%d:%d", &fh, &fm, &th, &tm); err != nil || n != 4 ||
+			fh > 23 || th > 23 || fm > 59 || tm > 59 || fh < 0 || th < 0 || fm < 0 || tm < 0 {
+			return nil, fmt.Errorf("invalid quiet hours %q, want HH:MM-HH:MM", hours)
+		}
+		q.from, q.to = fh*60+fm, th*60+tm
+	}
+	if days != "" {
+		for _, d := range strings.Split(days, ",") {
+			wd, ok := weekdays[strings.ToLower(strings.TrimSpace(d))]
+			if !ok {
+				return nil, fmt.Errorf("invalid quiet day %q", d)
+			}
+			q.days[wd] = true
+		}
+	}
+	return q, nil
+}
+
+// contains reports whether t falls within quiet hours. A nil quietHours
+// has none.
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	t = t.In(q.loc)
+	if q.days[t.Weekday()] {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if q.from <= q.to {
+		return m >= q.from && m < q.to
+	}
+	return m >= q.from || m < q.to
+}
+
+// trafficWeight scales the score used for the severity of an event of the
+// series labels by its request rate relative to the reference rate, so
+// anomalies of barely used endpoints stay warnings. Without a reference or
+// a known rate the weight is 1.
+func (s *service) trafficWeight(labels map[string]string) float64 {
+	if s.referenceRPS <= 0 {
+		return 1
+	}
+	rps, ok := s.traffic.lookup(event.Subject(labels))
+	if !ok {
+		return 1
+	}
+	return math.Min(1, rps/s.referenceRPS)
+}
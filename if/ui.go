@@ -0,0 +1,18 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles is the read-only dashboard served under /ui/. It reads
+// /api/v1/events, /api/v1/series and /api/v1/anomalies/stream.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+func handleUI() http.Handler {
+	static, _ := fs.Sub(uiFiles, "ui")
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(static)))
+}
@@ -0,0 +1,160 @@
+// Read-only anomaly dashboard: stored events from /api/v1/events, series for
+// sparklines from /api/v1/series, live updates from /api/v1/anomalies/stream.
+"use strict";
+
+const state = { events: [], windowMinutes: 30, threshold: 0.6, lastId: 0 };
+const seriesCache = new Map(); // key -> {at, points}
+const SERIES_TTL = 60000;
+
+const $ = (id) => document.getElementById(id);
+
+// labelPairs returns the series labels sorted by name; which labels there are
+// depends on the service's GROUP_BY.
+function labelPairs(ev) {
+  return Object.entries(ev.labels || {}).sort(([a], [b]) => (a < b ? -1 : a > b ? 1 : 0));
+}
+
+function seriesKey(ev) {
+  return [ev.metric, ...labelPairs(ev).map(([k, v]) => `${k}=${v}`)].join("|");
+}
+
+// otherLabels renders every label but service_name.
+function otherLabels(ev) {
+  return labelPairs(ev).filter(([k]) => k !== "service_name").map(([k, v]) => `${k}=${v}`).join(" · ");
+}
+
+function fmt(v) {
+  if (Math.abs(v) >= 100) return v.toFixed(0);
+  if (Math.abs(v) >= 1) return v.toFixed(2);
+  return v.toPrecision(3);
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) e.setAttribute(k, v);
+  for (const c of children) e.append(c instanceof Node ? c : document.createTextNode(c));
+  return e;
+}
+
+// sparkline draws [t, v] points; marks are times (unix seconds) to highlight.
+function sparkline(points, marks, w = 160, h = 28) {
+  const ns = "http://www.w3.org/2000/svg";
+  const svg = document.createElementNS(ns, "svg");
+  svg.setAttribute("class", "spark");
+  svg.setAttribute("width", w);
+  svg.setAttribute("height", h);
+  if (points.length < 2) return svg;
+  const t0 = points[0][0], t1 = points[points.length - 1][0];
+  let lo = Infinity, hi = -Infinity;
+  for (const [, v] of points) { lo = Math.min(lo, v); hi = Math.max(hi, v); }
+  const x = (t) => ((t - t0) / (t1 - t0 || 1)) * (w - 4) + 2;
+  const y = (v) => h - 2 - ((v - lo) / (hi - lo || 1)) * (h - 4);
+  const line = document.createElementNS(ns, "polyline");
+  line.setAttribute("points", points.map(([t, v]) => `${x(t).toFixed(1)},${y(v).toFixed(1)}`).join(" "));
+  svg.append(line);
+  for (const m of marks || []) {
+    const p = points.reduce((a, b) => (Math.abs(b[0] - m) < Math.abs(a[0] - m) ? b : a));
+    const c = document.createElementNS(ns, "circle");
+    c.setAttribute("cx", x(p[0]).toFixed(1));
+    c.setAttribute("cy", y(p[1]).toFixed(1));
+    c.setAttribute("r", 2.5);
+    svg.append(c);
+  }
+  return svg;
+}
+
+async function seriesPoints(ev) {
+  const key = seriesKey(ev);
+  const hit = seriesCache.get(key);
+  if (hit && Date.now() - hit.at < SERIES_TTL) return hit.points;
+  const q = new URLSearchParams([["metric", ev.metric], ...labelPairs(ev)]);
+  const res = await fetch("/api/v1/series?" + q);
+  const points = res.ok ? (await res.json()).points : [];
+  seriesCache.set(key, { at: Date.now(), points });
+  return points;
+}
+
+function visible(ev) {
+  const metric = $("metric").value;
+  const svc = $("service").value.trim().toLowerCase();
+  if (metric && ev.metric !== metric) return false;
+  if (svc && !((ev.labels || {}).service_name || "").toLowerCase().includes(svc)) return false;
+  return true;
+}
+
+function render(newIds) {
+  const since = Date.now() - state.windowMinutes * 60000;
+  const groups = new Map();
+  for (const ev of state.events) {
+    if (!visible(ev)) continue;
+    const k = seriesKey(ev);
+    if (!groups.has(k)) groups.set(k, []);
+    groups.get(k).push(ev);
+  }
+
+  const rows = [];
+  for (const evs of groups.values()) {
+    const current = evs.filter((e) => Date.parse(e.time) >= since);
+    if (current.length === 0) continue;
+    const last = current.reduce((a, b) => (Date.parse(b.time) > Date.parse(a.time) ? b : a));
+    const l = last.labels || {};
+    const seriesCell = el("td");
+    const history = evs.map((e) => [Date.parse(e.time) / 1000, e.score]).sort((a, b) => a[0] - b[0]);
+    const explore = (last.links || []).find((x) => x.rel === "explore");
+    const tr = el("tr", {},
+      el("td", {}, l.service_name || ""), el("td", {}, otherLabels(last)),
+      el("td", {}, last.metric), el("td", {}, new Date(last.time).toLocaleTimeString()),
+      el("td", { class: "num" }, fmt(last.value)),
+      el("td", { class: "num" + (last.score >= state.threshold ? " score-hi" : "") }, last.score.toFixed(3)),
+      seriesCell, el("td", {}, sparkline(history)),
+      el("td", {}, explore ? el("a", { href: explore.href, target: "_blank", rel: "noopener" }, "explore") : ""));
+    if (current.some((e) => newIds.has(e.id))) tr.classList.add("new");
+    rows.push({ score: last.score, tr });
+    seriesPoints(last).then((pts) => seriesCell.append(sparkline(pts, current.map((e) => Date.parse(e.time) / 1000))));
+  }
+  rows.sort((a, b) => b.score - a.score);
+  $("current").replaceChildren(...rows.map((r) => r.tr));
+  $("empty").hidden = rows.length > 0;
+
+  const recent = state.events.filter(visible).slice(-100).reverse();
+  $("events").replaceChildren(...recent.map((ev) => {
+    const tr = el("tr", {}, el("td", {}, String(ev.id)), el("td", {}, new Date(ev.time).toLocaleString()),
+      el("td", {}, ev.metric), el("td", {}, labelPairs(ev).map(([, v]) => v).join(" / ")),
+      el("td", { class: "num" }, fmt(ev.value)), el("td", { class: "num" }, ev.score.toFixed(3)));
+    if (newIds.has(ev.id)) tr.classList.add("new");
+    return tr;
+  }));
+}
+
+async function load() {
+  const res = await fetch("/api/v1/events?limit=1000");
+  const body = await res.json();
+  state.events = body.events || [];
+  state.windowMinutes = body.windowMinutes;
+  state.threshold = body.threshold;
+  state.lastId = state.events.length ? state.events[state.events.length - 1].id : 0;
+  $("meta").textContent = `window ${state.windowMinutes}m · threshold ${state.threshold}`;
+  render(new Set());
+}
+
+function live() {
+  const es = new EventSource("/api/v1/anomalies/stream?lastEventId=" + state.lastId);
+  es.onopen = () => { $("live").className = "on"; $("live").textContent = "live"; };
+  es.onerror = () => { $("live").className = "off"; $("live").textContent = "reconnecting"; };
+  es.addEventListener("io.ifservice.anomaly.v1", (m) => {
+    const ce = JSON.parse(m.data);
+    const ev = Object.assign({ id: Number(ce.id) }, ce.data);
+    if (ev.id <= state.lastId) return;
+    state.lastId = ev.id;
+    state.events.push(ev);
+    if (state.events.length > 5000) state.events.splice(0, state.events.length - 5000);
+    seriesCache.delete(seriesKey(ev));
+    render(new Set([ev.id]));
+  });
+}
+
+$("metric").addEventListener("change", () => render(new Set()));
+$("service").addEventListener("input", () => render(new Set()));
+// re-render periodically so anomalies age out of the window
+setInterval(() => render(new Set()), 60000);
+load().then(live);
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"ifservice/internal/event"
+	"ifservice/internal/promresult"
+)
+
+// ring holds the aligned values of one series for the slots of a moving
+// grid; start is the time of the oldest slot, at head.
+type ring struct {
+	vals  []float64
+	head  int
+	start time.Time
+}
+
+func newRing(n int, start time.Time) *ring {
+	r := &ring{vals: make([]float64, n), start: start}
+	for i := range r.vals {
+		r.vals[i] = math.NaN()
+	}
+	return r
+}
+
+// advance moves the oldest slot to start, clearing slots that become new.
+func (r *ring) advance(start time.Time, step time.Duration) {
+	shift := int(start.Sub(r.start) / step)
+	if shift <= 0 {
+		return
+	}
+	if shift > len(r.vals) {
+		shift = len(r.vals)
+	}
+	for i := 0; i < shift; i++ {
+		r.vals[(r.head+i)%len(r.vals)] = math.NaN()
+	}
+	r.head = (r.head + shift) % len(r.vals)
+	r.start = start
+}
+
+// set stores v at slot i counted from the oldest.
+func (r *ring) set(i int, v float64) {
+	if i >= 0 && i < len(r.vals) {
+		r.vals[(r.head+i)%len(r.vals)] = v
+	}
+}
+
+// values returns the slots oldest first.
+func (r *ring) values() []float64 {
+	out := make([]float64, len(r.vals))
+	for i := range out {
+		out[i] = r.vals[(r.head+i)%len(r.vals)]
+	}
+	return out
+}
+
+func (r *ring) empty() bool {
+	for _, v := range r.vals {
+		if !math.IsNaN(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// windowSeries is one series aligned onto a scan's grid.
+type windowSeries struct {
+	Labels  map[string]string
+	Aligned []float64
+}
+
+// alignSeries aligns every series onto g.
+func alignSeries(series []promresult.Series, g promresult.Grid) []windowSeries {
+	out := make([]windowSeries, len(series))
+	for i, ps := range series {
+		out[i] = windowSeries{Labels: ps.Labels, Aligned: promresult.Align(ps.Points, g)}
+	}
+	return out
+}
+
+// metricWindow is the cached window of one metric.
+type metricWindow struct {
+	mu     sync.Mutex
+	grid   promresult.Grid
+	rings  map[string]*ring
+	labels map[string]map[string]string
+}
+
+// windowCache keeps each metric's series over the detection window between
+// scans, so a scan only fetches the tail since the previous one instead of
+// the whole window. The last overlap of the cached window is fetched again,
+// since the newest points of rate() and histogram_quantile() change as late
+// samples arrive.
+type windowCache struct {
+	mu      sync.Mutex
+	overlap time.Duration
+	metrics map[string]*metricWindow
+}
+
+func newWindowCache(overlap time.Duration) *windowCache {
+	return &windowCache{overlap: overlap, metrics: map[string]*metricWindow{}}
+}
+
+// fetch returns the series of metric aligned onto g, calling fetchGrid for
+// the part of g not cached. A nil cache always fetches all of g.
+func (wc *windowCache) fetch(metric string, g promresult.Grid, fetchGrid func(promresult.Grid) ([]promresult.Series, error)) ([]windowSeries, error) {
+	if wc == nil {
+		series, err := fetchGrid(g)
+		if err != nil {
+			return nil, err
+		}
+		return alignSeries(series, g), nil
+	}
+
+	wc.mu.Lock()
+	mw, found := wc.metrics[metric]
+	if !found {
+		mw = &metricWindow{}
+		wc.metrics[metric] = mw
+	}
+	wc.mu.Unlock()
+	// one scan per metric at a time; a concurrent one then finds the tail
+	// already fetched
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	fg := g
+	reuse := mw.rings != nil && mw.grid.Step == g.Step && mw.grid.Len == g.Len &&
+		!mw.grid.Start.After(g.Start) && mw.grid.End().Add(-wc.overlap).After(g.Start)
+	if reuse {
+		fg = promresult.NewGrid(mw.grid.End().Add(-wc.overlap), g.End(), g.Step)
+	}
+	series, err := fetchGrid(fg)
+	if err != nil {
+		return nil, err
+	}
+	if !reuse {
+		mw.rings, mw.labels = map[string]*ring{}, map[string]map[string]string{}
+	}
+	for _, r := range mw.rings {
+		r.advance(g.Start, g.Step)
+	}
+	// slots of g covered by the fetch; everything there is replaced
+	offset := int(fg.Start.Sub(g.Start) / g.Step)
+	fetched := map[string]bool{}
+	for _, ps := range series {
+		k := event.Subject(ps.Labels)
+		fetched[k] = true
+		r, found := mw.rings[k]
+		if !found {
+			r = newRing(g.Len, g.Start)
+			mw.rings[k] = r
+			mw.labels[k] = ps.Labels
+		}
+		for i, v := range promresult.Align(ps.Points, fg) {
+			r.set(offset+i, v)
+		}
+	}
+	for k, r := range mw.rings {
+		if !fetched[k] {
+			for i := 0; i < fg.Len; i++ {
+				r.set(offset+i, math.NaN())
+			}
+		}
+		if r.empty() {
+			delete(mw.rings, k)
+			delete(mw.labels, k)
+		}
+	}
+	mw.grid = g
+
+	keys := make([]string, 0, len(mw.rings))
+	for k := range mw.rings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]windowSeries, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, windowSeries{Labels: mw.labels[k], Aligned: mw.rings[k].values()})
+	}
+	return out, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mimir "mcp/internal/mimir"
+)
+
+// auditRecord is one tools/call invocation.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session,omitempty"`
+	Identity string    `json:"identity,omitempty"`
+	Role     string    `json:"role,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	// RequestID is the X-Request-ID of the call, also sent to Mimir and
+	// if-service.
+	RequestID string `json:"requestId,omitempty"`
+	Tool      string `json:"tool"`
+	// ArgsDigest is the SHA-256 of the compacted arguments, so repeated calls
+	// can be correlated without storing label values verbatim.
+	ArgsDigest string  `json:"argsDigest"`
+	DurationMs float64 `json:"durationMs"`
+	// Outcome is ok, denied (policy), unauthenticated (no valid token, so
+	// no identity) or error.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditLog appends records to a size-rotated JSON lines file and keeps the
+// most recent ones in memory for the /audit endpoint.
+type auditLog struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	size   int64
+	max    int64
+	keep   int
+	recent []auditRecord
+	limit  int
+}
+
+// openAuditLog opens path for appending; an empty path keeps records in
+// memory only. When the file exceeds maxBytes it is rotated to path.1,
+// path.2, ... keeping keep old files.
+func openAuditLog(path string, maxBytes int64, keep, recent int) (*auditLog, error) {
+	a := &auditLog{path: path, max: maxBytes, keep: keep, limit: recent}
+	if path == "" {
+		return a, nil
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load fills the in-memory tail from the current file.
+func (a *auditLog) load() error {
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec auditRecord
+		if json.Unmarshal(sc.Bytes(), &rec) == nil {
+			a.remember(rec)
+		}
+	}
+	return sc.Err()
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, st.Size()
+	return nil
+}
+
+func (a *auditLog) rotate() error {
+	a.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.keep))
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.keep > 0 {
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *auditLog) remember(rec auditRecord) {
+	a.recent = append(a.recent, rec)
+	if len(a.recent) > a.limit {
+		a.recent = a.recent[len(a.recent)-a.limit:]
+	}
+}
+
+func (a *auditLog) record(rec auditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.remember(rec)
+	if a.f == nil {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if a.max > 0 && a.size > 0 && a.size+int64(len(b)) > a.max {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	return err
+}
+
+// query returns up to limit of the most recent records, newest first,
+// optionally restricted to one tool, identity or session.
+func (a *auditLog) query(limit int, tool, identity, session string) []auditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []auditRecord{}
+	for i := len(a.recent) - 1; i >= 0 && len(out) < limit; i-- {
+		rec := a.recent[i]
+		if (tool != "" && rec.Tool != tool) || (identity != "" && rec.Identity != identity) || (session != "" && rec.Session != session) {
+			continue
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// newAuditRecord describes a finished tools/call request.
+func newAuditRecord(ctx context.Context, session string, in req, out resp, took time.Duration) auditRecord {
+	var p struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	_ = json.Unmarshal(in.Params, &p)
+	var args bytes.Buffer
+	if json.Compact(&args, p.Arguments) != nil {
+		args.Reset()
+		args.Write(p.Arguments)
+	}
+	sum := sha256.Sum256(args.Bytes())
+	rec := auditRecord{
+		Time:       time.Now().UTC(),
+		Session:    session,
+		Tenant:     mimir.Tenant(ctx),
+		RequestID:  mimir.RequestID(ctx),
+		Tool:       p.Name,
+		ArgsDigest: hex.EncodeToString(sum[:]),
+		DurationMs: float64(took.Microseconds()) / 1000,
+		Outcome:    "ok",
+	}
+	if opts, err := parseToolOptions(p.Arguments); err == nil && len(opts.Tenants) > 0 {
+		rec.Tenant = strings.Join(opts.Tenants, "|")
+	}
+	if who, authed := principalFrom(ctx); authed {
+		rec.Identity, rec.Role = who.Name, who.Role
+	}
+	if out.Error != nil {
+		rec.Outcome, rec.Error = "error", out.Error.Message
+		if out.Error.Code == codeForbidden {
+			rec.Outcome = "denied"
+		}
+	}
+	return rec
+}
+
+// handleAudit serves recent invocations:
+// GET /audit?limit=100&tool=...&identity=...&session=...
+// With a policy, only roles with "audit": true may read it.
+func (s *server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if s.policy != nil {
+		who, authed := s.policy.authenticate(r)
+		if !authed {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !s.policy.Roles[who.Role].Audit {
+			http.Error(w, fmt.Sprintf("role %q may not read the audit log", who.Role), http.StatusForbidden)
+			return
+		}
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	q := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"invocations": s.audit.query(limit, q.Get("tool"), q.Get("identity"), q.Get("session")),
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"mcp/internal/secret"
+)
+
+// policy maps bearer tokens to roles and roles to the tools they may call.
+// It is loaded from the JSON file named by MCP_POLICY_FILE:
+//
+//	{
+//	  "tokens": [
+//	    {"name": "ci", "token": "s3cret", "role": "readonly"},
+//	    {"name": "ops", "tokenFile": "/run/secrets/mcp-ops", "role": "admin"}
+//	  ],
+//	  "roles": {
+//	    "readonly": {"tools": ["servicegraph_topology", "spanmetrics_rps"]},
+//	    "intern":   {"tools": ["*"], "maxWindowMinutes": 60},
+//	    "team-a":   {"tools": ["*"], "tenants": ["team-a", "shared"]},
+//	    "admin":    {"tools": ["*"]}
+//	  }
+//	}
+type policy struct {
+	Tokens []policyToken   `json:"tokens"`
+	Roles  map[string]role `json:"roles"`
+}
+
+type policyToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// TokenFile names a file holding the token instead, e.g. a secret
+	// mount, re-read when rotated.
+	TokenFile string `json:"tokenFile"`
+	Role      string `json:"role"`
+
+	token secret.Secret
+}
+
+// role lists the allowed tools ("*" allows all) and the largest
+// windowMinutes its tool calls may use; 0 means no limit. Tenants, when set,
+// are the Mimir tenants its calls may query ("*" allows all). Audit grants
+// read access to the audit log.
+type role struct {
+	Tools            []string `json:"tools"`
+	MaxWindowMinutes int      `json:"maxWindowMinutes"`
+	Tenants          []string `json:"tenants"`
+	Audit            bool     `json:"audit"`
+}
+
+// codeForbidden is the JSON-RPC error code of calls denied by the policy.
+const codeForbidden = -32003
+
+// forbidden marks a policy violation found while running a tool.
+type forbidden struct{ error }
+
+// invalidParams is an error of a tool call whose arguments exceed the
+// server's limits.
+type invalidParams struct{ error }
+
+// toolError is the response to a failed tools/call.
+func toolError(id any, err error) resp {
+	var f forbidden
+	if errors.As(err, &f) {
+		return fail(id, codeForbidden, err)
+	}
+	var inv invalidParams
+	if errors.As(err, &inv) {
+		return fail(id, -32602, err)
+	}
+	return fail(id, -32000, err)
+}
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Name string
+	Role string
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the caller; ok is false when auth is disabled.
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+func loadPolicy(path string) (*policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, t := range p.Tokens {
+		if t.Token == "" && t.TokenFile == "" {
+			return nil, fmt.Errorf("token %q has no token value", t.Name)
+		}
+		if p.Tokens[i].token, err = secret.New(t.Token, t.TokenFile); err != nil {
+			return nil, fmt.Errorf("token %q: %w", t.Name, err)
+		}
+		if _, found := p.Roles[t.Role]; !found {
+			return nil, fmt.Errorf("token %q has unknown role %q", t.Name, t.Role)
+		}
+	}
+	return &p, nil
+}
+
+// authenticate resolves the bearer token of r.
+func (p *policy) authenticate(r *http.Request) (principal, bool) {
+	tok, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || tok == "" {
+		return principal{}, false
+	}
+	for _, t := range p.Tokens {
+		if v := t.token.Get(); v != "" && subtle.ConstantTimeCompare([]byte(v), []byte(tok)) == 1 {
+			return principal{Name: t.Name, Role: t.Role}, true
+		}
+	}
+	return principal{}, false
+}
+
+// allows reports whether the caller's role may use tool.
+func (p *policy) allows(who principal, tool string) bool {
+	for _, t := range p.Roles[who.Role].Tools {
+		if t == "*" || t == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that the caller's role may call tool. The error names the
+// role so it can be shown to the user as is.
+func (p *policy) authorize(who principal, tool string) error {
+	if !p.allows(who, tool) {
+		return fmt.Errorf("role %q is not allowed to call %s", who.Role, tool)
+	}
+	return nil
+}
+
+// checkWindow enforces the role's maximum query window on a plan about to
+// run, whichever argument (windowMinutes, weeks, ...) or default sized it.
+func (p *policy) checkWindow(who principal, window time.Duration) error {
+	max := p.Roles[who.Role].MaxWindowMinutes
+	if max > 0 && window > time.Duration(max)*time.Minute {
+		return fmt.Errorf("role %q may query at most %d minutes, this call covers %d", who.Role, max, int(window.Minutes()))
+	}
+	return nil
+}
+
+// checkTenants enforces the role's tenant allowlist on the X-Scope-OrgID of
+// a call, whose federated tenants must all be allowed. Without a tenant the
+// call would query Mimir's default one, which only "*" allows.
+func (p *policy) checkTenants(who principal, tenant string) error {
+	allowed := p.Roles[who.Role].Tenants
+	if len(allowed) == 0 || slices.Contains(allowed, "*") {
+		return nil
+	}
+	if tenant == "" {
+		return fmt.Errorf("role %q must name a tenant: one of %s", who.Role, strings.Join(allowed, ", "))
+	}
+	for _, t := range strings.Split(tenant, "|") {
+		if !slices.Contains(allowed, t) {
+			return fmt.Errorf("role %q may not query tenant %q", who.Role, t)
+		}
+	}
+	return nil
+}
+
+// visibleTools filters a tools/list result down to the tools the caller may
+// call.
+func (s *server) visibleTools(ctx context.Context, tools []any) []any {
+	who, authed := principalFrom(ctx)
+	if !authed {
+		return tools
+	}
+	out := make([]any, 0, len(tools))
+	for _, t := range tools {
+		if m, _ := t.(map[string]any); m != nil && s.policy.allows(who, fmt.Sprint(m["name"])) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testPolicy(t *testing.T) *policy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	err := os.WriteFile(path, []byte(`{
+	  "tokens": [
+	    {"name": "ci", "token": "s3cret", "role": "readonly"},
+	    {"name": "alex", "token": "an0ther", "role": "intern"},
+	    {"name": "team", "token": "t3am", "role": "team-a"}
+	  ],
+	  "roles": {
+	    "readonly": {"tools": ["servicegraph_topology", "spanmetrics_rps"]},
+	    "intern": {"tools": ["*"], "maxWindowMinutes": 60},
+	    "team-a": {"tools": ["*"], "tenants": ["team-a", "shared"]}
+	  }
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAuthenticate(t *testing.T) {
+	p := testPolicy(t)
+	for _, tc := range []struct {
+		header string
+		want   principal
+		ok     bool
+	}{
+		{"Bearer s3cret", principal{Name: "ci", Role: "readonly"}, true},
+		{"Bearer an0ther", principal{Name: "alex", Role: "intern"}, true},
+		{"Bearer unknown", principal{}, false},
+		{"Bearer ", principal{}, false},
+		{"s3cret", principal{}, false},
+		{"", principal{}, false},
+	} {
+		r := httptest.NewRequest("POST", "/rpc", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		got, ok := p.authenticate(r)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("authenticate(%q) = %v, %t, want %v, %t", tc.header, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	p := testPolicy(t)
+	for _, tc := range []struct {
+		role, tool string
+		ok         bool
+	}{
+		{"readonly", "spanmetrics_rps", true},
+		{"readonly", "servicegraph_topology", true},
+		{"readonly", "spanmetrics_red_summary", false},
+		{"intern", "spanmetrics_red_summary", true},
+		{"unknown", "spanmetrics_rps", false},
+	} {
+		err := p.authorize(principal{Name: "x", Role: tc.role}, tc.tool)
+		if (err == nil) != tc.ok {
+			t.Errorf("authorize(%s, %s) = %v, want allowed %t", tc.role, tc.tool, err, tc.ok)
+		}
+	}
+}
+
+func TestCheckWindow(t *testing.T) {
+	p := testPolicy(t)
+	for _, tc := range []struct {
+		role   string
+		window time.Duration
+		ok     bool
+	}{
+		{"intern", 30 * time.Minute, true},
+		{"intern", time.Hour, true},
+		{"intern", time.Hour + time.Minute, false},
+		{"intern", 7 * 24 * time.Hour, false},
+		{"readonly", 7 * 24 * time.Hour, true},
+	} {
+		err := p.checkWindow(principal{Name: "x", Role: tc.role}, tc.window)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkWindow(%s, %s) = %v, want allowed %t", tc.role, tc.window, err, tc.ok)
+		}
+	}
+}
+
+func TestCheckTenants(t *testing.T) {
+	p := testPolicy(t)
+	for _, tc := range []struct {
+		role, tenant string
+		ok           bool
+	}{
+		{"team-a", "team-a", true},
+		{"team-a", "team-a|shared", true},
+		{"team-a", "team-b", false},
+		{"team-a", "team-a|team-b", false},
+		{"team-a", "", false},
+		{"intern", "team-b", true},
+		{"intern", "", true},
+	} {
+		err := p.checkTenants(principal{Name: "x", Role: tc.role}, tc.tenant)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkTenants(%s, %q) = %v, want allowed %t", tc.role, tc.tenant, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"mcp/internal/promresult"
+)
+
+// errorCodeLabels are the spanmetrics dimensions carrying a response code,
+// depending on the semantic conventions version and protocol. They are only
+// present when configured as spanmetrics dimensions in the collector.
+var errorCodeLabels = []string{"http_status_code", "http_response_status_code", "rpc_grpc_status_code"}
+
+// errorRow is one group of a service's errors.
+type errorRow struct {
+	SpanName   string            `json:"span_name"`
+	Group      string            `json:"group,omitempty"`
+	StatusCode string            `json:"status_code,omitempty"`
+	Codes      map[string]string `json:"codes,omitempty"`
+	Count      float64           `json:"count"`
+	Rate       float64           `json:"rate"`
+	Share      float64           `json:"share"`
+}
+
+// planErrorBreakdown counts a server's failed calls over the window by span
+// name, span status and response code. A call counts as failed when its span
+// status is ERROR or it carries a 4xx/5xx HTTP code; the latter matters since
+// server spans leave 4xx responses unset by convention. With groupBy, rows
+// are also split by that label, their value in group.
+func planErrorBreakdown(serverName string, windowM int, groupBy, extra string) queryPlan {
+	sel := fmt.Sprintf(`{__name__=~"%s", service_name=%q, span_kind="SPAN_KIND_SERVER"%s`, currentCaps().Calls, serverName, extra)
+	by := sumBy(groupBy, append([]string{"span_name", "status_code"}, errorCodeLabels...)...)
+	q := fmt.Sprintf(`%s(increase(%s, status_code="STATUS_CODE_ERROR"}[%dm]) or increase(%s, http_status_code=~"[45].."}[%dm]) or increase(%s, http_response_status_code=~"[45].."}[%dm]))`,
+		by, sel, windowM, sel, windowM, sel, windowM)
+	p := instantPlan(windowM, namedQuery{promQL: q})
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		return shapeErrorBreakdown(res[""], float64(windowM*60), groupBy)
+	}
+	return p
+}
+
+// shapeErrorBreakdown turns the vector into rows ordered by count, with the
+// per-second rate over the window and each row's share of all errors.
+func shapeErrorBreakdown(raw json.RawMessage, windowSec float64, groupBy string) (any, error) {
+	samples, err := promresult.DecodeVector(raw)
+	if err != nil {
+		return nil, err
+	}
+	rows := []errorRow{}
+	var total float64
+	for _, smp := range samples {
+		// increase() extrapolates; round tiny leftovers of idle groups away
+		n := math.Round(smp.V*100) / 100
+		if math.IsNaN(n) || n <= 0 {
+			continue
+		}
+		r := errorRow{SpanName: smp.Labels["span_name"], Group: smp.Labels[groupBy], StatusCode: smp.Labels["status_code"], Count: n, Rate: n / windowSec}
+		for _, l := range errorCodeLabels {
+			if v := smp.Labels[l]; v != "" {
+				if r.Codes == nil {
+					r.Codes = map[string]string{}
+				}
+				r.Codes[l] = v
+			}
+		}
+		rows = append(rows, r)
+		total += n
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Count > rows[j].Count })
+	for i := range rows {
+		rows[i].Share = rows[i].Count / total
+	}
+	out := map[string]any{"total": total, "rate": total / windowSec, "errors": rows}
+	if groupBy != "" {
+		out["groupBy"] = groupBy
+	}
+	return out, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	mimir "mcp/internal/mimir"
+)
+
+// cachePolicy bounds how long a tool result is served. Within fresh it is
+// returned as is; up to fresh+stale it is still returned instantly while a
+// background refresh replaces it; older results are recomputed in the call.
+type cachePolicy struct {
+	fresh, stale time.Duration
+}
+
+// cachePolicies holds the per-tool bounds. Topology and top-N rankings move
+// slowly; rates and latencies get shorter bounds. Tools missing here are not
+// cached.
+var cachePolicies = map[string]cachePolicy{
+	"servicegraph_topology":           {fresh: 30 * time.Second, stale: 5 * time.Minute},
+	"servicegraph_latency_p95":        {fresh: 15 * time.Second, stale: 2 * time.Minute},
+	"spanmetrics_latency_quantile":    {fresh: 15 * time.Second, stale: 2 * time.Minute},
+	"spanmetrics_rps":                 {fresh: 15 * time.Second, stale: 2 * time.Minute},
+	"spanmetrics_top_callers":         {fresh: 30 * time.Second, stale: 5 * time.Minute},
+	"spanmetrics_top_endpoints":       {fresh: 30 * time.Second, stale: 5 * time.Minute},
+	"spanmetrics_red_summary":         {fresh: 15 * time.Second, stale: 2 * time.Minute},
+	"spanmetrics_error_breakdown":     {fresh: 30 * time.Second, stale: 2 * time.Minute},
+	"spanmetrics_latency_histogram":   {fresh: 30 * time.Second, stale: 2 * time.Minute},
+	"spanmetrics_latency_trend":       {fresh: time.Minute, stale: 5 * time.Minute},
+	"spanmetrics_capacity_headroom":   {fresh: 5 * time.Minute, stale: 30 * time.Minute},
+	"servicegraph_topology_diff":      {fresh: 30 * time.Second, stale: 5 * time.Minute},
+	"spanmetrics_seasonality_profile": {fresh: 15 * time.Minute, stale: time.Hour},
+}
+
+// refreshTimeout bounds a background refresh, which outlives the tool call
+// that triggered it.
+const refreshTimeout = 30 * time.Second
+
+type cacheEntry struct {
+	val        json.RawMessage
+	at         time.Time
+	refreshing bool
+}
+
+// resultCache caches tool results keyed by tenant, tool and request.
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	max     int
+}
+
+func newResultCache(max int) *resultCache {
+	return &resultCache{entries: map[string]*cacheEntry{}, max: max}
+}
+
+// len returns the number of cached results.
+func (c *resultCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// cached returns the result of fn for tool, served from the cache according
+// to the tool's policy. request identifies what fn queries.
+func (s *server) cached(ctx context.Context, tool, request string, fn func(context.Context) (json.RawMessage, error)) (json.RawMessage, error) {
+	pol, found := cachePolicies[tool]
+	if s.cache == nil || !found {
+		return fn(ctx)
+	}
+	cl, _ := clusterFrom(ctx)
+	key := mimir.Tenant(ctx) + "\x00" + cl.Name + "\x00" + tool + "\x00" + request
+
+	c := s.cache
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil {
+		age := time.Since(e.at)
+		if age < pol.fresh {
+			c.mu.Unlock()
+			return e.val, nil
+		}
+		if age < pol.fresh+pol.stale {
+			if !e.refreshing {
+				e.refreshing = true
+				go c.refresh(context.WithoutCancel(ctx), key, tool, fn)
+			}
+			c.mu.Unlock()
+			return e.val, nil
+		}
+	}
+	c.mu.Unlock()
+
+	val, err := fn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, val)
+	return val, nil
+}
+
+func (c *resultCache) refresh(ctx context.Context, key, tool string, fn func(context.Context) (json.RawMessage, error)) {
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+	val, err := fn(ctx)
+	if err != nil {
+		// keep serving the stale value until it ages out
+		log.Printf("cache refresh %s failed: %v", tool, err)
+		c.mu.Lock()
+		if e := c.entries[key]; e != nil {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.put(key, val)
+}
+
+func (c *resultCache) put(key string, val json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.entries[key]; !found && len(c.entries) >= c.max {
+		c.evictOldest()
+	}
+	c.entries[key] = &cacheEntry{val: val, at: time.Now()}
+}
+
+// evictOldest drops the least recently computed entry. The cache is small
+// enough for a linear scan.
+func (c *resultCache) evictOldest() {
+	var oldest string
+	var at time.Time
+	for k, e := range c.entries {
+		if oldest == "" || e.at.Before(at) {
+			oldest, at = k, e.at
+		}
+	}
+	delete(c.entries, oldest)
+}
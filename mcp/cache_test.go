@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mimir "mcp/internal/mimir"
+)
+
+// counter returns a tool function returning its call count, and the count.
+func counter() (func(context.Context) (json.RawMessage, error), *atomic.Int32) {
+	var n atomic.Int32
+	return func(context.Context) (json.RawMessage, error) {
+		return json.RawMessage(`{"call":` + strconv.Itoa(int(n.Add(1))) + `}`), nil
+	}, &n
+}
+
+// age backdates every cached entry by d.
+func age(c *resultCache, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		e.at = e.at.Add(-d)
+	}
+}
+
+func TestCachedFreshHit(t *testing.T) {
+	s := &server{cache: newResultCache(10)}
+	fn, calls := counter()
+	ctx := mimir.WithTenant(context.Background(), "team-a")
+	first, err := s.cached(ctx, "spanmetrics_rps", "a", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.cached(ctx, "spanmetrics_rps", "a", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(second) != string(first) || calls.Load() != 1 {
+		t.Errorf("fresh hit = %s after %d calls, want %s after 1", second, calls.Load(), first)
+	}
+	if _, err := s.cached(ctx, "spanmetrics_rps", "b", fn); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("another request was served from the cache")
+	}
+	if _, err := s.cached(ctx, "server_status", "a", fn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.cached(ctx, "server_status", "a", fn); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 4 {
+		t.Errorf("a tool without a cache policy was cached")
+	}
+}
+
+func TestCachedStaleRefreshesOnce(t *testing.T) {
+	s := &server{cache: newResultCache(10)}
+	ctx := mimir.WithTenant(context.Background(), "team-a")
+	if _, err := s.cached(ctx, "spanmetrics_rps", "a", func(context.Context) (json.RawMessage, error) {
+		return json.RawMessage(`"old"`), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pol := cachePolicies["spanmetrics_rps"]
+	age(s.cache, pol.fresh+time.Second)
+
+	var refreshes atomic.Int32
+	release, done := make(chan struct{}), make(chan struct{})
+	refresh := func(context.Context) (json.RawMessage, error) {
+		refreshes.Add(1)
+		<-release
+		defer close(done)
+		return json.RawMessage(`"new"`), nil
+	}
+	// stale hits while the refresh runs are served the old value and start
+	// no other refresh
+	for i := 0; i < 3; i++ {
+		got, err := s.cached(ctx, "spanmetrics_rps", "a", refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != `"old"` {
+			t.Errorf("stale hit %d = %s, want the stale value", i, got)
+		}
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh did not run")
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("refreshes = %d, want 1", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := s.cached(ctx, "spanmetrics_rps", "a", refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) == `"new"` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cached = %s after the refresh, want the new value", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("refreshes after the fresh value = %d, want 1", n)
+	}
+}
+
+func TestCachedPerTenantAndCluster(t *testing.T) {
+	s := &server{cache: newResultCache(10)}
+	fn, calls := counter()
+	base := context.Background()
+	for _, ctx := range []context.Context{
+		mimir.WithTenant(base, "team-a"),
+		mimir.WithTenant(base, "team-b"),
+		mimir.WithTenant(base, "team-a|team-b"),
+		base,
+		withCluster(mimir.WithTenant(base, "team-a"), cluster{Name: "eu"}),
+	} {
+		if _, err := s.cached(ctx, "spanmetrics_rps", "a", fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls.Load(); n != 5 {
+		t.Errorf("calls = %d, want one per tenant and cluster (5)", n)
+	}
+	got, err := s.cached(mimir.WithTenant(base, "team-b"), "spanmetrics_rps", "a", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"call":2}` || calls.Load() != 5 {
+		t.Errorf("team-b hit = %s, want its own result {\"call\":2}", got)
+	}
+}
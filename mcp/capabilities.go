@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mimir "mcp/internal/mimir"
+)
+
+// Metric names the tools read, emitted across collector versions. The
+// first present of each kind is read; latency histograms in milliseconds
+// are preferred when both units exist.
+var (
+	callsNames = []string{
+		"traces_span_metrics_calls_total",
+		"traces_spanmetrics_calls_total",
+		"calls_total",
+	}
+	latencyBucketsMs = []string{
+		"traces_span_metrics_duration_milliseconds_bucket",
+		"traces_spanmetrics_duration_milliseconds_bucket",
+		"duration_milliseconds_bucket",
+		"rpc_server_duration_milliseconds_bucket",
+	}
+	latencyBucketsSec = []string{
+		"traces_span_metrics_duration_seconds_bucket",
+		"traces_spanmetrics_duration_seconds_bucket",
+		"duration_seconds_bucket",
+	}
+	graphNames = []string{
+		"traces_service_graph_request_total",
+		"traces_service_graph_request_failed_total",
+	}
+)
+
+// Labels the tools select or group by, on spanmetrics and on servicegraph
+// metrics.
+var (
+	spanLabels  = []string{"service_name", "span_name", "span_kind", "status_code", "peer_service"}
+	graphLabels = []string{"client", "server"}
+)
+
+// latencyMetric is the raw latency histogram the tools read, a name or a
+// regex of names, and the factor converting its unit to milliseconds.
+type latencyMetric struct {
+	name string
+	toMs float64
+}
+
+// ms converts the value of expr, in the unit of m, to milliseconds.
+func (m latencyMetric) ms(expr string) string {
+	if m.toMs == 1 {
+		return expr
+	}
+	return fmt.Sprintf(`(%s) * %g`, expr, m.toMs)
+}
+
+// capabilities is what the backend has of the metrics the tools read, as
+// probed over the last hour.
+type capabilities struct {
+	// Calls and Latency are the spanmetrics the tools read: the names
+	// found, or regexes of the millisecond names before the first probe and
+	// when none is found.
+	Calls       string  `json:"calls"`
+	Latency     string  `json:"latency"`
+	LatencyToMs float64 `json:"latencyToMs"`
+	// Metrics maps the known metrics present to their label names.
+	Metrics map[string][]string `json:"metrics"`
+	// Problems explain missing metrics and labels, the likely cause of
+	// tools returning no data.
+	Problems []string   `json:"problems"`
+	Probed   *time.Time `json:"probed,omitempty"`
+}
+
+func defaultCapabilities() capabilities {
+	return capabilities{Calls: callsMetrics, Latency: bucketsMetrics, LatencyToMs: 1, Metrics: map[string][]string{}, Problems: []string{}}
+}
+
+// found tells whether the spanmetrics the tools read were found.
+func (c capabilities) found() bool {
+	_, calls := c.Metrics[c.Calls]
+	_, latency := c.Metrics[c.Latency]
+	return calls && latency
+}
+
+var (
+	capsMu sync.RWMutex
+	// caps is the profile of the default cluster, kept by discover, and
+	// discoverErr the error of its last probe, if it failed.
+	caps        = defaultCapabilities()
+	discoverErr string
+)
+
+// currentCaps returns the capabilities probed last.
+func currentCaps() capabilities {
+	capsMu.RLock()
+	defer capsMu.RUnlock()
+	return caps
+}
+
+// currentDiscoverErr returns the error of the last probe, if it failed.
+func currentDiscoverErr() string {
+	capsMu.RLock()
+	defer capsMu.RUnlock()
+	return discoverErr
+}
+
+// currentLatency returns the latency histogram probed last.
+func currentLatency() latencyMetric {
+	c := currentCaps()
+	return latencyMetric{name: c.Latency, toMs: c.LatencyToMs}
+}
+
+// discoverRetryInterval is how often the backend is probed again while it
+// lacks something, and discoverInterval how often otherwise, e.g. to follow
+// a collector upgrade.
+const (
+	discoverRetryInterval = 30 * time.Second
+	discoverInterval      = 10 * time.Minute
+)
+
+// discover probes the capabilities of the default cluster and makes the
+// tools read what it has, until ctx is done, and marks the server ready
+// once it has the spanmetrics. Changes and problems are logged. Queries run
+// as MIMIR_TENANT.
+func (s *server) discover(ctx context.Context) {
+	ctx = mimir.WithTenant(ctx, s.tenant)
+	for {
+		interval := discoverRetryInterval
+		c, err := probeCapabilities(ctx, s.c)
+		if err != nil {
+			log.Printf("metric discovery: %v", err)
+			var ue *url.Error
+			if errors.As(err, &ue) {
+				err = ue.Err
+			}
+			capsMu.Lock()
+			discoverErr = err.Error()
+			capsMu.Unlock()
+		} else {
+			if len(c.Problems) == 0 {
+				interval = discoverInterval
+			}
+			capsMu.Lock()
+			if c.Calls != caps.Calls || c.Latency != caps.Latency {
+				log.Printf("metric discovery: calls %s, latency %s (x%g to ms)", c.Calls, c.Latency, c.LatencyToMs)
+			}
+			if fmt.Sprint(c.Problems) != fmt.Sprint(caps.Problems) {
+				for _, p := range c.Problems {
+					log.Printf("metric discovery: %s", p)
+				}
+			}
+			caps, discoverErr = c, ""
+			capsMu.Unlock()
+			if c.found() && !ready.Swap(true) {
+				log.Printf("ready: spanmetrics found in %s", s.c.BaseURL)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probeCapabilities looks up which of the known metrics, and the recorded
+// ones if set, c has over the last hour, and their labels.
+func probeCapabilities(ctx context.Context, c *mimir.Client) (capabilities, error) {
+	end := time.Now()
+	start := end.Add(-time.Hour)
+	var all []string
+	for _, names := range [][]string{callsNames, latencyBucketsMs, latencyBucketsSec, graphNames, {recorded.rate, recorded.errors, recorded.latency}} {
+		for _, n := range names {
+			if n != "" {
+				all = append(all, n)
+			}
+		}
+	}
+	found, err := c.LabelValues(ctx, "__name__", []string{`{__name__=~"` + strings.Join(all, "|") + `"}`}, start, end)
+	if err != nil {
+		return capabilities{}, err
+	}
+	out := defaultCapabilities()
+	probed := end.UTC()
+	out.Probed = &probed
+	for _, n := range found {
+		labels, err := c.LabelNames(ctx, []string{`{__name__="` + n + `"}`}, start, end)
+		if err != nil {
+			return capabilities{}, err
+		}
+		out.Metrics[n] = labels
+	}
+	first := func(names []string) string {
+		for _, n := range names {
+			if _, ok := out.Metrics[n]; ok {
+				return n
+			}
+		}
+		return ""
+	}
+	if n := first(callsNames); n != "" {
+		out.Calls = n
+	} else {
+		out.Problems = append(out.Problems, fmt.Sprintf("no spanmetrics calls counter (%s): request rate and error tools return no data; check the collector's spanmetrics connector and its export to the backend", strings.Join(callsNames, ", ")))
+	}
+	if n := first(latencyBucketsMs); n != "" {
+		out.Latency = n
+	} else if n := first(latencyBucketsSec); n != "" {
+		out.Latency, out.LatencyToMs = n, 1000
+	} else {
+		out.Problems = append(out.Problems, "no spanmetrics duration histogram: latency tools return no data; check the spanmetrics connector's histogram settings")
+	}
+	for _, n := range graphNames {
+		if _, ok := out.Metrics[n]; !ok {
+			out.Problems = append(out.Problems, fmt.Sprintf("no %s: service graph tools return no data; check the collector's servicegraph connector", n))
+		}
+	}
+	for _, r := range []struct{ env, name string }{{"RECORDED_RATE_METRIC", recorded.rate}, {"RECORDED_ERROR_METRIC", recorded.errors}, {"RECORDED_LATENCY_METRIC", recorded.latency}} {
+		if _, ok := out.Metrics[r.name]; r.name != "" && !ok {
+			out.Problems = append(out.Problems, fmt.Sprintf("no %s (%s): tools reading it return no data; check the recording rules", r.name, r.env))
+		}
+	}
+	for _, m := range []struct {
+		name   string
+		labels []string
+	}{{out.Calls, spanLabels}, {out.Latency, spanLabels}, {graphNames[0], graphLabels}} {
+		have, ok := out.Metrics[m.name]
+		if !ok {
+			continue
+		}
+		for _, l := range m.labels {
+			if !slices.Contains(have, l) {
+				out.Problems = append(out.Problems, fmt.Sprintf("%s has no %s label: tools selecting or grouping by it return no data", m.name, l))
+			}
+		}
+	}
+	return out, nil
+}
+
+// handleCapabilities serves the capabilities of the default cluster as last
+// probed.
+func (s *server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if s.policy != nil {
+		if _, authed := s.policy.authenticate(r); !authed {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(currentCaps())
+}
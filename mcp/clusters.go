@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+
+	mimir "mcp/internal/mimir"
+	"mcp/internal/secret"
+)
+
+// cluster is a Mimir backend tools can query by name, read from
+// MIMIR_CLUSTERS_FILE. The cluster's tenants, pipe-separated in Tenant or
+// listed in Tenants, replace the caller's when set.
+type cluster struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Tenant      string   `json:"tenant"`
+	Tenants     []string `json:"tenants"`
+	BearerToken string   `json:"bearerToken"`
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	// BearerTokenFile and PasswordFile name files holding the credentials
+	// instead, e.g. secret mounts, re-read when rotated.
+	BearerTokenFile string `json:"bearerTokenFile"`
+	PasswordFile    string `json:"passwordFile"`
+
+	bearerToken, password secret.Secret
+
+	c *mimir.Client
+}
+
+// loadClusters reads a JSON array of clusters and gives each a client with
+// the settings of base. Names must be unique and not "all", which selects
+// every cluster.
+func loadClusters(path string, base *mimir.Client) ([]cluster, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []cluster
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s: no clusters", path)
+	}
+	seen := map[string]bool{}
+	for i, cl := range out {
+		if cl.Name == "" || cl.Name == "all" || seen[cl.Name] {
+			return nil, fmt.Errorf("%s: invalid or duplicate cluster name %q", path, cl.Name)
+		}
+		if cl.URL == "" {
+			return nil, fmt.Errorf("%s: cluster %q has no url", path, cl.Name)
+		}
+		seen[cl.Name] = true
+		if out[i].bearerToken, err = secret.New(cl.BearerToken, cl.BearerTokenFile); err != nil {
+			return nil, fmt.Errorf("%s: cluster %q: bearer token: %w", path, cl.Name, err)
+		}
+		if out[i].password, err = secret.New(cl.Password, cl.PasswordFile); err != nil {
+			return nil, fmt.Errorf("%s: cluster %q: password: %w", path, cl.Name, err)
+		}
+		tenants := cl.Tenants
+		if cl.Tenant != "" {
+			tenants = append(strings.Split(cl.Tenant, "|"), tenants...)
+		}
+		tenant, err := federatedTenant(tenants)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cluster %q: %w", path, cl.Name, err)
+		}
+		c := *base
+		c.BaseURL = strings.TrimSuffix(cl.URL, "/")
+		c.Tenant = tenant
+		c.BearerToken, c.Username, c.Password = out[i].bearerToken, cl.Username, out[i].password
+		out[i].c = &c
+	}
+	return out, nil
+}
+
+type clusterKey struct{}
+
+// withCluster returns a context whose Mimir queries go to cl.
+func withCluster(ctx context.Context, cl cluster) context.Context {
+	return context.WithValue(ctx, clusterKey{}, cl)
+}
+
+// clusterFrom returns the cluster set with withCluster.
+func clusterFrom(ctx context.Context) (cluster, bool) {
+	cl, ok := ctx.Value(clusterKey{}).(cluster)
+	return cl, ok
+}
+
+// mimirFor returns the client of the cluster of ctx, by default the first.
+func (s *server) mimirFor(ctx context.Context) *mimir.Client {
+	if cl, ok := clusterFrom(ctx); ok {
+		return cl.c
+	}
+	return s.c
+}
+
+// findCluster returns the cluster named name.
+func (s *server) findCluster(name string) (cluster, bool) {
+	for _, cl := range s.clusters {
+		if cl.Name == name {
+			return cl, true
+		}
+	}
+	return cluster{}, false
+}
+
+// promData is the data of a Prometheus query response.
+type promData struct {
+	ResultType string           `json:"resultType"`
+	Result     []map[string]any `json:"result"`
+}
+
+// fanOut runs tool call r on every cluster, at most s.parallel at once,
+// and merges the results. Query results, alone or keyed by query name, are
+// merged into one with a cluster label on every series; other results are
+// keyed by cluster. Failed clusters are listed in unavailable, unless all
+// fail.
+func (s *server) fanOut(ctx context.Context, r req) resp {
+	outs := make([]resp, len(s.clusters))
+	var g errgroup.Group
+	g.SetLimit(s.parallel)
+	for i, cl := range s.clusters {
+		i, cl := i, cl
+		g.Go(func() error {
+			outs[i] = s.handle(withCluster(ctx, cl), r)
+			return nil
+		})
+	}
+	g.Wait()
+	results := map[string]json.RawMessage{}
+	var names, unavailable []string
+	var lastErr *rpcError
+	for i, cl := range s.clusters {
+		out := outs[i]
+		if out.Error != nil {
+			unavailable = append(unavailable, cl.Name+": "+out.Error.Message)
+			lastErr = out.Error
+			continue
+		}
+		text := resultText(out)
+		if !json.Valid([]byte(text)) {
+			// e.g. a mermaid graph
+			b, _ := json.Marshal(text)
+			text = string(b)
+		}
+		results[cl.Name] = json.RawMessage(text)
+		names = append(names, cl.Name)
+	}
+	if len(names) == 0 {
+		return resp{ID: r.ID, JSONRPC: "2.0", Error: lastErr}
+	}
+	merged, isQuery := mergeQueryResults(names, results)
+	if !isQuery {
+		merged = map[string]any{"clusters": results}
+	}
+	if len(unavailable) > 0 {
+		merged["unavailable"] = unavailable
+	}
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return toolError(r.ID, err)
+	}
+	return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(b)}}})
+}
+
+// resultText returns the text of a successful tool result.
+func resultText(out resp) string {
+	res, _ := out.Result.(map[string]any)
+	content, _ := res["content"].([]any)
+	if len(content) == 0 {
+		return ""
+	}
+	item, _ := content[0].(map[string]any)
+	text, _ := item["text"].(string)
+	return text
+}
+
+// mergeQueryResults merges the Prometheus query results of each cluster,
+// or maps of them keyed by query name, labelling every series with its
+// cluster. isQuery is false when a result is neither.
+func mergeQueryResults(names []string, results map[string]json.RawMessage) (map[string]any, bool) {
+	merge := func(into *promData, name string, raw json.RawMessage) bool {
+		var d promData
+		if json.Unmarshal(raw, &d) != nil || d.ResultType == "" || (into.ResultType != "" && into.ResultType != d.ResultType) {
+			return false
+		}
+		into.ResultType = d.ResultType
+		for _, r := range d.Result {
+			metric, _ := r["metric"].(map[string]any)
+			if metric == nil {
+				metric = map[string]any{}
+			}
+			metric["cluster"] = name
+			r["metric"] = metric
+			into.Result = append(into.Result, r)
+		}
+		return true
+	}
+	single := promData{Result: []map[string]any{}}
+	isSingle := true
+	for _, name := range names {
+		if !merge(&single, name, results[name]) {
+			isSingle = false
+			break
+		}
+	}
+	if isSingle {
+		return map[string]any{"resultType": single.ResultType, "result": single.Result}, true
+	}
+	byQuery := map[string]*promData{}
+	for _, name := range names {
+		var m map[string]json.RawMessage
+		if json.Unmarshal(results[name], &m) != nil || len(m) == 0 {
+			return nil, false
+		}
+		for q, raw := range m {
+			if byQuery[q] == nil {
+				byQuery[q] = &promData{Result: []map[string]any{}}
+			}
+			if !merge(byQuery[q], name, raw) {
+				return nil, false
+			}
+		}
+	}
+	out := make(map[string]any, len(byQuery))
+	for q, d := range byQuery {
+		out[q] = d
+	}
+	return out, true
+}
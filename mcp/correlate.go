@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"mcp/internal/promresult"
+)
+
+// correlateArgs are the arguments of correlate.
+type correlateArgs struct {
+	Service string `json:"service"`
+	// At is the moment to look around, RFC 3339; defaults to now.
+	At string `json:"at"`
+	// WindowMinutes is how far before and after At to look.
+	WindowMinutes int `json:"windowMinutes"`
+}
+
+// correlateRange resolves the time range of a: WindowMinutes around At,
+// cut off at now.
+func correlateRange(a correlateArgs) (at, from, to time.Time, err error) {
+	now := time.Now().UTC()
+	at = now
+	if a.At != "" {
+		if at, err = time.Parse(time.RFC3339, a.At); err != nil {
+			return at, from, to, fmt.Errorf("invalid at: %w", err)
+		}
+	}
+	if at.After(now) {
+		return at, from, to, fmt.Errorf("at must not be in the future")
+	}
+	if a.WindowMinutes <= 0 {
+		a.WindowMinutes = 15
+	}
+	w := time.Duration(a.WindowMinutes) * time.Minute
+	from, to = at.Add(-w), at.Add(w)
+	if to.After(now) {
+		to = now
+	}
+	return at, from, to, nil
+}
+
+// correlatePoint is the RED metrics of the service at one step.
+type correlatePoint struct {
+	Time       time.Time `json:"time"`
+	RPS        float64   `json:"rps"`
+	ErrorRatio float64   `json:"error_ratio"`
+	P95Ms      *float64  `json:"p95_ms,omitempty"`
+}
+
+// chronologyEntry is one thing that happened, from any signal.
+type chronologyEntry struct {
+	Time time.Time `json:"time"`
+	// OffsetS is the time relative to at, negative before it.
+	OffsetS float64 `json:"offset_s"`
+	// Source is metrics, trace or log.
+	Source  string `json:"source"`
+	Summary string `json:"summary"`
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// correlation is the correlate tool result. Sources that failed are left
+// out of the chronology and listed in Unavailable.
+type correlation struct {
+	Service     string            `json:"service"`
+	At          time.Time         `json:"at"`
+	From        time.Time         `json:"from"`
+	To          time.Time         `json:"to"`
+	Metrics     []correlatePoint  `json:"metrics"`
+	Chronology  []chronologyEntry `json:"chronology"`
+	Unavailable []string          `json:"unavailable,omitempty"`
+}
+
+// planCorrelate queries the RED metrics of service between from and to at
+// a one minute step.
+func planCorrelate(service string, from, to time.Time, extra string) queryPlan {
+	calls := fmt.Sprintf(`{__name__=~"%s", service_name=%q, span_kind="SPAN_KIND_SERVER"%s`, currentCaps().Calls, service, extra)
+	lm := currentLatency()
+	p := queryPlan{
+		queries: []namedQuery{
+			{name: "rate", promQL: fmt.Sprintf(`sum(rate(%s}[2m]))`, calls)},
+			{name: "errors", promQL: fmt.Sprintf(`sum(rate(%s, status_code="STATUS_CODE_ERROR"}[2m]))`, calls)},
+			{name: "p95", promQL: lm.ms(fmt.Sprintf(`histogram_quantile(0.95, sum by (le) (rate(%s[2m])))`, exemplarSelector(lm, service, extra)))},
+		},
+		window: to.Sub(from),
+		step:   time.Minute,
+		end:    to,
+	}
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		return shapeCorrelate(res)
+	}
+	return p
+}
+
+func shapeCorrelate(res map[string]json.RawMessage) (any, error) {
+	byTime := map[time.Time]*correlatePoint{}
+	for _, name := range []string{"rate", "errors", "p95"} {
+		series, err := promresult.DecodeMatrix(res[name])
+		if err != nil {
+			return nil, err
+		}
+		for _, ser := range series {
+			for _, pt := range ser.Points {
+				if math.IsNaN(pt.V) || math.IsInf(pt.V, 0) {
+					continue
+				}
+				cp := byTime[pt.T]
+				if cp == nil {
+					cp = &correlatePoint{Time: pt.T.UTC()}
+					byTime[pt.T] = cp
+				}
+				switch name {
+				case "rate":
+					cp.RPS = pt.V
+				case "errors":
+					cp.ErrorRatio = pt.V
+				case "p95":
+					v := pt.V
+					cp.P95Ms = &v
+				}
+			}
+		}
+	}
+	out := make([]correlatePoint, 0, len(byTime))
+	for _, cp := range byTime {
+		// errors held the error rate until the request rate was known
+		if cp.RPS > 0 {
+			cp.ErrorRatio = math.Min(cp.ErrorRatio/cp.RPS, 1)
+		} else {
+			cp.ErrorRatio = 0
+		}
+		out = append(out, *cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// metricChanges finds where the metrics left their level before at: the
+// first step with an error ratio above graphWarnRatio after a baseline
+// below it, with p95 above 1.5 times the baseline median, and with the
+// request rate below half or above twice the baseline median.
+func metricChanges(points []correlatePoint, at time.Time) []chronologyEntry {
+	var rps, p95, errs []float64
+	for _, p := range points {
+		if p.Time.After(at) {
+			break
+		}
+		rps = append(rps, p.RPS)
+		errs = append(errs, p.ErrorRatio)
+		if p.P95Ms != nil {
+			p95 = append(p95, *p.P95Ms)
+		}
+	}
+	if len(rps) == 0 {
+		return nil
+	}
+	baseRPS, baseErr, baseP95 := median(rps), median(errs), 0.0
+	if len(p95) > 0 {
+		baseP95 = median(p95)
+	}
+	var out []chronologyEntry
+	seen := map[string]bool{}
+	add := func(p correlatePoint, kind, summary string) {
+		if seen[kind] {
+			return
+		}
+		seen[kind] = true
+		out = append(out, chronologyEntry{Time: p.Time, Source: "metrics", Summary: summary})
+	}
+	for _, p := range points {
+		if baseErr < graphWarnRatio && p.ErrorRatio >= graphWarnRatio {
+			add(p, "errors", fmt.Sprintf("error ratio rose to %.1f%% (baseline %.1f%%)", 100*p.ErrorRatio, 100*baseErr))
+		}
+		if p.P95Ms != nil && baseP95 > 0 && *p.P95Ms > 1.5*baseP95 {
+			add(p, "p95", fmt.Sprintf("p95 rose to %.0fms (baseline %.0fms)", *p.P95Ms, baseP95))
+		}
+		if baseRPS > 0 && p.RPS < baseRPS/2 {
+			add(p, "rps_drop", fmt.Sprintf("request rate fell to %.3g/s (baseline %.3g/s)", p.RPS, baseRPS))
+		}
+		if baseRPS > 0 && p.RPS > 2*baseRPS {
+			add(p, "rps_rise", fmt.Sprintf("request rate rose to %.3g/s (baseline %.3g/s)", p.RPS, baseRPS))
+		}
+	}
+	return out
+}
+
+// correlate aligns the metrics of service around at with its failed and
+// slow traces and error logs on one timeline. Only the metrics are
+// required; traces and logs are best effort. Slow means at least the
+// median p95 before at.
+func (s *server) correlate(ctx context.Context, a correlateArgs, opts toolOptions) (json.RawMessage, error) {
+	at, from, to, err := correlateRange(a)
+	if err != nil {
+		return nil, err
+	}
+	plan := planCorrelate(a.Service, from, to, opts.matchers())
+	errTraces := searchArgs{Service: a.Service, Error: true}
+	logs := logsArgs{Service: a.Service, ErrorsOnly: true}
+	if opts.Explain {
+		queries, err := explain(plan)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]any{
+			"queries": queries,
+			"traces":  map[string]string{"endpoint": s.tempo.BaseURL + "/api/search", "traceql": errTraces.traceQL()},
+			"logs":    map[string]string{"endpoint": s.loki.BaseURL + "/loki/api/v1/query_range", "logql": logs.logQL(opts.matchers())},
+		})
+	}
+	raw, err := s.runPlan(ctx, "correlate", opts, plan)
+	if err != nil {
+		return nil, err
+	}
+	out := correlation{Service: a.Service, At: at, From: from, To: to, Chronology: []chronologyEntry{}}
+	if err := json.Unmarshal(raw, &out.Metrics); err != nil {
+		return nil, err
+	}
+	out.Chronology = append(out.Chronology, metricChanges(out.Metrics, at)...)
+
+	slow := searchArgs{Service: a.Service}
+	var p95 []float64
+	for _, p := range out.Metrics {
+		if p.P95Ms != nil && !p.Time.After(at) {
+			p95 = append(p95, *p.P95Ms)
+		}
+	}
+	if len(p95) > 0 {
+		slow.MinDurationMs = int(median(p95))
+	}
+	seen := map[string]bool{}
+	for _, q := range []struct {
+		args searchArgs
+		kind string
+	}{{errTraces, "failed"}, {slow, "slow"}} {
+		if q.kind == "slow" && q.args.MinDurationMs <= 0 {
+			continue
+		}
+		found, err := s.tempo.Search(ctx, q.args.traceQL(), from, to, 10)
+		if err != nil {
+			out.Unavailable = append(out.Unavailable, "traces: "+err.Error())
+			break
+		}
+		for _, t := range found {
+			if seen[t.TraceID] {
+				continue
+			}
+			seen[t.TraceID] = true
+			summary := fmt.Sprintf("%s trace %s %s, %.0fms", q.kind, t.RootService, t.RootName, ms(t.Duration))
+			out.Chronology = append(out.Chronology, chronologyEntry{Time: t.Start, Source: "trace", Summary: summary, TraceID: t.TraceID})
+		}
+	}
+
+	entries, err := s.loki.QueryRange(ctx, logs.logQL(opts.matchers()), from, to, 50)
+	if err != nil {
+		out.Unavailable = append(out.Unavailable, "logs: "+err.Error())
+	}
+	for _, e := range entries {
+		line := e.Line
+		if len(line) > 200 {
+			line = strings.ToValidUTF8(line[:200], "") + "…"
+		}
+		out.Chronology = append(out.Chronology, chronologyEntry{Time: e.Time, Source: "log", Summary: line})
+	}
+
+	for i := range out.Chronology {
+		out.Chronology[i].OffsetS = out.Chronology[i].Time.Sub(at).Seconds()
+	}
+	sort.SliceStable(out.Chronology, func(i, j int) bool { return out.Chronology[i].Time.Before(out.Chronology[j].Time) })
+	return json.Marshal(out)
+}
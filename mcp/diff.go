@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"time"
+
+	"mcp/internal/promresult"
+)
+
+// edgeStats is the traffic of one client->server edge in one window.
+type edgeStats struct {
+	Requests   float64 `json:"requests"`
+	ErrorRatio float64 `json:"error_ratio"`
+}
+
+// edgeDiff is an edge present in either window.
+type edgeDiff struct {
+	Client   string     `json:"client"`
+	Server   string     `json:"server"`
+	Baseline *edgeStats `json:"baseline,omitempty"`
+	Current  *edgeStats `json:"current,omitempty"`
+	// VolumeChange is the relative change of requests (0.5 = +50%).
+	VolumeChange float64 `json:"volume_change,omitempty"`
+	// ErrorRatioChange is the absolute change of the failed share.
+	ErrorRatioChange float64 `json:"error_ratio_change,omitempty"`
+}
+
+// planTopologyDiff compares servicegraph edges of the last windowM minutes
+// with the same length window ending offsetM minutes ago. Edges whose volume
+// changes by more than volumeThreshold (relative) or whose error ratio
+// changes by more than errorThreshold (absolute) are reported as changed.
+func planTopologyDiff(windowM, offsetM int, volumeThreshold, errorThreshold float64, extra string) queryPlan {
+	q := func(metric, offset string) string {
+		return fmt.Sprintf(`sum by (client, server) (increase({__name__="%s"%s}[%dm]%s))`, metric, extra, windowM, offset)
+	}
+	off := fmt.Sprintf(" offset %dm", offsetM)
+	p := instantPlan(windowM,
+		namedQuery{name: "current", promQL: q("traces_service_graph_request_total", "")},
+		namedQuery{name: "current_failed", promQL: q("traces_service_graph_request_failed_total", "")},
+		namedQuery{name: "baseline", promQL: q("traces_service_graph_request_total", off)},
+		namedQuery{name: "baseline_failed", promQL: q("traces_service_graph_request_failed_total", off)},
+	)
+	// the baseline reaches back offsetM+windowM minutes
+	p.window = time.Duration(windowM+offsetM) * time.Minute
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		cur, err := decodeEdges(res["current"], res["current_failed"])
+		if err != nil {
+			return nil, err
+		}
+		base, err := decodeEdges(res["baseline"], res["baseline_failed"])
+		if err != nil {
+			return nil, err
+		}
+		end := time.Now().UTC()
+		win := time.Duration(windowM) * time.Minute
+		baseEnd := end.Add(-time.Duration(offsetM) * time.Minute)
+		out := diffEdges(base, cur, volumeThreshold, errorThreshold)
+		out["current"] = map[string]string{"from": end.Add(-win).Format(time.RFC3339), "to": end.Format(time.RFC3339)}
+		out["baseline"] = map[string]string{"from": baseEnd.Add(-win).Format(time.RFC3339), "to": baseEnd.Format(time.RFC3339)}
+		return out, nil
+	}
+	return p
+}
+
+type edgeKey struct{ client, server string }
+
+// decodeEdges combines request and failure vectors into per-edge stats.
+// Edges with no requests in the window are left out.
+func decodeEdges(reqRaw, failRaw json.RawMessage) (map[edgeKey]edgeStats, error) {
+	reqs, err := promresult.DecodeVector(reqRaw)
+	if err != nil {
+		return nil, err
+	}
+	fails, err := promresult.DecodeVector(failRaw)
+	if err != nil {
+		return nil, err
+	}
+	failed := map[edgeKey]float64{}
+	for _, s := range fails {
+		if !math.IsNaN(s.V) {
+			failed[edgeKey{s.Labels["client"], s.Labels["server"]}] = s.V
+		}
+	}
+	out := map[edgeKey]edgeStats{}
+	for _, s := range reqs {
+		if math.IsNaN(s.V) || s.V <= 0 {
+			continue
+		}
+		k := edgeKey{s.Labels["client"], s.Labels["server"]}
+		out[k] = edgeStats{Requests: s.V, ErrorRatio: math.Min(failed[k]/s.V, 1)}
+	}
+	return out, nil
+}
+
+func diffEdges(base, cur map[edgeKey]edgeStats, volumeThreshold, errorThreshold float64) map[string]any {
+	added, removed, changed := []edgeDiff{}, []edgeDiff{}, []edgeDiff{}
+	for k, c := range cur {
+		c := c
+		b, found := base[k]
+		if !found {
+			added = append(added, edgeDiff{Client: k.client, Server: k.server, Current: &c})
+			continue
+		}
+		d := edgeDiff{
+			Client: k.client, Server: k.server, Baseline: &b, Current: &c,
+			VolumeChange:     (c.Requests - b.Requests) / b.Requests,
+			ErrorRatioChange: c.ErrorRatio - b.ErrorRatio,
+		}
+		if math.Abs(d.VolumeChange) > volumeThreshold || math.Abs(d.ErrorRatioChange) > errorThreshold {
+			changed = append(changed, d)
+		}
+	}
+	for k, b := range base {
+		b := b
+		if _, found := cur[k]; !found {
+			removed = append(removed, edgeDiff{Client: k.client, Server: k.server, Baseline: &b})
+		}
+	}
+	for _, l := range [][]edgeDiff{added, removed, changed} {
+		sort.Slice(l, func(i, j int) bool {
+			if l[i].Client != l[j].Client {
+				return l[i].Client < l[j].Client
+			}
+			return l[i].Server < l[j].Server
+		})
+	}
+	return map[string]any{"new": added, "removed": removed, "changed": changed}
+}
+
+// diffDeployment is a deployment of a service on an edge that appeared,
+// disappeared or changed.
+type diffDeployment struct {
+	Service string    `json:"service"`
+	Version string    `json:"version,omitempty"`
+	Time    time.Time `json:"time"`
+	// MinutesBefore is how long before the end of the current window it
+	// happened.
+	MinutesBefore float64 `json:"minutes_before"`
+	Note          string  `json:"note"`
+}
+
+// annotateDeployments adds to a servicegraph_topology_diff result the
+// deployments if-service knows of the services on its new, removed and
+// changed edges since the baseline window ended, newest first. They are
+// best effort: a failure is listed in unavailable.
+func (s *server) annotateDeployments(ctx context.Context, raw json.RawMessage) (json.RawMessage, error) {
+	var res struct {
+		New, Removed, Changed []edgeDiff
+		Current, Baseline     struct{ To time.Time }
+	}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	services := map[string]bool{}
+	for _, l := range [][]edgeDiff{res.New, res.Removed, res.Changed} {
+		for _, d := range l {
+			services[d.Client], services[d.Server] = true, true
+		}
+	}
+	deployments := []diffDeployment{}
+	var unavailable []string
+	if s.ifURL == "" {
+		unavailable = append(unavailable, "deployments: IF_URL not set")
+	} else if len(services) > 0 {
+		q := url.Values{}
+		q.Set("from", res.Baseline.To.Format(time.RFC3339))
+		q.Set("to", res.Current.To.Format(time.RFC3339))
+		var body struct {
+			Deployments []struct {
+				Service, Version string
+				Time             time.Time
+			} `json:"deployments"`
+		}
+		if err := s.getIF(ctx, s.ifURL+"/api/v1/deployments?"+q.Encode(), &body); err != nil {
+			unavailable = append(unavailable, "deployments: "+err.Error())
+		}
+		for _, d := range body.Deployments {
+			if !services[d.Service] {
+				continue
+			}
+			what := d.Service
+			if d.Version != "" {
+				what += " " + d.Version
+			}
+			before := res.Current.To.Sub(d.Time).Minutes()
+			deployments = append(deployments, diffDeployment{
+				Service:       d.Service,
+				Version:       d.Version,
+				Time:          d.Time,
+				MinutesBefore: before,
+				Note:          fmt.Sprintf("deployment of %s occurred %.0f minutes before the end of the current window", what, before),
+			})
+		}
+	}
+	var err error
+	if out["deployments"], err = json.Marshal(deployments); err != nil {
+		return nil, err
+	}
+	if unavailable != nil {
+		if out["unavailable"], err = json.Marshal(unavailable); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(out)
+}
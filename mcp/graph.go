@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Node colors by error ratio of the requests a service receives.
+const (
+	graphWarnRatio = 0.01
+	graphCritRatio = 0.05
+)
+
+// graphResources are the MCP resources rendering the current topology.
+var graphResources = []map[string]any{
+	{
+		"uri":         "servicegraph://topology.mmd",
+		"name":        "Service graph (Mermaid)",
+		"description": "Current service graph as a Mermaid flowchart; node color by error rate, edge width by RPS",
+		"mimeType":    "text/vnd.mermaid",
+	},
+	{
+		"uri":         "servicegraph://topology.dot",
+		"name":        "Service graph (Graphviz DOT)",
+		"description": "Current service graph as a Graphviz digraph; node color by error rate, edge width by RPS",
+		"mimeType":    "text/vnd.graphviz",
+	},
+}
+
+// graphFormats maps resource URIs to render formats.
+var graphFormats = map[string]string{
+	"servicegraph://topology.mmd": "mermaid",
+	"servicegraph://topology.dot": "dot",
+}
+
+// toolText is a shape result returned to the client as is rather than
+// marshalled as JSON.
+type toolText string
+
+type graphEdge struct {
+	client, server string
+	rps, errRatio  float64
+}
+
+// planGraph renders the servicegraph edges of the last windowM minutes as
+// format ("mermaid" or "dot").
+func planGraph(windowM int, format, extra string) queryPlan {
+	q := func(metric string) string {
+		return fmt.Sprintf(`sum by (client, server) (rate({__name__="%s"%s}[%dm]))`, metric, extra, windowM)
+	}
+	p := instantPlan(windowM,
+		namedQuery{name: "requests", promQL: q("traces_service_graph_request_total")},
+		namedQuery{name: "failed", promQL: q("traces_service_graph_request_failed_total")},
+	)
+	p.variant = format
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		stats, err := decodeEdges(res["requests"], res["failed"])
+		if err != nil {
+			return nil, err
+		}
+		edges := make([]graphEdge, 0, len(stats))
+		for k, st := range stats {
+			edges = append(edges, graphEdge{client: k.client, server: k.server, rps: st.Requests, errRatio: st.ErrorRatio})
+		}
+		sort.Slice(edges, func(i, j int) bool {
+			if edges[i].client != edges[j].client {
+				return edges[i].client < edges[j].client
+			}
+			return edges[i].server < edges[j].server
+		})
+		if format == "dot" {
+			return toolText(renderDOT(edges)), nil
+		}
+		return toolText(renderMermaid(edges)), nil
+	}
+	return p
+}
+
+// graphNodes returns the services in name order and the error ratio of the
+// requests each receives.
+func graphNodes(edges []graphEdge) ([]string, map[string]float64) {
+	in, failed := map[string]float64{}, map[string]float64{}
+	seen := map[string]bool{}
+	for _, e := range edges {
+		seen[e.client], seen[e.server] = true, true
+		in[e.server] += e.rps
+		failed[e.server] += e.rps * e.errRatio
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	ratio := map[string]float64{}
+	for _, n := range names {
+		if in[n] > 0 {
+			ratio[n] = failed[n] / in[n]
+		}
+	}
+	return names, ratio
+}
+
+func nodeClass(errRatio float64) string {
+	switch {
+	case errRatio >= graphCritRatio:
+		return "crit"
+	case errRatio >= graphWarnRatio:
+		return "warn"
+	}
+	return "ok"
+}
+
+// edgeWidth scales an edge between 1 and 6 by its share of the busiest
+// edge, logarithmically so quiet edges stay visible.
+func edgeWidth(rps, max float64) float64 {
+	if max <= 0 {
+		return 1
+	}
+	return 1 + 5*math.Log1p(rps)/math.Log1p(max)
+}
+
+func maxRPS(edges []graphEdge) float64 {
+	var m float64
+	for _, e := range edges {
+		m = math.Max(m, e.rps)
+	}
+	return m
+}
+
+func renderMermaid(edges []graphEdge) string {
+	names, ratio := graphNodes(edges)
+	id := map[string]string{}
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	b.WriteString("  classDef ok fill:#d4f7d4,stroke:#2e7d32\n")
+	b.WriteString("  classDef warn fill:#ffe9b3,stroke:#ef6c00\n")
+	b.WriteString("  classDef crit fill:#ffcdd2,stroke:#c62828\n")
+	for i, n := range names {
+		id[n] = fmt.Sprintf("n%d", i)
+		fmt.Fprintf(&b, "  %s[\"%s<br/>%.1f%% err\"]:::%s\n", id[n], mermaidEscape(n), ratio[n]*100, nodeClass(ratio[n]))
+	}
+	max := maxRPS(edges)
+	for _, e := range edges {
+		fmt.Fprintf(&b, "  %s -->|%.2f rps| %s\n", id[e.client], e.rps, id[e.server])
+	}
+	for i, e := range edges {
+		fmt.Fprintf(&b, "  linkStyle %d stroke-width:%.1fpx\n", i, edgeWidth(e.rps, max))
+	}
+	return b.String()
+}
+
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
+
+func renderDOT(edges []graphEdge) string {
+	names, ratio := graphNodes(edges)
+	colors := map[string]string{"ok": "#d4f7d4", "warn": "#ffe9b3", "crit": "#ffcdd2"}
+	var b strings.Builder
+	b.WriteString("digraph servicegraph {\n  rankdir=LR;\n  node [shape=box, style=\"rounded,filled\"];\n")
+	for _, n := range names {
+		fmt.Fprintf(&b, "  %q [label=%q, fillcolor=%q];\n", n, fmt.Sprintf("%s\n%.1f%% err", n, ratio[n]*100), colors[nodeClass(ratio[n])])
+	}
+	max := maxRPS(edges)
+	for _, e := range edges {
+		fmt.Fprintf(&b, "  %q -> %q [label=%q, penwidth=%.1f];\n", e.client, e.server, fmt.Sprintf("%.2f rps", e.rps), edgeWidth(e.rps, max))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"mcp/internal/promresult"
+)
+
+// headroomDegrade is how far p95 latency must rise above its low-traffic
+// baseline for a traffic level to count as degraded.
+const headroomDegrade = 0.5
+
+// headroomRow is the capacity estimate of one endpoint.
+type headroomRow struct {
+	SpanName        string   `json:"span_name"`
+	CurrentRPS      float64  `json:"current_rps"`
+	MaxSustainedRPS float64  `json:"max_sustained_rps"`
+	BaselineP95Ms   float64  `json:"baseline_p95_ms"`
+	DegradedAtRPS   *float64 `json:"degraded_at_rps"`
+	// HeadroomPct is how much the current traffic can grow before reaching
+	// DegradedAtRPS or, when no degradation was observed, MaxSustainedRPS.
+	HeadroomPct float64 `json:"headroom_pct"`
+	// LowerBound is set when no degradation was observed, so the real
+	// headroom is at least HeadroomPct.
+	LowerBound bool `json:"lower_bound"`
+	Points     int  `json:"points"`
+}
+
+// planHeadroom relates sustained request rate (15m rate) to p95 latency per
+// endpoint of a server over a long window.
+func planHeadroom(serverName string, windowM int, extra string) queryPlan {
+	calls := fmt.Sprintf(`{__name__=~"%s", service_name=%q, span_kind="SPAN_KIND_SERVER"%s}`, currentCaps().Calls, serverName, extra)
+	lm := currentLatency()
+	buckets := fmt.Sprintf(`{__name__=~"%s", service_name=%q, span_kind="SPAN_KIND_SERVER"%s}`, lm.name, serverName, extra)
+	p := rangePlan(windowM,
+		namedQuery{name: "rps", promQL: fmt.Sprintf(`sum by (span_name) (rate(%s[15m]))`, calls)},
+		namedQuery{name: "p95", promQL: lm.ms(fmt.Sprintf(`histogram_quantile(0.95, sum by (span_name, le) (rate(%s[15m])))`, buckets))},
+	)
+	p.step = 5 * time.Minute
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		return shapeHeadroom(res, lm.name)
+	}
+	return p
+}
+
+func shapeHeadroom(res map[string]json.RawMessage, metric string) (any, error) {
+	rps, err := promresult.DecodeMatrix(res["rps"])
+	if err != nil {
+		return nil, err
+	}
+	lat, err := promresult.DecodeMatrix(res["p95"])
+	if err != nil {
+		return nil, err
+	}
+	latBySpan := map[string]promresult.Series{}
+	for _, s := range lat {
+		latBySpan[s.Labels["span_name"]] = s
+	}
+	rows := []headroomRow{}
+	for _, s := range rps {
+		name := s.Labels["span_name"]
+		if r, ok := estimateHeadroom(name, s, latBySpan[name]); ok {
+			rows = append(rows, r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].HeadroomPct < rows[j].HeadroomPct })
+	return map[string]any{"degradeThreshold": headroomDegrade, "metric": metric, "endpoints": rows}, nil
+}
+
+// estimateHeadroom pairs rate and latency samples by time. The baseline is
+// the median p95 at or below the median rate; the degradation point is the
+// lowest above-median rate whose p95 exceeds the baseline by
+// headroomDegrade. Latency spikes at low traffic are thus not blamed on load.
+func estimateHeadroom(name string, rps, lat promresult.Series) (headroomRow, bool) {
+	latAt := map[int64]float64{}
+	for _, p := range lat.Points {
+		if !math.IsNaN(p.V) {
+			latAt[p.T.Unix()] = p.V
+		}
+	}
+	type pair struct{ rps, lat float64 }
+	var pairs []pair
+	current := math.NaN()
+	for _, p := range rps.Points {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		current = p.V
+		if l, found := latAt[p.T.Unix()]; found {
+			pairs = append(pairs, pair{p.V, l})
+		}
+	}
+	if len(pairs) < 4 || math.IsNaN(current) || current <= 0 {
+		return headroomRow{}, false
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].rps < pairs[j].rps })
+	half := len(pairs) / 2
+	low := make([]float64, 0, half+1)
+	for _, p := range pairs[:half+1] {
+		low = append(low, p.lat)
+	}
+	baseline := median(low)
+	r := headroomRow{
+		SpanName:        name,
+		CurrentRPS:      current,
+		MaxSustainedRPS: pairs[len(pairs)-1].rps,
+		BaselineP95Ms:   baseline,
+		Points:          len(pairs),
+	}
+	capacity := r.MaxSustainedRPS
+	for _, p := range pairs[half:] {
+		if p.lat > baseline*(1+headroomDegrade) {
+			at := p.rps
+			r.DegradedAtRPS = &at
+			capacity = at
+			break
+		}
+	}
+	r.LowerBound = r.DegradedAtRPS == nil
+	r.HeadroomPct = (capacity - current) / current * 100
+	return r, true
+}
+
+func median(v []float64) float64 {
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mimir "mcp/internal/mimir"
+	"mcp/internal/promresult"
+)
+
+// healthURIPrefix prefixes the health resources: healthURIPrefix itself
+// lists all services, healthURIPrefix + "/<service_name>" one.
+const healthURIPrefix = "health://services"
+
+// serviceHealth is the state of one service at the last refresh.
+type serviceHealth struct {
+	Service    string  `json:"service"`
+	RPS        float64 `json:"rps"`
+	ErrorRatio float64 `json:"error_ratio"`
+	// P95Ms is absent without latency data.
+	P95Ms *float64 `json:"p95_ms,omitempty"`
+	// Anomalies are the anomaly events of the service in the last
+	// healthAnomalyWindow and AnomalyScore the highest of their scores.
+	Anomalies    int     `json:"anomalies"`
+	AnomalyScore float64 `json:"anomaly_score"`
+	// Status is critical or warning by error ratio (as in the service graph
+	// diagrams) or the worst anomaly severity, else ok.
+	Status string `json:"status"`
+}
+
+// healthAnomalyWindow is how far back anomaly events count towards health.
+const healthAnomalyWindow = 15 * time.Minute
+
+// healthBoard holds the latest health of every service, refreshed in the
+// background so reading it never queries a backend.
+type healthBoard struct {
+	mu       sync.RWMutex
+	services map[string]serviceHealth
+	updated  time.Time
+	// err is the failure of the last refresh, if any; the previous
+	// services are kept
+	err string
+}
+
+type healthSnapshot struct {
+	Updated  time.Time       `json:"updated"`
+	Error    string          `json:"error,omitempty"`
+	Services []serviceHealth `json:"services"`
+}
+
+// snapshot returns the services sorted by name, or only service when set.
+// found is false before the first refresh or for an unknown service.
+func (b *healthBoard) snapshot(service string) (healthSnapshot, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := healthSnapshot{Updated: b.updated, Error: b.err, Services: []serviceHealth{}}
+	if b.updated.IsZero() {
+		return out, false
+	}
+	if service != "" {
+		h, found := b.services[service]
+		out.Services = append(out.Services, h)
+		return out, found
+	}
+	for _, h := range b.services {
+		out.Services = append(out.Services, h)
+	}
+	sort.Slice(out.Services, func(i, j int) bool { return out.Services[i].Service < out.Services[j].Service })
+	return out, true
+}
+
+// names returns the known services, sorted.
+func (b *healthBoard) names() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make([]string, 0, len(b.services))
+	for name := range b.services {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// refreshHealth recomputes the health board every interval until ctx is
+// done. Queries run as MIMIR_TENANT.
+func (s *server) refreshHealth(ctx context.Context, interval time.Duration) {
+	ctx = mimir.WithTenant(ctx, s.tenant)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rctx, cancel := context.WithTimeout(ctx, interval)
+		services, err := s.computeHealth(rctx)
+		cancel()
+		s.health.mu.Lock()
+		if err != nil {
+			log.Printf("health refresh: %v", err)
+			s.health.err = err.Error()
+		} else {
+			s.health.services, s.health.err = services, ""
+		}
+		s.health.updated = time.Now().UTC()
+		s.health.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// computeHealth queries the RED metrics of all services over the last 5
+// minutes and joins recent anomaly events from if-service. Anomalies are
+// best effort: without them health is computed from the metrics alone.
+func (s *server) computeHealth(ctx context.Context) (map[string]serviceHealth, error) {
+	plan := instantPlan(5,
+		namedQuery{name: "rate", promQL: fmt.Sprintf(`sum by (service_name) (%s)`, callsRate(""))},
+		namedQuery{name: "errors", promQL: fmt.Sprintf(`sum by (service_name) (%s)`, errorsRate(""))},
+		namedQuery{name: "p95", promQL: latencyQuantile(0.95, sumBy("", "service_name", "le"), "")},
+	)
+	res, err := s.queryAll(ctx, plan)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]serviceHealth{}
+	for _, name := range []string{"rate", "errors", "p95"} {
+		samples, err := promresult.DecodeVector(res[name])
+		if err != nil {
+			return nil, err
+		}
+		for _, smp := range samples {
+			svc := smp.Labels["service_name"]
+			if svc == "" || math.IsNaN(smp.V) || math.IsInf(smp.V, 0) {
+				continue
+			}
+			h := out[svc]
+			h.Service = svc
+			switch name {
+			case "rate":
+				h.RPS = smp.V
+			case "errors":
+				h.ErrorRatio = smp.V
+			case "p95":
+				v := smp.V
+				h.P95Ms = &v
+			}
+			out[svc] = h
+		}
+	}
+
+	severity := map[string]string{}
+	if s.ifURL != "" {
+		q := url.Values{}
+		q.Set("from", time.Now().Add(-healthAnomalyWindow).UTC().Format(time.RFC3339))
+		q.Set("limit", "500")
+		var events struct {
+			Events []historyEvent `json:"events"`
+		}
+		if err := s.getIF(ctx, s.ifURL+"/api/v1/events?"+q.Encode(), &events); err != nil {
+			log.Printf("health refresh: anomalies: %v", err)
+		}
+		for _, ev := range events.Events {
+			svc := ev.Labels["service_name"]
+			h, found := out[svc]
+			if !found {
+				continue
+			}
+			h.Anomalies++
+			h.AnomalyScore = math.Max(h.AnomalyScore, ev.Score)
+			out[svc] = h
+			if severity[svc] != "critical" {
+				severity[svc] = ev.Severity
+			}
+		}
+	}
+
+	for svc, h := range out {
+		// errors held the error rate until the request rate was known
+		if h.RPS > 0 {
+			h.ErrorRatio = math.Min(h.ErrorRatio/h.RPS, 1)
+		} else {
+			h.ErrorRatio = 0
+		}
+		switch {
+		case h.ErrorRatio >= graphCritRatio || severity[svc] == "critical":
+			h.Status = "critical"
+		case h.ErrorRatio >= graphWarnRatio || severity[svc] == "warning":
+			h.Status = "warning"
+		default:
+			h.Status = "ok"
+		}
+		out[svc] = h
+	}
+	return out, nil
+}
+
+// healthResources lists the health resources: all services, then one per
+// known service.
+func (s *server) healthResources() []map[string]any {
+	out := []map[string]any{{
+		"uri":         healthURIPrefix,
+		"name":        "Service health",
+		"description": "Traffic, error ratio, p95 latency, recent anomalies and status of every service, refreshed in the background",
+		"mimeType":    "application/json",
+	}}
+	for _, name := range s.health.names() {
+		out = append(out, map[string]any{
+			"uri":         healthURIPrefix + "/" + url.PathEscape(name),
+			"name":        "Health of " + name,
+			"description": "Traffic, error ratio, p95 latency, recent anomalies and status of " + name,
+			"mimeType":    "application/json",
+		})
+	}
+	return out
+}
+
+// readHealth serves a health resource from the board.
+func (s *server) readHealth(uri string) (json.RawMessage, error) {
+	service := ""
+	if rest, found := strings.CutPrefix(uri, healthURIPrefix+"/"); found {
+		name, err := url.PathUnescape(rest)
+		if err != nil {
+			return nil, err
+		}
+		service = name
+	}
+	snap, found := s.health.snapshot(service)
+	if !found {
+		if snap.Updated.IsZero() {
+			return nil, fmt.Errorf("service health not computed yet")
+		}
+		return nil, fmt.Errorf("unknown service: %s", service)
+	}
+	return json.Marshal(snap)
+}
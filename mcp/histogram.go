@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"mcp/internal/promresult"
+)
+
+// modeMinShare is the share of requests a latency bucket needs to be a
+// mode, so a stray slow request does not make a tail.
+const modeMinShare = 0.05
+
+// planLatencyHistogram returns the latency bucket distribution of a server,
+// or one endpoint or caller of it, over the window: per-second rates per
+// bucket, quantiles, and the modes telling a uniform slowdown (one) from a
+// slow tail (two), in milliseconds whatever the unit of the metric read.
+func planLatencyHistogram(serverName, spanName, client string, windowM int, extra string) queryPlan {
+	m := fmt.Sprintf(`, service_name=%q`, serverName)
+	if spanName != "" {
+		m += fmt.Sprintf(`, span_name=%q`, spanName)
+	}
+	if client != "" {
+		m += fmt.Sprintf(`, peer_service=%q`, client)
+	}
+	m += extra
+	lm := currentLatency()
+	q := fmt.Sprintf(`sum by (le) (rate({__name__=~"%s", span_kind="SPAN_KIND_SERVER"%s}[%dm]))`, lm.name, m, windowM)
+	if recorded.latency != "" {
+		// 5m rates already
+		lm = latencyMetric{name: recorded.latency, toMs: 1}
+		q = fmt.Sprintf(`sum by (le) (avg_over_time({__name__="%s"%s}[%dm]))`, lm.name, m, windowM)
+	}
+	p := instantPlan(windowM, namedQuery{promQL: q})
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		samples, err := promresult.DecodeVector(res[""])
+		if err != nil {
+			return nil, err
+		}
+		out := shapeHistogram(promresult.NewHistogram(samples, lm.toMs))
+		out["metric"] = lm.name
+		return out, nil
+	}
+	return p
+}
+
+// shapeHistogram describes h: its buckets, p50 to p99 where there is
+// traffic, the le of its modes and its shape by the number of modes.
+func shapeHistogram(h promresult.Histogram) map[string]any {
+	buckets := h.Buckets
+	if buckets == nil {
+		buckets = []promresult.Bucket{}
+	}
+	quantiles := map[string]float64{}
+	for _, q := range []float64{0.5, 0.9, 0.95, 0.99} {
+		if v := h.Quantile(q); !math.IsNaN(v) {
+			quantiles["p"+strconv.Itoa(int(q*100))] = v
+		}
+	}
+	modes := []string{}
+	for _, i := range h.Modes(modeMinShare) {
+		modes = append(modes, h.Buckets[i].Le)
+	}
+	return map[string]any{"rate": h.Rate, "quantiles": quantiles, "modes": modes, "shape": histogramShape(len(modes)), "buckets": buckets}
+}
+
+// histogramShape names a distribution by its number of modes.
+func histogramShape(modes int) string {
+	switch modes {
+	case 0:
+		return "empty"
+	case 1:
+		return "unimodal"
+	case 2:
+		return "bimodal"
+	}
+	return "multimodal"
+}
+
+// maxQuantiles bounds the quantiles of one spanmetrics_latency_quantile call.
+const maxQuantiles = 10
+
+// planLatencyQuantiles returns several latency quantiles for a client->server
+// edge from one fetch of the summed bucket rates, computed like
+// histogram_quantile at each step. The result is a matrix with a quantile
+// label on each series, and the groupBy label if set.
+func planLatencyQuantiles(client, serverName string, qs []float64, windowM int, groupBy, extra string) queryPlan {
+	buckets, lm := groupedBy(groupBy).buckets(fmt.Sprintf(`, service_name="%s", peer_service="%s"%s`, serverName, client, extra))
+	p := rangePlan(windowM, namedQuery{promQL: fmt.Sprintf(`%s(%s)`, sumBy(groupBy, "le"), buckets)})
+	p.variant = fmt.Sprint(qs)
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		series, err := promresult.DecodeMatrix(res[""])
+		if err != nil {
+			return nil, err
+		}
+		return quantileMatrix(series, qs, lm.toMs), nil
+	}
+	return p
+}
+
+// quantileMatrix computes quantiles qs of bucket series at each of their
+// timestamps, per set of labels besides le, with bounds scaled by toMs.
+func quantileMatrix(series []promresult.Series, qs []float64, toMs float64) promData {
+	type group struct {
+		labels map[string]string
+		at     map[time.Time][]promresult.Sample
+	}
+	groups := map[string]*group{}
+	var keys []string
+	for _, s := range series {
+		labels := map[string]string{}
+		for k, v := range s.Labels {
+			if k != "le" && k != "__name__" {
+				labels[k] = v
+			}
+		}
+		b, _ := json.Marshal(labels)
+		g := groups[string(b)]
+		if g == nil {
+			g = &group{labels: labels, at: map[time.Time][]promresult.Sample{}}
+			groups[string(b)] = g
+			keys = append(keys, string(b))
+		}
+		for _, pt := range s.Points {
+			g.at[pt.T] = append(g.at[pt.T], promresult.Sample{Labels: s.Labels, Point: pt})
+		}
+	}
+	sort.Strings(keys)
+	out := promData{ResultType: "matrix", Result: []map[string]any{}}
+	for _, k := range keys {
+		g := groups[k]
+		times := make([]time.Time, 0, len(g.at))
+		for t := range g.at {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		values := make([][][2]any, len(qs))
+		for _, t := range times {
+			h := promresult.NewHistogram(g.at[t], toMs)
+			for i, q := range qs {
+				if v := h.Quantile(q); !math.IsNaN(v) {
+					values[i] = append(values[i], [2]any{float64(t.UnixMilli()) / 1000, strconv.FormatFloat(v, 'f', -1, 64)})
+				}
+			}
+		}
+		for i, q := range qs {
+			metric := map[string]string{"quantile": strconv.FormatFloat(q, 'g', -1, 64)}
+			for k, v := range g.labels {
+				metric[k] = v
+			}
+			if values[i] == nil {
+				values[i] = [][2]any{}
+			}
+			out.Result = append(out.Result, map[string]any{"metric": metric, "values": values[i]})
+		}
+	}
+	return out
+}
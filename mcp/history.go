@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mimir "mcp/internal/mimir"
+)
+
+// historyArgs are the arguments of anomalies_history.
+type historyArgs struct {
+	Service  string `json:"service"`
+	Metric   string `json:"metric"`
+	Severity string `json:"severity"`
+	// From and To bound the event times, RFC 3339. From defaults to
+	// LookbackHours before To, To to now.
+	From          string `json:"from"`
+	To            string `json:"to"`
+	LookbackHours int    `json:"lookbackHours"`
+	Limit         int    `json:"limit"`
+}
+
+// historyEvent is a stored anomaly event as served by if-service.
+type historyEvent struct {
+	ID       int64             `json:"id"`
+	Metric   string            `json:"metric"`
+	Labels   map[string]string `json:"labels"`
+	Time     time.Time         `json:"time"`
+	Value    float64           `json:"value"`
+	Score    float64           `json:"score"`
+	Severity string            `json:"severity"`
+	// RunLength is the number of consecutive anomalous points of the
+	// event's run, when if-service includes it.
+	RunLength int `json:"runLength,omitempty"`
+	// Level is "service" for anomalies of a service's aggregate, and
+	// Related the series of the other level anomalous at the same time,
+	// when if-service includes them.
+	Level   string              `json:"level,omitempty"`
+	Related []map[string]string `json:"related,omitempty"`
+	// Scope is the named detection scope of the event, if any.
+	Scope string `json:"scope,omitempty"`
+	Links []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links,omitempty"`
+	// Deployment is the deployment of the service shortly before the
+	// event, if if-service knows one.
+	Deployment *struct {
+		Service       string    `json:"service"`
+		Version       string    `json:"version,omitempty"`
+		Time          time.Time `json:"time"`
+		MinutesBefore float64   `json:"minutesBefore"`
+		Note          string    `json:"note"`
+	} `json:"deployment,omitempty"`
+	// Kubernetes is the state of the service's deployment at the event,
+	// when if-service enriches events with it.
+	Kubernetes *struct {
+		Namespace         string `json:"namespace"`
+		Deployment        string `json:"deployment"`
+		Replicas          int    `json:"replicas"`
+		ReadyReplicas     int    `json:"readyReplicas"`
+		AvailableReplicas int    `json:"availableReplicas"`
+		UpdatedReplicas   int    `json:"updatedReplicas"`
+		Restarts          int    `json:"restarts"`
+		RecentRestarts    int    `json:"recentRestarts"`
+		Rollout           string `json:"rollout"`
+	} `json:"kubernetes,omitempty"`
+	// Sparkline summarizes the detection window of the series in buckets,
+	// oldest first, when if-service includes it.
+	Sparkline *struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		Min   []float64 `json:"min"`
+		Mean  []float64 `json:"mean"`
+		Max   []float64 `json:"max"`
+	} `json:"sparkline,omitempty"`
+}
+
+// historyDay is the number of events of one service and metric on one UTC
+// day, including events already pruned from the store.
+type historyDay struct {
+	Day      string  `json:"day"`
+	Service  string  `json:"service"`
+	Metric   string  `json:"metric"`
+	Count    int     `json:"count"`
+	MaxScore float64 `json:"maxScore"`
+}
+
+// historyResult is the anomalies_history tool result.
+type historyResult struct {
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Events []historyEvent `json:"events"`
+	// Summary counts the returned events.
+	Summary struct {
+		Events     int            `json:"events"`
+		BySeverity map[string]int `json:"bySeverity"`
+		First      *time.Time     `json:"first,omitempty"`
+		Last       *time.Time     `json:"last,omitempty"`
+	} `json:"summary"`
+	// Daily are the per-day counts within the range, which also cover
+	// events older than the store's retention.
+	Daily []historyDay `json:"daily"`
+}
+
+// historyRequests builds the if-service requests answering a; from and to
+// are the resolved time range.
+func (s *server) historyRequests(a historyArgs) (events, daily string, from, to time.Time, err error) {
+	to = time.Now().UTC()
+	if a.To != "" {
+		if to, err = time.Parse(time.RFC3339, a.To); err != nil {
+			return "", "", from, to, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if a.LookbackHours <= 0 {
+		a.LookbackHours = 168
+	}
+	from = to.Add(-time.Duration(a.LookbackHours) * time.Hour)
+	if a.From != "" {
+		if from, err = time.Parse(time.RFC3339, a.From); err != nil {
+			return "", "", from, to, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if !from.Before(to) {
+		return "", "", from, to, fmt.Errorf("from must be before to")
+	}
+	switch a.Severity {
+	case "", "warning", "critical":
+	default:
+		return "", "", from, to, fmt.Errorf("unknown severity: %s", a.Severity)
+	}
+	if a.Limit <= 0 {
+		a.Limit = 50
+	}
+	if a.Limit > 500 {
+		a.Limit = 500
+	}
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(a.Limit))
+	q.Set("from", from.Format(time.RFC3339))
+	q.Set("to", to.Format(time.RFC3339))
+	for k, v := range map[string]string{"service": a.Service, "metric": a.Metric, "severity": a.Severity} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	dq := url.Values{}
+	if a.Service != "" {
+		dq.Set("service", a.Service)
+	}
+	return s.ifURL + "/api/v1/events?" + q.Encode(), s.ifURL + "/api/v1/events/daily?" + dq.Encode(), from, to, nil
+}
+
+// anomaliesHistory returns stored anomaly events from if-service, most
+// recently stored first. Label filters select among the returned events by
+// their series labels.
+func (s *server) anomaliesHistory(ctx context.Context, a historyArgs, opts toolOptions) (json.RawMessage, error) {
+	if s.ifURL == "" {
+		return nil, fmt.Errorf("anomaly history unavailable: IF_URL not set")
+	}
+	eventsURL, dailyURL, from, to, err := s.historyRequests(a)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Explain {
+		return json.Marshal(map[string]any{"requests": []string{eventsURL, dailyURL}})
+	}
+	var events struct {
+		Events []historyEvent `json:"events"`
+	}
+	if err := s.getIF(ctx, eventsURL, &events); err != nil {
+		return nil, err
+	}
+	var daily struct {
+		Days []historyDay `json:"days"`
+	}
+	if err := s.getIF(ctx, dailyURL, &daily); err != nil {
+		return nil, err
+	}
+
+	out := historyResult{From: from, To: to, Events: []historyEvent{}, Daily: []historyDay{}}
+	out.Summary.BySeverity = map[string]int{}
+	for i := len(events.Events) - 1; i >= 0; i-- {
+		ev := events.Events[i]
+		if !labelsMatch(ev.Labels, opts.LabelFilters) {
+			continue
+		}
+		out.Events = append(out.Events, ev)
+		out.Summary.BySeverity[ev.Severity]++
+		if out.Summary.First == nil || ev.Time.Before(*out.Summary.First) {
+			out.Summary.First = &ev.Time
+		}
+		if out.Summary.Last == nil || ev.Time.After(*out.Summary.Last) {
+			out.Summary.Last = &ev.Time
+		}
+	}
+	out.Summary.Events = len(out.Events)
+	fromDay, toDay := from.UTC().Format(time.DateOnly), to.UTC().Format(time.DateOnly)
+	for _, d := range daily.Days {
+		if d.Day >= fromDay && d.Day <= toDay && (a.Metric == "" || d.Metric == a.Metric) {
+			out.Daily = append(out.Daily, d)
+		}
+	}
+	return json.Marshal(out)
+}
+
+func labelsMatch(labels, filters map[string]string) bool {
+	for k, v := range filters {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// getIF fetches an if-service API URL into v.
+func (s *server) getIF(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if id := mimir.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	res, err := s.ifClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("if-service: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("if-service: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"mcp/internal/promresult"
+)
+
+// incidentArgs are the arguments of incident_report.
+type incidentArgs struct {
+	Service string `json:"service"`
+	// From and To bound the incident, RFC 3339. From defaults to
+	// LookbackMinutes before To, To to now.
+	From            string `json:"from"`
+	To              string `json:"to"`
+	LookbackMinutes int    `json:"lookbackMinutes"`
+	// BaselineOffsetMinutes is how much earlier the baseline window of the
+	// same length lies.
+	BaselineOffsetMinutes int `json:"baselineOffsetMinutes"`
+}
+
+// incidentRange resolves the time range and baseline offset of a.
+func incidentRange(a incidentArgs) (from, to time.Time, offset time.Duration, err error) {
+	to = time.Now().UTC()
+	if a.To != "" {
+		if to, err = time.Parse(time.RFC3339, a.To); err != nil {
+			return from, to, 0, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if a.LookbackMinutes <= 0 {
+		a.LookbackMinutes = 30
+	}
+	from = to.Add(-time.Duration(a.LookbackMinutes) * time.Minute)
+	if a.From != "" {
+		if from, err = time.Parse(time.RFC3339, a.From); err != nil {
+			return from, to, 0, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if to.Sub(from) < time.Minute {
+		return from, to, 0, fmt.Errorf("from must be at least a minute before to")
+	}
+	if a.BaselineOffsetMinutes <= 0 {
+		a.BaselineOffsetMinutes = 1440
+	}
+	return from, to, time.Duration(a.BaselineOffsetMinutes) * time.Minute, nil
+}
+
+// redStats are the RED metrics of a service or endpoint over a window.
+type redStats struct {
+	RPS        float64 `json:"rps"`
+	ErrorRatio float64 `json:"error_ratio"`
+	// P95Ms is absent without latency data, e.g. for idle endpoints.
+	P95Ms *float64 `json:"p95_ms,omitempty"`
+}
+
+// redChange compares a window with its baseline.
+type redChange struct {
+	Current  redStats  `json:"current"`
+	Baseline *redStats `json:"baseline,omitempty"`
+	// RPSChange is the relative change of the request rate (0.5 = +50%).
+	RPSChange float64 `json:"rps_change,omitempty"`
+	// ErrorRatioChange is the absolute change of the failed share.
+	ErrorRatioChange float64 `json:"error_ratio_change,omitempty"`
+	// P95Change is the relative change of p95 latency.
+	P95Change float64 `json:"p95_change,omitempty"`
+}
+
+type endpointChange struct {
+	SpanName string `json:"span_name"`
+	redChange
+}
+
+// incidentEdge is a servicegraph edge touching the service.
+type incidentEdge struct {
+	Peer string `json:"peer"`
+	edgeStats
+}
+
+// incidentTrace is an example trace of the service within the range.
+type incidentTrace struct {
+	TraceID    string    `json:"trace_id"`
+	SpanName   string    `json:"span_name,omitempty"`
+	DurationMs float64   `json:"duration_ms"`
+	Time       time.Time `json:"time"`
+}
+
+// incidentReport is the incident_report tool result. Sections whose source
+// failed are left empty and their error listed in Unavailable.
+type incidentReport struct {
+	Service  string    `json:"service"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Baseline struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"baseline"`
+	RED redChange `json:"red"`
+	// Endpoints are the span names of the service, largest change of
+	// error ratio first.
+	Endpoints []endpointChange `json:"endpoints"`
+	Topology  struct {
+		// Callers are edges into the service, Callees edges out of it.
+		Callers []incidentEdge `json:"callers"`
+		Callees []incidentEdge `json:"callees"`
+	} `json:"topology"`
+	Anomalies []historyEvent  `json:"anomalies"`
+	Traces    []incidentTrace `json:"traces"`
+	// LatencyMetric is the histogram p95 and trace durations are read
+	// from, converted to milliseconds.
+	LatencyMetric string   `json:"latency_metric"`
+	Unavailable   []string `json:"unavailable,omitempty"`
+}
+
+// planIncident queries the RED metrics of service over the window ending at
+// to, overall and per endpoint, in the window and offset earlier, and the
+// servicegraph edges into and out of it.
+func planIncident(service string, window, offset time.Duration, to time.Time, extra string) queryPlan {
+	w, off := fmt.Sprintf("%ds", int(window.Seconds())), fmt.Sprintf(" offset %ds", int(offset.Seconds()))
+	calls := fmt.Sprintf(`{__name__=~"%s", service_name=%q, span_kind="SPAN_KIND_SERVER"%s`, currentCaps().Calls, service, extra)
+	lm := currentLatency()
+	buckets := fmt.Sprintf(`{__name__=~"%s", service_name=%q, span_kind="SPAN_KIND_SERVER"%s`, lm.name, service, extra)
+	var qs []namedQuery
+	for _, win := range []struct{ name, offset string }{{"current", ""}, {"baseline", off}} {
+		for _, by := range []struct{ name, labels string }{{"", ""}, {"_endpoints", "span_name"}} {
+			qs = append(qs,
+				namedQuery{name: win.name + by.name + "_rate", promQL: fmt.Sprintf(`sum by (%s) (rate(%s}[%s]%s))`, by.labels, calls, w, win.offset)},
+				namedQuery{name: win.name + by.name + "_errors", promQL: fmt.Sprintf(`sum by (%s) (rate(%s, status_code="STATUS_CODE_ERROR"}[%s]%s))`, by.labels, calls, w, win.offset)},
+				namedQuery{name: win.name + by.name + "_p95", promQL: lm.ms(fmt.Sprintf(`histogram_quantile(0.95, sum by (%s) (rate(%s}[%s]%s)))`, joinLabels(by.labels, "le"), buckets, w, win.offset))},
+			)
+		}
+	}
+	edges := func(metric, side string) string {
+		return fmt.Sprintf(`sum by (client, server) (rate({__name__="%s", %s=%q%s}[%s]))`, metric, side, service, extra, w)
+	}
+	qs = append(qs,
+		namedQuery{name: "callers", promQL: edges("traces_service_graph_request_total", "server")},
+		namedQuery{name: "callers_failed", promQL: edges("traces_service_graph_request_failed_total", "server")},
+		namedQuery{name: "callees", promQL: edges("traces_service_graph_request_total", "client")},
+		namedQuery{name: "callees_failed", promQL: edges("traces_service_graph_request_failed_total", "client")},
+	)
+	p := instantPlan(0, qs...)
+	// the baseline reaches back offset before the window
+	p.window = window + offset
+	p.end = to
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		return shapeIncident(res)
+	}
+	return p
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + ", " + b
+}
+
+// incidentMetrics is the part of the report computed from the queries.
+type incidentMetrics struct {
+	RED       redChange        `json:"red"`
+	Endpoints []endpointChange `json:"endpoints"`
+	Callers   []incidentEdge   `json:"callers"`
+	Callees   []incidentEdge   `json:"callees"`
+}
+
+func shapeIncident(res map[string]json.RawMessage) (any, error) {
+	red := func(prefix string) (map[string]redStats, error) {
+		out := map[string]redStats{}
+		for _, part := range []string{"_rate", "_errors", "_p95"} {
+			samples, err := promresult.DecodeVector(res[prefix+part])
+			if err != nil {
+				return nil, err
+			}
+			for _, smp := range samples {
+				if math.IsNaN(smp.V) || math.IsInf(smp.V, 0) {
+					continue
+				}
+				k := smp.Labels["span_name"]
+				st := out[k]
+				switch part {
+				case "_rate":
+					st.RPS = smp.V
+				case "_errors":
+					st.ErrorRatio = smp.V
+				case "_p95":
+					v := smp.V
+					st.P95Ms = &v
+				}
+				out[k] = st
+			}
+		}
+		for k, st := range out {
+			// errors held the error rate until the request rate was known
+			if st.RPS > 0 {
+				st.ErrorRatio = math.Min(st.ErrorRatio/st.RPS, 1)
+			} else {
+				st.ErrorRatio = 0
+			}
+			out[k] = st
+		}
+		return out, nil
+	}
+	var out incidentMetrics
+	stats := map[string]map[string]redStats{}
+	for _, prefix := range []string{"current", "baseline", "current_endpoints", "baseline_endpoints"} {
+		m, err := red(prefix)
+		if err != nil {
+			return nil, err
+		}
+		stats[prefix] = m
+	}
+	out.RED = compareRED(stats["current"][""], stats["baseline"], "")
+	out.Endpoints = []endpointChange{}
+	for name, cur := range stats["current_endpoints"] {
+		out.Endpoints = append(out.Endpoints, endpointChange{SpanName: name, redChange: compareRED(cur, stats["baseline_endpoints"], name)})
+	}
+	sort.Slice(out.Endpoints, func(i, j int) bool {
+		a, b := out.Endpoints[i], out.Endpoints[j]
+		if a.ErrorRatioChange != b.ErrorRatioChange {
+			return a.ErrorRatioChange > b.ErrorRatioChange
+		}
+		return a.SpanName < b.SpanName
+	})
+	var err error
+	if out.Callers, err = peerEdges(res["callers"], res["callers_failed"], "client"); err != nil {
+		return nil, err
+	}
+	if out.Callees, err = peerEdges(res["callees"], res["callees_failed"], "server"); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// compareRED compares cur with the baseline stats of key, if any.
+func compareRED(cur redStats, baseline map[string]redStats, key string) redChange {
+	c := redChange{Current: cur}
+	b, found := baseline[key]
+	if !found {
+		return c
+	}
+	c.Baseline = &b
+	if b.RPS > 0 {
+		c.RPSChange = (cur.RPS - b.RPS) / b.RPS
+	}
+	c.ErrorRatioChange = cur.ErrorRatio - b.ErrorRatio
+	if cur.P95Ms != nil && b.P95Ms != nil && *b.P95Ms > 0 {
+		c.P95Change = (*cur.P95Ms - *b.P95Ms) / *b.P95Ms
+	}
+	return c
+}
+
+// peerEdges returns the edges of a servicegraph rate vector, named after
+// their peer label, busiest first.
+func peerEdges(reqRaw, failRaw json.RawMessage, peer string) ([]incidentEdge, error) {
+	stats, err := decodeEdges(reqRaw, failRaw)
+	if err != nil {
+		return nil, err
+	}
+	out := []incidentEdge{}
+	for k, st := range stats {
+		name := k.client
+		if peer == "server" {
+			name = k.server
+		}
+		out = append(out, incidentEdge{Peer: name, edgeStats: st})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Requests > out[j].Requests })
+	return out, nil
+}
+
+// exemplarSelector selects the latency histogram lm of service, whose
+// exemplars carry trace IDs when the spanmetrics connector records them.
+func exemplarSelector(lm latencyMetric, service, extra string) string {
+	return fmt.Sprintf(`{__name__=~"%s", service_name=%q, span_kind="SPAN_KIND_SERVER"%s}`, lm.name, service, extra)
+}
+
+// incidentTraces returns up to limit example traces of service between from
+// and to, slowest first.
+func (s *server) incidentTraces(ctx context.Context, service, extra string, from, to time.Time, limit int) ([]incidentTrace, error) {
+	lm := currentLatency()
+	raw, err := s.mimirFor(ctx).QueryExemplars(ctx, exemplarSelector(lm, service, extra), from, to)
+	if err != nil {
+		return nil, err
+	}
+	var series []struct {
+		SeriesLabels map[string]string `json:"seriesLabels"`
+		Exemplars    []struct {
+			Labels    map[string]string `json:"labels"`
+			Value     string            `json:"value"`
+			Timestamp float64           `json:"timestamp"`
+		} `json:"exemplars"`
+	}
+	if err := json.Unmarshal(raw, &series); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	out := []incidentTrace{}
+	for _, ser := range series {
+		for _, ex := range ser.Exemplars {
+			id := ex.Labels["trace_id"]
+			if id == "" {
+				id = ex.Labels["traceID"]
+			}
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			var v float64
+			fmt.Sscanf(ex.Value, "%g", &v)
+			sec, frac := math.Modf(ex.Timestamp)
+			out = append(out, incidentTrace{
+				TraceID:    id,
+				SpanName:   ser.SeriesLabels["span_name"],
+				DurationMs: v * lm.toMs,
+				Time:       time.Unix(int64(sec), int64(frac*1e9)).UTC(),
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DurationMs > out[j].DurationMs })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// incidentReport gathers everything known about service between from and
+// to into one report: RED metrics and their change against the baseline,
+// per endpoint too, the service's callers and callees, anomaly events from
+// if-service and example traces. Only the metrics are required; other
+// sources that fail are listed as unavailable.
+func (s *server) incidentReport(ctx context.Context, a incidentArgs, opts toolOptions) (json.RawMessage, error) {
+	from, to, offset, err := incidentRange(a)
+	if err != nil {
+		return nil, err
+	}
+	plan := planIncident(a.Service, to.Sub(from), offset, to, opts.matchers())
+	history := historyArgs{Service: a.Service, From: from.Format(time.RFC3339), To: to.Format(time.RFC3339), Limit: 20}
+	if opts.Explain {
+		queries, err := explain(plan)
+		if err != nil {
+			return nil, err
+		}
+		out := map[string]any{
+			"queries":   queries,
+			"exemplars": map[string]string{"endpoint": "/api/v1/query_exemplars", "query": exemplarSelector(currentLatency(), a.Service, opts.matchers())},
+		}
+		if s.ifURL != "" {
+			events, _, _, _, _ := s.historyRequests(history)
+			out["anomalies"] = events
+		}
+		return json.Marshal(out)
+	}
+	raw, err := s.runPlan(ctx, "incident_report", opts, plan)
+	if err != nil {
+		return nil, err
+	}
+	var m incidentMetrics
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	out := incidentReport{Service: a.Service, From: from, To: to, RED: m.RED, Endpoints: m.Endpoints, Anomalies: []historyEvent{}, LatencyMetric: currentLatency().name}
+	out.Baseline.From, out.Baseline.To = from.Add(-offset), to.Add(-offset)
+	out.Topology.Callers, out.Topology.Callees = m.Callers, m.Callees
+
+	if s.ifURL == "" {
+		out.Unavailable = append(out.Unavailable, "anomalies: IF_URL not set")
+	} else if events, _, _, _, err := s.historyRequests(history); err != nil {
+		out.Unavailable = append(out.Unavailable, "anomalies: "+err.Error())
+	} else {
+		var res struct {
+			Events []historyEvent `json:"events"`
+		}
+		if err := s.getIF(ctx, events, &res); err != nil {
+			out.Unavailable = append(out.Unavailable, "anomalies: "+err.Error())
+		}
+		for _, ev := range res.Events {
+			if labelsMatch(ev.Labels, opts.LabelFilters) {
+				out.Anomalies = append(out.Anomalies, ev)
+			}
+		}
+	}
+	if out.Traces, err = s.incidentTraces(ctx, a.Service, opts.matchers(), from, to, 10); err != nil {
+		out.Traces = []incidentTrace{}
+		out.Unavailable = append(out.Unavailable, "traces: "+err.Error())
+	}
+	return json.Marshal(out)
+}
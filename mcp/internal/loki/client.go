@@ -0,0 +1,92 @@
+// Package loki is a small client for the Grafana Loki HTTP API: LogQL range
+// queries over log lines.
+package loki
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mimir "mcp/internal/mimir"
+)
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: &http.Client{Timeout: 15 * time.Second}}
+}
+
+// Entry is a log line with the labels of its stream.
+type Entry struct {
+	Time   time.Time
+	Labels map[string]string
+	Line   string
+}
+
+// QueryRange runs the LogQL log query logQL between start and end and
+// returns at most limit lines, newest first. Requests carry the tenant of
+// ctx (see mimir.WithTenant).
+func (c *Client) QueryRange(ctx context.Context, logQL string, start, end time.Time, limit int) ([]Entry, error) {
+	q := url.Values{}
+	q.Set("query", logQL)
+	q.Set("start", strconv.FormatInt(start.UnixNano(), 10))
+	q.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("direction", "backward")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/loki/api/v1/query_range?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if t := mimir.Tenant(ctx); t != "" {
+		req.Header.Set("X-Scope-OrgID", t)
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("loki: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("loki: %s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	var body struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Stream map[string]string `json:"stream"`
+				Values [][2]string       `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Data.ResultType != "streams" {
+		return nil, fmt.Errorf("loki: expected streams, got %s", body.Data.ResultType)
+	}
+	var out []Entry
+	for _, s := range body.Data.Result {
+		for _, v := range s.Values {
+			ns, _ := strconv.ParseInt(v[0], 10, 64)
+			out = append(out, Entry{Time: time.Unix(0, ns).UTC(), Labels: s.Stream, Line: v[1]})
+		}
+	}
+	// the limit applies across streams, but each stream comes back sorted
+	// on its own
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
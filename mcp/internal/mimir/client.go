@@ -1,12 +1,22 @@
 package mimir
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
+
+	"mcp/internal/secret"
 )
 
 // Client is a tiny Mimir/Prometheus HTTP API client focused on query endpoints.
@@ -16,73 +26,229 @@ import (
 type Client struct {
 	BaseURL    string
 	HTTPClient *http.Client
+	// Retries is how often a request failing with a transport error or a
+	// 429/502/503/504 is retried.
+	Retries int
+	// SlowQuery is the duration above which a call is logged; 0 disables it.
+	SlowQuery time.Duration
+	// Timeouts bound each call by its kind.
+	Timeouts Timeouts
+	// Profile adapts requests and error parsing to the backend.
+	Profile Profile
+	// Tenant, when set, is sent instead of the tenant of the context, for
+	// clusters whose data is in one tenant.
+	Tenant string
+	// UserAgent and QuerySource, when set, are sent as User-Agent and
+	// X-Query-Source, so backend operators can attribute the query load.
+	UserAgent   string
+	QuerySource string
+	// BearerToken, or else Username and Password, authenticate requests.
+	// They are read on every request, so rotated file secrets take effect.
+	BearerToken secret.Secret
+	Username    string
+	Password    secret.Secret
 }
 
 type queryResponse struct {
 	Status string          `json:"status"`
 	Data   json.RawMessage `json:"data"`
 	Error  string          `json:"error"`
+	// Warnings is set by Prometheus-compatible backends, IsPartial by
+	// VictoriaMetrics when not all storage nodes answered.
+	Warnings  []string `json:"warnings"`
+	IsPartial bool     `json:"isPartial"`
 }
 
-func New(baseURL string) *Client {
+// New returns a client of the API at baseURL connecting as opts say.
+func New(baseURL string, opts Options) *Client {
 	return &Client{
 		BaseURL:    baseURL,
-		HTTPClient: &http.Client{Timeout: 15 * time.Second},
+		HTTPClient: &http.Client{Transport: opts.Transport()},
+		Timeouts:   DefaultTimeouts,
+		Retries:    2,
+		SlowQuery:  5 * time.Second,
+		Profile:    ProfileMimir,
 	}
 }
 
+type tenantKey struct{}
+
+// WithTenant returns a context whose queries are sent on behalf of tenant
+// (the X-Scope-OrgID header). An empty tenant leaves the header unset.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// Tenant returns the tenant set with WithTenant.
+func Tenant(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose queries are sent with the
+// X-Request-ID id, so a tool call or scan can be followed across services.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID set with WithRequestID.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether id, e.g. from a caller's X-Request-ID, is
+// fit to pass on and log: at most 128 printable ASCII characters.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestTag is the suffix naming the request ID of ctx in log lines.
+func requestTag(ctx context.Context) string {
+	if id := RequestID(ctx); id != "" {
+		return " request=" + id
+	}
+	return ""
+}
+
 // Query runs an instant query.
 func (c *Client) Query(ctx context.Context, promQL string, ts time.Time) (json.RawMessage, error) {
-	endpoint := c.BaseURL + "/api/v1/query"
 	q := url.Values{}
 	q.Set("query", promQL)
 	if !ts.IsZero() {
 		q.Set("time", fmt.Sprintf("%d", ts.Unix()))
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+q.Encode(), nil)
-	if err != nil {
-		return nil, err
+	return c.get(ctx, "query", "/api/v1/query", q)
+}
+
+// QueryRange runs a range query.
+func (c *Client) QueryRange(ctx context.Context, promQL string, start, end time.Time, step time.Duration) (json.RawMessage, error) {
+	q := url.Values{}
+	q.Set("query", promQL)
+	q.Set("start", fmt.Sprintf("%d", start.Unix()))
+	q.Set("end", fmt.Sprintf("%d", end.Unix()))
+	q.Set("step", c.Profile.step(step))
+	return c.get(ctx, "query_range", "/api/v1/query_range", q)
+}
+
+// QueryStats runs promQL like QueryRange, or like Query at end when step is
+// 0, asking the backend for the statistics of its evaluation with
+// stats=all. Prometheus returns them in the stats field of the data; other
+// backends may leave them out.
+func (c *Client) QueryStats(ctx context.Context, promQL string, start, end time.Time, step time.Duration) (json.RawMessage, error) {
+	q := url.Values{}
+	q.Set("query", promQL)
+	q.Set("stats", "all")
+	if step == 0 {
+		q.Set("time", fmt.Sprintf("%d", end.Unix()))
+		return c.get(ctx, "query", "/api/v1/query", q)
 	}
-	resp, err := c.HTTPClient.Do(req)
+	q.Set("start", fmt.Sprintf("%d", start.Unix()))
+	q.Set("end", fmt.Sprintf("%d", end.Unix()))
+	q.Set("step", c.Profile.step(step))
+	return c.get(ctx, "query_range", "/api/v1/query_range", q)
+}
+
+// QueryExemplars returns the exemplars, e.g. trace IDs, of the series
+// selected by promQL between start and end.
+func (c *Client) QueryExemplars(ctx context.Context, promQL string, start, end time.Time) (json.RawMessage, error) {
+	q := url.Values{}
+	q.Set("query", promQL)
+	q.Set("start", fmt.Sprintf("%d", start.Unix()))
+	q.Set("end", fmt.Sprintf("%d", end.Unix()))
+	return c.get(ctx, "query_exemplars", "/api/v1/query_exemplars", q)
+}
+
+// LabelValues queries /api/v1/label/<name>/values, optionally restricted to series matching matchers.
+func (c *Client) LabelValues(ctx context.Context, label string, matchers []string, start, end time.Time) ([]string, error) {
+	q := url.Values{}
+	for _, m := range matchers {
+		q.Add("match[]", m)
+	}
+	q.Set("start", fmt.Sprintf("%d", start.Unix()))
+	q.Set("end", fmt.Sprintf("%d", end.Unix()))
+	data, err := c.get(ctx, "label_values", "/api/v1/label/"+url.PathEscape(label)+"/values", q)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("mimir query failed: %s", resp.Status)
-	}
-	var qr queryResponse
-	if err := json.NewDecoder(resp.Body).Decode(&qr); err != nil {
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
 		return nil, err
 	}
-	if qr.Status != "success" {
-		if qr.Error != "" {
-			return nil, fmt.Errorf(qr.Error)
-		}
-		return nil, fmt.Errorf("query failed")
-	}
-	return qr.Data, nil
+	return values, nil
 }
 
-// QueryRange runs a range query.
-func (c *Client) QueryRange(ctx context.Context, promQL string, start, end time.Time, step time.Duration) (json.RawMessage, error) {
-	endpoint := c.BaseURL + "/api/v1/query_range"
+// LabelNames queries /api/v1/labels, optionally restricted to series matching matchers.
+func (c *Client) LabelNames(ctx context.Context, matchers []string, start, end time.Time) ([]string, error) {
 	q := url.Values{}
-	q.Set("query", promQL)
+	for _, m := range matchers {
+		q.Add("match[]", m)
+	}
 	q.Set("start", fmt.Sprintf("%d", start.Unix()))
 	q.Set("end", fmt.Sprintf("%d", end.Unix()))
-	q.Set("step", fmt.Sprintf("%ds", int(step.Seconds())))
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+q.Encode(), nil)
+	data, err := c.get(ctx, "labels", "/api/v1/labels", q)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.HTTPClient.Do(req)
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// get calls a GET endpoint of the API, retrying transient failures, and
+// returns the data field of a successful response.
+func (c *Client) get(ctx context.Context, op, path string, q url.Values) (json.RawMessage, error) {
+	c.Profile.params(q)
+	ctx, cancel := c.withTimeout(ctx, op)
+	defer cancel()
+	began := time.Now()
+	defer func() { c.logSlow(ctx, op, q, time.Since(began)) }()
+	resp, err := c.do(ctx, op, path, q)
+	for attempt := 1; attempt <= c.Retries && retryable(resp, err) && ctx.Err() == nil; attempt++ {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * 250 * time.Millisecond):
+		}
+		retriesTotal.WithLabelValues(op).Inc()
+		resp, err = c.do(ctx, op, path, q)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// without the URL of the query, which the error repeats
+		return nil, fmt.Errorf("mimir %s timed out: %w", op, context.DeadlineExceeded)
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("mimir query_range failed: %s", resp.Status)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if msg := errorMessage(body); msg != "" {
+			return nil, fmt.Errorf("mimir %s failed: %s: %s", op, resp.Status, msg)
+		}
+		return nil, fmt.Errorf("mimir %s failed: %s", op, resp.Status)
 	}
 	var qr queryResponse
 	if err := json.NewDecoder(resp.Body).Decode(&qr); err != nil {
@@ -90,9 +256,108 @@ func (c *Client) QueryRange(ctx context.Context, promQL string, start, end time.
 	}
 	if qr.Status != "success" {
 		if qr.Error != "" {
-			return nil, fmt.Errorf(qr.Error)
+			return nil, errors.New(qr.Error)
 		}
-		return nil, fmt.Errorf("query_range failed")
+		return nil, fmt.Errorf("%s failed", op)
+	}
+	for _, w := range qr.Warnings {
+		log.Printf("mimir %s warning: %s%s", op, w, requestTag(ctx))
+	}
+	if qr.IsPartial {
+		log.Printf("mimir %s: partial response%s", op, requestTag(ctx))
 	}
 	return qr.Data, nil
 }
+
+// do sends a single request and records its metrics.
+func (c *Client) do(ctx context.Context, op, path string, q url.Values) (*http.Response, error) {
+	setTimeout(ctx, op, q)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	t := Tenant(ctx)
+	if c.Tenant != "" {
+		t = c.Tenant
+	}
+	if t != "" {
+		req.Header.Set("X-Scope-OrgID", t)
+	}
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if c.QuerySource != "" {
+		req.Header.Set("X-Query-Source", c.QuerySource)
+	}
+	// set explicitly, so responses are decompressed below whatever the
+	// transport; http.Transport only does it when it adds the header
+	req.Header.Set("Accept-Encoding", "gzip")
+	c.authenticate(req)
+	start := time.Now()
+	resp, err := c.HTTPClient.Do(req)
+	if err == nil {
+		err = decompress(resp)
+	}
+	requestDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	requestsTotal.WithLabelValues(op, code).Inc()
+	c.record(resp, err)
+	return resp, err
+}
+
+// authenticate sets the credentials of c on req, if any.
+func (c *Client) authenticate(req *http.Request) {
+	switch token := c.BearerToken.Get(); {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password.Get())
+	}
+}
+
+// retryable reports whether a request failed in a way worth retrying.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// decompress replaces the body of a gzipped response by its decompressed
+// content.
+func decompress(resp *http.Response) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return fmt.Errorf("gzip response: %w", err)
+	}
+	resp.Body = gzipBody{zr, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength, resp.Uncompressed = -1, true
+	return nil
+}
+
+// gzipBody reads the decompressed body and closes the compressed one.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipBody) Close() error {
+	_ = b.Reader.Close()
+	return b.body.Close()
+}
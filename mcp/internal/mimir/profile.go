@@ -0,0 +1,78 @@
+package mimir
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profile names the backend behind BaseURL. All of them speak the Prometheus
+// HTTP API, but differ in step formats, extra query parameters and the shape
+// of error responses.
+type Profile string
+
+const (
+	ProfileMimir           Profile = "mimir"
+	ProfilePrometheus      Profile = "prometheus"
+	ProfileVictoriaMetrics Profile = "victoriametrics"
+	ProfileThanos          Profile = "thanos"
+)
+
+// ParseProfile validates a profile name; empty selects ProfileMimir.
+func ParseProfile(s string) (Profile, error) {
+	switch p := Profile(strings.ToLower(s)); p {
+	case "":
+		return ProfileMimir, nil
+	case ProfileMimir, ProfilePrometheus, ProfileVictoriaMetrics, ProfileThanos:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown backend profile %q (want mimir, prometheus, victoriametrics or thanos)", s)
+}
+
+// step formats a query_range step. Prometheus and Thanos get float seconds,
+// which they accept for any step; Mimir and VictoriaMetrics get a duration.
+func (p Profile) step(d time.Duration) string {
+	switch p {
+	case ProfilePrometheus, ProfileThanos:
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	}
+	return fmt.Sprintf("%ds", int(d.Seconds()))
+}
+
+// params adds backend specific parameters to a request. Thanos is asked to
+// deduplicate replicas and to fail rather than silently answer from a subset
+// of stores; VictoriaMetrics is asked to bypass its rollup result cache so the
+// most recent steps of a scan are never served stale.
+func (p Profile) params(q url.Values) {
+	switch p {
+	case ProfileThanos:
+		q.Set("dedup", "true")
+		q.Set("partial_response", "false")
+	case ProfileVictoriaMetrics:
+		q.Set("nocache", "1")
+	}
+}
+
+// errorMessage extracts the error from a failed response body. Prometheus,
+// Mimir and Thanos answer with the JSON error envelope; VictoriaMetrics and
+// proxies in front of any backend may answer with plain text.
+func errorMessage(body []byte) string {
+	var e struct {
+		ErrorType string `json:"errorType"`
+		Error     string `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error != "" {
+		if e.ErrorType != "" {
+			return e.ErrorType + ": " + e.Error
+		}
+		return e.Error
+	}
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 512 {
+		msg = msg[:512] + "..."
+	}
+	return msg
+}
@@ -0,0 +1,69 @@
+package mimir
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Status is the outcome of the recent requests to a backend: the last one
+// answered successfully and the last one failing for the backend's sake,
+// without a response, with a 5xx or a 429. Other client errors, such as a
+// bad query, count as neither.
+type Status struct {
+	LastSuccess time.Time
+	LastFailure time.Time
+	LastError   string
+}
+
+// Reachable tells whether the backend answered the last request that
+// counted.
+func (s Status) Reachable() bool {
+	return !s.LastSuccess.IsZero() && s.LastSuccess.After(s.LastFailure)
+}
+
+var (
+	statusMu sync.Mutex
+	// statuses by BaseURL, shared by clients of the same backend
+	statuses = map[string]*Status{}
+)
+
+// Status returns the outcome of the recent requests to c's backend.
+func (c *Client) Status() Status {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	if s := statuses[c.BaseURL]; s != nil {
+		return *s
+	}
+	return Status{}
+}
+
+// record updates the status of c's backend with the outcome of a request.
+func (c *Client) record(resp *http.Response, err error) {
+	now := time.Now()
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	s := statuses[c.BaseURL]
+	if s == nil {
+		s = &Status{}
+		statuses[c.BaseURL] = s
+	}
+	switch {
+	case err != nil:
+		if !errors.Is(err, context.Canceled) {
+			// the URL is the backend's, known
+			var ue *url.Error
+			if errors.As(err, &ue) {
+				err = ue.Err
+			}
+			s.LastFailure, s.LastError = now, err.Error()
+		}
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		s.LastFailure, s.LastError = now, resp.Status
+	case resp.StatusCode/100 == 2:
+		s.LastSuccess = now
+	}
+}
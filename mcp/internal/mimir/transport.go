@@ -0,0 +1,56 @@
+package mimir
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Options configure the connections of a client. The zero value connects
+// like Go's default transport, through the proxy of the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables.
+type Options struct {
+	// Proxy, when set, is the HTTP or HTTPS proxy every request goes
+	// through, regardless of the environment.
+	Proxy *url.URL
+	// DialTimeout bounds establishing a connection; 0 is 30s.
+	DialTimeout time.Duration
+	// UnixSocket, when set, is the path of the unix socket every request is
+	// sent to, e.g. of a sidecar proxy, instead of the host of the URL,
+	// which is still sent as the Host header. It takes precedence over
+	// proxies.
+	UnixSocket string
+	// DNSServer, when set, is the host:port of the DNS server host names
+	// are resolved with instead of the system resolver.
+	DNSServer string
+}
+
+// Transport returns the HTTP transport of o.
+func (o Options) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if o.DialTimeout > 0 {
+		d.Timeout = o.DialTimeout
+	}
+	if o.DNSServer != "" {
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: d.Timeout}).DialContext(ctx, network, o.DNSServer)
+			},
+		}
+	}
+	t.DialContext = d.DialContext
+	switch {
+	case o.UnixSocket != "":
+		t.Proxy = nil
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", o.UnixSocket)
+		}
+	case o.Proxy != nil:
+		t.Proxy = http.ProxyURL(o.Proxy)
+	}
+	return t
+}
@@ -0,0 +1,299 @@
+// Package promresult decodes and preprocesses Prometheus query results.
+package promresult
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Point is a single sample. With the default policies V is NaN for samples
+// Prometheus reported as NaN or ±Inf (e.g. 0/0 error rates,
+// histogram_quantile without traffic).
+type Point struct {
+	T time.Time
+	V float64
+}
+
+// Series is one series of a range query result.
+type Series struct {
+	Labels map[string]string
+	Points []Point
+}
+
+// Policy says how a special sample value is represented after decoding.
+type Policy int
+
+const (
+	// Missing turns the value into NaN, the missing marker used by Align and Clean.
+	Missing Policy = iota
+	// Zero turns the value into 0.
+	Zero
+	// Keep passes the value through unchanged.
+	Keep
+)
+
+// Options select the policies for NaN and ±Inf samples.
+type Options struct {
+	NaN Policy
+	Inf Policy
+}
+
+// DefaultOptions treat every special value as missing.
+var DefaultOptions = Options{NaN: Missing, Inf: Missing}
+
+// ParseValue parses a Prometheus sample value ("1.5", "NaN", "+Inf", "-Inf",
+// ...) and applies the policies. Malformed values are an error rather than a
+// silent zero.
+func ParseValue(s string, opts Options) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sample value %q", s)
+	}
+	switch {
+	case math.IsNaN(f):
+		return apply(opts.NaN, f), nil
+	case math.IsInf(f, 0):
+		return apply(opts.Inf, f), nil
+	}
+	return f, nil
+}
+
+func apply(p Policy, f float64) float64 {
+	switch p {
+	case Zero:
+		return 0
+	case Keep:
+		return f
+	default:
+		return math.NaN()
+	}
+}
+
+// ParseTime parses a Prometheus sample timestamp (float seconds).
+func ParseTime(v json.Number) (time.Time, error) {
+	f, err := strconv.ParseFloat(string(v), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, fmt.Errorf("invalid sample timestamp %q", v)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e3))*int64(time.Millisecond)), nil
+}
+
+// sample is a [timestamp, "value"] pair.
+type sample struct {
+	T time.Time
+	V string
+}
+
+func (s *sample) UnmarshalJSON(b []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("sample has %d elements, want 2", len(pair))
+	}
+	var ts json.Number
+	if err := json.Unmarshal(pair[0], &ts); err != nil {
+		return fmt.Errorf("invalid sample timestamp: %w", err)
+	}
+	t, err := ParseTime(ts)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(pair[1], &s.V); err != nil {
+		return fmt.Errorf("invalid sample value: %w", err)
+	}
+	s.T = t
+	return nil
+}
+
+// DecodeMatrix decodes the data field of a query_range response with
+// DefaultOptions.
+func DecodeMatrix(raw json.RawMessage) ([]Series, error) {
+	return DecodeMatrixWith(raw, DefaultOptions)
+}
+
+// DecodeMatrixWith decodes the data field of a query_range response.
+func DecodeMatrixWith(raw json.RawMessage, opts Options) ([]Series, error) {
+	var m struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Values []sample          `json:"values"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	if m.ResultType != "" && m.ResultType != "matrix" {
+		return nil, fmt.Errorf("unexpected result type %q", m.ResultType)
+	}
+	out := make([]Series, 0, len(m.Result))
+	for _, r := range m.Result {
+		pts := make([]Point, 0, len(r.Values))
+		for _, v := range r.Values {
+			f, err := ParseValue(v.V, opts)
+			if err != nil {
+				return nil, err
+			}
+			pts = append(pts, Point{T: v.T, V: f})
+		}
+		out = append(out, Series{Labels: r.Metric, Points: pts})
+	}
+	return out, nil
+}
+
+// Sample is one element of an instant query result.
+type Sample struct {
+	Labels map[string]string
+	Point
+}
+
+// DecodeVector decodes the data field of an instant query response with
+// DefaultOptions.
+func DecodeVector(raw json.RawMessage) ([]Sample, error) {
+	var m struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  sample            `json:"value"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	if m.ResultType != "" && m.ResultType != "vector" {
+		return nil, fmt.Errorf("unexpected result type %q", m.ResultType)
+	}
+	out := make([]Sample, 0, len(m.Result))
+	for _, r := range m.Result {
+		f, err := ParseValue(r.Value.V, DefaultOptions)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Sample{Labels: r.Metric, Point: Point{T: r.Value.T, V: f}})
+	}
+	return out, nil
+}
+
+// Grid is a common time axis series are aligned onto: Len slots of Step
+// starting at Start.
+type Grid struct {
+	Start time.Time
+	Step  time.Duration
+	Len   int
+}
+
+// NewGrid covers [start, end] with slots of step. Start is truncated to a
+// multiple of step so consecutive scans share slot timestamps.
+func NewGrid(start, end time.Time, step time.Duration) Grid {
+	start = start.Truncate(step)
+	return Grid{Start: start, Step: step, Len: int(end.Sub(start)/step) + 1}
+}
+
+// End is the time of the last slot.
+func (g Grid) End() time.Time {
+	return g.Start.Add(time.Duration(g.Len-1) * g.Step)
+}
+
+// Times returns the slot timestamps.
+func (g Grid) Times() []time.Time {
+	ts := make([]time.Time, g.Len)
+	for i := range ts {
+		ts[i] = g.Start.Add(time.Duration(i) * g.Step)
+	}
+	return ts
+}
+
+// Align resamples points onto g. Each slot holds the mean of the usable
+// samples in [slot, slot+step); slots without one are NaN, the explicit
+// missing marker. Series starting or ending mid-window therefore line up with
+// every other series on the same grid.
+func Align(points []Point, g Grid) []float64 {
+	sum := make([]float64, g.Len)
+	n := make([]int, g.Len)
+	for _, p := range points {
+		if math.IsNaN(p.V) || p.T.Before(g.Start) {
+			continue
+		}
+		i := int(p.T.Sub(g.Start) / g.Step)
+		if i >= g.Len {
+			continue
+		}
+		sum[i] += p.V
+		n[i]++
+	}
+	out := make([]float64, g.Len)
+	for i := range out {
+		if n[i] == 0 {
+			out[i] = math.NaN()
+			continue
+		}
+		out[i] = sum[i] / float64(n[i])
+	}
+	return out
+}
+
+// AlignAll aligns every series onto g, one row per series.
+func AlignAll(series []Series, g Grid) [][]float64 {
+	out := make([][]float64, len(series))
+	for i, s := range series {
+		out[i] = Align(s.Points, g)
+	}
+	return out
+}
+
+// Cleaned is a series prepared for detection.
+type Cleaned struct {
+	Values []float64
+	Times  []time.Time
+	// Filled marks values interpolated over a missing slot; they are used for
+	// training but never reported as anomalies.
+	Filled []bool
+	// Missing is the number of slots without a usable sample between the first
+	// and last usable sample.
+	Missing int
+}
+
+// MissingRatio is the share of slots that had to be filled.
+func (c Cleaned) MissingRatio() float64 {
+	if len(c.Values) == 0 {
+		return 1
+	}
+	return float64(c.Missing) / float64(len(c.Values))
+}
+
+// Clean turns a series aligned onto g into a gap-free one. NaN slots (stale
+// markers, undefined ratios, no sample) are missing. Leading and trailing
+// missing slots are dropped; interior ones are linearly interpolated between
+// the neighbouring samples so they neither show up as drops to zero nor shift
+// the remaining points. Counter resets need no handling here since the
+// queries use rate()/increase(), which already compensate for them.
+func Clean(aligned []float64, g Grid) Cleaned {
+	var c Cleaned
+	prev := -1
+	for i, v := range aligned {
+		if math.IsNaN(v) {
+			continue
+		}
+		if prev >= 0 {
+			gap := i - prev - 1
+			for k := 1; k <= gap; k++ {
+				frac := float64(k) / float64(gap+1)
+				c.Values = append(c.Values, aligned[prev]+(v-aligned[prev])*frac)
+				c.Times = append(c.Times, g.Start.Add(time.Duration(prev+k)*g.Step))
+				c.Filled = append(c.Filled, true)
+				c.Missing++
+			}
+		}
+		c.Values = append(c.Values, v)
+		c.Times = append(c.Times, g.Start.Add(time.Duration(i)*g.Step))
+		c.Filled = append(c.Filled, false)
+		prev = i
+	}
+	return c
+}
@@ -0,0 +1,77 @@
+package secret
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// KeyPair is a TLS certificate and key read from PEM files, re-read like
+// secret files when they change, so renewed certificates are served
+// without a restart.
+type KeyPair struct {
+	cert, key Secret
+
+	mu sync.Mutex
+	// pem is the PEM that parsed was built from; bad is the last invalid
+	// PEM, so it is logged once.
+	pem, bad string
+	parsed   *tls.Certificate
+}
+
+// LoadKeyPair reads the key pair of the files certFile and keyFile.
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	cert, err := File(certFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := File(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	kp := &KeyPair{cert: cert, key: key}
+	if _, err := kp.Certificate(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// Certificate returns the current certificate. While the files do not make
+// a valid pair, e.g. between the writes of a renewed certificate and key,
+// the last valid one is kept.
+func (kp *KeyPair) Certificate() (*tls.Certificate, error) {
+	cert, key := kp.cert.Get(), kp.key.Get()
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if cert+key == kp.pem || cert+key == kp.bad {
+		return kp.parsed, nil
+	}
+	c, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		if kp.parsed == nil {
+			return nil, fmt.Errorf("key pair %s: %w", kp.cert.f.path, err)
+		}
+		log.Printf("key pair %s: %v, keeping the last certificate", kp.cert.f.path, err)
+		kp.bad = cert + key
+		return kp.parsed, nil
+	}
+	kp.pem, kp.parsed = cert+key, &c
+	return kp.parsed, nil
+}
+
+// LoadCertPool reads the PEM certificates of the CAs in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New(file + ": no PEM certificates")
+	}
+	return pool, nil
+}
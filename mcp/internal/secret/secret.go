@@ -0,0 +1,101 @@
+// Package secret holds credentials given inline or as the path of a file,
+// e.g. a Docker or Kubernetes secret mount. Files are re-read when they
+// change, so rotated credentials take effect without a restart.
+package secret
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Secret is a credential. The zero value is empty. Copies share the file
+// of the secret.
+type Secret struct {
+	value string
+	f     *file
+}
+
+// Inline returns the secret v.
+func Inline(v string) Secret {
+	return Secret{value: v}
+}
+
+// File returns the secret held in the file at path, without surrounding
+// whitespace such as a trailing newline. It fails when the file cannot be
+// read.
+func File(path string) (Secret, error) {
+	f := &file{path: path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Secret{}, err
+	}
+	if err := f.read(fi); err != nil {
+		return Secret{}, err
+	}
+	return Secret{f: f}, nil
+}
+
+// New returns the secret in the file at path, or else value.
+func New(value, path string) (Secret, error) {
+	switch {
+	case path == "":
+		return Inline(value), nil
+	case value != "":
+		return Secret{}, fmt.Errorf("both a value and the file %s given", path)
+	}
+	return File(path)
+}
+
+// Get returns the current value of s. The file of s is checked on every
+// call and re-read when it was replaced or modified; while it cannot be
+// read, its last value is kept.
+func (s Secret) Get() string {
+	if s.f == nil {
+		return s.value
+	}
+	return s.f.get()
+}
+
+// file is the state of a secret file.
+type file struct {
+	path string
+
+	mu    sync.Mutex
+	info  os.FileInfo
+	value string
+	// failing is set while the file cannot be read, so it is logged once
+	failing bool
+}
+
+func (f *file) get() string {
+	fi, err := os.Stat(f.path)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed := err == nil && !(os.SameFile(fi, f.info) && fi.ModTime().Equal(f.info.ModTime()) && fi.Size() == f.info.Size())
+	if changed {
+		err = f.read(fi)
+	}
+	switch {
+	case err != nil && !f.failing:
+		log.Printf("secret %s: %v, keeping the last value", f.path, err)
+	case err == nil && f.failing:
+		log.Printf("secret %s: readable again", f.path)
+	case changed:
+		log.Printf("secret %s: reloaded", f.path)
+	}
+	f.failing = err != nil
+	return f.value
+}
+
+// read reads the file, whose stat before reading is fi.
+func (f *file) read(fi os.FileInfo) error {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.info, f.value = fi, strings.TrimSpace(string(b))
+	return nil
+}
@@ -0,0 +1,303 @@
+// Package tempo is a small client for the Grafana Tempo HTTP API: fetching
+// traces by ID and searching them.
+package tempo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mimir "mcp/internal/mimir"
+)
+
+// ErrNotFound is returned for a trace ID Tempo doesn't know.
+var ErrNotFound = errors.New("trace not found")
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: &http.Client{Timeout: 15 * time.Second}}
+}
+
+// Span is one span of a trace.
+type Span struct {
+	ID       string
+	ParentID string
+	Service  string
+	Name     string
+	// Kind is the OTLP kind without prefix, e.g. "server".
+	Kind          string
+	Start, End    time.Time
+	Error         bool
+	StatusMessage string
+	// Attributes are the span attributes with scalar values, as strings.
+	Attributes map[string]string
+}
+
+// Trace fetches the spans of trace id. Requests carry the tenant of ctx
+// (see mimir.WithTenant), as Tempo shares Mimir's X-Scope-OrgID.
+func (c *Client) Trace(ctx context.Context, id string) ([]Span, error) {
+	res, err := c.get(ctx, "/api/traces/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body otlpTrace
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.spans(), nil
+}
+
+// TraceSummary is a trace found by Search.
+type TraceSummary struct {
+	TraceID     string
+	RootService string
+	RootName    string
+	Start       time.Time
+	Duration    time.Duration
+	// Matched is the number of spans matching the query; Spans holds
+	// those Tempo returned, at most its spans per span set.
+	Matched int
+	Spans   []MatchedSpan
+}
+
+// MatchedSpan is a span matching a search.
+type MatchedSpan struct {
+	ID         string
+	Name       string
+	Start      time.Time
+	Duration   time.Duration
+	Attributes map[string]string
+}
+
+// Search runs a TraceQL query over traces between start and end and
+// returns at most limit of them.
+func (c *Client) Search(ctx context.Context, traceQL string, start, end time.Time, limit int) ([]TraceSummary, error) {
+	q := url.Values{}
+	q.Set("q", traceQL)
+	q.Set("start", strconv.FormatInt(start.Unix(), 10))
+	q.Set("end", strconv.FormatInt(end.Unix(), 10))
+	q.Set("limit", strconv.Itoa(limit))
+	res, err := c.get(ctx, "/api/search", q)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body struct {
+		Traces []struct {
+			TraceID           string          `json:"traceID"`
+			RootServiceName   string          `json:"rootServiceName"`
+			RootTraceName     string          `json:"rootTraceName"`
+			StartTimeUnixNano string          `json:"startTimeUnixNano"`
+			DurationMs        int64           `json:"durationMs"`
+			SpanSet           *searchSpanSet  `json:"spanSet"`
+			SpanSets          []searchSpanSet `json:"spanSets"`
+		} `json:"traces"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	out := make([]TraceSummary, 0, len(body.Traces))
+	for _, t := range body.Traces {
+		ts := TraceSummary{
+			TraceID:     t.TraceID,
+			RootService: t.RootServiceName,
+			RootName:    t.RootTraceName,
+			Start:       unixNano(t.StartTimeUnixNano),
+			Duration:    time.Duration(t.DurationMs) * time.Millisecond,
+		}
+		sets := t.SpanSets
+		if len(sets) == 0 && t.SpanSet != nil {
+			sets = []searchSpanSet{*t.SpanSet}
+		}
+		for _, set := range sets {
+			ts.Matched += set.Matched
+			for _, sp := range set.Spans {
+				n, _ := strconv.ParseInt(sp.DurationNanos, 10, 64)
+				ms := MatchedSpan{ID: sp.SpanID, Name: sp.Name, Start: unixNano(sp.StartTimeUnixNano), Duration: time.Duration(n), Attributes: map[string]string{}}
+				for _, a := range sp.Attributes {
+					if v, ok := a.String(); ok {
+						ms.Attributes[a.Key] = v
+					}
+				}
+				ts.Spans = append(ts.Spans, ms)
+			}
+		}
+		out = append(out, ts)
+	}
+	return out, nil
+}
+
+type searchSpanSet struct {
+	Spans []struct {
+		SpanID            string          `json:"spanID"`
+		Name              string          `json:"name"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		DurationNanos     string          `json:"durationNanos"`
+		Attributes        []otlpAttribute `json:"attributes"`
+	} `json:"spans"`
+	Matched int `json:"matched"`
+}
+
+func (c *Client) get(ctx context.Context, path string, q url.Values) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if t := mimir.Tenant(ctx); t != "" {
+		req.Header.Set("X-Scope-OrgID", t)
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tempo: %w", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		res.Body.Close()
+		return nil, fmt.Errorf("tempo: %s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	return res, nil
+}
+
+// otlpTrace is the OTLP JSON of a trace as Tempo serves it: "batches" of
+// resource spans, with "scopeSpans" or, before OTLP 0.15,
+// "instrumentationLibrarySpans".
+type otlpTrace struct {
+	Batches       []otlpResourceSpans `json:"batches"`
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []struct {
+		Spans []otlpSpan `json:"spans"`
+	} `json:"scopeSpans"`
+	InstrumentationLibrarySpans []struct {
+		Spans []otlpSpan `json:"spans"`
+	} `json:"instrumentationLibrarySpans"`
+}
+
+type otlpSpan struct {
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId"`
+	Name              string          `json:"name"`
+	Kind              json.RawMessage `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code    json.RawMessage `json:"code"`
+		Message string          `json:"message"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string  `json:"stringValue"`
+		IntValue    *string  `json:"intValue"`
+		DoubleValue *float64 `json:"doubleValue"`
+		BoolValue   *bool    `json:"boolValue"`
+	} `json:"value"`
+}
+
+// String returns the attribute value as a string; ok is false for arrays
+// and maps.
+func (a otlpAttribute) String() (string, bool) {
+	v := a.Value
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue, true
+	case v.IntValue != nil:
+		return *v.IntValue, true
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64), true
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue), true
+	}
+	return "", false
+}
+
+// otlpKinds are the numeric OTLP span kinds.
+var otlpKinds = []string{"unspecified", "internal", "server", "client", "producer", "consumer"}
+
+// enum decodes an OTLP enum, given by name (with prefix) or number.
+func enum(raw json.RawMessage, prefix string, names []string) string {
+	var n int
+	if json.Unmarshal(raw, &n) == nil {
+		if n >= 0 && n < len(names) {
+			return names[n]
+		}
+		return ""
+	}
+	var s string
+	_ = json.Unmarshal(raw, &s)
+	return strings.ToLower(strings.TrimPrefix(s, prefix))
+}
+
+func unixNano(s string) time.Time {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return time.Unix(0, n).UTC()
+}
+
+func (t otlpTrace) spans() []Span {
+	var out []Span
+	for _, rs := range append(t.Batches, t.ResourceSpans...) {
+		service := ""
+		for _, a := range rs.Resource.Attributes {
+			if a.Key == "service.name" {
+				service, _ = a.String()
+			}
+		}
+		var spans []otlpSpan
+		for _, ss := range rs.ScopeSpans {
+			spans = append(spans, ss.Spans...)
+		}
+		for _, ss := range rs.InstrumentationLibrarySpans {
+			spans = append(spans, ss.Spans...)
+		}
+		for _, sp := range spans {
+			s := Span{
+				ID:            sp.SpanID,
+				ParentID:      sp.ParentSpanID,
+				Service:       service,
+				Name:          sp.Name,
+				Kind:          enum(sp.Kind, "SPAN_KIND_", otlpKinds),
+				Start:         unixNano(sp.StartTimeUnixNano),
+				End:           unixNano(sp.EndTimeUnixNano),
+				Error:         enum(sp.Status.Code, "STATUS_CODE_", []string{"unset", "ok", "error"}) == "error",
+				StatusMessage: sp.Status.Message,
+				Attributes:    map[string]string{},
+			}
+			for _, a := range sp.Attributes {
+				if v, ok := a.String(); ok {
+					s.Attributes[a.Key] = v
+				}
+			}
+			out = append(out, s)
+		}
+	}
+	return out
+}
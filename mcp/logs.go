@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logsArgs are the arguments of logs_query.
+type logsArgs struct {
+	Service string `json:"service"`
+	// Contains keeps lines containing the text, e.g. a trace ID.
+	Contains string `json:"contains"`
+	// ErrorsOnly keeps lines that look like errors.
+	ErrorsOnly bool `json:"errorsOnly"`
+	// From and To bound the query, RFC 3339. From defaults to
+	// LookbackMinutes before To, To to now.
+	From            string `json:"from"`
+	To              string `json:"to"`
+	LookbackMinutes int    `json:"lookbackMinutes"`
+	Limit           int    `json:"limit"`
+}
+
+// errorLinePattern is the line filter of errorsOnly.
+const errorLinePattern = `(?i)(error|exception|fatal|panic)`
+
+// maxLogLine is the length beyond which log lines are cut.
+const maxLogLine = 1000
+
+// logsRange resolves the time range of a.
+func logsRange(a logsArgs) (from, to time.Time, err error) {
+	return lookbackRange(a.From, a.To, a.LookbackMinutes, 30)
+}
+
+// logQL renders a as a LogQL log query on the service_name stream label.
+// labelFilters become further stream matchers.
+func (a logsArgs) logQL(matchers string) string {
+	q := fmt.Sprintf("{service_name=%s%s}", strconv.Quote(a.Service), matchers)
+	if a.Contains != "" {
+		q += " |= " + strconv.Quote(a.Contains)
+	}
+	if a.ErrorsOnly {
+		q += " |~ " + strconv.Quote(errorLinePattern)
+	}
+	return q
+}
+
+// logLine is a line returned by logs_query.
+type logLine struct {
+	Time time.Time `json:"time"`
+	Line string    `json:"line"`
+	// Labels are the stream labels besides service_name.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// queryLogs fetches the newest matching log lines of a service from Loki.
+func (s *server) queryLogs(ctx context.Context, a logsArgs, opts toolOptions) (json.RawMessage, error) {
+	from, to, err := logsRange(a)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRange(ctx, to.Sub(from), 0); err != nil {
+		return nil, err
+	}
+	q := a.logQL(opts.matchers())
+	if opts.Explain {
+		return json.Marshal(map[string]any{
+			"endpoint": s.loki.BaseURL + "/loki/api/v1/query_range",
+			"logql":    q,
+			"from":     from,
+			"to":       to,
+			"limit":    a.Limit,
+		})
+	}
+	entries, err := s.loki.QueryRange(ctx, q, from, to, a.Limit)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]logLine, 0, len(entries))
+	for _, e := range entries {
+		l := logLine{Time: e.Time, Line: e.Line}
+		if len(l.Line) > maxLogLine {
+			l.Line = strings.ToValidUTF8(l.Line[:maxLogLine], "") + "…"
+		}
+		for k, v := range e.Labels {
+			if k == "service_name" {
+				continue
+			}
+			if l.Labels == nil {
+				l.Labels = map[string]string{}
+			}
+			l.Labels[k] = v
+		}
+		lines = append(lines, l)
+	}
+	return json.Marshal(map[string]any{
+		"logql": q,
+		"from":  from,
+		"to":    to,
+		"lines": lines,
+		// a full page means older lines were left out
+		"truncated": len(lines) == a.Limit,
+	})
+}
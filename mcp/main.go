@@ -2,16 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"mcp/internal/compress"
+	"mcp/internal/loki"
 	mimir "mcp/internal/mimir"
+	"mcp/internal/secret"
+	"mcp/internal/tempo"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// version is the version of the build, set with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
 // Basic MCP JSON-RPC 2.0 messages
 type req struct {
 	ID      any             `json:"id"`
@@ -28,37 +46,223 @@ type resp struct {
 type rpcError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
 }
 
-type server struct{ c *mimir.Client }
+type server struct {
+	c *mimir.Client
+	// clusters are the Mimir backends tools select with their cluster
+	// argument; c is the first.
+	clusters []cluster
+	// parallel bounds the concurrent backend queries of one composite tool call.
+	parallel int
+	// calls queues tool calls beyond those running; nil runs all at once.
+	calls *callQueue
+	// cache holds recent tool results; nil disables caching.
+	cache *resultCache
+	// limits bound the time range of tool calls.
+	limits rangeLimits
+	// tenant is sent to Mimir when a request names none.
+	tenant string
+	// policy authorizes tool calls; nil disables authentication.
+	policy *policy
+	// audit records every tools/call.
+	audit *auditLog
+	// ifURL is the if-service base URL anomalies_history reads from; empty
+	// disables the tool.
+	ifURL string
+	// ifClient, and ifStream without a timeout for the anomaly stream, share
+	// the TLS settings of the if-service.
+	ifClient, ifStream *http.Client
+	// tempo serves the trace tools.
+	tempo *tempo.Client
+	// loki serves logs_query.
+	loki *loki.Client
+	// notify pushes if-service anomalies to listening sessions; nil
+	// disables notifications.
+	notify *notifier
+	// health is served as resources, refreshed every healthInterval; nil
+	// disables the health resources.
+	health         *healthBoard
+	healthInterval time.Duration
+	// snapshot, in offline mode, answers tool calls instead of the backends.
+	snapshot *snapshot
+}
 
 func newServer() *server {
 	base := getenv("MIMIR_URL", "http://mimir:9009/prometheus")
-	return &server{c: mimir.New(base)}
+	parallel := 4
+	fmt.Sscanf(getenv("MCP_QUERY_PARALLELISM", "4"), "%d", &parallel)
+	if parallel < 1 {
+		parallel = 1
+	}
+	c := mimir.New(base, mimirOptions())
+	profile, err := mimir.ParseProfile(getenv("MIMIR_BACKEND", "mimir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.Profile = profile
+	fmt.Sscanf(getenv("MIMIR_RETRIES", "2"), "%d", &c.Retries)
+	// credentials of the Mimir backend, the secrets also from files
+	c.BearerToken, c.Username, c.Password = getenvSecret("MIMIR_BEARER_TOKEN"), getenv("MIMIR_USERNAME", ""), getenvSecret("MIMIR_PASSWORD")
+	// so Mimir operators can tell the load of the MCP tools from other queries
+	c.UserAgent, c.QuerySource = "mimir-servicegraph-mcp/"+version, getenv("MIMIR_QUERY_SOURCE", "")
+	if v := getenv("MIMIR_SLOW_QUERY", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid MIMIR_SLOW_QUERY %q", v)
+		}
+		c.SlowQuery = d
+	}
+	// timeouts of instant queries, range queries and metadata calls, also
+	// sent to the backend as the query timeout
+	for _, t := range []struct {
+		env string
+		dst *time.Duration
+	}{{"MIMIR_TIMEOUT_INSTANT", &c.Timeouts.Instant}, {"MIMIR_TIMEOUT_RANGE", &c.Timeouts.Range}, {"MIMIR_TIMEOUT_SERIES", &c.Timeouts.Series}} {
+		if v := getenv(t.env, ""); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				log.Fatalf("invalid %s %q", t.env, v)
+			}
+			*t.dst = d
+		}
+	}
+	var calls *callQueue
+	concurrency, depth := 16, 64
+	fmt.Sscanf(getenv("MCP_MAX_CONCURRENT_CALLS", "16"), "%d", &concurrency)
+	fmt.Sscanf(getenv("MCP_QUEUE_DEPTH", "64"), "%d", &depth)
+	if concurrency > 0 {
+		calls = newCallQueue(concurrency, max(depth, 0))
+	}
+	var cache *resultCache
+	size := 1024
+	fmt.Sscanf(getenv("MCP_CACHE_SIZE", "1024"), "%d", &size)
+	if size > 0 {
+		cache = newResultCache(size)
+	}
+	// bounds of the time range of every tool call
+	limits := rangeLimits{maxWindow: defaultMaxWindowMinutes * time.Minute, maxPoints: defaultMaxPoints}
+	if v := getenv("MCP_MAX_WINDOW_MINUTES", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid MCP_MAX_WINDOW_MINUTES %q", v)
+		}
+		limits.maxWindow = time.Duration(n) * time.Minute
+	}
+	if v := getenv("MCP_MAX_POINTS", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 {
+			log.Fatalf("invalid MCP_MAX_POINTS %q", v)
+		}
+		limits.maxPoints = n
+	}
+	var pol *policy
+	if path := getenv("MCP_POLICY_FILE", ""); path != "" {
+		pol, err = loadPolicy(path)
+		if err != nil {
+			log.Fatalf("load policy: %v", err)
+		}
+	}
+	maxMB, keep := 10, 5
+	fmt.Sscanf(getenv("MCP_AUDIT_MAX_MB", "10"), "%d", &maxMB)
+	fmt.Sscanf(getenv("MCP_AUDIT_KEEP", "5"), "%d", &keep)
+	audit, err := openAuditLog(getenv("MCP_AUDIT_LOG", ""), int64(maxMB)<<20, keep, 1000)
+	if err != nil {
+		log.Fatalf("open audit log: %v", err)
+	}
+	var health *healthBoard
+	healthInterval := time.Minute
+	if v := getenv("MCP_HEALTH_INTERVAL", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || (d != 0 && d < 10*time.Second) {
+			log.Fatalf("invalid MCP_HEALTH_INTERVAL %q", v)
+		}
+		healthInterval = d
+	}
+	if healthInterval > 0 {
+		health = &healthBoard{}
+	}
+	// pre-aggregated recording rules read instead of the raw spanmetrics
+	for _, r := range []struct {
+		env  string
+		name *string
+	}{{"RECORDED_RATE_METRIC", &recorded.rate}, {"RECORDED_ERROR_METRIC", &recorded.errors}, {"RECORDED_LATENCY_METRIC", &recorded.latency}} {
+		if v := getenv(r.env, ""); v != "" {
+			if !metricName.MatchString(v) {
+				log.Fatalf("invalid %s %q", r.env, v)
+			}
+			*r.name = v
+		}
+	}
+	clusters := []cluster{{Name: "default", URL: base, c: c}}
+	if path := getenv("MIMIR_CLUSTERS_FILE", ""); path != "" {
+		if clusters, err = loadClusters(path, c); err != nil {
+			log.Fatalf("load clusters: %v", err)
+		}
+		c = clusters[0].c
+	}
+	var notify *notifier
+	if getenv("MCP_ANOMALY_NOTIFICATIONS", "") == "true" {
+		notify = newNotifier()
+	}
+	ifTr := ifTransport()
+	s := &server{
+		c: c, clusters: clusters, parallel: parallel, calls: calls, cache: cache, limits: limits, tenant: getenv("MIMIR_TENANT", ""), policy: pol, audit: audit,
+		ifURL:          strings.TrimSuffix(getenv("IF_URL", "http://if-service:9030"), "/"),
+		ifClient:       &http.Client{Timeout: 15 * time.Second, Transport: ifTr},
+		ifStream:       &http.Client{Transport: ifTr},
+		tempo:          tempo.New(getenv("TEMPO_URL", "http://tempo:3200")),
+		loki:           loki.New(getenv("LOKI_URL", "http://loki:3100")),
+		notify:         notify,
+		health:         health,
+		healthInterval: healthInterval,
+	}
+	// offline mode: replay a snapshot, without backends to discover or
+	// refresh from
+	if path := getenv("MCP_SNAPSHOT_FILE", ""); path != "" {
+		if s.snapshot, err = loadSnapshot(path, s.toolDefaults()); err != nil {
+			log.Fatalf("load snapshot: %v", err)
+		}
+		s.notify, s.health = nil, nil
+		log.Printf("offline: replaying the snapshot of %s from %s", s.snapshot.manifest.Created.Format(time.RFC3339), path)
+	}
+	return s
 }
 
-func (s *server) handle(r req) resp {
+func (s *server) handle(ctx context.Context, r req) resp {
 	switch r.Method {
 	case "initialize":
 		// Minimal MCP handshake
-		return ok(r.ID, map[string]any{
-			"capabilities": map[string]any{
-				"tools": map[string]any{},
-			},
+		capabilities := map[string]any{
+			"tools":     map[string]any{},
+			"resources": map[string]any{},
+		}
+		if s.notify != nil {
+			// anomalies arrive as log messages on the GET /rpc stream
+			capabilities["logging"] = map[string]any{}
+		}
+		out := map[string]any{
+			"capabilities":    capabilities,
 			"protocolVersion": "2024-11-05",
-			"serverInfo":      map[string]any{"name": "mimir-servicegraph", "version": "0.1.0"},
-		})
+			"serverInfo":      map[string]any{"name": "mimir-servicegraph", "version": version},
+		}
+		if s.snapshot != nil {
+			out["instructions"] = s.snapshot.offlineInstructions()
+		}
+		return ok(r.ID, out)
 	case "tools/list":
-		// Advertise two tools with JSON Schemas
+		// Advertise the tools with JSON Schemas
 		return ok(r.ID, map[string]any{
-			"tools": []any{
+			"tools": s.visibleTools(ctx, withCommonArgs([]any{
 				map[string]any{
 					"name":        "servicegraph_topology",
-					"description": "Return client->server edge weights from servicegraph_request_total over a recent window",
+					"description": "Return client->server edge weights from servicegraph_request_total over a recent window, as JSON or as a Mermaid or Graphviz DOT diagram",
 					"inputSchema": map[string]any{
 						"type": "object",
 						"properties": map[string]any{
 							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"format":        map[string]any{"type": "string", "enum": []string{"json", "mermaid", "dot"}, "default": "json", "description": "mermaid and dot color nodes by error rate and size edges by RPS"},
 						},
 					},
 				},
@@ -81,12 +285,19 @@ func (s *server) handle(r req) resp {
 					"description": "Return latency quantile for a client->server edge using spanmetrics histogram",
 					"inputSchema": map[string]any{
 						"type":     "object",
-						"required": []string{"client", "server", "quantile"},
+						"required": []string{"client", "server"},
 						"properties": map[string]any{
-							"client":        map[string]any{"type": "string"},
-							"server":        map[string]any{"type": "string"},
-							"quantile":      map[string]any{"type": "number", "minimum": 0, "maximum": 1, "default": 0.95},
+							"client":   map[string]any{"type": "string"},
+							"server":   map[string]any{"type": "string"},
+							"quantile": map[string]any{"type": "number", "minimum": 0, "maximum": 1, "default": 0.95},
+							"quantiles": map[string]any{
+								"type":        "array",
+								"items":       map[string]any{"type": "number", "exclusiveMinimum": 0, "exclusiveMaximum": 1},
+								"maxItems":    maxQuantiles,
+								"description": "Several quantiles from one bucket fetch, e.g. [0.5, 0.9, 0.95, 0.99], instead of quantile; series carry a quantile label",
+							},
 							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"groupBy":       groupByArg,
 						},
 					},
 				},
@@ -101,6 +312,7 @@ func (s *server) handle(r req) resp {
 							"server":        map[string]any{"type": "string"},
 							"client":        map[string]any{"type": "string"},
 							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"groupBy":       groupByArg,
 						},
 					},
 				},
@@ -115,6 +327,106 @@ func (s *server) handle(r req) resp {
 							"server":        map[string]any{"type": "string"},
 							"limit":         map[string]any{"type": "integer", "minimum": 1, "default": 5},
 							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"groupBy":       groupByArg,
+						},
+					},
+				},
+				// Composite: rate, errors and duration in one call
+				map[string]any{
+					"name":        "spanmetrics_red_summary",
+					"description": "RED summary for a server: request rate, error ratio and p95 latency (spanmetrics)",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"server"},
+						"properties": map[string]any{
+							"server":        map[string]any{"type": "string"},
+							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"groupBy":       groupByArg,
+						},
+					},
+				},
+				// Error breakdown by endpoint and response code
+				map[string]any{
+					"name":        "spanmetrics_error_breakdown",
+					"description": "Break a server's errors down by span name, span status and HTTP/gRPC status code, with counts and rates over the window",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"server"},
+						"properties": map[string]any{
+							"server":        map[string]any{"type": "string"},
+							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"groupBy":       groupByArg,
+						},
+					},
+				},
+				// p95 latency trend per endpoint
+				map[string]any{
+					"name":        "spanmetrics_latency_trend",
+					"description": "Fit a linear trend to p95 latency per endpoint of a server and project it ahead, flagging steadily degrading endpoints",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"server"},
+						"properties": map[string]any{
+							"server":         map[string]any{"type": "string"},
+							"windowMinutes":  map[string]any{"type": "integer", "minimum": 1, "default": 60},
+							"horizonMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 30},
+						},
+					},
+				},
+				// Capacity headroom per endpoint
+				map[string]any{
+					"name":        "spanmetrics_capacity_headroom",
+					"description": "Estimate per endpoint how much traffic growth a server can absorb before p95 latency degrades, from sustained RPS vs latency history",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"server"},
+						"properties": map[string]any{
+							"server":        map[string]any{"type": "string"},
+							"windowMinutes": map[string]any{"type": "integer", "minimum": 60, "default": 1440},
+						},
+					},
+				},
+				// Service graph changes between two windows
+				map[string]any{
+					"name":        "servicegraph_topology_diff",
+					"description": "Compare service graph edges of the last window with an earlier window: new and removed edges, and edges whose volume or error ratio changed beyond a threshold",
+					"inputSchema": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"windowMinutes":   map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"offsetMinutes":   map[string]any{"type": "integer", "minimum": 1, "default": 60, "description": "How long ago the baseline window ended"},
+							"volumeThreshold": map[string]any{"type": "number", "minimum": 0, "default": 0.5, "description": "Relative request volume change reported as changed"},
+							"errorThreshold":  map[string]any{"type": "number", "minimum": 0, "maximum": 1, "default": 0.05, "description": "Absolute error ratio change reported as changed"},
+						},
+					},
+				},
+				// Hour-of-day traffic profile
+				map[string]any{
+					"name":        "spanmetrics_seasonality_profile",
+					"description": "Typical hourly RPS profile (median and IQR per hour of day over N weeks) for a server or one endpoint, and where the current traffic falls in it",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"server"},
+						"properties": map[string]any{
+							"server":   map[string]any{"type": "string"},
+							"endpoint": map[string]any{"type": "string", "description": "span_name; whole server when omitted"},
+							"weeks":    map[string]any{"type": "integer", "minimum": 1, "maximum": 8, "default": 4},
+							"timezone": map[string]any{"type": "string", "default": "UTC", "description": "IANA time zone for hours of day"},
+						},
+					},
+				},
+				// Latency bucket distribution
+				map[string]any{
+					"name":        "spanmetrics_latency_histogram",
+					"description": "Latency distribution of a server, or one endpoint or caller of it: per-second rates per histogram bucket, quantiles and modes, to tell a uniform slowdown from a bimodal tail",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"server"},
+						"properties": map[string]any{
+							"server":        map[string]any{"type": "string"},
+							"endpoint":      map[string]any{"type": "string", "description": "span_name; whole server when omitted"},
+							"client":        map[string]any{"type": "string", "description": "peer_service; all callers when omitted"},
+							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 10},
 						},
 					},
 				},
@@ -129,10 +441,136 @@ func (s *server) handle(r req) resp {
 							"server":        map[string]any{"type": "string"},
 							"limit":         map[string]any{"type": "integer", "minimum": 1, "default": 5},
 							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"groupBy":       groupByArg,
 						},
 					},
 				},
-			},
+				// Stored anomaly events from if-service
+				map[string]any{
+					"name":        "anomalies_history",
+					"description": "Past anomaly events detected by if-service, newest first, with per-day counts that reach back beyond its retention. Use it to check whether an anomaly has happened before",
+					"inputSchema": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"service":       map[string]any{"type": "string", "description": "service_name"},
+							"metric":        map[string]any{"type": "string", "enum": []string{"rps", "error_rate", "latency_p95"}},
+							"severity":      map[string]any{"type": "string", "enum": []string{"warning", "critical"}},
+							"from":          map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to lookbackHours before to"},
+							"to":            map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to now"},
+							"lookbackHours": map[string]any{"type": "integer", "minimum": 1, "default": 168},
+							"limit":         map[string]any{"type": "integer", "minimum": 1, "maximum": 500, "default": 50},
+						},
+					},
+				},
+				// Trace by ID from Tempo
+				map[string]any{
+					"name":        "get_trace",
+					"description": "Fetch a trace by ID from Tempo as a compacted span tree (service, span name, offset, duration, status) with its critical path. Use it on trace IDs from exemplars, incident_report or anomaly events",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"traceId"},
+						"properties": map[string]any{
+							"traceId":  map[string]any{"type": "string", "description": "16 or 32 hex digits"},
+							"maxSpans": map[string]any{"type": "integer", "minimum": 1, "maximum": 2000, "default": 200, "description": "Tree size beyond which spans off the critical path and without errors are left out"},
+						},
+					},
+				},
+				map[string]any{
+					"name":        "search_traces",
+					"description": "Find traces of a service in Tempo with a span matching all the given conditions (span name, minimum duration, failed), slowest first. Bridges from a metric or anomaly to trace IDs for get_trace",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"service"},
+						"properties": map[string]any{
+							"service":         map[string]any{"type": "string", "description": "service.name of the span"},
+							"spanName":        map[string]any{"type": "string"},
+							"minDurationMs":   map[string]any{"type": "integer", "minimum": 0},
+							"error":           map[string]any{"type": "boolean", "default": false, "description": "Only failed spans"},
+							"from":            map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to lookbackMinutes before to"},
+							"to":              map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to now"},
+							"lookbackMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 60},
+							"limit":           map[string]any{"type": "integer", "minimum": 1, "maximum": 100, "default": 20},
+						},
+					},
+				},
+				map[string]any{
+					"name":        "logs_query",
+					"description": "Newest log lines of a service from Loki, optionally only lines containing a text (e.g. a trace ID) or looking like errors. Use it for the evidence behind anomalies or failing endpoints",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"service"},
+						"properties": map[string]any{
+							"service":         map[string]any{"type": "string", "description": "service_name stream label"},
+							"contains":        map[string]any{"type": "string", "description": "Only lines containing this text"},
+							"errorsOnly":      map[string]any{"type": "boolean", "default": false, "description": "Only lines mentioning error, exception, fatal or panic"},
+							"from":            map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to lookbackMinutes before to"},
+							"to":              map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to now"},
+							"lookbackMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 30},
+							"limit":           map[string]any{"type": "integer", "minimum": 1, "maximum": 1000, "default": 100},
+						},
+					},
+				},
+				map[string]any{
+					"name":        "correlate",
+					"description": "Metrics, failed and slow traces and error logs of a service around a moment, merged into one chronology relative to it. Use it to see what happened first around an anomaly or alert",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"service"},
+						"properties": map[string]any{
+							"service":       map[string]any{"type": "string", "description": "service_name"},
+							"at":            map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to now"},
+							"windowMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 15, "description": "How far before and after at to look"},
+						},
+					},
+				},
+				// One-call starting point for an investigation
+				map[string]any{
+					"name":        "incident_report",
+					"description": "Everything about a service during an incident in one report: RED metrics overall and per endpoint with their change against a baseline window, callers and callees from the service graph, anomaly events from if-service and example trace IDs. Start an investigation here",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"service"},
+						"properties": map[string]any{
+							"service":               map[string]any{"type": "string", "description": "service_name"},
+							"from":                  map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to lookbackMinutes before to"},
+							"to":                    map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to now"},
+							"lookbackMinutes":       map[string]any{"type": "integer", "minimum": 1, "default": 30},
+							"baselineOffsetMinutes": map[string]any{"type": "integer", "minimum": 1, "default": 1440, "description": "How much earlier the baseline window of the same length lies"},
+						},
+					},
+				},
+				// Server readiness and backend status
+				map[string]any{
+					"name":        "server_status",
+					"description": "Report whether the MCP server is ready, how each Mimir cluster answered recent queries (reachable, last success, last error) and the metrics discovered",
+					"inputSchema": map[string]any{"type": "object", "properties": map[string]any{}},
+				},
+				// Why tools return no data
+				map[string]any{
+					"name":        "backend_capabilities",
+					"description": "Probe which spanmetrics and servicegraph metrics and labels the backend has over the last hour, which ones the tools read, and problems explaining tools that return no data",
+					"inputSchema": map[string]any{"type": "object", "properties": map[string]any{}},
+				},
+				// Backend cost of an ad-hoc query
+				map[string]any{
+					"name":        "query_stats",
+					"description": "Run a PromQL query and report what it cost the backend (duration, series and points returned, samples read and timings when the backend reports statistics) instead of its result, or with estimate only estimate the series and samples it would read from the series its selectors match. Check ad-hoc queries here first; costly is set with advice for expensive ones",
+					"inputSchema": map[string]any{
+						"type":     "object",
+						"required": []string{"query"},
+						"properties": map[string]any{
+							"query":                 map[string]any{"type": "string", "description": "PromQL; labelFilters do not apply, put matchers in the query"},
+							"from":                  map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to lookbackMinutes before to"},
+							"to":                    map[string]any{"type": "string", "format": "date-time", "description": "RFC 3339; defaults to now"},
+							"lookbackMinutes":       map[string]any{"type": "integer", "minimum": 1, "default": 10},
+							"instant":               map[string]any{"type": "boolean", "default": false, "description": "Evaluate once at to instead of over the range"},
+							"stepSeconds":           map[string]any{"type": "integer", "minimum": 1, "default": 30},
+							"estimate":              map[string]any{"type": "boolean", "default": false, "description": "Estimate the cost without running the query"},
+							"scrapeIntervalSeconds": map[string]any{"type": "integer", "minimum": 1, "default": 15, "description": "Sample interval the estimate assumes"},
+						},
+					},
+				},
+			})),
 		})
 	case "tools/call":
 		var p struct {
@@ -142,18 +580,70 @@ func (s *server) handle(r req) resp {
 		if err := json.Unmarshal(r.Params, &p); err != nil {
 			return fail(r.ID, -32602, err)
 		}
+		if who, authed := principalFrom(ctx); authed {
+			if err := s.policy.authorize(who, p.Name); err != nil {
+				return fail(r.ID, codeForbidden, err)
+			}
+		}
+		if s.snapshot != nil {
+			if who, authed := principalFrom(ctx); authed {
+				if err := s.policy.checkTenants(who, s.snapshot.manifest.Tenant); err != nil {
+					return fail(r.ID, codeForbidden, err)
+				}
+			}
+			return s.snapshot.replay(r.ID, p.Name, p.Arguments)
+		}
+		opts, err := parseToolOptions(p.Arguments)
+		if err != nil {
+			return fail(r.ID, -32602, err)
+		}
+		if _, pinned := clusterFrom(ctx); !pinned && opts.Cluster != "" {
+			if opts.Cluster == "all" {
+				return s.fanOut(ctx, r)
+			}
+			cl, found := s.findCluster(opts.Cluster)
+			if !found {
+				return fail(r.ID, -32602, fmt.Errorf("unknown cluster: %s", opts.Cluster))
+			}
+			ctx = withCluster(ctx, cl)
+		}
+		tenant := mimir.Tenant(ctx)
+		if len(opts.Tenants) > 0 {
+			if cl, _ := clusterFrom(ctx); cl.c != nil && cl.c.Tenant != "" {
+				return fail(r.ID, -32602, fmt.Errorf("cluster %s has fixed tenants", cl.Name))
+			}
+			tenant = strings.Join(opts.Tenants, "|")
+			ctx = mimir.WithTenant(ctx, tenant)
+		}
+		if cl, _ := clusterFrom(ctx); cl.c != nil && cl.c.Tenant != "" {
+			tenant = cl.c.Tenant
+		}
+		if who, authed := principalFrom(ctx); authed {
+			if err := s.policy.checkTenants(who, tenant); err != nil {
+				return fail(r.ID, codeForbidden, err)
+			}
+		}
 		switch p.Name {
 		case "servicegraph_topology":
 			var a struct {
-				WindowMinutes int `json:"windowMinutes"`
+				WindowMinutes int    `json:"windowMinutes"`
+				Format        string `json:"format"`
 			}
 			_ = json.Unmarshal(p.Arguments, &a)
 			if a.WindowMinutes <= 0 {
 				a.WindowMinutes = 10
 			}
-			out, err := s.getTopology(a.WindowMinutes)
+			plan := planTopology(a.WindowMinutes, opts.matchers())
+			switch a.Format {
+			case "", "json":
+			case "mermaid", "dot":
+				plan = planGraph(a.WindowMinutes, a.Format, opts.matchers())
+			default:
+				return fail(r.ID, -32602, fmt.Errorf("unknown format: %s", a.Format))
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, plan)
 			if err != nil {
-				return fail(r.ID, -32000, err)
+				return toolError(r.ID, err)
 			}
 			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
 		case "servicegraph_latency_p95":
@@ -170,16 +660,18 @@ func (s *server) handle(r req) resp {
 			if a.Client == "" || a.Server == "" {
 				return fail(r.ID, -32602, fmt.Errorf("client and server required"))
 			}
-			out, err := s.getLatency(a.Client, a.Server, a.WindowMinutes)
+			out, err := s.runPlan(ctx, p.Name, opts, planLatency(a.Client, a.Server, a.WindowMinutes, opts.matchers()))
 			if err != nil {
-				return fail(r.ID, -32000, err)
+				return toolError(r.ID, err)
 			}
 			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
 		case "spanmetrics_latency_quantile":
 			var a struct {
 				Client, Server string
 				Quantile       float64
+				Quantiles      []float64
 				WindowMinutes  int
+				GroupBy        string
 			}
 			if err := json.Unmarshal(p.Arguments, &a); err != nil {
 				return fail(r.ID, -32602, err)
@@ -193,15 +685,31 @@ func (s *server) handle(r req) resp {
 			if a.Client == "" || a.Server == "" {
 				return fail(r.ID, -32602, fmt.Errorf("client and server required"))
 			}
-			out, err := s.getLatencyQuantile(a.Client, a.Server, a.Quantile, a.WindowMinutes)
+			if err := checkGroupBy(a.GroupBy); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			plan := planLatencyQuantile(a.Client, a.Server, a.Quantile, a.WindowMinutes, a.GroupBy, opts.matchers())
+			if len(a.Quantiles) > 0 {
+				if len(a.Quantiles) > maxQuantiles {
+					return fail(r.ID, -32602, fmt.Errorf("at most %d quantiles", maxQuantiles))
+				}
+				for _, q := range a.Quantiles {
+					if q <= 0 || q >= 1 {
+						return fail(r.ID, -32602, fmt.Errorf("quantiles must be between 0 and 1: %g", q))
+					}
+				}
+				plan = planLatencyQuantiles(a.Client, a.Server, a.Quantiles, a.WindowMinutes, a.GroupBy, opts.matchers())
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, plan)
 			if err != nil {
-				return fail(r.ID, -32000, err)
+				return toolError(r.ID, err)
 			}
 			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
 		case "spanmetrics_rps":
 			var a struct {
 				Server, Client string
 				WindowMinutes  int
+				GroupBy        string
 			}
 			if err := json.Unmarshal(p.Arguments, &a); err != nil {
 				return fail(r.ID, -32602, err)
@@ -209,14 +717,17 @@ func (s *server) handle(r req) resp {
 			if a.WindowMinutes <= 0 {
 				a.WindowMinutes = 10
 			}
-			out, err := s.getRPS(a.Server, a.Client, a.WindowMinutes)
+			if err := checkGroupBy(a.GroupBy); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planRPS(a.Server, a.Client, a.WindowMinutes, a.GroupBy, opts.matchers()))
 			if err != nil {
-				return fail(r.ID, -32000, err)
+				return toolError(r.ID, err)
 			}
 			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
 		case "spanmetrics_top_callers":
 			var a struct {
-				Server               string
+				Server, GroupBy      string
 				Limit, WindowMinutes int
 			}
 			if err := json.Unmarshal(p.Arguments, &a); err != nil {
@@ -228,14 +739,17 @@ func (s *server) handle(r req) resp {
 			if a.Limit <= 0 {
 				a.Limit = 5
 			}
-			out, err := s.getTopCallers(a.Server, a.Limit, a.WindowMinutes)
+			if err := checkGroupBy(a.GroupBy); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planTopCallers(a.Server, a.Limit, a.WindowMinutes, a.GroupBy, opts.matchers()))
 			if err != nil {
-				return fail(r.ID, -32000, err)
+				return toolError(r.ID, err)
 			}
 			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
 		case "spanmetrics_top_endpoints":
 			var a struct {
-				Server               string
+				Server, GroupBy      string
 				Limit, WindowMinutes int
 			}
 			if err := json.Unmarshal(p.Arguments, &a); err != nil {
@@ -247,14 +761,402 @@ func (s *server) handle(r req) resp {
 			if a.Limit <= 0 {
 				a.Limit = 5
 			}
-			out, err := s.getTopEndpoints(a.Server, a.Limit, a.WindowMinutes)
+			if err := checkGroupBy(a.GroupBy); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planTopEndpoints(a.Server, a.Limit, a.WindowMinutes, a.GroupBy, opts.matchers()))
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "spanmetrics_red_summary":
+			var a struct {
+				Server        string
+				GroupBy       string
+				WindowMinutes int
+			}
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.WindowMinutes <= 0 {
+				a.WindowMinutes = 10
+			}
+			if a.Server == "" {
+				return fail(r.ID, -32602, fmt.Errorf("server required"))
+			}
+			if err := checkGroupBy(a.GroupBy); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planREDSummary(a.Server, a.WindowMinutes, a.GroupBy, opts.matchers()))
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "spanmetrics_error_breakdown":
+			var a struct {
+				Server        string
+				GroupBy       string
+				WindowMinutes int
+			}
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.WindowMinutes <= 0 {
+				a.WindowMinutes = 10
+			}
+			if a.Server == "" {
+				return fail(r.ID, -32602, fmt.Errorf("server required"))
+			}
+			if err := checkGroupBy(a.GroupBy); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planErrorBreakdown(a.Server, a.WindowMinutes, a.GroupBy, opts.matchers()))
 			if err != nil {
-				return fail(r.ID, -32000, err)
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "spanmetrics_latency_trend":
+			var a struct {
+				Server                        string
+				WindowMinutes, HorizonMinutes int
+			}
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.WindowMinutes <= 0 {
+				a.WindowMinutes = 60
+			}
+			if a.HorizonMinutes <= 0 {
+				a.HorizonMinutes = 30
+			}
+			if a.Server == "" {
+				return fail(r.ID, -32602, fmt.Errorf("server required"))
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planLatencyTrend(a.Server, a.WindowMinutes, a.HorizonMinutes, opts.matchers()))
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "spanmetrics_capacity_headroom":
+			var a struct {
+				Server        string
+				WindowMinutes int
+			}
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.WindowMinutes <= 0 {
+				a.WindowMinutes = 1440
+			}
+			if a.Server == "" {
+				return fail(r.ID, -32602, fmt.Errorf("server required"))
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planHeadroom(a.Server, a.WindowMinutes, opts.matchers()))
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "servicegraph_topology_diff":
+			var a struct {
+				WindowMinutes, OffsetMinutes    int
+				VolumeThreshold, ErrorThreshold *float64
+			}
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.WindowMinutes <= 0 {
+				a.WindowMinutes = 10
+			}
+			if a.OffsetMinutes <= 0 {
+				a.OffsetMinutes = 60
+			}
+			volume, errs := 0.5, 0.05
+			if a.VolumeThreshold != nil && *a.VolumeThreshold >= 0 {
+				volume = *a.VolumeThreshold
+			}
+			if a.ErrorThreshold != nil && *a.ErrorThreshold >= 0 {
+				errs = *a.ErrorThreshold
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planTopologyDiff(a.WindowMinutes, a.OffsetMinutes, volume, errs, opts.matchers()))
+			if err == nil && !opts.Explain {
+				out, err = s.annotateDeployments(ctx, out)
+			}
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "spanmetrics_latency_histogram":
+			var a struct {
+				Server, Endpoint, Client string
+				WindowMinutes            int
+			}
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.WindowMinutes <= 0 {
+				a.WindowMinutes = 10
+			}
+			if a.Server == "" {
+				return fail(r.ID, -32602, fmt.Errorf("server required"))
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planLatencyHistogram(a.Server, a.Endpoint, a.Client, a.WindowMinutes, opts.matchers()))
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "spanmetrics_seasonality_profile":
+			var a struct {
+				Server, Endpoint, Timezone string
+				Weeks                      int
+			}
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.Weeks <= 0 {
+				a.Weeks = 4
+			}
+			if a.Weeks > 8 {
+				return fail(r.ID, -32602, fmt.Errorf("weeks must be at most 8"))
+			}
+			if a.Server == "" {
+				return fail(r.ID, -32602, fmt.Errorf("server required"))
+			}
+			loc := time.UTC
+			if a.Timezone != "" {
+				l, err := time.LoadLocation(a.Timezone)
+				if err != nil {
+					return fail(r.ID, -32602, fmt.Errorf("invalid timezone: %w", err))
+				}
+				loc = l
+			}
+			out, err := s.runPlan(ctx, p.Name, opts, planSeasonality(a.Server, a.Endpoint, a.Weeks, loc, opts.matchers()))
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "anomalies_history":
+			var a historyArgs
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if _, _, _, _, err := s.historyRequests(a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.anomaliesHistory(ctx, a, opts)
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "get_trace":
+			var a struct {
+				TraceID  string `json:"traceId"`
+				MaxSpans int    `json:"maxSpans"`
+			}
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if !traceIDPattern.MatchString(a.TraceID) {
+				return fail(r.ID, -32602, fmt.Errorf("traceId must be 16 or 32 hex digits"))
+			}
+			if a.MaxSpans <= 0 {
+				a.MaxSpans = 200
+			}
+			if a.MaxSpans > 2000 {
+				a.MaxSpans = 2000
+			}
+			out, err := s.getTrace(ctx, a.TraceID, a.MaxSpans, opts)
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "search_traces":
+			var a searchArgs
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.Service == "" {
+				return fail(r.ID, -32602, fmt.Errorf("service required"))
+			}
+			if _, _, err := searchRange(a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.MinDurationMs < 0 {
+				return fail(r.ID, -32602, fmt.Errorf("minDurationMs must not be negative"))
+			}
+			if a.Limit <= 0 {
+				a.Limit = 20
+			}
+			if a.Limit > 100 {
+				a.Limit = 100
+			}
+			out, err := s.searchTraces(ctx, a, opts)
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "logs_query":
+			var a logsArgs
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.Service == "" {
+				return fail(r.ID, -32602, fmt.Errorf("service required"))
+			}
+			if _, _, err := logsRange(a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.Limit <= 0 {
+				a.Limit = 100
+			}
+			if a.Limit > 1000 {
+				a.Limit = 1000
+			}
+			out, err := s.queryLogs(ctx, a, opts)
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "correlate":
+			var a correlateArgs
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.Service == "" {
+				return fail(r.ID, -32602, fmt.Errorf("service required"))
+			}
+			if _, _, _, err := correlateRange(a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.correlate(ctx, a, opts)
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "incident_report":
+			var a incidentArgs
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if a.Service == "" {
+				return fail(r.ID, -32602, fmt.Errorf("service required"))
+			}
+			if _, _, _, err := incidentRange(a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.incidentReport(ctx, a, opts)
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "server_status":
+			out, err := json.Marshal(s.status())
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "backend_capabilities":
+			c, err := probeCapabilities(ctx, s.mimirFor(ctx))
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			out, err := json.Marshal(c)
+			if err != nil {
+				return toolError(r.ID, err)
+			}
+			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
+		case "query_stats":
+			var a statsArgs
+			if err := json.Unmarshal(p.Arguments, &a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if strings.TrimSpace(a.Query) == "" {
+				return fail(r.ID, -32602, fmt.Errorf("query required"))
+			}
+			if len(opts.LabelFilters) > 0 {
+				return fail(r.ID, -32602, fmt.Errorf("labelFilters do not apply to query_stats; put the matchers in the query"))
+			}
+			if _, _, _, err := statsRange(a); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			if _, err := promSelectors(a.Query); err != nil {
+				return fail(r.ID, -32602, err)
+			}
+			out, err := s.queryStats(ctx, a, opts)
+			if err != nil {
+				return toolError(r.ID, err)
 			}
 			return ok(r.ID, map[string]any{"content": []any{map[string]any{"type": "text", "text": string(out)}}})
 		default:
 			return fail(r.ID, -32601, fmt.Errorf("unknown tool: %s", p.Name))
 		}
+	case "resources/list":
+		who, authed := principalFrom(ctx)
+		resources := []map[string]any{}
+		if !authed || s.policy.authorize(who, "servicegraph_topology") == nil {
+			resources = append(resources, graphResources...)
+		}
+		if s.health != nil && (!authed || s.policy.authorize(who, "spanmetrics_red_summary") == nil) {
+			resources = append(resources, s.healthResources()...)
+		}
+		return ok(r.ID, map[string]any{"resources": resources})
+	case "resources/read":
+		var p struct {
+			URI string `json:"uri"`
+		}
+		if err := json.Unmarshal(r.Params, &p); err != nil {
+			return fail(r.ID, -32602, err)
+		}
+		if s.health != nil && (p.URI == healthURIPrefix || strings.HasPrefix(p.URI, healthURIPrefix+"/")) {
+			// health resources are views of RED metrics and share the policy
+			// of spanmetrics_red_summary
+			if who, authed := principalFrom(ctx); authed {
+				if err := s.policy.authorize(who, "spanmetrics_red_summary"); err != nil {
+					return fail(r.ID, codeForbidden, err)
+				}
+			}
+			out, err := s.readHealth(p.URI)
+			if err != nil {
+				return fail(r.ID, -32002, err)
+			}
+			return ok(r.ID, map[string]any{"contents": []any{map[string]any{"uri": p.URI, "mimeType": "application/json", "text": string(out)}}})
+		}
+		format, found := graphFormats[p.URI]
+		if !found {
+			return fail(r.ID, -32002, fmt.Errorf("resource not found: %s", p.URI))
+		}
+		// resources are views of servicegraph_topology and share its policy
+		if who, authed := principalFrom(ctx); authed {
+			if err := s.policy.authorize(who, "servicegraph_topology"); err != nil {
+				return fail(r.ID, codeForbidden, err)
+			}
+		}
+		out, err := s.runPlan(ctx, "servicegraph_topology", toolOptions{}, planGraph(10, format, ""))
+		if err != nil {
+			return toolError(r.ID, err)
+		}
+		mime := "text/vnd.mermaid"
+		if format == "dot" {
+			mime = "text/vnd.graphviz"
+		}
+		return ok(r.ID, map[string]any{"contents": []any{map[string]any{"uri": p.URI, "mimeType": mime, "text": string(out)}}})
+	case "logging/setLevel":
+		if s.notify == nil {
+			return fail(r.ID, -32601, fmt.Errorf("method not found"))
+		}
+		var p struct {
+			Level string `json:"level"`
+		}
+		if err := json.Unmarshal(r.Params, &p); err != nil {
+			return fail(r.ID, -32602, err)
+		}
+		session := sessionFrom(ctx)
+		if session == "" {
+			return fail(r.ID, -32602, fmt.Errorf("Mcp-Session-Id required"))
+		}
+		if err := s.notify.setLevel(session, p.Level); err != nil {
+			return fail(r.ID, -32602, err)
+		}
+		return ok(r.ID, map[string]any{})
 	case "shutdown":
 		return ok(r.ID, map[string]any{})
 	default:
@@ -262,77 +1164,73 @@ func (s *server) handle(r req) resp {
 	}
 }
 
-// Query helpers
-func (s *server) getTopology(windowM int) (json.RawMessage, error) {
-	ctx := context.Background()
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := 30 * time.Second
+// Query plans
+// Plan builders take extra matchers (see toolOptions.matchers) appended to
+// every selector.
+
+func planTopology(windowM int, extra string) queryPlan {
 	// Use the OTEL servicegraph connector metric name
-	q := `sum by (client, server) (increase(traces_service_graph_request_total[5m]))`
-	return s.c.QueryRange(ctx, q, start, end, step)
+	q := fmt.Sprintf(`sum by (client, server) (increase({__name__="traces_service_graph_request_total"%s}[5m]))`, extra)
+	return rangePlan(windowM, namedQuery{promQL: q})
 }
 
-func (s *server) getLatency(client, serverName string, windowM int) (json.RawMessage, error) {
-	ctx := context.Background()
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := 30 * time.Second
+func planLatency(client, serverName string, windowM int, extra string) queryPlan {
 	// Use spanmetrics histogram exported by the collector's spanmetrics connector
 	// Labels: service_name (server), peer_service (client), span_kind (SERVER)
 	// Support multiple possible metric names via __name__ regex for robustness across versions.
-	q := fmt.Sprintf(`histogram_quantile(0.95, sum by (le) (rate(({__name__=~"traces_span_metrics_duration_milliseconds_bucket|duration_milliseconds_bucket|rpc_server_duration_milliseconds_bucket", service_name="%s", peer_service="%s", span_kind="SPAN_KIND_SERVER"}[5m]))))`, serverName, client)
-	return s.c.QueryRange(ctx, q, start, end, step)
+	q := latencyQuantile(0.95, sumBy("", "le"), fmt.Sprintf(`, service_name="%s", peer_service="%s"%s`, serverName, client, extra))
+	return rangePlan(windowM, namedQuery{promQL: q})
 }
 
-// getLatencyQuantile returns a latency quantile for a client->server edge using spanmetrics histogram buckets.
-func (s *server) getLatencyQuantile(client, serverName string, q float64, windowM int) (json.RawMessage, error) {
-	ctx := context.Background()
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := 30 * time.Second
-	prom := fmt.Sprintf(`histogram_quantile(%g, sum by (le) (rate(({__name__=~"traces_span_metrics_duration_milliseconds_bucket|duration_milliseconds_bucket|rpc_server_duration_milliseconds_bucket", service_name="%s", peer_service="%s", span_kind="SPAN_KIND_SERVER"}[5m]))))`, q, serverName, client)
-	return s.c.QueryRange(ctx, prom, start, end, step)
+// planLatencyQuantile returns a latency quantile for a client->server edge using spanmetrics histogram buckets,
+// one series per value of the groupBy label if set.
+func planLatencyQuantile(client, serverName string, q float64, windowM int, groupBy, extra string) queryPlan {
+	prom := groupedBy(groupBy).quantile(q, sumBy(groupBy, "le"), fmt.Sprintf(`, service_name="%s", peer_service="%s"%s`, serverName, client, extra))
+	return rangePlan(windowM, namedQuery{promQL: prom})
 }
 
-// getRPS returns request rate for server (optionally by client) using spanmetrics count metric.
-func (s *server) getRPS(serverName, client string, windowM int) (json.RawMessage, error) {
-	ctx := context.Background()
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := 30 * time.Second
+// planRPS returns request rate for server (optionally by client) using spanmetrics count metric.
+func planRPS(serverName, client string, windowM int, groupBy, extra string) queryPlan {
 	// Use spanmetrics calls_total for request rate. Fallback to namespaced variant if present.
-	filter := fmt.Sprintf(`service_name="%s", span_kind="SPAN_KIND_SERVER"`, serverName)
+	filter := fmt.Sprintf(`, service_name="%s"`, serverName)
 	if client != "" {
-		filter += fmt.Sprintf(",peer_service=\"%s\"", client)
+		filter += fmt.Sprintf(`, peer_service="%s"`, client)
 	}
-	prom := fmt.Sprintf(`sum(rate(({__name__=~"traces_span_metrics_calls_total|calls_total", %s}[5m])))`, filter)
-	return s.c.QueryRange(ctx, prom, start, end, step)
+	filter += extra
+	prom := fmt.Sprintf(`%s(%s)`, sumBy(groupBy), groupedBy(groupBy).calls(filter))
+	return rangePlan(windowM, namedQuery{promQL: prom})
 }
 
-// getTopCallers returns top-N callers by request rate to a given server.
-func (s *server) getTopCallers(serverName string, limit, windowM int) (json.RawMessage, error) {
-	ctx := context.Background()
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := 30 * time.Second
-	prom := fmt.Sprintf(`topk(%d, sum by (peer_service) (rate(({__name__=~"traces_span_metrics_calls_total|calls_total", service_name="%s", span_kind="SPAN_KIND_SERVER"}[5m]))))`, limit, serverName)
-	return s.c.QueryRange(ctx, prom, start, end, step)
+// planTopCallers returns top-N callers by request rate to a given server.
+func planTopCallers(serverName string, limit, windowM int, groupBy, extra string) queryPlan {
+	prom := fmt.Sprintf(`topk(%d, %s(%s))`, limit, sumBy(groupBy, "peer_service"), groupedBy(groupBy).calls(fmt.Sprintf(`, service_name="%s"%s`, serverName, extra)))
+	return rangePlan(windowM, namedQuery{promQL: prom})
 }
 
-// getTopEndpoints returns top-N span names for a server by request rate.
-func (s *server) getTopEndpoints(serverName string, limit, windowM int) (json.RawMessage, error) {
-	ctx := context.Background()
-	end := time.Now()
-	start := end.Add(-time.Duration(windowM) * time.Minute)
-	step := 30 * time.Second
-	prom := fmt.Sprintf(`topk(%d, sum by (span_name) (rate(({__name__=~"traces_span_metrics_calls_total|calls_total", service_name="%s", span_kind="SPAN_KIND_SERVER"}[5m]))))`, limit, serverName)
-	return s.c.QueryRange(ctx, prom, start, end, step)
+// planTopEndpoints returns top-N span names for a server by request rate.
+func planTopEndpoints(serverName string, limit, windowM int, groupBy, extra string) queryPlan {
+	prom := fmt.Sprintf(`topk(%d, %s(%s))`, limit, sumBy(groupBy, "span_name"), groupedBy(groupBy).calls(fmt.Sprintf(`, service_name="%s"%s`, serverName, extra)))
+	return rangePlan(windowM, namedQuery{promQL: prom})
+}
+
+// planREDSummary returns request rate, error ratio and p95 latency for a server,
+// per value of the groupBy label if set. The three queries run concurrently.
+func planREDSummary(serverName string, windowM int, groupBy, extra string) queryPlan {
+	m := fmt.Sprintf(`, service_name="%s"%s`, serverName, extra)
+	r, sum := groupedBy(groupBy), sumBy(groupBy)
+	return rangePlan(windowM,
+		namedQuery{name: "rate", promQL: fmt.Sprintf(`%s(%s)`, sum, r.calls(m))},
+		namedQuery{name: "errors", promQL: fmt.Sprintf(`%s(%s) / %s(%s)`, sum, r.failed(m), sum, r.calls(m))},
+		namedQuery{name: "duration_p95", promQL: r.quantile(0.95, sumBy(groupBy, "le"), m)},
+	)
 }
 
 func main() {
 	log.SetFlags(0)
 	s := newServer()
+	if s.cache != nil {
+		expvar.Publish("cache_entries", expvar.Func(func() any { return s.cache.len() }))
+	}
 	addr := getenv("MCP_LISTEN_ADDR", ":9020")
 
 	mux := http.NewServeMux()
@@ -340,7 +1238,36 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/audit", s.handleAudit)
+	mux.HandleFunc("/capabilities", s.handleCapabilities)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/snapshot", s.handleSnapshot)
+	// Optional pprof and expvar diagnostics, behind a token
+	if getenv("DEBUG_ENDPOINTS", "") == "true" {
+		token := getenvSecret("DEBUG_TOKEN")
+		if token.Get() == "" {
+			log.Fatal("DEBUG_ENDPOINTS requires DEBUG_TOKEN")
+		}
+		mux.Handle("/debug/", handleDebug(token))
+		log.Printf("debug endpoints enabled at /debug/pprof/ and /debug/vars")
+	}
+	if s.snapshot == nil {
+		go s.discover(context.Background())
+	} else {
+		ready.Store(true)
+	}
+	if s.notify != nil {
+		go s.followAnomalies(context.Background())
+	}
+	if s.health != nil {
+		go s.refreshHealth(context.Background(), s.healthInterval)
+	}
 	mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			s.handleNotifications(w, r)
+			return
+		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -351,16 +1278,86 @@ func main() {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
+		// Mimir tenant: the caller's X-Scope-OrgID, else MIMIR_TENANT
+		tenant := r.Header.Get("X-Scope-OrgID")
+		if tenant == "" {
+			tenant = s.tenant
+		}
+		ctx := withSession(mimir.WithTenant(r.Context(), tenant), r.Header.Get("Mcp-Session-Id"))
+		// the caller's X-Request-ID, else a new one, sent on to Mimir and
+		// if-service and returned in the response and its errors
+		rid := r.Header.Get("X-Request-ID")
+		if !mimir.ValidRequestID(rid) {
+			rid = mimir.NewRequestID()
+		}
+		ctx = mimir.WithRequestID(ctx, rid)
+		w.Header().Set("X-Request-ID", rid)
+		if s.policy != nil {
+			who, authed := s.policy.authenticate(r)
+			if !authed {
+				if in.Method == "tools/call" {
+					rec := newAuditRecord(ctx, r.Header.Get("Mcp-Session-Id"), in, resp{}, 0)
+					rec.Outcome, rec.Error = "unauthenticated", "missing or unknown bearer token"
+					if err := s.audit.record(rec); err != nil {
+						log.Printf("audit log write failed: %v", err)
+					}
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			ctx = withPrincipal(ctx, who)
+		}
+		if in.Method == "initialize" {
+			w.Header().Set("Mcp-Session-Id", newSessionID())
+		}
+		began := time.Now()
+		var out resp
+		if release, err := s.admit(ctx, in); err != nil {
+			out = fail(in.ID, -32000, err)
+			if errors.Is(err, errQueueFull) {
+				retry := s.calls.retryAfter()
+				out.Error.Code, out.Error.Data = codeBusy, map[string]any{"retryAfter": retry}
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+			}
+		} else {
+			out = s.handle(ctx, in)
+			release()
+		}
+		if out.Error != nil {
+			data, _ := out.Error.Data.(map[string]any)
+			if data == nil {
+				data = map[string]any{}
+			}
+			data["requestId"] = rid
+			out.Error.Data = data
+		}
+		if in.Method == "tools/call" {
+			rec := newAuditRecord(ctx, r.Header.Get("Mcp-Session-Id"), in, out, time.Since(began))
+			if rec.Outcome == "error" {
+				log.Printf("tools/call %s failed: %s request=%s", rec.Tool, rec.Error, rid)
+			}
+			if err := s.audit.record(rec); err != nil {
+				log.Printf("audit log write failed: %v", err)
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(s.handle(in))
+		_ = json.NewEncoder(w).Encode(out)
 	})
 
 	log.Printf("mcp http server listening on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	if err := http.ListenAndServe(addr, compress.Handler(mux)); err != nil {
 		log.Fatalf("http server error: %v", err)
 	}
 }
 
+// newSessionID returns a random Mcp-Session-Id handed out on initialize.
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func ok(id any, res any) resp { return resp{ID: id, JSONRPC: "2.0", Result: res} }
 func fail(id any, code int, err error) resp {
 	return resp{ID: id, JSONRPC: "2.0", Error: &rpcError{Code: code, Message: err.Error()}}
@@ -371,3 +1368,41 @@ func getenv(k, def string) string {
 	}
 	return def
 }
+
+// getenvSecret returns the secret k, read instead from the file named by
+// k_FILE when that is set, e.g. a Docker or Kubernetes secret mount, and
+// re-read when the file is rotated.
+func getenvSecret(k string) secret.Secret {
+	sec, err := secret.New(os.Getenv(k), os.Getenv(k+"_FILE"))
+	if err != nil {
+		log.Fatalf("invalid %s: %v", k, err)
+	}
+	return sec
+}
+
+// mimirOptions returns how the Mimir client connects, from MIMIR_PROXY_URL,
+// MIMIR_DIAL_TIMEOUT, MIMIR_UNIX_SOCKET and MIMIR_DNS_SERVER.
+func mimirOptions() mimir.Options {
+	opts := mimir.Options{UnixSocket: getenv("MIMIR_UNIX_SOCKET", ""), DNSServer: getenv("MIMIR_DNS_SERVER", "")}
+	if v := getenv("MIMIR_PROXY_URL", ""); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" {
+			// without the URL, which may hold credentials
+			log.Fatal("invalid MIMIR_PROXY_URL: want e.g. http://proxy:3128")
+		}
+		opts.Proxy = u
+	}
+	if v := getenv("MIMIR_DIAL_TIMEOUT", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid MIMIR_DIAL_TIMEOUT %q", v)
+		}
+		opts.DialTimeout = d
+	}
+	if opts.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(opts.DNSServer); err != nil {
+			log.Fatalf("invalid MIMIR_DNS_SERVER %q: want host:port", opts.DNSServer)
+		}
+	}
+	return opts
+}
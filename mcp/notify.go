@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevels orders the MCP logging levels; anomaly notifications use the
+// event severity, warning or critical, as their level.
+var logLevels = map[string]int{
+	"debug": 0, "info": 1, "notice": 2, "warning": 3,
+	"error": 4, "critical": 5, "alert": 6, "emergency": 7,
+}
+
+// notifier fans anomaly notifications out to the sessions listening on
+// GET /rpc.
+type notifier struct {
+	mu   sync.Mutex
+	subs map[chan []byte]string
+	// levels are the minimum levels sessions set with logging/setLevel
+	levels map[string]string
+}
+
+func newNotifier() *notifier {
+	return &notifier{subs: map[chan []byte]string{}, levels: map[string]string{}}
+}
+
+func (n *notifier) subscribe(session string) (<-chan []byte, func()) {
+	ch := make(chan []byte, 64)
+	n.mu.Lock()
+	n.subs[ch] = session
+	n.mu.Unlock()
+	return ch, func() {
+		n.mu.Lock()
+		delete(n.subs, ch)
+		n.mu.Unlock()
+	}
+}
+
+func (n *notifier) setLevel(session, level string) error {
+	if _, ok := logLevels[level]; !ok {
+		return fmt.Errorf("unknown level: %s", level)
+	}
+	n.mu.Lock()
+	n.levels[session] = level
+	n.mu.Unlock()
+	return nil
+}
+
+// publish sends a notifications/message at level to every listening
+// session whose level allows it. Slow listeners miss notifications rather
+// than hold up the others.
+func (n *notifier) publish(level string, data any) {
+	b, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"method":  "notifications/message",
+		"params":  map[string]any{"level": level, "logger": "if-service", "data": data},
+	})
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch, session := range n.subs {
+		if floor, ok := n.levels[session]; ok && logLevels[level] < logLevels[floor] {
+			continue
+		}
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+type sessionKey struct{}
+
+func withSession(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, id)
+}
+
+// sessionFrom returns the request's Mcp-Session-Id, if any.
+func sessionFrom(ctx context.Context) string {
+	id, _ := ctx.Value(sessionKey{}).(string)
+	return id
+}
+
+// anomalyNotification is the data of an anomaly notification: the event
+// as anomalies_history returns it and its series' label set.
+type anomalyNotification struct {
+	Subject string       `json:"subject"`
+	Event   historyEvent `json:"event"`
+}
+
+// followAnomalies relays the if-service anomaly stream to the notifier
+// until ctx is done, reconnecting after failures and resuming after the
+// last event seen.
+func (s *server) followAnomalies(ctx context.Context) {
+	lastID := ""
+	for {
+		err := s.readAnomalyStream(ctx, &lastID)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("anomaly stream: %v; reconnecting", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (s *server) readAnomalyStream(ctx context.Context, lastID *string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.ifURL+"/api/v1/anomalies/stream", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+	// the stream stays open, so no client timeout
+	res, err := s.ifStream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("if-service: %s", res.Status)
+	}
+	sc := bufio.NewScanner(res.Body)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	var id, data string
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			var ce struct {
+				ID      string       `json:"id"`
+				Subject string       `json:"subject"`
+				Data    historyEvent `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(data), &ce); err != nil {
+				log.Printf("anomaly stream: invalid event %s: %v", id, err)
+			} else {
+				// the event ID is the store ID anomalies_history reports
+				ce.Data.ID, _ = strconv.ParseInt(ce.ID, 10, 64)
+				level := ce.Data.Severity
+				if _, ok := logLevels[level]; !ok {
+					level = "warning"
+				}
+				s.notify.publish(level, anomalyNotification{Subject: ce.Subject, Event: ce.Data})
+			}
+			*lastID, data = id, ""
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("if-service closed the stream")
+}
+
+// handleNotifications serves GET /rpc: the Streamable HTTP stream on which
+// the server sends a session its notifications.
+func (s *server) handleNotifications(w http.ResponseWriter, r *http.Request) {
+	if s.notify == nil {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+		return
+	}
+	session := r.Header.Get("Mcp-Session-Id")
+	if session == "" {
+		http.Error(w, "Mcp-Session-Id required", http.StatusBadRequest)
+		return
+	}
+	if s.policy != nil {
+		who, authed := s.policy.authenticate(r)
+		if !authed {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// notifications carry what anomalies_history returns
+		if err := s.policy.authorize(who, "anomalies_history"); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	msgs, cancel := s.notify.subscribe(session)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case b := <-msgs:
+			if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
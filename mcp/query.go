@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// namedQuery is one PromQL query of a composite tool; name is the key of its
+// result in the merged output.
+type namedQuery struct {
+	name   string
+	promQL string
+}
+
+// queryPlan is what a tool executes: range queries over the last window,
+// evaluated every step, or instant queries evaluated at its end. Without
+// shape, tools with a single query return its result as is and composite
+// tools return the results keyed by query name.
+type queryPlan struct {
+	queries []namedQuery
+	window  time.Duration
+	step    time.Duration
+	instant bool
+	// variant tells apart plans with the same queries but different shapes,
+	// e.g. the formats of a rendered graph.
+	variant string
+	// end anchors the window; the zero value is now.
+	end time.Time
+	// shape turns the raw results, keyed by query name, into the tool result.
+	shape func(map[string]json.RawMessage) (any, error)
+}
+
+// rangePlan is the plan of the spanmetrics and servicegraph tools: the last
+// windowM minutes at a 30s step.
+func rangePlan(windowM int, qs ...namedQuery) queryPlan {
+	return queryPlan{queries: qs, window: time.Duration(windowM) * time.Minute, step: 30 * time.Second}
+}
+
+// instantPlan evaluates the queries once; they cover the last windowM
+// minutes by themselves (e.g. increase(...[10m])).
+func instantPlan(windowM int, qs ...namedQuery) queryPlan {
+	return queryPlan{queries: qs, window: time.Duration(windowM) * time.Minute, instant: true}
+}
+
+// key identifies the plan independent of when it runs.
+func (p queryPlan) key() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s/%s/%t/%s", p.window, p.step, p.instant, p.variant)
+	if !p.end.IsZero() {
+		fmt.Fprintf(&b, "/%d", p.end.Unix())
+	}
+	for _, q := range p.queries {
+		fmt.Fprintf(&b, "\x00%s=%s", q.name, q.promQL)
+	}
+	return b.String()
+}
+
+// timeRange anchors the plan's window at its end, by default now.
+func (p queryPlan) timeRange() (start, end time.Time) {
+	end = p.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Add(-p.window), end
+}
+
+// toolOptions are arguments every tool accepts.
+type toolOptions struct {
+	// Explain returns the plan instead of running it.
+	Explain bool `json:"explain"`
+	// LabelFilters are equality matchers added to every selector of the
+	// tool's queries, e.g. {"env": "prod"}.
+	LabelFilters map[string]string `json:"labelFilters"`
+	// Cluster names the Mimir cluster to query; "all" queries every one.
+	Cluster string `json:"cluster"`
+	// Tenants replace the caller's tenant; several are queried together
+	// with Mimir tenant federation.
+	Tenants []string `json:"tenants"`
+}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func parseToolOptions(args json.RawMessage) (toolOptions, error) {
+	var o toolOptions
+	if len(args) == 0 {
+		return o, nil
+	}
+	if err := json.Unmarshal(args, &o); err != nil {
+		return o, err
+	}
+	for k := range o.LabelFilters {
+		if !labelName.MatchString(k) || strings.HasPrefix(k, "__") {
+			return o, fmt.Errorf("invalid label name in labelFilters: %q", k)
+		}
+	}
+	if _, err := federatedTenant(o.Tenants); err != nil {
+		return o, fmt.Errorf("tenants: %w", err)
+	}
+	return o, nil
+}
+
+// federatedTenant returns the X-Scope-OrgID of tenants: several are joined
+// with "|", which Mimir queries together when tenant federation is enabled.
+func federatedTenant(tenants []string) (string, error) {
+	for _, t := range tenants {
+		if t == "" || strings.Contains(t, "|") {
+			return "", fmt.Errorf("invalid tenant %q", t)
+		}
+	}
+	return strings.Join(tenants, "|"), nil
+}
+
+// matchers renders LabelFilters as matchers to append inside a selector:
+// empty, or a comma followed by the matchers sorted by label. Values are
+// quoted, so they cannot break out of the selector.
+func (o toolOptions) matchers() string {
+	keys := make([]string, 0, len(o.LabelFilters))
+	for k := range o.LabelFilters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, ", %s=%s", k, strconv.Quote(o.LabelFilters[k]))
+	}
+	return b.String()
+}
+
+// commonArgs is the input schema of toolOptions.
+var commonArgs = map[string]any{
+	"explain": map[string]any{"type": "boolean", "default": false, "description": "Return the PromQL, time range and step instead of running the query"},
+	"labelFilters": map[string]any{
+		"type":                 "object",
+		"additionalProperties": map[string]any{"type": "string"},
+		"description":          "Extra label=value filters added to every selector, e.g. {\"env\": \"prod\"}",
+	},
+	"cluster": map[string]any{"type": "string", "description": "Mimir cluster to query (see MIMIR_CLUSTERS_FILE), by default the first; \"all\" queries every cluster and merges the results, labelled by cluster"},
+	"tenants": map[string]any{
+		"type":        "array",
+		"items":       map[string]any{"type": "string"},
+		"description": "Tenants to query instead of the caller's X-Scope-OrgID; several are federated (Mimir tenant federation), series carrying __tenant_id__",
+	},
+}
+
+// groupByArg is the input schema of the groupBy argument of spanmetrics
+// tools, breaking their result down by one more label.
+var groupByArg = map[string]any{"type": "string", "description": "Label to break the result down by, e.g. tenant_id for the testapp's tenants; reads the raw spanmetrics when recording rules drop it"}
+
+// checkGroupBy validates a groupBy label; empty means no grouping.
+func checkGroupBy(label string) error {
+	if label != "" && !labelName.MatchString(label) {
+		return fmt.Errorf("invalid label name in groupBy: %q", label)
+	}
+	return nil
+}
+
+// sumBy renders a sum by labels and the groupBy label, if any, to prefix a
+// parenthesized expression: "sum" or "sum by (le) ".
+func sumBy(groupBy string, labels ...string) string {
+	if groupBy != "" {
+		labels = append(labels, groupBy)
+	}
+	if len(labels) == 0 {
+		return "sum"
+	}
+	return "sum by (" + strings.Join(labels, ", ") + ") "
+}
+
+// withCommonArgs adds commonArgs to the input schema of every tool.
+func withCommonArgs(tools []any) []any {
+	for _, t := range tools {
+		schema, _ := t.(map[string]any)["inputSchema"].(map[string]any)
+		props, _ := schema["properties"].(map[string]any)
+		for k, v := range commonArgs {
+			props[k] = v
+		}
+	}
+	return tools
+}
+
+// checkRange enforces the server's limits and the caller role's maximum
+// window on a call over window, evaluated every step or once when step is
+// 0, whichever argument (windowMinutes, weeks, ...) or default sized it.
+func (s *server) checkRange(ctx context.Context, window, step time.Duration) error {
+	if err := s.limits.check(window, step); err != nil {
+		return invalidParams{err}
+	}
+	if who, authed := principalFrom(ctx); authed {
+		if err := s.policy.checkWindow(who, window); err != nil {
+			return forbidden{err}
+		}
+	}
+	return nil
+}
+
+// runPlan executes plan for tool, through the result cache, or explains it.
+func (s *server) runPlan(ctx context.Context, tool string, opts toolOptions, plan queryPlan) (json.RawMessage, error) {
+	step := plan.step
+	if plan.instant {
+		step = 0
+	}
+	if err := s.checkRange(ctx, plan.window, step); err != nil {
+		return nil, err
+	}
+	if opts.Explain {
+		return explain(plan)
+	}
+	return s.cached(ctx, tool, plan.key(), func(ctx context.Context) (json.RawMessage, error) {
+		res, err := s.queryAll(ctx, plan)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case plan.shape != nil:
+			v, err := plan.shape(res)
+			if err != nil {
+				return nil, err
+			}
+			if t, isText := v.(toolText); isText {
+				return json.RawMessage(t), nil
+			}
+			return json.Marshal(v)
+		case len(plan.queries) == 1:
+			return res[plan.queries[0].name], nil
+		}
+		return json.Marshal(res)
+	})
+}
+
+// explain describes the requests plan would send, in a form that can be
+// pasted into Grafana Explore or curl.
+func explain(plan queryPlan) (json.RawMessage, error) {
+	start, end := plan.timeRange()
+	qs := make([]map[string]string, 0, len(plan.queries))
+	for _, q := range plan.queries {
+		e := map[string]string{"query": q.promQL}
+		if q.name != "" {
+			e["name"] = q.name
+		}
+		qs = append(qs, e)
+	}
+	if plan.instant {
+		return json.Marshal(map[string]any{
+			"endpoint": "/api/v1/query",
+			"queries":  qs,
+			"time":     end.UTC().Format(time.RFC3339),
+		})
+	}
+	return json.Marshal(map[string]any{
+		"endpoint": "/api/v1/query_range",
+		"queries":  qs,
+		"start":    start.UTC().Format(time.RFC3339),
+		"end":      end.UTC().Format(time.RFC3339),
+		"step":     plan.step.String(),
+	})
+}
+
+// queryAll runs the queries of a plan concurrently, at most s.parallel at a
+// time, so a composite tool takes roughly the latency of its slowest query
+// rather than the sum. Results are merged by query name. The first failure
+// cancels the queries still running.
+func (s *server) queryAll(ctx context.Context, plan queryPlan) (map[string]json.RawMessage, error) {
+	start, end := plan.timeRange()
+	res := make([]json.RawMessage, len(plan.queries))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.parallel)
+	for i, q := range plan.queries {
+		i, q := i, q
+		g.Go(func() error {
+			var data json.RawMessage
+			var err error
+			if plan.instant {
+				data, err = s.mimirFor(ctx).Query(ctx, q.promQL, end)
+			} else {
+				data, err = s.mimirFor(ctx).QueryRange(ctx, q.promQL, start, end, plan.step)
+			}
+			if err != nil {
+				if q.name == "" {
+					return err
+				}
+				return fmt.Errorf("%s: %w", q.name, err)
+			}
+			res[i] = data
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	out := make(map[string]json.RawMessage, len(plan.queries))
+	for i, q := range plan.queries {
+		out[q.name] = res[i]
+	}
+	return out, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// codeBusy is the JSON-RPC error code of tool calls rejected because the
+// queue is full. The error data holds retryAfter, in seconds.
+const codeBusy = -32004
+
+// Tool call queue metrics, on /metrics.
+var (
+	callsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mcp_tool_calls_in_flight",
+		Help: "Tool calls running.",
+	})
+	callsQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mcp_tool_calls_queued",
+		Help: "Tool calls waiting for a free slot.",
+	})
+	callsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mcp_tool_calls_rejected_total",
+		Help: "Tool calls rejected because the queue was full.",
+	})
+	callQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mcp_tool_call_queue_wait_seconds",
+		Help:    "Time tool calls waited in the queue.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(callsInFlight, callsQueued, callsRejected, callQueueWait)
+}
+
+// errQueueFull rejects a call when all slots are taken and depth calls wait.
+var errQueueFull = errors.New("server busy: tool call queue is full")
+
+// callQueue runs up to cap(slots) tool calls at once and lets up to depth
+// more wait for a slot, so bursts from agents queue up in the server rather
+// than pile up on Mimir.
+type callQueue struct {
+	slots chan struct{}
+	depth int
+
+	mu      sync.Mutex
+	waiting int
+	// avg is a moving average of call durations, for retryAfter.
+	avg time.Duration
+}
+
+func newCallQueue(concurrency, depth int) *callQueue {
+	return &callQueue{slots: make(chan struct{}, concurrency), depth: depth}
+}
+
+// acquire takes a slot, waiting in the queue if needed, and returns the
+// function to give it back. It fails with errQueueFull when the queue is
+// full and with ctx's error when the caller gives up waiting.
+func (q *callQueue) acquire(ctx context.Context) (func(), error) {
+	select {
+	case q.slots <- struct{}{}:
+		return q.started(time.Now()), nil
+	default:
+	}
+	q.mu.Lock()
+	if q.waiting >= q.depth {
+		q.mu.Unlock()
+		callsRejected.Inc()
+		return nil, errQueueFull
+	}
+	q.waiting++
+	q.mu.Unlock()
+	callsQueued.Inc()
+	began := time.Now()
+	defer func() {
+		q.mu.Lock()
+		q.waiting--
+		q.mu.Unlock()
+		callsQueued.Dec()
+		callQueueWait.Observe(time.Since(began).Seconds())
+	}()
+	select {
+	case q.slots <- struct{}{}:
+		return q.started(time.Now()), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// started counts a call running since t and returns its release.
+func (q *callQueue) started(t time.Time) func() {
+	callsInFlight.Inc()
+	return func() {
+		took := time.Since(t)
+		q.mu.Lock()
+		if q.avg == 0 {
+			q.avg = took
+		} else {
+			q.avg += (took - q.avg) / 8
+		}
+		q.mu.Unlock()
+		callsInFlight.Dec()
+		<-q.slots
+	}
+}
+
+// retryAfter estimates in whole seconds, at least 1, how long a rejected
+// call should wait: until the queue ahead of it has drained.
+func (q *callQueue) retryAfter() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	drain := q.avg.Seconds() * float64(q.waiting+1) / float64(cap(q.slots))
+	return int(math.Max(1, math.Ceil(drain)))
+}
+
+// admit queues a tools/call for a slot; other methods run right away.
+func (s *server) admit(ctx context.Context, r req) (func(), error) {
+	if r.Method != "tools/call" || s.calls == nil {
+		return func() {}, nil
+	}
+	return s.calls.acquire(ctx)
+}
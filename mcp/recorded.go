@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Raw spanmetrics names read until probeCapabilities finds which exist.
+const (
+	callsMetrics   = `traces_span_metrics_calls_total|calls_total`
+	bucketsMetrics = `traces_span_metrics_duration_milliseconds_bucket|duration_milliseconds_bucket|rpc_server_duration_milliseconds_bucket`
+)
+
+// recordedMetrics name recording rules pre-aggregating the spanmetrics of
+// server spans into per-second rates over 5m, by service_name, span_name
+// and peer_service: all calls, failed calls, and latency buckets in
+// milliseconds, also by le. When set, the tools with a 5m rate read them
+// instead of the raw metrics.
+type recordedMetrics struct {
+	rate, errors, latency string
+}
+
+// recorded is set from RECORDED_RATE_METRIC, RECORDED_ERROR_METRIC and
+// RECORDED_LATENCY_METRIC; empty names read the raw metrics.
+var recorded recordedMetrics
+
+var metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// recordedLabels are the labels the recording rules keep, besides le.
+var recordedLabels = map[string]bool{"service_name": true, "span_name": true, "peer_service": true}
+
+// groupedBy returns the metrics to read when grouping by label: the raw ones
+// if the recording rules sum it away.
+func groupedBy(label string) recordedMetrics {
+	if label != "" && !recordedLabels[label] {
+		return recordedMetrics{}
+	}
+	return recorded
+}
+
+// callsRate is the per-second rate of server span calls selected by
+// matchers, empty or starting with a comma.
+func callsRate(matchers string) string { return recorded.calls(matchers) }
+
+// errorsRate is the per-second rate of failed server span calls selected
+// by matchers.
+func errorsRate(matchers string) string { return recorded.failed(matchers) }
+
+// latencyQuantile is the q-quantile in milliseconds of the latency of
+// server spans selected by matchers, summed by sum.
+func latencyQuantile(q float64, sum, matchers string) string {
+	return recorded.quantile(q, sum, matchers)
+}
+
+func (r recordedMetrics) calls(matchers string) string {
+	if r.rate != "" {
+		return fmt.Sprintf(`{__name__="%s"%s}`, r.rate, matchers)
+	}
+	return fmt.Sprintf(`rate({__name__=~"%s", span_kind="SPAN_KIND_SERVER"%s}[5m])`, currentCaps().Calls, matchers)
+}
+
+func (r recordedMetrics) failed(matchers string) string {
+	if r.errors != "" {
+		return fmt.Sprintf(`{__name__="%s"%s}`, r.errors, matchers)
+	}
+	return fmt.Sprintf(`rate({__name__=~"%s", span_kind="SPAN_KIND_SERVER", status_code="STATUS_CODE_ERROR"%s}[5m])`, currentCaps().Calls, matchers)
+}
+
+// buckets returns the per-second rate of the latency buckets of server
+// spans selected by matchers, to sum by le, and the histogram read.
+func (r recordedMetrics) buckets(matchers string) (string, latencyMetric) {
+	if r.latency != "" {
+		return fmt.Sprintf(`{__name__="%s"%s}`, r.latency, matchers), latencyMetric{name: r.latency, toMs: 1}
+	}
+	lm := currentLatency()
+	return fmt.Sprintf(`rate({__name__=~"%s", span_kind="SPAN_KIND_SERVER"%s}[5m])`, lm.name, matchers), lm
+}
+
+func (r recordedMetrics) quantile(q float64, sum, matchers string) string {
+	b, lm := r.buckets(matchers)
+	return lm.ms(fmt.Sprintf(`histogram_quantile(%g, %s(%s))`, q, sum, b))
+}
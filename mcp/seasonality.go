@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"mcp/internal/promresult"
+)
+
+// hourProfile is the typical RPS in one hour of the day.
+type hourProfile struct {
+	Hour    int     `json:"hour"`
+	Median  float64 `json:"median"`
+	P25     float64 `json:"p25"`
+	P75     float64 `json:"p75"`
+	IQR     float64 `json:"iqr"`
+	Samples int     `json:"samples"`
+}
+
+// planSeasonality fetches hourly RPS of a server, or one of its endpoints,
+// over the last weeks and profiles it per hour of day in loc.
+func planSeasonality(serverName, spanName string, weeks int, loc *time.Location, extra string) queryPlan {
+	filter := fmt.Sprintf(`service_name=%q, span_kind="SPAN_KIND_SERVER"`, serverName)
+	if spanName != "" {
+		filter += fmt.Sprintf(`, span_name=%q`, spanName)
+	}
+	q := fmt.Sprintf(`sum(rate({__name__=~"%s", %s%s}[1h]))`, currentCaps().Calls, filter, extra)
+	p := rangePlan(weeks*7*24*60, namedQuery{promQL: q})
+	p.step = time.Hour
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		series, err := promresult.DecodeMatrix(res[""])
+		if err != nil {
+			return nil, err
+		}
+		return profileHours(series, weeks, loc), nil
+	}
+	return p
+}
+
+// profileHours computes the median and interquartile range per hour of day
+// and places the latest sample within its hour: "below" or "above" when
+// outside the Tukey fences (1.5 IQR beyond the quartiles), else "normal".
+func profileHours(series []promresult.Series, weeks int, loc *time.Location) map[string]any {
+	byHour := make([][]float64, 24)
+	var last promresult.Point
+	for _, s := range series {
+		for _, p := range s.Points {
+			if math.IsNaN(p.V) {
+				continue
+			}
+			h := p.T.In(loc).Hour()
+			byHour[h] = append(byHour[h], p.V)
+			if p.T.After(last.T) {
+				last = p
+			}
+		}
+	}
+	hours := make([]hourProfile, 0, 24)
+	for h, vs := range byHour {
+		hp := hourProfile{Hour: h, Samples: len(vs)}
+		if len(vs) > 0 {
+			sort.Float64s(vs)
+			hp.P25, hp.Median, hp.P75 = quantile(vs, 0.25), quantile(vs, 0.5), quantile(vs, 0.75)
+			hp.IQR = hp.P75 - hp.P25
+		}
+		hours = append(hours, hp)
+	}
+	out := map[string]any{"weeks": weeks, "timezone": loc.String(), "hours": hours}
+	if !last.T.IsZero() {
+		hp := hours[last.T.In(loc).Hour()]
+		assessment := "normal"
+		switch {
+		case last.V < hp.P25-1.5*hp.IQR:
+			assessment = "below"
+		case last.V > hp.P75+1.5*hp.IQR:
+			assessment = "above"
+		}
+		out["current"] = map[string]any{"time": last.T.In(loc).Format(time.RFC3339), "hour": hp.Hour, "rps": last.V, "assessment": assessment}
+	}
+	return out
+}
+
+// quantile interpolates linearly between the closest ranks of sorted.
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo))
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"mcp/internal/mimir"
+)
+
+// A snapshot is a gzipped tar archive of the analysis state at one moment:
+// manifest.json, describing the snapshot and the configuration, and under
+// calls/ the results of the tool calls it captured, which offline mode
+// replays.
+
+// snapshotManifest is manifest.json of a snapshot.
+type snapshotManifest struct {
+	Created time.Time `json:"created"`
+	Version string    `json:"version"`
+	// Tenant is the Mimir tenant the calls were made for.
+	Tenant string `json:"tenant"`
+	// Config is the configuration of the server, without credentials.
+	Config   map[string]any `json:"config"`
+	Services []string       `json:"services"`
+	Calls    int            `json:"calls"`
+}
+
+// snapshotCall is a captured tool call. Result holds a JSON result, Text
+// any other, Error a failure.
+type snapshotCall struct {
+	Tool      string          `json:"tool"`
+	Arguments json.RawMessage `json:"arguments"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Text      string          `json:"text,omitempty"`
+	Error     *rpcError       `json:"error,omitempty"`
+}
+
+// snapshotGlobalCalls are the calls of a snapshot not about one service.
+var snapshotGlobalCalls = []snapshotCall{
+	{Tool: "server_status"},
+	{Tool: "backend_capabilities"},
+	{Tool: "servicegraph_topology"},
+	{Tool: "servicegraph_topology", Arguments: json.RawMessage(`{"format":"mermaid"}`)},
+	{Tool: "anomalies_history"},
+}
+
+// snapshotServiceCalls are the calls of a snapshot for every service, with
+// the argument naming it.
+var snapshotServiceCalls = []struct{ tool, arg string }{
+	{"spanmetrics_red_summary", "server"},
+	{"spanmetrics_error_breakdown", "server"},
+	{"spanmetrics_top_callers", "server"},
+	{"spanmetrics_top_endpoints", "server"},
+	{"incident_report", "service"},
+}
+
+// exportSnapshot captures the tool calls of a snapshot for services, by
+// default those with traffic in the last five minutes, and returns the
+// archive. The calls run as the caller of ctx, so its role's limits apply;
+// failed calls are captured with their error.
+func (s *server) exportSnapshot(ctx context.Context, tenant string, services []string) ([]byte, error) {
+	ctx = mimir.WithTenant(ctx, tenant)
+	created := time.Now().UTC()
+	if len(services) == 0 {
+		health, err := s.computeHealth(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list services: %w", err)
+		}
+		for svc := range health {
+			services = append(services, svc)
+		}
+	}
+	sort.Strings(services)
+	calls := append([]snapshotCall(nil), snapshotGlobalCalls...)
+	for _, svc := range services {
+		for _, sc := range snapshotServiceCalls {
+			args, _ := json.Marshal(map[string]string{sc.arg: svc})
+			calls = append(calls, snapshotCall{Tool: sc.tool, Arguments: args})
+		}
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.parallel)
+	for i := range calls {
+		c := &calls[i]
+		if len(c.Arguments) == 0 {
+			c.Arguments = json.RawMessage(`{}`)
+		}
+		g.Go(func() error {
+			params, _ := json.Marshal(map[string]any{"name": c.Tool, "arguments": c.Arguments})
+			out := s.handle(gctx, req{ID: 1, JSONRPC: "2.0", Method: "tools/call", Params: params})
+			if out.Error != nil {
+				c.Error = &rpcError{Code: out.Error.Code, Message: out.Error.Message}
+				return gctx.Err()
+			}
+			text := resultText(out)
+			if json.Valid([]byte(text)) {
+				c.Result = json.RawMessage(text)
+			} else {
+				c.Text = text
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	manifest := snapshotManifest{Created: created, Version: version, Tenant: tenant, Config: s.snapshotConfig(), Services: services, Calls: len(calls)}
+	if manifest.Services == nil {
+		manifest.Services = []string{}
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	add := func(name string, v any) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(b)), ModTime: created}); err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	}
+	if err := add("manifest.json", manifest); err != nil {
+		return nil, err
+	}
+	for i, c := range calls {
+		if err := add(fmt.Sprintf("calls/%04d-%s.json", i+1, c.Tool), c); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// snapshotConfig is the configuration recorded in a snapshot. URLs are
+// redacted, credentials left out.
+func (s *server) snapshotConfig() map[string]any {
+	redact := func(raw string) string {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return ""
+		}
+		return u.Redacted()
+	}
+	clusters := make([]map[string]string, 0, len(s.clusters))
+	for _, cl := range s.clusters {
+		clusters = append(clusters, map[string]string{"name": cl.Name, "url": redact(cl.c.BaseURL), "tenant": cl.c.Tenant})
+	}
+	return map[string]any{
+		"clusters":         clusters,
+		"backend":          string(s.c.Profile),
+		"tenant":           s.tenant,
+		"ifUrl":            redact(s.ifURL),
+		"tempoUrl":         redact(s.tempo.BaseURL),
+		"lokiUrl":          redact(s.loki.BaseURL),
+		"maxWindowMinutes": int(s.limits.maxWindow.Minutes()),
+		"maxPoints":        s.limits.maxPoints,
+		"recorded":         map[string]string{"rate": recorded.rate, "errors": recorded.errors, "latency": recorded.latency},
+	}
+}
+
+// handleSnapshot serves a snapshot archive, authenticated like /rpc:
+// exported now, for the services named by service parameters or all
+// active ones, or in offline mode the snapshot served. Roles must be allowed
+// the tenant, and in offline mode every captured tool.
+func (s *server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.policy != nil {
+		who, authed := s.policy.authenticate(r)
+		if !authed {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx = withPrincipal(ctx, who)
+	}
+	if s.snapshot != nil {
+		if who, authed := principalFrom(ctx); authed {
+			if err := s.snapshot.authorize(s.policy, who); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		http.ServeFile(w, r, s.snapshot.path)
+		return
+	}
+	tenant := r.Header.Get("X-Scope-OrgID")
+	if tenant == "" {
+		tenant = s.tenant
+	}
+	if who, authed := principalFrom(ctx); authed {
+		if err := s.policy.checkTenants(who, tenant); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	archive, err := s.exportSnapshot(ctx, tenant, r.URL.Query()["service"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("snapshot exported: %d bytes", len(archive))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="mcp-snapshot-%s.tar.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+	_, _ = w.Write(archive)
+}
+
+// snapshot is a snapshot served in offline mode.
+type snapshot struct {
+	path     string
+	manifest snapshotManifest
+	// calls are keyed by tool and canonical arguments; captured lists the
+	// canonical arguments of every tool.
+	calls    map[string]snapshotCall
+	captured map[string][]string
+	// defaults are the defaults of the arguments of every tool, left out of
+	// canonical arguments.
+	defaults map[string]map[string]any
+}
+
+// loadSnapshot reads the snapshot archive at file. defaults are the
+// argument defaults of the tools.
+func loadSnapshot(file string, defaults map[string]map[string]any) (*snapshot, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	sn := &snapshot{path: file, calls: map[string]snapshotCall{}, captured: map[string][]string{}, defaults: defaults}
+	tr := tar.NewReader(zr)
+	manifest := false
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		switch {
+		case h.Name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&sn.manifest); err != nil {
+				return nil, fmt.Errorf("%s: manifest.json: %w", file, err)
+			}
+			manifest = true
+		case path.Dir(h.Name) == "calls":
+			var c snapshotCall
+			if err := json.NewDecoder(tr).Decode(&c); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", file, h.Name, err)
+			}
+			args, err := canonicalArgs(c.Arguments, defaults[c.Tool])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", file, h.Name, err)
+			}
+			sn.calls[c.Tool+"\x00"+args] = c
+			sn.captured[c.Tool] = append(sn.captured[c.Tool], args)
+		}
+	}
+	if !manifest {
+		return nil, fmt.Errorf("%s: no manifest.json, not a snapshot", file)
+	}
+	return sn, nil
+}
+
+// authorize checks that the role of who may read the whole snapshot: its
+// tenant and every tool it captured.
+func (sn *snapshot) authorize(p *policy, who principal) error {
+	if err := p.checkTenants(who, sn.manifest.Tenant); err != nil {
+		return err
+	}
+	for tool := range sn.captured {
+		if err := p.authorize(who, tool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay answers a tools/call from the snapshot. Calls it did not capture
+// fail, listing the arguments of those it did.
+func (sn *snapshot) replay(id any, tool string, arguments json.RawMessage) resp {
+	args, err := canonicalArgs(arguments, sn.defaults[tool])
+	if err != nil {
+		return fail(id, -32602, err)
+	}
+	c, found := sn.calls[tool+"\x00"+args]
+	if !found {
+		out := fail(id, -32000, fmt.Errorf("offline: the snapshot of %s did not capture %s with these arguments", sn.manifest.Created.Format(time.RFC3339), tool))
+		captured := sn.captured[tool]
+		if captured == nil {
+			captured = []string{}
+		}
+		out.Error.Data = map[string]any{"captured": captured}
+		return out
+	}
+	if c.Error != nil {
+		return fail(id, c.Error.Code, errors.New(c.Error.Message))
+	}
+	text := c.Text
+	if c.Result != nil {
+		var b bytes.Buffer
+		if err := json.Compact(&b, c.Result); err != nil {
+			return fail(id, -32000, err)
+		}
+		text = b.String()
+	}
+	return ok(id, map[string]any{"content": []any{map[string]any{"type": "text", "text": text}}})
+}
+
+// canonicalArgs renders tool arguments so calls asking for the same thing
+// compare equal: without zero values and values equal to their default,
+// keys sorted.
+func canonicalArgs(arguments json.RawMessage, defaults map[string]any) (string, error) {
+	args := map[string]any{}
+	if len(arguments) > 0 && string(arguments) != "null" {
+		if err := json.Unmarshal(arguments, &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+	}
+	for k, v := range args {
+		b, _ := json.Marshal(v)
+		switch string(b) {
+		case "null", "false", "0", `""`, "[]", "{}":
+			delete(args, k)
+			continue
+		}
+		if def, ok := defaults[k]; ok {
+			if d, _ := json.Marshal(def); bytes.Equal(b, d) {
+				delete(args, k)
+			}
+		}
+	}
+	b, err := json.Marshal(args)
+	return string(b), err
+}
+
+// toolDefaults returns the defaults of the arguments of every tool, from
+// their input schemas.
+func (s *server) toolDefaults() map[string]map[string]any {
+	out := map[string]map[string]any{}
+	res, _ := s.handle(context.Background(), req{Method: "tools/list"}).Result.(map[string]any)
+	tools, _ := res["tools"].([]any)
+	for _, t := range tools {
+		tool, _ := t.(map[string]any)
+		name, _ := tool["name"].(string)
+		schema, _ := tool["inputSchema"].(map[string]any)
+		props, _ := schema["properties"].(map[string]any)
+		for k, p := range props {
+			if def, ok := p.(map[string]any)["default"]; ok {
+				if out[name] == nil {
+					out[name] = map[string]any{}
+				}
+				out[name][k] = def
+			}
+		}
+	}
+	return out
+}
+
+// offlineInstructions tells clients that answers come from the snapshot.
+func (sn *snapshot) offlineInstructions() string {
+	tools := make([]string, 0, len(sn.captured))
+	for t := range sn.captured {
+		tools = append(tools, t)
+	}
+	sort.Strings(tools)
+	return fmt.Sprintf("Offline: tool calls are replayed from a snapshot taken at %s, for services %s. Only the captured calls of %s are answered; times are relative to the snapshot.",
+		sn.manifest.Created.Format(time.RFC3339), strings.Join(sn.manifest.Services, ", "), strings.Join(tools, ", "))
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mcp/internal/promresult"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// statsArgs are the arguments of query_stats.
+type statsArgs struct {
+	Query string `json:"query"`
+	// From and To bound the query, RFC 3339. From defaults to
+	// LookbackMinutes before To, To to now.
+	From            string `json:"from"`
+	To              string `json:"to"`
+	LookbackMinutes int    `json:"lookbackMinutes"`
+	// Instant evaluates the query once at To instead of every StepSeconds.
+	Instant     bool `json:"instant"`
+	StepSeconds int  `json:"stepSeconds"`
+	// Estimate estimates the cost from the series the selectors of the
+	// query match instead of running it.
+	Estimate bool `json:"estimate"`
+	// ScrapeIntervalSeconds is the interval between samples estimates
+	// assume.
+	ScrapeIntervalSeconds int `json:"scrapeIntervalSeconds"`
+}
+
+// statsRange resolves the time range and step of a; the step of an instant
+// query is 0.
+func statsRange(a statsArgs) (from, to time.Time, step time.Duration, err error) {
+	from, to, err = lookbackRange(a.From, a.To, a.LookbackMinutes, 10)
+	if err != nil || a.Instant {
+		return from, to, 0, err
+	}
+	if a.StepSeconds <= 0 {
+		a.StepSeconds = 30
+	}
+	return from, to, time.Duration(a.StepSeconds) * time.Second, nil
+}
+
+// Costs above which query_stats advises against a query.
+const (
+	costlySeries = 10000
+	// costlySamples is Prometheus' default limit of samples a query may
+	// load, query.max-samples.
+	costlySamples = 50000000
+	costlyTime    = 10 * time.Second
+)
+
+// queryCost is the result of query_stats.
+type queryCost struct {
+	Query string    `json:"query"`
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Step  string    `json:"step,omitempty"`
+	// Estimated is set when the query was not run.
+	Estimated bool           `json:"estimated"`
+	Selectors []selectorCost `json:"selectors,omitempty"`
+	// Series are, in estimates, the series the selectors match, or else
+	// the series of the result, which has Points values.
+	Series int `json:"series"`
+	Points int `json:"points,omitempty"`
+	// Samples are the samples estimated to be read, or else the samples
+	// the backend reported reading.
+	Samples    int64           `json:"samples,omitempty"`
+	DurationMs int64           `json:"durationMs,omitempty"`
+	Stats      *promQueryStats `json:"stats,omitempty"`
+	// Note tells why Samples is missing.
+	Note   string   `json:"note,omitempty"`
+	Costly bool     `json:"costly"`
+	Advice []string `json:"advice"`
+}
+
+// selectorCost is the estimated cost of one vector selector of a query.
+type selectorCost struct {
+	Selector string `json:"selector"`
+	Range    string `json:"range,omitempty"`
+	Series   int    `json:"series"`
+	Samples  int64  `json:"samples"`
+}
+
+// promQueryStats are the statistics Prometheus returns for stats=all,
+// without the samples of every step.
+type promQueryStats struct {
+	Timings map[string]float64 `json:"timings"`
+	Samples struct {
+		TotalQueryableSamples int64 `json:"totalQueryableSamples"`
+		PeakSamples           int64 `json:"peakSamples"`
+	} `json:"samples"`
+}
+
+// queryStats runs the query of a with statistics, or estimates its cost.
+func (s *server) queryStats(ctx context.Context, a statsArgs, opts toolOptions) (json.RawMessage, error) {
+	from, to, step, err := statsRange(a)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRange(ctx, to.Sub(from), step); err != nil {
+		return nil, err
+	}
+	sels, err := promSelectors(a.Query)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Explain {
+		if a.Estimate {
+			qs := make([]map[string]string, 0, len(sels))
+			for _, sel := range sels {
+				qs = append(qs, map[string]string{"query": "count(" + sel.expr + ")"})
+			}
+			return json.Marshal(map[string]any{"endpoint": "/api/v1/query", "queries": qs, "time": to.Format(time.RFC3339)})
+		}
+		return explain(queryPlan{queries: []namedQuery{{promQL: a.Query}}, window: to.Sub(from), step: step, instant: step == 0, end: to})
+	}
+	out := queryCost{Query: a.Query, From: from, To: to, Advice: []string{}}
+	if step > 0 {
+		out.Step = step.String()
+	}
+	if a.Estimate {
+		err = s.estimateQuery(ctx, &out, sels, a.ScrapeIntervalSeconds, step)
+	} else {
+		err = s.measureQuery(ctx, &out, step)
+	}
+	if err != nil {
+		return nil, err
+	}
+	out.Costly = len(out.Advice) > 0
+	return json.Marshal(out)
+}
+
+// estimateQuery estimates the cost of the query of out from the series its
+// selectors match at its end: each step reads the last sample of every
+// series of a selector, or the samples of its range, one every scrape
+// interval.
+func (s *server) estimateQuery(ctx context.Context, out *queryCost, sels []selector, scrapeSeconds int, step time.Duration) error {
+	if scrapeSeconds <= 0 {
+		scrapeSeconds = 15
+	}
+	scrape := time.Duration(scrapeSeconds) * time.Second
+	steps := int64(1)
+	if step > 0 {
+		steps = int64(out.To.Sub(out.From)/step) + 1
+	}
+	var exprs []string
+	index := map[string]int{}
+	for _, sel := range sels {
+		if _, ok := index[sel.expr]; !ok {
+			index[sel.expr] = len(exprs)
+			exprs = append(exprs, sel.expr)
+		}
+	}
+	series := make([]int, len(exprs))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.parallel)
+	for i, expr := range exprs {
+		i, expr := i, expr
+		g.Go(func() error {
+			data, err := s.mimirFor(gctx).Query(gctx, "count("+expr+")", out.To)
+			if err != nil {
+				return fmt.Errorf("count %s: %w", expr, err)
+			}
+			v, err := promresult.DecodeVector(data)
+			if err != nil {
+				return err
+			}
+			if len(v) > 0 {
+				series[i] = int(v[0].V)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	out.Estimated = true
+	out.Selectors = make([]selectorCost, 0, len(sels))
+	for _, sel := range sels {
+		perStep := int64(1)
+		if sel.rng > 0 {
+			perStep = max(int64(sel.rng/scrape), 1)
+		}
+		c := selectorCost{Selector: sel.expr, Series: series[index[sel.expr]]}
+		c.Samples = int64(c.Series) * steps * perStep
+		if sel.rng > 0 {
+			c.Range = sel.rng.String()
+		}
+		if c.Series > costlySeries {
+			out.Advice = append(out.Advice, fmt.Sprintf("%s matches %d series: add label matchers or read a recording rule", sel.expr, c.Series))
+		}
+		out.Selectors = append(out.Selectors, c)
+		out.Series += c.Series
+		out.Samples += c.Samples
+	}
+	if out.Samples > costlySamples {
+		out.Advice = append(out.Advice, fmt.Sprintf("reads about %d samples: shorten the time range or range selectors, or raise the step", out.Samples))
+	}
+	return nil
+}
+
+// measureQuery runs the query of out with statistics.
+func (s *server) measureQuery(ctx context.Context, out *queryCost, step time.Duration) error {
+	began := time.Now()
+	data, err := s.mimirFor(ctx).QueryStats(ctx, out.Query, out.From, out.To, step)
+	if err != nil {
+		return err
+	}
+	took := time.Since(began)
+	out.DurationMs = took.Milliseconds()
+	var d struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+		Stats      *promQueryStats `json:"stats"`
+	}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	switch d.ResultType {
+	case "matrix":
+		var m []struct {
+			Values []json.RawMessage `json:"values"`
+		}
+		if err := json.Unmarshal(d.Result, &m); err != nil {
+			return err
+		}
+		out.Series = len(m)
+		for _, r := range m {
+			out.Points += len(r.Values)
+		}
+	case "vector":
+		var v []json.RawMessage
+		if err := json.Unmarshal(d.Result, &v); err != nil {
+			return err
+		}
+		out.Series, out.Points = len(v), len(v)
+	default:
+		out.Points = 1
+	}
+	out.Stats = d.Stats
+	if d.Stats == nil {
+		out.Note = "the backend reported no statistics; estimate tells the samples read"
+	} else {
+		out.Samples = d.Stats.Samples.TotalQueryableSamples
+	}
+	if took > costlyTime {
+		out.Advice = append(out.Advice, fmt.Sprintf("took %s: shorten the time range or aggregate before the backend returns series", took.Round(time.Millisecond)))
+	}
+	if out.Series > costlySeries {
+		out.Advice = append(out.Advice, fmt.Sprintf("returns %d series: aggregate, e.g. with sum by (service_name), or add label matchers", out.Series))
+	}
+	if out.Samples > costlySamples {
+		out.Advice = append(out.Advice, fmt.Sprintf("read %d samples: shorten the time range or range selectors, or raise the step", out.Samples))
+	}
+	return nil
+}
+
+// selector is a vector selector of a PromQL query, with the range of a
+// range vector selector.
+type selector struct {
+	expr string
+	rng  time.Duration
+}
+
+// promKeywords are the identifiers of PromQL that are not metric names,
+// true for the grouping modifiers, which are followed by a label list.
+var promKeywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+	"and": false, "or": false, "unless": false, "bool": false, "offset": false, "inf": false, "nan": false,
+	"sum": false, "min": false, "max": false, "avg": false, "group": false, "stddev": false, "stdvar": false,
+	"count": false, "count_values": false, "bottomk": false, "topk": false, "quantile": false,
+	"limitk": false, "limit_ratio": false,
+}
+
+// promSelectors returns the vector selectors of query. It lexes the query
+// rather than parsing it: strings, numbers, keywords, function names and
+// the label lists of grouping modifiers are skipped, and subqueries are
+// not told apart from range vectors.
+func promSelectors(query string) ([]selector, error) {
+	var out []selector
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			end := closing(query, i)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in query")
+			}
+			i = end
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c >= '0' && c <= '9' || c == '.':
+			for i < len(query) && (identChar(query[i]) || query[i] == '.') {
+				i++
+			}
+		case c == '[':
+			// subquery of an expression
+			end := strings.IndexByte(query[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in query")
+			}
+			i += end + 1
+		case identChar(c) || c == '{':
+			start := i
+			for i < len(query) && identChar(query[i]) {
+				i++
+			}
+			name := query[start:i]
+			next := skipSpace(query, i)
+			grouping, keyword := promKeywords[strings.ToLower(name)]
+			if name != "" && (keyword || next < len(query) && query[next] == '(') {
+				if grouping && next < len(query) && query[next] == '(' {
+					end := strings.IndexByte(query[next:], ')')
+					if end < 0 {
+						return nil, fmt.Errorf("unterminated ( in query")
+					}
+					i = next + end + 1
+				}
+				continue
+			}
+			if next < len(query) && query[next] == '{' {
+				end := closing(query, next)
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated { in query")
+				}
+				i = end
+			}
+			sel := selector{expr: query[start:i]}
+			if next = skipSpace(query, i); next < len(query) && query[next] == '[' {
+				end := strings.IndexByte(query[next:], ']')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated [ in query")
+				}
+				rng, _, _ := strings.Cut(query[next+1:next+end], ":")
+				d, err := promDuration(strings.TrimSpace(rng))
+				if err != nil {
+					return nil, err
+				}
+				sel.rng, i = d, next+end+1
+			}
+			out = append(out, sel)
+		default:
+			i++
+		}
+	}
+	return out, nil
+}
+
+// closing returns the index after the string or matcher list opening at
+// query[i], or -1 when it is not closed.
+func closing(query string, i int) int {
+	open := query[i]
+	if open == '{' {
+		for j := i + 1; j < len(query); j++ {
+			switch query[j] {
+			case '}':
+				return j + 1
+			case '"', '\'', '`':
+				if j = closing(query, j); j < 0 {
+					return -1
+				}
+				j--
+			}
+		}
+		return -1
+	}
+	for j := i + 1; j < len(query); j++ {
+		switch {
+		case query[j] == '\\' && open != '`':
+			j++
+		case query[j] == open:
+			return j + 1
+		}
+	}
+	return -1
+}
+
+func identChar(c byte) bool {
+	return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func skipSpace(query string, i int) int {
+	for i < len(query) && strings.IndexByte(" \t\r\n", query[i]) >= 0 {
+		i++
+	}
+	return i
+}
+
+var promDurationRe = regexp.MustCompile(`^(?:(\d+)y)?(?:(\d+)w)?(?:(\d+)d)?(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s)?(?:(\d+)ms)?$`)
+
+// promDuration parses a PromQL duration such as 5m or 1h30m.
+func promDuration(s string) (time.Duration, error) {
+	m := promDurationRe.FindStringSubmatch(s)
+	if s == "" || m == nil {
+		return 0, fmt.Errorf("invalid duration %q in query", s)
+	}
+	units := []time.Duration{365 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second, time.Millisecond}
+	var d time.Duration
+	for i, u := range units {
+		if m[i+1] != "" {
+			n, _ := strconv.Atoi(m[i+1])
+			d += time.Duration(n) * u
+		}
+	}
+	return d, nil
+}
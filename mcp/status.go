@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// started is when the server started, for serverStatus.
+var started = time.Now().UTC()
+
+// ready is set once metric discovery first found the spanmetrics the tools
+// read in the default cluster. It stays set when the backend fails later, so
+// an outage of the shared backend does not take every replica out of
+// rotation; the status tells the outage instead.
+var ready atomic.Bool
+
+// backendStatus is how a cluster answered recent queries.
+type backendStatus struct {
+	Cluster     string     `json:"cluster"`
+	URL         string     `json:"url"`
+	Reachable   bool       `json:"reachable"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// serverStatus is served by /readyz and the server_status tool.
+type serverStatus struct {
+	Ready bool `json:"ready"`
+	// Reason tells why the server is not ready.
+	Reason   string          `json:"reason,omitempty"`
+	Started  time.Time       `json:"started"`
+	Backends []backendStatus `json:"backends"`
+	// Metrics are the known metrics discovered in the default cluster.
+	Metrics  []string   `json:"metrics"`
+	Problems []string   `json:"problems"`
+	Probed   *time.Time `json:"probed,omitempty"`
+}
+
+func (s *server) status() serverStatus {
+	caps, discoverErr := currentCaps(), currentDiscoverErr()
+	out := serverStatus{Ready: ready.Load(), Started: started, Backends: []backendStatus{}, Metrics: []string{}, Problems: caps.Problems, Probed: caps.Probed}
+	for _, cl := range s.clusters {
+		st := cl.c.Status()
+		b := backendStatus{Cluster: cl.Name, URL: cl.c.BaseURL, Reachable: st.Reachable(), LastError: st.LastError}
+		if !st.LastSuccess.IsZero() {
+			t := st.LastSuccess.UTC()
+			b.LastSuccess = &t
+		}
+		if !st.LastFailure.IsZero() {
+			t := st.LastFailure.UTC()
+			b.LastFailure = &t
+		}
+		out.Backends = append(out.Backends, b)
+	}
+	for _, names := range [][]string{callsNames, latencyBucketsMs, latencyBucketsSec, graphNames} {
+		for _, n := range names {
+			if _, ok := caps.Metrics[n]; ok {
+				out.Metrics = append(out.Metrics, n)
+			}
+		}
+	}
+	if !out.Ready {
+		switch {
+		case discoverErr != "":
+			out.Reason = "metric discovery failed: " + discoverErr
+		case caps.Probed == nil:
+			out.Reason = "metric discovery has not run yet"
+		default:
+			out.Reason = "spanmetrics not found: " + strings.Join(caps.Problems, "; ")
+		}
+	}
+	return out
+}
+
+// handleReadyz answers 200 once the server is ready and 503 before, with
+// the status either way. Like /healthz it is never authenticated, for
+// orchestrator probes.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	st := s.status()
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(st)
+}
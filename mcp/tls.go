@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"mcp/internal/secret"
+)
+
+// ifTransport returns the transport of requests to the anomaly service.
+// With IF_CA_FILE its certificate is verified against those CAs instead of
+// the system's, and with IF_CLIENT_CERT_FILE and IF_CLIENT_KEY_FILE the
+// server presents that certificate, for anomaly services requiring client
+// certificates. The certificate is re-read when its files change.
+func ifTransport() http.RoundTripper {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	certFile, keyFile := getenv("IF_CLIENT_CERT_FILE", ""), getenv("IF_CLIENT_KEY_FILE", "")
+	caFile := getenv("IF_CA_FILE", "")
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return tr
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			log.Fatal("IF_CLIENT_CERT_FILE and IF_CLIENT_KEY_FILE are set together")
+		}
+		kp, err := secret.LoadKeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("load IF client certificate: %v", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return kp.Certificate()
+		}
+	}
+	if caFile != "" {
+		pool, err := secret.LoadCertPool(caFile)
+		if err != nil {
+			log.Fatalf("load IF_CA_FILE: %v", err)
+		}
+		cfg.RootCAs = pool
+	}
+	tr.TLSClientConfig = cfg
+	return tr
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mcp/internal/tempo"
+)
+
+// traceIDPattern matches a hex trace ID, 64 or 128 bit.
+var traceIDPattern = regexp.MustCompile(`^([0-9a-fA-F]{16}|[0-9a-fA-F]{32})$`)
+
+// traceNode is a span, or a run of similar sibling spans, in the compacted
+// span tree of get_trace.
+type traceNode struct {
+	Service string `json:"service"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind,omitempty"`
+	// OffsetMs is the start relative to the trace start.
+	OffsetMs   float64 `json:"offset_ms"`
+	DurationMs float64 `json:"duration_ms"`
+	Status     string  `json:"status"`
+	Message    string  `json:"message,omitempty"`
+	// Critical marks spans on the critical path.
+	Critical bool `json:"critical,omitempty"`
+	// Count is the number of merged sibling spans, whose durations are
+	// summed in DurationMs; absent for a single span.
+	Count    int          `json:"count,omitempty"`
+	Children []*traceNode `json:"children,omitempty"`
+
+	span tempo.Span
+	// keep is set when the node or a descendant is critical or failed
+	keep bool
+}
+
+// criticalStep is a span on the critical path with the time spent in the
+// span itself rather than in critical children.
+type criticalStep struct {
+	Service    string  `json:"service"`
+	Name       string  `json:"name"`
+	DurationMs float64 `json:"duration_ms"`
+	SelfMs     float64 `json:"self_ms"`
+	// Count is the number of merged sibling spans, as in traceNode.
+	Count int `json:"count,omitempty"`
+}
+
+// traceResult is the get_trace tool result.
+type traceResult struct {
+	TraceID    string         `json:"trace_id"`
+	Start      time.Time      `json:"start"`
+	DurationMs float64        `json:"duration_ms"`
+	Spans      int            `json:"spans"`
+	Errors     int            `json:"errors"`
+	Services   []string       `json:"services"`
+	Critical   []criticalStep `json:"critical_path"`
+	Roots      []*traceNode   `json:"roots"`
+	// Truncated counts spans left out beyond maxSpans.
+	Truncated int `json:"truncated,omitempty"`
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+// compactTrace builds the span tree of spans. Spans whose parent is missing
+// become roots. The critical path is walked back from the end of the
+// longest root: the last child to finish is critical, then the last one to
+// finish before that child started, and so on. Leaf siblings with the same
+// service and name that did not fail are merged, critical ones separately,
+// and the tree is cut down to about maxSpans nodes, keeping the critical
+// path and failed spans.
+func compactTrace(id string, spans []tempo.Span, maxSpans int) traceResult {
+	out := traceResult{TraceID: id, Spans: len(spans), Services: []string{}, Critical: []criticalStep{}, Roots: []*traceNode{}}
+	if len(spans) == 0 {
+		return out
+	}
+	nodes := make(map[string]*traceNode, len(spans))
+	start, end := spans[0].Start, spans[0].End
+	services := map[string]bool{}
+	for _, sp := range spans {
+		nodes[sp.ID] = &traceNode{span: sp}
+		if sp.Start.Before(start) {
+			start = sp.Start
+		}
+		if sp.End.After(end) {
+			end = sp.End
+		}
+		services[sp.Service] = true
+		if sp.Error {
+			out.Errors++
+		}
+	}
+	out.Start, out.DurationMs = start, ms(end.Sub(start))
+	for name := range services {
+		out.Services = append(out.Services, name)
+	}
+	sort.Strings(out.Services)
+	for _, sp := range spans {
+		n := nodes[sp.ID]
+		n.Service, n.Name, n.Kind = sp.Service, sp.Name, sp.Kind
+		n.OffsetMs, n.DurationMs = ms(sp.Start.Sub(start)), ms(sp.End.Sub(sp.Start))
+		n.Status, n.Message = "ok", sp.StatusMessage
+		if sp.Error {
+			n.Status = "error"
+		}
+		if p, found := nodes[sp.ParentID]; found && sp.ParentID != sp.ID {
+			p.Children = append(p.Children, n)
+		} else {
+			out.Roots = append(out.Roots, n)
+		}
+	}
+	byStart := func(ns []*traceNode) {
+		sort.Slice(ns, func(i, j int) bool { return ns[i].span.Start.Before(ns[j].span.Start) })
+	}
+	byStart(out.Roots)
+	for _, n := range nodes {
+		byStart(n.Children)
+	}
+
+	longest := out.Roots[0]
+	for _, r := range out.Roots {
+		if r.span.End.Sub(r.span.Start) > longest.span.End.Sub(longest.span.Start) {
+			longest = r
+		}
+	}
+	markCritical(longest, longest.span.End)
+	for _, r := range out.Roots {
+		markKeep(r)
+		mergeSiblings(r)
+	}
+	out.Critical = criticalPath(longest)
+	budget := maxSpans
+	for _, r := range out.Roots {
+		out.Truncated += prune(r, &budget)
+	}
+	return out
+}
+
+// markCritical marks n and, walking back from cursor, the children that
+// determined when it ended.
+func markCritical(n *traceNode, cursor time.Time) {
+	n.Critical = true
+	children := append([]*traceNode(nil), n.Children...)
+	sort.Slice(children, func(i, j int) bool { return children[i].span.End.After(children[j].span.End) })
+	for _, c := range children {
+		if c.span.End.After(cursor) || !c.span.End.After(n.span.Start) {
+			continue
+		}
+		markCritical(c, c.span.End)
+		cursor = c.span.Start
+	}
+}
+
+// criticalPath lists the critical spans under n in start order.
+func criticalPath(n *traceNode) []criticalStep {
+	self := n.DurationMs
+	var below []criticalStep
+	for _, c := range n.Children {
+		if c.Critical {
+			self -= c.DurationMs
+			below = append(below, criticalPath(c)...)
+		}
+	}
+	step := criticalStep{Service: n.Service, Name: n.Name, DurationMs: n.DurationMs, SelfMs: max(self, 0), Count: n.Count}
+	return append([]criticalStep{step}, below...)
+}
+
+func markKeep(n *traceNode) bool {
+	n.keep = n.Critical || n.Status == "error"
+	for _, c := range n.Children {
+		if markKeep(c) {
+			n.keep = true
+		}
+	}
+	return n.keep
+}
+
+// mergeSiblings merges, below n, leaf siblings with the same service, name
+// and criticality that did not fail, e.g. a loop of identical database
+// calls.
+func mergeSiblings(n *traceNode) {
+	var out []*traceNode
+	type run struct {
+		service, name string
+		critical      bool
+	}
+	runs := map[run]*traceNode{}
+	for _, c := range n.Children {
+		mergeSiblings(c)
+		if c.Status == "error" || len(c.Children) > 0 {
+			out = append(out, c)
+			continue
+		}
+		k := run{c.Service, c.Name, c.Critical}
+		if r, found := runs[k]; found {
+			if r.Count == 0 {
+				r.Count = 1
+			}
+			r.Count++
+			r.DurationMs += c.DurationMs
+			continue
+		}
+		runs[k] = c
+		out = append(out, c)
+	}
+	n.Children = out
+}
+
+// prune keeps nodes while budget lasts, and kept nodes regardless, and
+// returns the number of spans dropped.
+func prune(n *traceNode, budget *int) int {
+	*budget--
+	dropped := 0
+	var out []*traceNode
+	for _, c := range n.Children {
+		if *budget <= 0 && !c.keep {
+			dropped += spanCount(c)
+			continue
+		}
+		dropped += prune(c, budget)
+		out = append(out, c)
+	}
+	n.Children = out
+	return dropped
+}
+
+func spanCount(n *traceNode) int {
+	c := max(n.Count, 1)
+	for _, ch := range n.Children {
+		c += spanCount(ch)
+	}
+	return c
+}
+
+// getTrace fetches a trace from Tempo and compacts it.
+func (s *server) getTrace(ctx context.Context, id string, maxSpans int, opts toolOptions) (json.RawMessage, error) {
+	if opts.Explain {
+		return json.Marshal(map[string]any{"requests": []string{s.tempo.BaseURL + "/api/traces/" + id}})
+	}
+	spans, err := s.tempo.Trace(ctx, id)
+	if errors.Is(err, tempo.ErrNotFound) {
+		return nil, fmt.Errorf("trace %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(compactTrace(id, spans, maxSpans))
+}
+
+// searchArgs are the arguments of search_traces.
+type searchArgs struct {
+	Service  string `json:"service"`
+	SpanName string `json:"spanName"`
+	// MinDurationMs matches spans lasting at least this long.
+	MinDurationMs int  `json:"minDurationMs"`
+	Error         bool `json:"error"`
+	// From and To bound the search, RFC 3339. From defaults to
+	// LookbackMinutes before To, To to now.
+	From            string `json:"from"`
+	To              string `json:"to"`
+	LookbackMinutes int    `json:"lookbackMinutes"`
+	Limit           int    `json:"limit"`
+}
+
+// searchRange resolves the time range of a.
+func searchRange(a searchArgs) (from, to time.Time, err error) {
+	return lookbackRange(a.From, a.To, a.LookbackMinutes, 60)
+}
+
+// lookbackRange parses an RFC 3339 range where to defaults to now and from
+// to lookbackMinutes, or defaultMinutes, before to.
+func lookbackRange(fromArg, toArg string, lookbackMinutes, defaultMinutes int) (from, to time.Time, err error) {
+	to = time.Now().UTC()
+	if toArg != "" {
+		if to, err = time.Parse(time.RFC3339, toArg); err != nil {
+			return from, to, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if lookbackMinutes <= 0 {
+		lookbackMinutes = defaultMinutes
+	}
+	from = to.Add(-time.Duration(lookbackMinutes) * time.Minute)
+	if fromArg != "" {
+		if from, err = time.Parse(time.RFC3339, fromArg); err != nil {
+			return from, to, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// traceQL renders a as a TraceQL span set filter. All conditions apply to
+// the same span, so a slow span and a failed one elsewhere in the trace
+// don't match together.
+func (a searchArgs) traceQL() string {
+	conds := []string{"resource.service.name = " + strconv.Quote(a.Service)}
+	if a.SpanName != "" {
+		conds = append(conds, "name = "+strconv.Quote(a.SpanName))
+	}
+	if a.MinDurationMs > 0 {
+		conds = append(conds, fmt.Sprintf("duration >= %dms", a.MinDurationMs))
+	}
+	if a.Error {
+		conds = append(conds, "status = error")
+	}
+	return "{ " + strings.Join(conds, " && ") + " }"
+}
+
+// foundSpan is a span matching search_traces.
+type foundSpan struct {
+	SpanID     string  `json:"span_id"`
+	Name       string  `json:"name"`
+	DurationMs float64 `json:"duration_ms"`
+	// Status is only known when the search asked for failed spans.
+	Status string `json:"status,omitempty"`
+}
+
+// foundTrace is a trace found by search_traces.
+type foundTrace struct {
+	TraceID     string      `json:"trace_id"`
+	RootService string      `json:"root_service"`
+	RootName    string      `json:"root_name"`
+	Start       time.Time   `json:"start"`
+	DurationMs  float64     `json:"duration_ms"`
+	Matched     int         `json:"matched_spans"`
+	Spans       []foundSpan `json:"spans"`
+}
+
+// searchTraces finds traces of a service with matching spans in Tempo,
+// slowest first.
+func (s *server) searchTraces(ctx context.Context, a searchArgs, opts toolOptions) (json.RawMessage, error) {
+	from, to, err := searchRange(a)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRange(ctx, to.Sub(from), 0); err != nil {
+		return nil, err
+	}
+	q := a.traceQL()
+	if opts.Explain {
+		return json.Marshal(map[string]any{
+			"endpoint": s.tempo.BaseURL + "/api/search",
+			"traceql":  q,
+			"start":    from,
+			"end":      to,
+			"limit":    a.Limit,
+		})
+	}
+	found, err := s.tempo.Search(ctx, q, from, to, a.Limit)
+	if err != nil {
+		return nil, err
+	}
+	traces := make([]foundTrace, 0, len(found))
+	for _, t := range found {
+		ft := foundTrace{TraceID: t.TraceID, RootService: t.RootService, RootName: t.RootName, Start: t.Start, DurationMs: ms(t.Duration), Matched: t.Matched, Spans: []foundSpan{}}
+		for _, sp := range t.Spans {
+			fs := foundSpan{SpanID: sp.ID, Name: sp.Name, DurationMs: ms(sp.Duration)}
+			if a.Error {
+				fs.Status = "error"
+			}
+			ft.Spans = append(ft.Spans, fs)
+		}
+		traces = append(traces, ft)
+	}
+	sort.SliceStable(traces, func(i, j int) bool { return traces[i].DurationMs > traces[j].DurationMs })
+	return json.Marshal(map[string]any{"traceql": q, "from": from, "to": to, "traces": traces})
+}
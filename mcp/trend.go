@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"mcp/internal/promresult"
+)
+
+// An endpoint is flagged as degrading when its p95 rises steadily: the fit
+// explains at least trendMinR2 of the variance and the projection is at least
+// trendMinRise above the current fitted value.
+const (
+	trendMinR2   = 0.6
+	trendMinRise = 0.1
+)
+
+// trendRow is the fitted p95 trend of one endpoint.
+type trendRow struct {
+	SpanName string `json:"span_name"`
+	// SlopeMsPerMin is the fitted change of p95 latency per minute.
+	SlopeMsPerMin float64 `json:"slope_ms_per_min"`
+	CurrentMs     float64 `json:"current_ms"`
+	ProjectedMs   float64 `json:"projected_ms"`
+	R2            float64 `json:"r2"`
+	Points        int     `json:"points"`
+	Degrading     bool    `json:"degrading"`
+}
+
+// planLatencyTrend fetches p95 latency per endpoint of a server and fits a
+// least squares line to each, projecting it horizonM minutes ahead.
+func planLatencyTrend(serverName string, windowM, horizonM int, extra string) queryPlan {
+	lm := currentLatency()
+	q := lm.ms(fmt.Sprintf(`histogram_quantile(0.95, sum by (span_name, le) (rate(({__name__=~"%s", service_name=%q, span_kind="SPAN_KIND_SERVER"%s}[5m]))))`, lm.name, serverName, extra))
+	p := rangePlan(windowM, namedQuery{promQL: q})
+	p.shape = func(res map[string]json.RawMessage) (any, error) {
+		series, err := promresult.DecodeMatrix(res[""])
+		if err != nil {
+			return nil, err
+		}
+		rows := []trendRow{}
+		for _, s := range series {
+			if r, ok := fitTrend(s, float64(horizonM)); ok {
+				rows = append(rows, r)
+			}
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i].SlopeMsPerMin > rows[j].SlopeMsPerMin })
+		return map[string]any{"horizonMinutes": horizonM, "metric": lm.name, "endpoints": rows}, nil
+	}
+	return p
+}
+
+// fitTrend fits v = a + b*t (t in minutes) to the usable points of s. Steps
+// without traffic (NaN) are skipped; fewer than 3 points give no trend.
+func fitTrend(s promresult.Series, horizonMin float64) (trendRow, bool) {
+	var xs, ys []float64
+	for _, p := range s.Points {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		xs = append(xs, float64(p.T.Unix())/60)
+		ys = append(ys, p.V)
+	}
+	n := float64(len(xs))
+	if n < 3 {
+		return trendRow{}, false
+	}
+	// center t to keep the sums well conditioned
+	var mx, my float64
+	for i := range xs {
+		mx += xs[i]
+		my += ys[i]
+	}
+	mx /= n
+	my /= n
+	var sxx, sxy, syy float64
+	for i := range xs {
+		dx, dy := xs[i]-mx, ys[i]-my
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 {
+		return trendRow{}, false
+	}
+	b := sxy / sxx
+	r2 := 1.0
+	if syy > 0 {
+		r2 = sxy * sxy / (sxx * syy)
+	}
+	last := xs[len(xs)-1]
+	current := my + b*(last-mx)
+	projected := current + b*horizonMin
+	r := trendRow{
+		SpanName:      s.Labels["span_name"],
+		SlopeMsPerMin: b,
+		CurrentMs:     current,
+		ProjectedMs:   projected,
+		R2:            r2,
+		Points:        len(xs),
+	}
+	r.Degrading = b > 0 && r2 >= trendMinR2 && current > 0 && (projected-current)/current >= trendMinRise
+	return r, true
+}
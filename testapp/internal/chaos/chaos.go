@@ -0,0 +1,261 @@
+// Package chaos injects errors, latency and timeouts into a service's
+// requests, configured at startup from the environment and at runtime via
+// the /chaos endpoint.
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	apitrace "go.opentelemetry.io/otel/trace"
+)
+
+// Faults describes what to inject. Percentages are of requests, 0 to 100.
+type Faults struct {
+	// ErrorPercent of requests fail with one of ErrorCodes, 500 if none.
+	ErrorPercent float64
+	ErrorCodes   []ErrorCode
+	// Latency is added to LatencyPercent of requests.
+	Latency        time.Duration
+	LatencyPercent float64
+	// TimeoutPercent of requests hang for Timeout, or until the caller
+	// gives up, then fail with a 504.
+	TimeoutPercent float64
+	Timeout        time.Duration
+	// Until is when the faults end; zero keeps them until cleared.
+	Until time.Time
+}
+
+// MarshalJSON renders the faults with the names and duration format of the
+// /chaos parameters.
+func (f Faults) MarshalJSON() ([]byte, error) {
+	v := map[string]any{
+		"errorPercent":   f.ErrorPercent,
+		"errorCodes":     formatErrorCodes(f.ErrorCodes),
+		"latency":        f.Latency.String(),
+		"latencyPercent": f.LatencyPercent,
+		"timeoutPercent": f.TimeoutPercent,
+		"timeout":        f.Timeout.String(),
+	}
+	if !f.Until.IsZero() {
+		v["until"] = f.Until.Format(time.RFC3339)
+	}
+	return json.Marshal(v)
+}
+
+// ErrorCode is a status code injected errors pick with a weight relative to
+// the other codes.
+type ErrorCode struct {
+	Code   int
+	Weight float64
+}
+
+// parseErrorCodes parses "code:weight" or "code" (weight 1) pairs,
+// comma-separated, such as "400:1,404:1,429:2,500:4,503:2".
+func parseErrorCodes(s string) ([]ErrorCode, error) {
+	var codes []ErrorCode
+	for _, part := range strings.Split(s, ",") {
+		c, w, hasWeight := strings.Cut(strings.TrimSpace(part), ":")
+		code, err := strconv.Atoi(c)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("invalid error code %q", part)
+		}
+		weight := 1.0
+		if hasWeight {
+			if weight, err = strconv.ParseFloat(w, 64); err != nil || weight <= 0 {
+				return nil, fmt.Errorf("invalid error code weight %q", part)
+			}
+		}
+		codes = append(codes, ErrorCode{Code: code, Weight: weight})
+	}
+	return codes, nil
+}
+
+func formatErrorCodes(codes []ErrorCode) string {
+	parts := make([]string, len(codes))
+	for i, c := range codes {
+		parts[i] = strconv.Itoa(c.Code) + ":" + strconv.FormatFloat(c.Weight, 'g', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+// pick returns a code of codes at random by weight, 500 if there are none.
+func pick(codes []ErrorCode) int {
+	total := 0.0
+	for _, c := range codes {
+		total += c.Weight
+	}
+	x := rand.Float64() * total
+	for _, c := range codes {
+		if x -= c.Weight; x < 0 {
+			return c.Code
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// Injector applies the current faults to requests.
+type Injector struct {
+	mu     sync.RWMutex
+	faults Faults
+}
+
+// FromEnv returns an injector with the faults of CHAOS_ERROR_PERCENT,
+// CHAOS_ERROR_CODES, CHAOS_LATENCY, CHAOS_LATENCY_PERCENT, CHAOS_TIMEOUT_PERCENT and
+// CHAOS_TIMEOUT, none by default.
+func FromEnv() *Injector {
+	env := map[string]string{
+		"errorPercent":   "CHAOS_ERROR_PERCENT",
+		"errorCodes":     "CHAOS_ERROR_CODES",
+		"latency":        "CHAOS_LATENCY",
+		"latencyPercent": "CHAOS_LATENCY_PERCENT",
+		"timeoutPercent": "CHAOS_TIMEOUT_PERCENT",
+		"timeout":        "CHAOS_TIMEOUT",
+	}
+	f, err := parse(func(name string) string { return os.Getenv(env[name]) })
+	if err != nil {
+		log.Fatalf("chaos: %v", err)
+	}
+	return &Injector{faults: f}
+}
+
+// parse reads faults from the named values of get, as query parameters or
+// environment variables.
+func parse(get func(string) string) (Faults, error) {
+	f := Faults{Timeout: 30 * time.Second}
+	percents := []struct {
+		name string
+		p    *float64
+	}{{"errorPercent", &f.ErrorPercent}, {"latencyPercent", &f.LatencyPercent}, {"timeoutPercent", &f.TimeoutPercent}}
+	for _, p := range percents {
+		if v := get(p.name); v != "" {
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil || x < 0 || x > 100 {
+				return f, fmt.Errorf("invalid %s %q", p.name, v)
+			}
+			*p.p = x
+		}
+	}
+	durations := []struct {
+		name string
+		d    *time.Duration
+	}{{"latency", &f.Latency}, {"timeout", &f.Timeout}}
+	for _, d := range durations {
+		if v := get(d.name); v != "" {
+			x, err := time.ParseDuration(v)
+			if err != nil || x < 0 {
+				return f, fmt.Errorf("invalid %s %q", d.name, v)
+			}
+			*d.d = x
+		}
+	}
+	if v := get("errorCodes"); v != "" {
+		codes, err := parseErrorCodes(v)
+		if err != nil {
+			return f, err
+		}
+		f.ErrorCodes = codes
+	}
+	if f.Latency > 0 && get("latencyPercent") == "" {
+		f.LatencyPercent = 100
+	}
+	if v := get("duration"); v != "" {
+		x, err := time.ParseDuration(v)
+		if err != nil || x <= 0 {
+			return f, fmt.Errorf("invalid duration %q", v)
+		}
+		f.Until = time.Now().Add(x)
+	}
+	return f, nil
+}
+
+func (in *Injector) current() Faults {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	if !in.faults.Until.IsZero() && time.Now().After(in.faults.Until) {
+		return Faults{}
+	}
+	return in.faults
+}
+
+// Middleware injects the current faults into requests to next.
+func (in *Injector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := in.current()
+		if hit(f.TimeoutPercent) {
+			select {
+			case <-time.After(f.Timeout):
+			case <-r.Context().Done():
+			}
+			slog.WarnContext(r.Context(), "chaos: injected timeout", "timeout", f.Timeout)
+			http.Error(w, "injected timeout", http.StatusGatewayTimeout)
+			return
+		}
+		if f.Latency > 0 && hit(f.LatencyPercent) {
+			time.Sleep(f.Latency)
+		}
+		if hit(f.ErrorPercent) {
+			code := pick(f.ErrorCodes)
+			// otelhttp marks the server span failed for 5xx only, as the
+			// semantic conventions have it; error.type tells the class
+			apitrace.SpanFromContext(r.Context()).SetAttributes(attribute.String("error.type", strconv.Itoa(code)))
+			if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1")
+			}
+			slog.WarnContext(r.Context(), "chaos: injected error", "status", code)
+			http.Error(w, "injected "+http.StatusText(code), code)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func hit(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// Handler serves the faults: GET shows them, POST replaces them from query
+// or form parameters (errorPercent, errorCodes, latency, latencyPercent,
+// timeoutPercent, timeout and duration, e.g. 10m), DELETE clears them.
+func (in *Injector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f, err := parse(r.Form.Get)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			in.mu.Lock()
+			in.faults = f
+			in.mu.Unlock()
+			log.Printf("chaos: injecting %+v", f)
+		case http.MethodDelete:
+			in.mu.Lock()
+			in.faults = Faults{}
+			in.mu.Unlock()
+			log.Printf("chaos: cleared")
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(in.current())
+	})
+}
@@ -0,0 +1,104 @@
+// Package fakedb simulates a database: queries only record a client span and
+// take a variable time, so traces carry database calls without a database.
+package fakedb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	apitrace "go.opentelemetry.io/otel/trace"
+)
+
+// DB is a simulated database called Peer, e.g. "db", of System holding
+// database Name.
+type DB struct {
+	System, Name, Peer string
+	// Latency is the median query time; times vary log-normally around it,
+	// and SlowPercent of queries take ten times longer.
+	Latency     time.Duration
+	SlowPercent float64
+	// ErrorPercent of queries fail.
+	ErrorPercent float64
+}
+
+// FromEnv returns the database of DB_SYSTEM (postgresql), DB_NAME (orders),
+// DB_PEER (db), DB_LATENCY (20ms), DB_SLOW_PERCENT (5) and DB_ERROR_PERCENT
+// (0).
+func FromEnv() *DB {
+	db := &DB{System: "postgresql", Name: "orders", Peer: "db", Latency: 20 * time.Millisecond, SlowPercent: 5}
+	for _, s := range []struct {
+		env string
+		s   *string
+	}{{"DB_SYSTEM", &db.System}, {"DB_NAME", &db.Name}, {"DB_PEER", &db.Peer}} {
+		if v := os.Getenv(s.env); v != "" {
+			*s.s = v
+		}
+	}
+	if v := os.Getenv("DB_LATENCY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid DB_LATENCY %q", v)
+		}
+		db.Latency = d
+	}
+	for _, p := range []struct {
+		env string
+		p   *float64
+	}{{"DB_SLOW_PERCENT", &db.SlowPercent}, {"DB_ERROR_PERCENT", &db.ErrorPercent}} {
+		if v := os.Getenv(p.env); v != "" {
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil || x < 0 || x > 100 {
+				log.Fatalf("invalid %s %q", p.env, v)
+			}
+			*p.p = x
+		}
+	}
+	return db
+}
+
+// Query runs statement against table as a client span named after its
+// operation, the statement's first word, like "SELECT orders.items".
+func (db *DB) Query(ctx context.Context, table, statement string) error {
+	op, _, _ := strings.Cut(statement, " ")
+	op = strings.ToUpper(op)
+	_, span := otel.Tracer("fakedb").Start(ctx, op+" "+db.Name+"."+table,
+		apitrace.WithSpanKind(apitrace.SpanKindClient),
+		apitrace.WithAttributes(
+			attribute.String("db.system", db.System),
+			attribute.String("db.name", db.Name),
+			attribute.String("db.statement", statement),
+			attribute.String("db.operation", op),
+			attribute.String("db.sql.table", table),
+			attribute.String("server.address", db.Peer),
+			attribute.String("peer.service", db.Peer),
+		),
+	)
+	defer span.End()
+	d := time.Duration(float64(db.Latency) * math.Exp(rand.NormFloat64()*0.5))
+	if rand.Float64()*100 < db.SlowPercent {
+		d *= 10
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		span.SetStatus(codes.Error, ctx.Err().Error())
+		return ctx.Err()
+	}
+	if rand.Float64()*100 < db.ErrorPercent {
+		err := fmt.Errorf("%s: deadlock detected", db.System)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Package load generates a service's self traffic following a pattern: a
+// constant rate shaped by a diurnal curve, step changes and random spikes.
+package load
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tick is how often the generator recomputes the rate.
+const tick = 100 * time.Millisecond
+
+// Generator calls a function at a rate varying over time. The base rate is
+// one call per Interval; each shape in Shapes multiplies it.
+type Generator struct {
+	Interval time.Duration
+	// Shapes are any of "constant", "diurnal", "step" and "spikes".
+	Shapes []string
+
+	// The diurnal shape is a sinusoid of Period, lowest at multiples of Period
+	// since the Unix epoch (midnight UTC for 24h), scaling the rate between
+	// 1-Amplitude and 1+Amplitude.
+	DiurnalPeriod    time.Duration
+	DiurnalAmplitude float64
+	// The step shape alternates the rate between 1 and StepFactor times
+	// every StepEvery.
+	StepEvery  time.Duration
+	StepFactor float64
+	// The spikes shape multiplies the rate by SpikeFactor for SpikeDuration,
+	// starting at random on average every SpikeEvery.
+	SpikeEvery    time.Duration
+	SpikeDuration time.Duration
+	SpikeFactor   float64
+}
+
+// FromEnv returns the generator of prefix: <prefix>_RATE, the interval
+// (default def), <prefix>_PATTERN, a comma-separated list of shapes
+// (default constant), and their parameters <prefix>_DIURNAL_PERIOD (24h),
+// <prefix>_DIURNAL_AMPLITUDE (0.5), <prefix>_STEP_EVERY (1h),
+// <prefix>_STEP_FACTOR (2), <prefix>_SPIKE_EVERY (30m),
+// <prefix>_SPIKE_DURATION (2m) and <prefix>_SPIKE_FACTOR (5).
+func FromEnv(prefix string, def time.Duration) *Generator {
+	g := &Generator{
+		Interval:         def,
+		Shapes:           []string{"constant"},
+		DiurnalPeriod:    24 * time.Hour,
+		DiurnalAmplitude: 0.5,
+		StepEvery:        time.Hour,
+		StepFactor:       2,
+		SpikeEvery:       30 * time.Minute,
+		SpikeDuration:    2 * time.Minute,
+		SpikeFactor:      5,
+	}
+	if v := os.Getenv(prefix + "_PATTERN"); v != "" {
+		g.Shapes = nil
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			switch s {
+			case "constant", "diurnal", "step", "spikes":
+				g.Shapes = append(g.Shapes, s)
+			default:
+				log.Fatalf("invalid %s_PATTERN shape %q", prefix, s)
+			}
+		}
+	}
+	for _, d := range []struct {
+		env string
+		d   *time.Duration
+	}{
+		{"_RATE", &g.Interval},
+		{"_DIURNAL_PERIOD", &g.DiurnalPeriod},
+		{"_STEP_EVERY", &g.StepEvery},
+		{"_SPIKE_EVERY", &g.SpikeEvery},
+		{"_SPIKE_DURATION", &g.SpikeDuration},
+	} {
+		if v := os.Getenv(prefix + d.env); v != "" {
+			x, err := time.ParseDuration(v)
+			if err != nil || x <= 0 {
+				log.Fatalf("invalid %s%s %q", prefix, d.env, v)
+			}
+			*d.d = x
+		}
+	}
+	for _, f := range []struct {
+		env string
+		f   *float64
+	}{
+		{"_DIURNAL_AMPLITUDE", &g.DiurnalAmplitude},
+		{"_STEP_FACTOR", &g.StepFactor},
+		{"_SPIKE_FACTOR", &g.SpikeFactor},
+	} {
+		if v := os.Getenv(prefix + f.env); v != "" {
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil || x < 0 {
+				log.Fatalf("invalid %s%s %q", prefix, f.env, v)
+			}
+			*f.f = x
+		}
+	}
+	if g.DiurnalAmplitude > 1 {
+		log.Fatalf("invalid %s_DIURNAL_AMPLITUDE %v: at most 1", prefix, g.DiurnalAmplitude)
+	}
+	return g
+}
+
+func (g *Generator) String() string {
+	var parts []string
+	for _, s := range g.Shapes {
+		switch s {
+		case "diurnal":
+			parts = append(parts, fmt.Sprintf("diurnal(period=%s amplitude=%g)", g.DiurnalPeriod, g.DiurnalAmplitude))
+		case "step":
+			parts = append(parts, fmt.Sprintf("step(every=%s factor=%g)", g.StepEvery, g.StepFactor))
+		case "spikes":
+			parts = append(parts, fmt.Sprintf("spikes(every=%s duration=%s factor=%g)", g.SpikeEvery, g.SpikeDuration, g.SpikeFactor))
+		default:
+			parts = append(parts, s)
+		}
+	}
+	return fmt.Sprintf("every %s, %s", g.Interval, strings.Join(parts, " * "))
+}
+
+// factor is the multiplier of the base rate at t, spiking or not.
+func (g *Generator) factor(t time.Time, spiking bool) float64 {
+	f := 1.0
+	for _, s := range g.Shapes {
+		switch s {
+		case "diurnal":
+			phase := float64(t.UnixNano()%int64(g.DiurnalPeriod)) / float64(g.DiurnalPeriod)
+			f *= 1 - g.DiurnalAmplitude*math.Cos(2*math.Pi*phase)
+		case "step":
+			if (t.UnixNano()/int64(g.StepEvery))%2 == 1 {
+				f *= g.StepFactor
+			}
+		case "spikes":
+			if spiking {
+				f *= g.SpikeFactor
+			}
+		}
+	}
+	return f
+}
+
+// Run calls fn at the generator's rate until ctx is done, each call in its
+// own goroutine so slow calls don't hold back the rate.
+func (g *Generator) Run(ctx context.Context, fn func()) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	spikes := false
+	for _, s := range g.Shapes {
+		spikes = spikes || s == "spikes"
+	}
+	var spikeEnd time.Time
+	credit := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if spikes && now.After(spikeEnd) && rand.Float64() < float64(tick)/float64(g.SpikeEvery) {
+				spikeEnd = now.Add(g.SpikeDuration)
+				log.Printf("load: spike of %s x%g", g.SpikeDuration, g.SpikeFactor)
+			}
+			credit += g.factor(now, now.Before(spikeEnd)) * float64(tick) / float64(g.Interval)
+			for ; credit >= 1; credit-- {
+				go fn()
+			}
+		}
+	}
+}
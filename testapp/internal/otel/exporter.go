@@ -0,0 +1,188 @@
+package otelx
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"google.golang.org/grpc/credentials"
+)
+
+// exporterConfig is how to reach the collector, from the standard OTLP
+// exporter variables:
+//   - OTEL_EXPORTER_OTLP_PROTOCOL: grpc (default) or http/protobuf
+//   - OTEL_EXPORTER_OTLP_INSECURE: plaintext, true unless a certificate is set
+//   - OTEL_EXPORTER_OTLP_CERTIFICATE: CA file verifying the collector
+//   - OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE and _CLIENT_KEY: client certificate
+//   - OTEL_EXPORTER_OTLP_HEADERS: k=v pairs, comma-separated, e.g. auth
+//   - OTEL_EXPORTER_OTLP_TIMEOUT: per export, milliseconds or a duration (10s)
+//
+// Exporters don't wait for the collector at startup; failed exports are
+// retried for up to a minute.
+type exporterConfig struct {
+	endpoint string
+	http     bool
+	insecure bool
+	tls      *tls.Config
+	headers  map[string]string
+	timeout  time.Duration
+}
+
+func newExporterConfig(endpoint string) (exporterConfig, error) {
+	c := exporterConfig{endpoint: endpoint, insecure: true, timeout: 10 * time.Second}
+	switch p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); p {
+	case "", "grpc":
+	case "http/protobuf":
+		c.http = true
+	default:
+		return c, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_PROTOCOL %q", p)
+	}
+	ca := os.Getenv("OTEL_EXPORTER_OTLP_CERTIFICATE")
+	cert, key := os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE"), os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_KEY")
+	if ca != "" || cert != "" {
+		c.insecure = false
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_INSECURE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_INSECURE %q", v)
+		}
+		c.insecure = b
+	}
+	if !c.insecure {
+		c.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+		if ca != "" {
+			pem, err := os.ReadFile(ca)
+			if err != nil {
+				return c, err
+			}
+			c.tls.RootCAs = x509.NewCertPool()
+			if !c.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return c, fmt.Errorf("no certificates in %s", ca)
+			}
+		}
+		if cert != "" || key != "" {
+			pair, err := tls.LoadX509KeyPair(cert, key)
+			if err != nil {
+				return c, err
+			}
+			c.tls.Certificates = []tls.Certificate{pair}
+		}
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+		c.headers = map[string]string{}
+		for _, kv := range strings.Split(v, ",") {
+			k, val, ok := strings.Cut(kv, "=")
+			if !ok || strings.TrimSpace(k) == "" {
+				return c, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q", kv)
+			}
+			c.headers[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if ms, merr := strconv.Atoi(v); merr == nil {
+			d, err = time.Duration(ms)*time.Millisecond, nil
+		}
+		if err != nil || d <= 0 {
+			return c, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_TIMEOUT %q", v)
+		}
+		c.timeout = d
+	}
+	return c, nil
+}
+
+func (c exporterConfig) traceExporter(ctx context.Context) (*otlptrace.Exporter, error) {
+	if c.http {
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(c.endpoint),
+			otlptracehttp.WithHeaders(c.headers),
+			otlptracehttp.WithTimeout(c.timeout),
+		}
+		if c.insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(c.tls))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	opts := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(c.endpoint),
+		otlptracegrpc.WithHeaders(c.headers),
+		otlptracegrpc.WithTimeout(c.timeout),
+	}
+	if c.insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(c.tls)))
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+func (c exporterConfig) metricExporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	if c.http {
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(c.endpoint),
+			otlpmetrichttp.WithHeaders(c.headers),
+			otlpmetrichttp.WithTimeout(c.timeout),
+		}
+		if c.insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(c.tls))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(c.endpoint),
+		otlpmetricgrpc.WithHeaders(c.headers),
+		otlpmetricgrpc.WithTimeout(c.timeout),
+	}
+	if c.insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	} else {
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(c.tls)))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// logExporter always speaks OTLP/HTTP: with the grpc protocol, on port 4318
+// of the endpoint's host unless OTEL_EXPORTER_OTLP_LOGS_ENDPOINT is set.
+func (c exporterConfig) logExporter(ctx context.Context) (sdklog.Exporter, error) {
+	opts := []otlploghttp.Option{
+		otlploghttp.WithHeaders(c.headers),
+		otlploghttp.WithTimeout(c.timeout),
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT") == "" {
+		endpoint := c.endpoint
+		if !c.http {
+			host, _, err := net.SplitHostPort(endpoint)
+			if err != nil {
+				host = endpoint
+			}
+			endpoint = net.JoinHostPort(host, "4318")
+		}
+		opts = append(opts, otlploghttp.WithEndpoint(endpoint))
+		if c.insecure {
+			opts = append(opts, otlploghttp.WithInsecure())
+		}
+	}
+	if !c.insecure {
+		opts = append(opts, otlploghttp.WithTLSClientConfig(c.tls))
+	}
+	return otlploghttp.New(ctx, opts...)
+}
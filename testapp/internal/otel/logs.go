@@ -0,0 +1,127 @@
+package otelx
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	apitrace "go.opentelemetry.io/otel/trace"
+)
+
+// NewLoggerProvider returns a LoggerProvider of serviceName exporting to the OTEL
+// collector over OTLP/HTTP, on port 4318 of the endpoint's host unless the
+// protocol is already http/protobuf or OTEL_EXPORTER_OTLP_LOGS_ENDPOINT is set.
+func NewLoggerProvider(ctx context.Context, serviceName, endpoint string) (*sdklog.LoggerProvider, error) {
+	cfg, err := newExporterConfig(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := cfg.logExporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResource(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exp)),
+		sdklog.WithResource(res),
+	), nil
+}
+
+// NewSlogHandler returns an slog.Handler emitting records to the logger name of
+// lp, with the trace context of the record's context, and passing them on to
+// next with trace_id and span_id attributes.
+func NewSlogHandler(lp log.LoggerProvider, name string, next slog.Handler) slog.Handler {
+	return &slogHandler{logger: lp.Logger(name), next: next}
+}
+
+type slogHandler struct {
+	logger log.Logger
+	next   slog.Handler
+	// attrs of WithAttrs, keys prefixed with the groups then open
+	attrs  []log.KeyValue
+	prefix string
+}
+
+func (h *slogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var rec log.Record
+	rec.SetTimestamp(r.Time)
+	// slog's Debug, Info, Warn and Error are 4 apart from -4, like the OTel
+	// severities from 5
+	rec.SetSeverity(log.Severity(int(r.Level) + 9))
+	rec.SetSeverityText(r.Level.String())
+	rec.SetBody(log.StringValue(r.Message))
+	rec.AddAttributes(h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		rec.AddAttributes(convertAttr(h.prefix, a)...)
+		return true
+	})
+	h.logger.Emit(ctx, rec)
+
+	if sc := apitrace.SpanContextFromContext(ctx); sc.IsValid() {
+		r = r.Clone()
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append([]log.KeyValue(nil), h.attrs...)
+	for _, a := range attrs {
+		c.attrs = append(c.attrs, convertAttr(h.prefix, a)...)
+	}
+	c.next = h.next.WithAttrs(attrs)
+	return &c
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "."
+	c.next = h.next.WithGroup(name)
+	return &c
+}
+
+// convertAttr flattens an slog attribute into OTel attributes, groups
+// becoming key prefixes.
+func convertAttr(prefix string, a slog.Attr) []log.KeyValue {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		p := prefix
+		if a.Key != "" {
+			p += a.Key + "."
+		}
+		var out []log.KeyValue
+		for _, g := range v.Group() {
+			out = append(out, convertAttr(p, g)...)
+		}
+		return out
+	}
+	if a.Key == "" {
+		return nil
+	}
+	key := prefix + a.Key
+	switch v.Kind() {
+	case slog.KindBool:
+		return []log.KeyValue{log.Bool(key, v.Bool())}
+	case slog.KindInt64:
+		return []log.KeyValue{log.Int64(key, v.Int64())}
+	case slog.KindUint64:
+		return []log.KeyValue{log.Int64(key, int64(v.Uint64()))}
+	case slog.KindFloat64:
+		return []log.KeyValue{log.Float64(key, v.Float64())}
+	}
+	return []log.KeyValue{log.String(key, v.String())}
+}
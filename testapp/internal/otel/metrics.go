@@ -0,0 +1,90 @@
+package otelx
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// NewMeterProvider returns a MeterProvider of serviceName exporting to the OTEL
+// collector at endpoint, by default every minute (OTEL_METRIC_EXPORT_INTERVAL).
+// otelhttp records its request duration and size histograms with the global one.
+func NewMeterProvider(ctx context.Context, serviceName, endpoint string) (*sdkmetric.MeterProvider, error) {
+	cfg, err := newExporterConfig(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := cfg.metricExporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResource(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp)),
+		sdkmetric.WithResource(res),
+	), nil
+}
+
+// Request counters by peer.service, method and status code, on the global
+// MeterProvider once Init has set it.
+var serverRequests, clientRequests = func() (metric.Int64Counter, metric.Int64Counter) {
+	meter := otel.Meter("testapp/internal/otel")
+	server, _ := meter.Int64Counter("http.server.requests",
+		metric.WithDescription("HTTP requests served"), metric.WithUnit("{request}"))
+	client, _ := meter.Int64Counter("http.client.requests",
+		metric.WithDescription("HTTP requests made"), metric.WithUnit("{request}"))
+	return server, client
+}()
+
+// WithRequestMetrics wraps an http.Handler, counting its requests by caller
+// (X-Peer-Service), method and status code.
+func WithRequestMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		peer := r.Header.Get("X-Peer-Service")
+		if i := strings.Index(peer, ":"); i > 0 {
+			peer = peer[:i]
+		}
+		serverRequests.Add(r.Context(), 1, metric.WithAttributes(
+			attribute.String("peer.service", peer),
+			attribute.String("http.request.method", r.Method),
+			attribute.Int("http.response.status_code", sw.status),
+		))
+	})
+}
+
+// countClientRequest counts a request to target; resp is nil if it failed.
+func countClientRequest(r *http.Request, target string, resp *http.Response) {
+	attrs := []attribute.KeyValue{
+		attribute.String("peer.service", target),
+		attribute.String("http.request.method", r.Method),
+	}
+	if resp != nil {
+		attrs = append(attrs, attribute.Int("http.response.status_code", resp.StatusCode))
+	} else {
+		attrs = append(attrs, attribute.String("error.type", "transport"))
+	}
+	clientRequests.Add(r.Context(), 1, metric.WithAttributes(attrs...))
+}
+
+// statusWriter records the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -2,63 +2,166 @@ package otelx
 
 import (
 	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
 	"strings"
 	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/log/global"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	apitrace "go.opentelemetry.io/otel/trace"
-	"google.golang.org/grpc"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-// Init configures a global TracerProvider exporting to the OTEL collector at endpoint.
-// endpoint example: "localhost:4317" or "otel-collector:4317"
+// Init configures a global TracerProvider, MeterProvider and LoggerProvider exporting
+// to the OTEL collector at endpoint, and a default slog logger writing JSON to stderr
+// and to the LoggerProvider. The log package then writes through it too.
+// endpoint example: "localhost:4317" or "otel-collector:4317", or port 4318 with
+// OTEL_EXPORTER_OTLP_PROTOCOL=http/protobuf; see exporterConfig for TLS and headers.
 func Init(ctx context.Context, serviceName, endpoint string) (func(context.Context) error, error) {
-	exp, err := otlptracegrpc.New(ctx,
-		otlptracegrpc.WithEndpoint(endpoint),
-		otlptracegrpc.WithInsecure(),
-		otlptracegrpc.WithDialOption(grpc.WithBlock()),
-	)
+	tp, err := NewTracerProvider(ctx, serviceName, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	mp, err := NewMeterProvider(ctx, serviceName, endpoint)
 	if err != nil {
 		return nil, err
 	}
+	lp, err := NewLoggerProvider(ctx, serviceName, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	global.SetLoggerProvider(lp)
+	slog.SetDefault(slog.New(NewSlogHandler(lp, serviceName, slog.NewJSONHandler(os.Stderr, nil))))
+	// Ensure W3C TraceContext and Baggage are used for propagation across HTTP boundaries.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
 
-	res, err := resource.New(ctx,
-		resource.WithAttributes(
-			attribute.String("service.name", serviceName),
-		),
-	)
+	// The SDK reports failed exports through log, which now leads back to
+	// the LoggerProvider; keep its errors on stderr.
+	stderr := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		stderr.Error("opentelemetry", "error", err)
+	}))
+
+	// The returned function flushes what is buffered, then shuts down.
+	return func(ctx context.Context) error {
+		return errors.Join(
+			tp.ForceFlush(ctx), mp.ForceFlush(ctx), lp.ForceFlush(ctx),
+			tp.Shutdown(ctx), mp.Shutdown(ctx), lp.Shutdown(ctx),
+		)
+	}, nil
+}
+
+// NewTracerProvider returns a TracerProvider of serviceName exporting to the OTEL
+// collector at endpoint, for a process hosting more than one service. Spans
+// carry the tenant.id of their baggage, see WithTenant.
+func NewTracerProvider(ctx context.Context, serviceName, endpoint string) (*sdktrace.TracerProvider, error) {
+	cfg, err := newExporterConfig(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := cfg.traceExporter(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	tp := sdktrace.NewTracerProvider(
+	res, err := newResource(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(tenantProcessor{}),
 		sdktrace.WithBatcher(exp,
 			sdktrace.WithBatchTimeout(500*time.Millisecond),
 			sdktrace.WithMaxExportBatchSize(1024),
 		),
 		sdktrace.WithResource(res),
+	), nil
+}
+
+// newResource describes serviceName: service.version from SERVICE_VERSION (default
+// the VCS revision of the build, else "dev"), deployment.environment from
+// DEPLOYMENT_ENVIRONMENT (default "dev"), the host and container, and
+// OTEL_RESOURCE_ATTRIBUTES, which overrides all but service.name.
+func newResource(ctx context.Context, serviceName string) (*resource.Resource, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.version", getenv("SERVICE_VERSION", buildVersion())),
+			attribute.String("deployment.environment", getenv("DEPLOYMENT_ENVIRONMENT", "dev")),
+		),
+		resource.WithHost(),
+		resource.WithContainer(),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+		resource.WithAttributes(
+			attribute.String("service.name", serviceName),
+		),
 	)
-	otel.SetTracerProvider(tp)
-	// Ensure W3C TraceContext and Baggage are used for propagation across HTTP boundaries.
-	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
-		propagation.TraceContext{},
-		propagation.Baggage{},
-	))
+	// Detectors failing, e.g. outside a container, leave the rest
+	if errors.Is(err, resource.ErrPartialResource) {
+		err = nil
+	}
+	return res, err
+}
+
+// buildVersion is the short VCS revision the binary was built from, or "dev".
+func buildVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				return s.Value[:12]
+			}
+		}
+	}
+	return "dev"
+}
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
 
-	return tp.Shutdown, nil
+// transport is shared by the clients of NewHTTPClient, so they reuse kept-alive
+// connections; the default two idle connections per host would make load
+// bursts and fan-outs dial anew.
+var transport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          256,
+	MaxIdleConnsPerHost:   64,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   5 * time.Second,
+	ExpectContinueTimeout: time.Second,
 }
 
 // NewHTTPClient returns an http.Client instrumented with otelhttp transport and
 // automatically injects X-Peer-Service header with the caller's service name.
-func NewHTTPClient(callerService string) http.Client {
+// opts are passed to otelhttp, e.g. the TracerProvider of callerService.
+// Requests time out after HTTP_CLIENT_TIMEOUT (10s), body included.
+func NewHTTPClient(callerService string, opts ...otelhttp.Option) *http.Client {
 	// Inner transport runs AFTER otelhttp starts the client span, so we can annotate it.
 	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
 		// clone request to avoid mutating shared headers in rare cases
@@ -74,10 +177,19 @@ func NewHTTPClient(callerService string) http.Client {
 		if span := apitrace.SpanFromContext(r.Context()); span != nil {
 			span.SetAttributes(attribute.String("peer.service", target))
 		}
-		return http.DefaultTransport.RoundTrip(r)
+		resp, err := transport.RoundTrip(r)
+		countClientRequest(r, target, resp)
+		if err == nil {
+			resp.Body = drainingBody{resp.Body}
+		}
+		return resp, err
 	})
+	timeout, err := time.ParseDuration(getenv("HTTP_CLIENT_TIMEOUT", "10s"))
+	if err != nil || timeout < 0 {
+		log.Fatalf("invalid HTTP_CLIENT_TIMEOUT %q", os.Getenv("HTTP_CLIENT_TIMEOUT"))
+	}
 	// Instrument with otelhttp, which will create the client span and inject trace headers.
-	return http.Client{Transport: otelhttp.NewTransport(inner)}
+	return &http.Client{Transport: otelhttp.NewTransport(inner, opts...), Timeout: timeout}
 }
 
 // WithPeerServiceAttribute wraps an http.Handler and, if X-Peer-Service header is present,
@@ -98,6 +210,15 @@ func WithPeerServiceAttribute(next http.Handler) http.Handler {
 	})
 }
 
+// drainingBody reads what is left of a response, up to 64KiB, when closed, so
+// its connection goes back to the pool rather than being closed.
+type drainingBody struct{ io.ReadCloser }
+
+func (b drainingBody) Close() error {
+	_, _ = io.CopyN(io.Discard, b.ReadCloser, 64<<10)
+	return b.ReadCloser.Close()
+}
+
 // roundTripperFunc allows using a function as an http.RoundTripper.
 type roundTripperFunc func(*http.Request) (*http.Response, error)
 
@@ -0,0 +1,36 @@
+package otelx
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout bounds draining requests in flight, then flushing telemetry.
+const shutdownTimeout = 10 * time.Second
+
+// ListenAndServe serves handler on addr until ctx is done, e.g. on SIGTERM,
+// then stops accepting connections, waits for requests in flight and runs
+// flush, the function returned by Init, so a short run still delivers all
+// its telemetry. Flush errors are only logged.
+func ListenAndServe(ctx context.Context, addr string, handler http.Handler, flush func(context.Context) error) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		log.Printf("shutting down %s", addr)
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err == nil {
+		err = srv.Shutdown(sctx)
+	}
+	if ferr := flush(sctx); ferr != nil {
+		log.Printf("flushing telemetry: %v", ferr)
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package otelx
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// TenantKey is the baggage member naming the tenant a request is served for,
+// copied to the tenant.id attribute of every span started under it.
+const TenantKey = "tenant.id"
+
+// WithTenant returns ctx with tenant in its baggage, propagated to every
+// service the request reaches.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	m, err := baggage.NewMemberRaw(TenantKey, tenant)
+	if err != nil {
+		return ctx
+	}
+	b, err := baggage.FromContext(ctx).SetMember(m)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, b)
+}
+
+// Tenants are synthetic tenants; earlier ones get more traffic.
+type Tenants []string
+
+// TenantsFromEnv returns the comma-separated TENANTS, by default acme, globex,
+// initech and umbrella.
+func TenantsFromEnv() Tenants {
+	var t Tenants
+	for _, s := range strings.Split(getenv("TENANTS", "acme,globex,initech,umbrella"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			t = append(t, s)
+		}
+	}
+	return t
+}
+
+// Pick returns a tenant, the i-th with weight 1/(i+1), or "" if there are none.
+func (t Tenants) Pick() string {
+	var total float64
+	for i := range t {
+		total += 1 / float64(i+1)
+	}
+	x := rand.Float64() * total
+	for i, s := range t {
+		if x -= 1 / float64(i+1); x < 0 {
+			return s
+		}
+	}
+	return ""
+}
+
+// tenantProcessor stamps spans with the tenant of their context's baggage.
+type tenantProcessor struct{}
+
+func (tenantProcessor) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	if v := baggage.FromContext(ctx).Member(TenantKey).Value(); v != "" {
+		s.SetAttributes(attribute.String(TenantKey, v))
+	}
+}
+
+func (tenantProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (tenantProcessor) Shutdown(context.Context) error   { return nil }
+func (tenantProcessor) ForceFlush(context.Context) error { return nil }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"testapp/internal/load"
+	otelx "testapp/internal/otel"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	apitrace "go.opentelemetry.io/otel/trace"
+)
+
+// message is a queued message; headers carry the trace context.
+type message struct {
+	headers map[string]string
+	body    []byte
+}
+
+// queue is the broker between producer and consumer: in memory, or NATS
+// with MESSAGING_NATS_URL.
+type queue interface {
+	system() string
+	publish(ctx context.Context, m message) error
+	subscribe(fn func(message)) error
+}
+
+type memQueue chan message
+
+func (q memQueue) system() string { return "inmemory" }
+
+func (q memQueue) publish(ctx context.Context, m message) error {
+	select {
+	case q <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return fmt.Errorf("queue full")
+	}
+}
+
+func (q memQueue) subscribe(fn func(message)) error {
+	go func() {
+		for m := range q {
+			fn(m)
+		}
+	}()
+	return nil
+}
+
+type natsQueue struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (q natsQueue) system() string { return "nats" }
+
+func (q natsQueue) publish(_ context.Context, m message) error {
+	msg := nats.NewMsg(q.subject)
+	for k, v := range m.headers {
+		msg.Header.Set(k, v)
+	}
+	msg.Data = m.body
+	return q.conn.PublishMsg(msg)
+}
+
+func (q natsQueue) subscribe(fn func(message)) error {
+	_, err := q.conn.Subscribe(q.subject, func(msg *nats.Msg) {
+		m := message{headers: map[string]string{}, body: msg.Data}
+		for k := range msg.Header {
+			m.headers[k] = msg.Header.Get(k)
+		}
+		fn(m)
+	})
+	return err
+}
+
+func main() {
+	// Publishing stops on SIGTERM, then the deferred shutdowns flush the spans.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	endpoint := getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "otel-collector:4317")
+	// Producer and consumer are two services in one process, so the
+	// in-memory queue can connect them.
+	producerTP, err := otelx.NewTracerProvider(ctx, "orders-producer", endpoint)
+	if err != nil {
+		log.Fatalf("failed to init otel: %v", err)
+	}
+	defer func() { _ = producerTP.Shutdown(context.Background()) }()
+	consumerTP, err := otelx.NewTracerProvider(ctx, "orders-consumer", endpoint)
+	if err != nil {
+		log.Fatalf("failed to init otel: %v", err)
+	}
+	defer func() { _ = consumerTP.Shutdown(context.Background()) }()
+	// Only the consumer makes HTTP calls, so its meters are the global ones.
+	consumerMP, err := otelx.NewMeterProvider(ctx, "orders-consumer", endpoint)
+	if err != nil {
+		log.Fatalf("failed to init otel: %v", err)
+	}
+	defer func() { _ = consumerMP.Shutdown(context.Background()) }()
+	otel.SetMeterProvider(consumerMP)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	subject := getenv("MESSAGING_SUBJECT", "orders")
+	var q queue = make(memQueue, 1024)
+	if url := os.Getenv("MESSAGING_NATS_URL"); url != "" {
+		conn, err := nats.Connect(url, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+		if err != nil {
+			log.Fatalf("failed to connect to nats: %v", err)
+		}
+		defer conn.Close()
+		q = natsQueue{conn: conn, subject: subject}
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.system", q.system()),
+		attribute.String("messaging.destination.name", subject),
+		// The peer of either side is the queue, not the other service.
+		attribute.String("peer.service", subject),
+	}
+
+	batchSize := 10
+	if v := os.Getenv("CONSUMER_BATCH_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			batchSize = n
+		}
+	}
+	batchWait := getDurationEnv("CONSUMER_BATCH_WAIT", time.Second)
+	batches := make(chan message, batchSize)
+	if err := q.subscribe(func(m message) { batches <- m }); err != nil {
+		log.Fatalf("failed to subscribe: %v", err)
+	}
+	go consume(consumerTP, batches, subject, batchSize, batchWait, attrs)
+
+	gen := load.FromEnv("PRODUCER", 5*time.Second)
+	log.Printf("orders-producer on %s %q, traffic: %s", q.system(), subject, gen)
+	tr := producerTP.Tracer("orders-producer")
+	tenants := otelx.TenantsFromEnv()
+	var n atomic.Int64
+	gen.Run(ctx, func() {
+		ctx, span := tr.Start(otelx.WithTenant(ctx, tenants.Pick()), subject+" publish",
+			apitrace.WithSpanKind(apitrace.SpanKindProducer),
+			apitrace.WithAttributes(append(attrs, attribute.String("messaging.operation", "publish"))...),
+		)
+		defer span.End()
+		m := message{headers: map[string]string{}, body: []byte(fmt.Sprintf("order %d", n.Add(1)))}
+		otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(m.headers))
+		if err := q.publish(ctx, m); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	})
+	log.Printf("orders-producer shutting down")
+}
+
+// consume receives messages as consumer spans, children of their producer
+// spans, and processes them in batches of up to size, or what arrived within
+// wait, each batch a new trace linked to the producer spans of its messages.
+func consume(tp apitrace.TracerProvider, in <-chan message, subject string, size int, wait time.Duration, attrs []attribute.KeyValue) {
+	tr := tp.Tracer("orders-consumer")
+	client := otelx.NewHTTPClient("orders-consumer", otelhttp.WithTracerProvider(tp))
+	dURL := getenv("SERVICE_D_URL", "http://service-d:8083/do")
+	for {
+		var links []apitrace.Link
+		timeout := time.After(wait)
+	collect:
+		for len(links) < size {
+			select {
+			case m := <-in:
+				ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(m.headers))
+				_, span := tr.Start(ctx, subject+" receive",
+					apitrace.WithSpanKind(apitrace.SpanKindConsumer),
+					apitrace.WithAttributes(append(attrs, attribute.String("messaging.operation", "receive"))...),
+				)
+				span.End()
+				links = append(links, apitrace.Link{SpanContext: apitrace.SpanContextFromContext(ctx)})
+			case <-timeout:
+				break collect
+			}
+		}
+		if len(links) == 0 {
+			continue
+		}
+		ctx, span := tr.Start(context.Background(), subject+" process",
+			apitrace.WithNewRoot(),
+			apitrace.WithLinks(links...),
+			apitrace.WithAttributes(attribute.Int("messaging.batch.message_count", len(links))),
+		)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, dURL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				err = fmt.Errorf("service-d: %s", resp.Status)
+			}
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func getenv(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+func getDurationEnv(k string, def time.Duration) time.Duration {
+	if v := os.Getenv(k); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// retrier GETs a URL, retrying transport errors, 429 and 5xx up to retries
+// times with exponential backoff and jitter, or after Retry-After.
+type retrier struct {
+	client  *http.Client
+	retries int
+	backoff time.Duration
+}
+
+// maxRetryAfter caps the wait a Retry-After header asks for.
+const maxRetryAfter = 5 * time.Second
+
+// get returns the last status, zero on a transport error, and the attempts
+// made. Each attempt is its own client span.
+func (rt retrier) get(ctx context.Context, url string) (int, int, error) {
+	var status int
+	var err error
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err = rt.client.Do(req)
+		status = 0
+		wait := rt.backoff << attempt
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait)))
+		if err == nil {
+			resp.Body.Close()
+			status = resp.StatusCode
+			if status < 500 && status != http.StatusTooManyRequests {
+				return status, attempt + 1, nil
+			}
+			err = fmt.Errorf("%s", resp.Status)
+			if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+				wait = min(time.Duration(s)*time.Second, maxRetryAfter)
+			}
+		}
+		if attempt == rt.retries {
+			return status, attempt + 1, err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return status, attempt + 1, ctx.Err()
+		}
+	}
+}
+
+// fanout calls every target concurrently with retries, failing with a 502
+// if any call failed for good.
+func fanout(rt retrier, targets map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tr := otel.Tracer("service-a")
+		ctx, span := tr.Start(r.Context(), "handle /fanout")
+		defer span.End()
+
+		var mu sync.Mutex
+		var failed []string
+		var wg sync.WaitGroup
+		for name, url := range targets {
+			wg.Add(1)
+			go func(name, url string) {
+				defer wg.Done()
+				ctx, span := tr.Start(ctx, "call "+name)
+				defer span.End()
+				status, attempts, err := rt.get(ctx, url)
+				span.SetAttributes(
+					attribute.String("fanout.target", name),
+					attribute.Int("retry.attempts", attempts),
+				)
+				if err != nil {
+					span.SetStatus(codes.Error, err.Error())
+					slog.WarnContext(ctx, "fan-out call failed", "target", name, "status", status, "attempts", attempts, "error", err)
+					mu.Lock()
+					failed = append(failed, name)
+					mu.Unlock()
+					return
+				}
+				if attempts > 1 {
+					slog.InfoContext(ctx, "fan-out call retried", "target", name, "status", status, "attempts", attempts)
+				}
+			}(name, url)
+		}
+		wg.Wait()
+		if len(failed) > 0 {
+			http.Error(w, fmt.Sprintf("fan-out failed for %v", failed), http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("service-a -> service-b, service-c, service-d OK"))
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"testapp/internal/chaos"
+	"testapp/internal/load"
 	otelx "testapp/internal/otel"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -15,45 +21,80 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	endpoint := getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "otel-collector:4317")
 	shutdown, err := otelx.Init(ctx, "service-a", endpoint)
 	if err != nil {
 		log.Fatalf("failed to init otel: %v", err)
 	}
-	defer func() { _ = shutdown(context.Background()) }()
 
+	client := otelx.NewHTTPClient("service-a")
 	mux := http.NewServeMux()
 	mux.HandleFunc("/call", func(w http.ResponseWriter, r *http.Request) {
 		tr := otel.Tracer("service-a")
 		ctx, span := tr.Start(r.Context(), "handle /call")
 		defer span.End()
 
-		client := otelx.NewHTTPClient("service-a")
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, getenv("SERVICE_B_URL", "http://service-b:8081/hello"), nil)
 		resp, err := client.Do(req)
 		if err != nil {
+			slog.ErrorContext(ctx, "calling service-b failed", "error", err)
 			http.Error(w, fmt.Sprintf("error calling service-b: %v", err), http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
+		level := slog.LevelInfo
+		if resp.StatusCode >= 500 {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "called service-b", "status", resp.StatusCode)
 		_, _ = w.Write([]byte("service-a -> service-b OK"))
 	})
 
-	// Periodic traffic generator to produce ~5 tx/min (default every 12s)
-	go func() {
-		rate := getDurationEnv("SERVICE_A_RATE", 12*time.Second)
-		ticker := time.NewTicker(rate)
-		defer ticker.Stop()
-		client := otelx.NewHTTPClient("service-a")
-		for range ticker.C {
-			_, _ = client.Get("http://localhost:8080/call")
-		}
-	}()
+	retries, err := strconv.Atoi(getenv("SERVICE_A_RETRIES", "2"))
+	if err != nil || retries < 0 {
+		log.Fatalf("invalid SERVICE_A_RETRIES %q", os.Getenv("SERVICE_A_RETRIES"))
+	}
+	backoff, err := time.ParseDuration(getenv("SERVICE_A_RETRY_BACKOFF", "100ms"))
+	if err != nil || backoff <= 0 {
+		log.Fatalf("invalid SERVICE_A_RETRY_BACKOFF %q", os.Getenv("SERVICE_A_RETRY_BACKOFF"))
+	}
+	mux.HandleFunc("/fanout", fanout(retrier{client: client, retries: retries, backoff: backoff}, map[string]string{
+		"service-b": getenv("SERVICE_B_URL", "http://service-b:8081/hello"),
+		"service-c": getenv("SERVICE_C_URL", "http://service-c:8082/work"),
+		"service-d": getenv("SERVICE_D_URL", "http://service-d:8083/do"),
+	}))
 
-	handler := otelhttp.NewHandler(otelx.WithPeerServiceAttribute(mux), "service-a-server")
+	// Self traffic, by default one request every 12s to /call and every 30s
+	// to /fanout; see internal/load. Each request is for one of TENANTS.
+	tenants := otelx.TenantsFromEnv()
+	for _, t := range []struct {
+		path string
+		gen  *load.Generator
+	}{
+		{"/call", load.FromEnv("SERVICE_A", 12*time.Second)},
+		{"/fanout", load.FromEnv("SERVICE_A_FANOUT", 30*time.Second)},
+	} {
+		log.Printf("service-a %s traffic: %s", t.path, t.gen)
+		go func() {
+			t.gen.Run(ctx, func() {
+				req, _ := http.NewRequestWithContext(otelx.WithTenant(ctx, tenants.Pick()), http.MethodGet, "http://localhost:8080"+t.path, nil)
+				if resp, err := client.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			})
+		}()
+	}
+
+	faults := chaos.FromEnv()
+	handler := http.NewServeMux()
+	handler.Handle("/chaos", faults.Handler())
+	handler.Handle("/", otelhttp.NewHandler(otelx.WithPeerServiceAttribute(otelx.WithRequestMetrics(faults.Middleware(mux))), "service-a-server"))
 	log.Println("service-a listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	if err := otelx.ListenAndServe(ctx, ":8080", handler, shutdown); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func getenv(k, def string) string {
@@ -62,12 +103,3 @@ func getenv(k, def string) string {
 	}
 	return def
 }
-
-func getDurationEnv(k string, def time.Duration) time.Duration {
-	if v := os.Getenv(k); v != "" {
-		if d, err := time.ParseDuration(v); err == nil {
-			return d
-		}
-	}
-	return def
-}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"testapp/internal/chaos"
+	"testapp/internal/load"
 	otelx "testapp/internal/otel"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -15,14 +20,15 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	endpoint := getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "otel-collector:4317")
 	shutdown, err := otelx.Init(ctx, "service-b", endpoint)
 	if err != nil {
 		log.Fatalf("failed to init otel: %v", err)
 	}
-	defer func() { _ = shutdown(context.Background()) }()
 
+	client := otelx.NewHTTPClient("service-b")
 	mux := http.NewServeMux()
 	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
 		tr := otel.Tracer("service-b")
@@ -30,31 +36,41 @@ func main() {
 		defer span.End()
 
 		// Call service-c for further processing
-		client := otelx.NewHTTPClient("service-b")
 		cURL := getenv("SERVICE_C_URL", "http://service-c:8082/work")
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, cURL, nil)
 		resp, err := client.Do(req)
 		if err != nil {
+			slog.ErrorContext(ctx, "calling service-c failed", "error", err)
 			http.Error(w, fmt.Sprintf("error calling service-c: %v", err), http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
+		level := slog.LevelInfo
+		if resp.StatusCode >= 500 {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "called service-c", "status", resp.StatusCode)
 		fmt.Fprintln(w, "hello from service-b -> service-c")
 	})
 
-	handler := otelhttp.NewHandler(otelx.WithPeerServiceAttribute(mux), "service-b-server")
+	faults := chaos.FromEnv()
+	handler := http.NewServeMux()
+	handler.Handle("/chaos", faults.Handler())
+	handler.Handle("/", otelhttp.NewHandler(otelx.WithPeerServiceAttribute(otelx.WithRequestMetrics(faults.Middleware(mux))), "service-b-server"))
 	log.Println("service-b listening on :8081")
-	// Periodic self-hit to generate server spans ~5/min
+	// Self traffic, by default one request every 12s; see internal/load
+	gen := load.FromEnv("SERVICE_B", 12*time.Second)
+	log.Printf("service-b traffic: %s", gen)
 	go func() {
-		rate := getDurationEnv("SERVICE_B_RATE", 12*time.Second)
-		ticker := time.NewTicker(rate)
-		defer ticker.Stop()
-		client := otelx.NewHTTPClient("service-b")
-		for range ticker.C {
-			_, _ = client.Get("http://localhost:8081/hello")
-		}
+		gen.Run(ctx, func() {
+			if resp, err := client.Get("http://localhost:8081/hello"); err == nil {
+				resp.Body.Close()
+			}
+		})
 	}()
-	log.Fatal(http.ListenAndServe(":8081", handler))
+	if err := otelx.ListenAndServe(ctx, ":8081", handler, shutdown); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func getenv(k, def string) string {
@@ -63,12 +79,3 @@ func getenv(k, def string) string {
 	}
 	return def
 }
-
-func getDurationEnv(k string, def time.Duration) time.Duration {
-	if v := os.Getenv(k); v != "" {
-		if d, err := time.ParseDuration(v); err == nil {
-			return d
-		}
-	}
-	return def
-}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"testapp/internal/chaos"
+	"testapp/internal/load"
 	otelx "testapp/internal/otel"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -15,14 +20,15 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	endpoint := getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "otel-collector:4317")
 	shutdown, err := otelx.Init(ctx, "service-c", endpoint)
 	if err != nil {
 		log.Fatalf("failed to init otel: %v", err)
 	}
-	defer func() { _ = shutdown(context.Background()) }()
 
+	client := otelx.NewHTTPClient("service-c")
 	mux := http.NewServeMux()
 	mux.HandleFunc("/work", func(w http.ResponseWriter, r *http.Request) {
 		tr := otel.Tracer("service-c")
@@ -30,32 +36,42 @@ func main() {
 		defer span.End()
 
 		// Call service-d to perform deeper nested work
-		client := otelx.NewHTTPClient("service-c")
 		dURL := getenv("SERVICE_D_URL", "http://service-d:8083/do")
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, dURL, nil)
 		resp, err := client.Do(req)
 		if err != nil {
+			slog.ErrorContext(ctx, "calling service-d failed", "error", err)
 			http.Error(w, fmt.Sprintf("error calling service-d: %v", err), http.StatusBadGateway)
 			return
 		}
 		defer resp.Body.Close()
+		level := slog.LevelInfo
+		if resp.StatusCode >= 500 {
+			level = slog.LevelWarn
+		}
+		slog.Log(ctx, level, "called service-d", "status", resp.StatusCode)
 		_, _ = w.Write([]byte("service-c -> service-d OK"))
 	})
 
-	// Optional periodic traffic to generate standalone traces
+	// Self traffic, by default one request every 25s; see internal/load
+	gen := load.FromEnv("SERVICE_C", 25*time.Second)
+	log.Printf("service-c traffic: %s", gen)
 	go func() {
-		rate := getDurationEnv("SERVICE_C_RATE", 25*time.Second)
-		ticker := time.NewTicker(rate)
-		defer ticker.Stop()
-		client := otelx.NewHTTPClient("service-c")
-		for range ticker.C {
-			_, _ = client.Get("http://localhost:8082/work")
-		}
+		gen.Run(ctx, func() {
+			if resp, err := client.Get("http://localhost:8082/work"); err == nil {
+				resp.Body.Close()
+			}
+		})
 	}()
 
-	handler := otelhttp.NewHandler(otelx.WithPeerServiceAttribute(mux), "service-c-server")
+	faults := chaos.FromEnv()
+	handler := http.NewServeMux()
+	handler.Handle("/chaos", faults.Handler())
+	handler.Handle("/", otelhttp.NewHandler(otelx.WithPeerServiceAttribute(otelx.WithRequestMetrics(faults.Middleware(mux))), "service-c-server"))
 	log.Println("service-c listening on :8082")
-	log.Fatal(http.ListenAndServe(":8082", handler))
+	if err := otelx.ListenAndServe(ctx, ":8082", handler, shutdown); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func getenv(k, def string) string {
@@ -64,12 +80,3 @@ func getenv(k, def string) string {
 	}
 	return def
 }
-
-func getDurationEnv(k string, def time.Duration) time.Duration {
-	if v := os.Getenv(k); v != "" {
-		if d, err := time.ParseDuration(v); err == nil {
-			return d
-		}
-	}
-	return def
-}
@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"testapp/internal/chaos"
+	"testapp/internal/fakedb"
 	otelx "testapp/internal/otel"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -15,27 +20,47 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	endpoint := getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "otel-collector:4317")
 	shutdown, err := otelx.Init(ctx, "service-d", endpoint)
 	if err != nil {
 		log.Fatalf("failed to init otel: %v", err)
 	}
-	defer func() { _ = shutdown(context.Background()) }()
 
+	db := fakedb.FromEnv()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/do", func(w http.ResponseWriter, r *http.Request) {
 		tr := otel.Tracer("service-d")
-		_, span := tr.Start(r.Context(), "service-d do work")
+		ctx, span := tr.Start(r.Context(), "service-d do work")
 		defer span.End()
+		// Read an order and now and then update it
+		if err := db.Query(ctx, "orders", "SELECT id, status FROM orders WHERE id = ?"); err != nil {
+			slog.ErrorContext(ctx, "query failed", "table", "orders", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rand.Intn(3) == 0 {
+			if err := db.Query(ctx, "orders", "UPDATE orders SET status = ? WHERE id = ?"); err != nil {
+				slog.ErrorContext(ctx, "query failed", "table", "orders", "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 		// Simulate variable work
 		time.Sleep(time.Duration(50+rand.Intn(100)) * time.Millisecond)
+		slog.InfoContext(ctx, "did work", "caller", r.Header.Get("X-Peer-Service"))
 		w.Write([]byte("done by service-d"))
 	})
 
-	handler := otelhttp.NewHandler(otelx.WithPeerServiceAttribute(mux), "service-d-server")
+	faults := chaos.FromEnv()
+	handler := http.NewServeMux()
+	handler.Handle("/chaos", faults.Handler())
+	handler.Handle("/", otelhttp.NewHandler(otelx.WithPeerServiceAttribute(otelx.WithRequestMetrics(faults.Middleware(mux))), "service-d-server"))
 	log.Println("service-d listening on :8083")
-	log.Fatal(http.ListenAndServe(":8083", handler))
+	if err := otelx.ListenAndServe(ctx, ":8083", handler, shutdown); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func getenv(k, def string) string {